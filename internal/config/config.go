@@ -5,7 +5,9 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
+	"fmt"
 	"log"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -237,18 +239,35 @@ func (c *Config) GetChannels() []string {
 	return channels
 }
 
-// AddChannel adds a new channel
+// AddChannel adds a new channel, with spam dampening, mention replies and the
+// originality check on
 func (c *Config) AddChannel(channel string) error {
 	db := database.GetDB()
-	_, err := db.Exec("INSERT OR IGNORE INTO channels (name) VALUES (?)", strings.ToLower(channel))
+	_, err := db.Exec("INSERT OR IGNORE INTO channels (name, spam_dampening, mention_replies, originality_threshold) VALUES (?, 1, 1, 80)", strings.ToLower(channel))
 	return err
 }
 
-// RemoveChannel removes a channel
+// RemoveChannel removes a channel along with its own blacklist and its
+// brain group memberships
 func (c *Config) RemoveChannel(channel string) error {
+	channel = strings.ToLower(channel)
 	db := database.GetDB()
-	_, err := db.Exec("DELETE FROM channels WHERE name = ?", strings.ToLower(channel))
-	return err
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM channels WHERE name = ?", channel); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM channel_blacklist WHERE channel = ?", channel); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM brain_group_members WHERE channel = ?", channel); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // SetChannelEnabled enables or disables a channel
@@ -333,6 +352,206 @@ func (c *Config) SetChannelUseGlobalBrain(channel string, useGlobal bool) error
 	return err
 }
 
+// GetChannelGlobalOptOut returns whether a channel's brain is kept out of the
+// global index that global generation draws from
+func (c *Config) GetChannelGlobalOptOut(channel string) bool {
+	db := database.GetDB()
+	var optOut int
+	err := db.QueryRow("SELECT global_opt_out FROM channels WHERE name = ?", strings.ToLower(channel)).Scan(&optOut)
+	if err != nil {
+		return false
+	}
+	return optOut == 1
+}
+
+// GetGlobalPoolChannels returns the channels whose brains global generation
+// draws from: every joined channel that hasn't opted out
+func (c *Config) GetGlobalPoolChannels() []string {
+	db := database.GetDB()
+	rows, err := db.Query("SELECT name FROM channels WHERE global_opt_out = 0 ORDER BY name")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var channels []string
+	for rows.Next() {
+		var channel string
+		if rows.Scan(&channel) == nil {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// SetChannelGlobalOptOut sets whether a channel's brain is kept out of the global index
+func (c *Config) SetChannelGlobalOptOut(channel string, optOut bool) error {
+	db := database.GetDB()
+	val := 0
+	if optOut {
+		val = 1
+	}
+	_, err := db.Exec("UPDATE channels SET global_opt_out = ? WHERE name = ?", val, strings.ToLower(channel))
+	return err
+}
+
+// GetChannelBrainGroup returns the brain group a channel generates from, or
+// "" if it uses its own brain or the global brain
+func (c *Config) GetChannelBrainGroup(channel string) string {
+	db := database.GetDB()
+	var group string
+	err := db.QueryRow("SELECT brain_group FROM channels WHERE name = ?", strings.ToLower(channel)).Scan(&group)
+	if err != nil {
+		return ""
+	}
+	return group
+}
+
+// SetChannelBrainGroup sets the brain group a channel generates from ("" for none)
+func (c *Config) SetChannelBrainGroup(channel, group string) error {
+	group = NormalizeBrainGroupName(group)
+	if group != "" && !c.BrainGroupExists(group) {
+		return fmt.Errorf("brain group %q does not exist", group)
+	}
+	db := database.GetDB()
+	_, err := db.Exec("UPDATE channels SET brain_group = ? WHERE name = ?", group, strings.ToLower(channel))
+	return err
+}
+
+// Link policies: what happens to chat messages with links that aren't allowlisted
+const (
+	LinkPolicySkip  = "skip"  // Don't learn the message
+	LinkPolicyStrip = "strip" // Learn the message without its links
+	LinkPolicyLearn = "learn" // Learn the message, links and all
+)
+
+// GetChannelLinkPolicy returns a channel's link policy
+func (c *Config) GetChannelLinkPolicy(channel string) string {
+	db := database.GetDB()
+	var policy string
+	err := db.QueryRow("SELECT link_policy FROM channels WHERE name = ?", strings.ToLower(channel)).Scan(&policy)
+	if err != nil {
+		return LinkPolicySkip
+	}
+	switch policy {
+	case LinkPolicyStrip, LinkPolicyLearn:
+		return policy
+	}
+	return LinkPolicySkip
+}
+
+// SetChannelLinkPolicy sets a channel's link policy
+func (c *Config) SetChannelLinkPolicy(channel, policy string) error {
+	switch policy {
+	case LinkPolicySkip, LinkPolicyStrip, LinkPolicyLearn:
+	default:
+		return fmt.Errorf("unknown link policy %q", policy)
+	}
+	db := database.GetDB()
+	_, err := db.Exec("UPDATE channels SET link_policy = ? WHERE name = ?", policy, strings.ToLower(channel))
+	return err
+}
+
+// Brain storage backends
+const (
+	StorageSQLite = "sqlite" // Transitions are read from the brain's database file
+	StorageMemory = "memory" // Transitions are also held in memory for faster generation ("hot" channels)
+)
+
+// GetChannelStorage returns the storage backend of a channel's brain
+func (c *Config) GetChannelStorage(channel string) string {
+	db := database.GetDB()
+	var storage string
+	err := db.QueryRow("SELECT storage FROM channels WHERE name = ?", strings.ToLower(channel)).Scan(&storage)
+	if err == nil && storage == StorageMemory {
+		return StorageMemory
+	}
+	return StorageSQLite
+}
+
+// SetChannelStorage sets the storage backend of a channel's brain. It takes
+// effect when the brain is next opened.
+func (c *Config) SetChannelStorage(channel, storage string) error {
+	switch storage {
+	case StorageSQLite, StorageMemory:
+	default:
+		return fmt.Errorf("unknown storage backend %q", storage)
+	}
+	db := database.GetDB()
+	_, err := db.Exec("UPDATE channels SET storage = ? WHERE name = ?", storage, strings.ToLower(channel))
+	return err
+}
+
+// Script sets a channel can allow messages to be written in. ASCII and emoji
+// are always allowed.
+const (
+	ScriptAny           = "any"            // Anything goes; turns the script check off
+	ScriptLatin         = "latin"          // Latin-1 letters (English, Portuguese, French, ...)
+	ScriptLatinExtended = "latin-extended" // All Latin letters, diacritics and punctuation (Polish, Czech, Spanish ¿¡, ...)
+	ScriptCyrillic      = "cyrillic"
+	ScriptGreek         = "greek"
+	ScriptCJK           = "cjk" // Chinese, Japanese kana and Korean Hangul
+	ScriptArabic        = "arabic"
+	ScriptHebrew        = "hebrew"
+	ScriptThai          = "thai"
+	ScriptDevanagari    = "devanagari"
+)
+
+// Scripts lists the script sets in display order
+var Scripts = []string{
+	ScriptAny, ScriptLatin, ScriptLatinExtended, ScriptCyrillic, ScriptGreek,
+	ScriptCJK, ScriptArabic, ScriptHebrew, ScriptThai, ScriptDevanagari,
+}
+
+// NormalizeScripts parses a comma or space separated list of script sets,
+// dropping duplicates and keeping them in display order. Unknown names are
+// returned separately.
+func NormalizeScripts(list string) (scripts, unknown []string) {
+	wanted := make(map[string]bool)
+	for _, s := range strings.FieldsFunc(strings.ToLower(list), func(r rune) bool { return r == ',' || r == ' ' }) {
+		wanted[s] = true
+	}
+	for _, s := range Scripts {
+		if wanted[s] {
+			scripts = append(scripts, s)
+			delete(wanted, s)
+		}
+	}
+	for s := range wanted {
+		unknown = append(unknown, s)
+	}
+	return scripts, unknown
+}
+
+// GetChannelAllowedScripts returns the script sets a channel learns messages in
+func (c *Config) GetChannelAllowedScripts(channel string) []string {
+	db := database.GetDB()
+	var list string
+	err := db.QueryRow("SELECT allowed_scripts FROM channels WHERE name = ?", strings.ToLower(channel)).Scan(&list)
+	if err != nil {
+		return []string{ScriptLatin}
+	}
+	scripts, _ := NormalizeScripts(list)
+	if len(scripts) == 0 {
+		return []string{ScriptLatin}
+	}
+	return scripts
+}
+
+// SetChannelAllowedScripts sets the script sets a channel learns messages in
+func (c *Config) SetChannelAllowedScripts(channel string, scripts []string) error {
+	normalized, unknown := NormalizeScripts(strings.Join(scripts, ","))
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown script %q", unknown[0])
+	}
+	if len(normalized) == 0 {
+		return fmt.Errorf("at least one script is required")
+	}
+	db := database.GetDB()
+	_, err := db.Exec("UPDATE channels SET allowed_scripts = ? WHERE name = ?", strings.Join(normalized, ","), strings.ToLower(channel))
+	return err
+}
+
 // GetChannelTimerEnabled returns whether the inactivity timer is enabled for a channel
 func (c *Config) GetChannelTimerEnabled(channel string) bool {
 	db := database.GetDB()
@@ -379,6 +598,538 @@ func (c *Config) SetChannelTimerMinutes(channel string, minutes int) error {
 	return err
 }
 
+// GetChannelMarkovOrder returns the Markov chain order (context length in words) for a channel
+func (c *Config) GetChannelMarkovOrder(channel string) int {
+	db := database.GetDB()
+	var order int
+	err := db.QueryRow("SELECT markov_order FROM channels WHERE name = ?", strings.ToLower(channel)).Scan(&order)
+	if err != nil || order < 1 || order > 4 {
+		return 2 // Default second-order chain
+	}
+	return order
+}
+
+// SetChannelMarkovOrder sets the Markov chain order for a channel (1-4)
+func (c *Config) SetChannelMarkovOrder(channel string, order int) error {
+	if order < 1 {
+		order = 1
+	}
+	if order > 4 {
+		order = 4
+	}
+	db := database.GetDB()
+	_, err := db.Exec("UPDATE channels SET markov_order = ? WHERE name = ?", order, strings.ToLower(channel))
+	return err
+}
+
+// GetChannelSeededReplies returns whether a channel builds replies through a
+// word from the triggering message instead of from a random opening
+func (c *Config) GetChannelSeededReplies(channel string) bool {
+	db := database.GetDB()
+	var enabled int
+	err := db.QueryRow("SELECT seeded_replies FROM channels WHERE name = ?", strings.ToLower(channel)).Scan(&enabled)
+	if err != nil {
+		return false
+	}
+	return enabled == 1
+}
+
+// SetChannelSeededReplies sets whether a channel uses keyword-seeded replies
+func (c *Config) SetChannelSeededReplies(channel string, enabled bool) error {
+	db := database.GetDB()
+	val := 0
+	if enabled {
+		val = 1
+	}
+	_, err := db.Exec("UPDATE channels SET seeded_replies = ? WHERE name = ?", val, strings.ToLower(channel))
+	return err
+}
+
+// GetChannelSpamDampening returns whether a channel dampens copypasta floods
+// and repeated messages before learning them
+func (c *Config) GetChannelSpamDampening(channel string) bool {
+	db := database.GetDB()
+	var enabled int
+	err := db.QueryRow("SELECT spam_dampening FROM channels WHERE name = ?", strings.ToLower(channel)).Scan(&enabled)
+	if err != nil {
+		return false
+	}
+	return enabled == 1
+}
+
+// SetChannelSpamDampening sets whether a channel dampens spam before learning
+func (c *Config) SetChannelSpamDampening(channel string, enabled bool) error {
+	db := database.GetDB()
+	val := 0
+	if enabled {
+		val = 1
+	}
+	_, err := db.Exec("UPDATE channels SET spam_dampening = ? WHERE name = ?", val, strings.ToLower(channel))
+	return err
+}
+
+// GetChannelLearnQuota returns how many messages per chatter a channel learns
+// in each 10 minutes. 0 means no quota.
+func (c *Config) GetChannelLearnQuota(channel string) int {
+	db := database.GetDB()
+	var quota int
+	err := db.QueryRow("SELECT learn_quota FROM channels WHERE name = ?", strings.ToLower(channel)).Scan(&quota)
+	if err != nil || quota < 0 {
+		return 0
+	}
+	return quota
+}
+
+// SetChannelLearnQuota sets how many messages per chatter a channel learns in
+// each 10 minutes (0-1000, 0 = no quota)
+func (c *Config) SetChannelLearnQuota(channel string, quota int) error {
+	if quota < 0 {
+		quota = 0
+	}
+	if quota > 1000 {
+		quota = 1000
+	}
+	db := database.GetDB()
+	_, err := db.Exec("UPDATE channels SET learn_quota = ? WHERE name = ?", quota, strings.ToLower(channel))
+	return err
+}
+
+// GetChannelMentionReplies returns whether the bot answers @mentions and replies in a channel
+func (c *Config) GetChannelMentionReplies(channel string) bool {
+	db := database.GetDB()
+	var enabled int
+	err := db.QueryRow("SELECT mention_replies FROM channels WHERE name = ?", strings.ToLower(channel)).Scan(&enabled)
+	if err != nil {
+		return false
+	}
+	return enabled == 1
+}
+
+// SetChannelMentionReplies sets whether the bot answers @mentions and replies in a channel
+func (c *Config) SetChannelMentionReplies(channel string, enabled bool) error {
+	db := database.GetDB()
+	val := 0
+	if enabled {
+		val = 1
+	}
+	_, err := db.Exec("UPDATE channels SET mention_replies = ? WHERE name = ?", val, strings.ToLower(channel))
+	return err
+}
+
+// GetChannelMentionCooldown returns the minimum seconds between mention answers in a channel
+func (c *Config) GetChannelMentionCooldown(channel string) int {
+	db := database.GetDB()
+	var seconds int
+	err := db.QueryRow("SELECT mention_cooldown FROM channels WHERE name = ?", strings.ToLower(channel)).Scan(&seconds)
+	if err != nil || seconds < 0 {
+		return 30 // Default 30 seconds
+	}
+	return seconds
+}
+
+// SetChannelMentionCooldown sets the minimum seconds between mention answers (0-3600)
+func (c *Config) SetChannelMentionCooldown(channel string, seconds int) error {
+	if seconds < 0 {
+		seconds = 0
+	}
+	if seconds > 3600 {
+		seconds = 3600
+	}
+	db := database.GetDB()
+	_, err := db.Exec("UPDATE channels SET mention_cooldown = ? WHERE name = ?", seconds, strings.ToLower(channel))
+	return err
+}
+
+// GetChannelOriginalityThreshold returns the share of a generated message, in
+// percent, that may be copied word for word from one recent chat message
+// before the message is rejected. 0 turns the check off.
+func (c *Config) GetChannelOriginalityThreshold(channel string) int {
+	db := database.GetDB()
+	var percent int
+	err := db.QueryRow("SELECT originality_threshold FROM channels WHERE name = ?", strings.ToLower(channel)).Scan(&percent)
+	if err != nil || percent < 0 || percent > 100 {
+		return 0 // Off, like channels that predate the check
+	}
+	return percent
+}
+
+// SetChannelOriginalityThreshold sets the originality threshold for a channel (0-100, 0 = off)
+func (c *Config) SetChannelOriginalityThreshold(channel string, percent int) error {
+	db := database.GetDB()
+	_, err := db.Exec("UPDATE channels SET originality_threshold = ? WHERE name = ?", clamp(percent, 0, 100), strings.ToLower(channel))
+	return err
+}
+
+// GetChannelStripEmotes returns whether emotes the bot can't use are removed
+// from its messages in a channel before sending
+func (c *Config) GetChannelStripEmotes(channel string) bool {
+	db := database.GetDB()
+	var enabled int
+	err := db.QueryRow("SELECT strip_emotes FROM channels WHERE name = ?", strings.ToLower(channel)).Scan(&enabled)
+	if err != nil {
+		return false
+	}
+	return enabled == 1
+}
+
+// SetChannelStripEmotes sets whether unusable emotes are stripped from the bot's messages in a channel
+func (c *Config) SetChannelStripEmotes(channel string, enabled bool) error {
+	db := database.GetDB()
+	val := 0
+	if enabled {
+		val = 1
+	}
+	_, err := db.Exec("UPDATE channels SET strip_emotes = ? WHERE name = ?", val, strings.ToLower(channel))
+	return err
+}
+
+// DecayPolicy controls how a channel's brain forgets transitions it hasn't
+// seen in a while. Every Days days, transitions not seen during the last Days
+// days keep KeepPercent of their count, and those that drop below PruneBelow
+// are deleted.
+type DecayPolicy struct {
+	Enabled     bool `json:"enabled"`
+	Days        int  `json:"days"`
+	KeepPercent int  `json:"keep_percent"`
+	PruneBelow  int  `json:"prune_below"`
+}
+
+// GetChannelDecayPolicy returns the brain decay policy for a channel
+func (c *Config) GetChannelDecayPolicy(channel string) DecayPolicy {
+	policy := DecayPolicy{Days: 30, KeepPercent: 50, PruneBelow: 1} // Defaults (disabled)
+	db := database.GetDB()
+	var enabled, days, keep, prune int
+	err := db.QueryRow("SELECT decay_enabled, decay_days, decay_keep_percent, decay_prune_below FROM channels WHERE name = ?",
+		strings.ToLower(channel)).Scan(&enabled, &days, &keep, &prune)
+	if err != nil {
+		return policy
+	}
+	policy.Enabled = enabled == 1
+	if days >= 1 && days <= 365 {
+		policy.Days = days
+	}
+	if keep >= 0 && keep <= 99 {
+		policy.KeepPercent = keep
+	}
+	if prune >= 1 && prune <= 1000 {
+		policy.PruneBelow = prune
+	}
+	return policy
+}
+
+// SetChannelDecayPolicy sets the brain decay policy for a channel (days 1-365,
+// keep percent 0-99, prune below 1-1000)
+func (c *Config) SetChannelDecayPolicy(channel string, policy DecayPolicy) error {
+	policy.Days = clamp(policy.Days, 1, 365)
+	policy.KeepPercent = clamp(policy.KeepPercent, 0, 99)
+	policy.PruneBelow = clamp(policy.PruneBelow, 1, 1000)
+	enabled := 0
+	if policy.Enabled {
+		enabled = 1
+	}
+	db := database.GetDB()
+	_, err := db.Exec("UPDATE channels SET decay_enabled = ?, decay_days = ?, decay_keep_percent = ?, decay_prune_below = ? WHERE name = ?",
+		enabled, policy.Days, policy.KeepPercent, policy.PruneBelow, strings.ToLower(channel))
+	return err
+}
+
+// SnapshotPolicy controls the scheduled brain snapshots. Every IntervalHours
+// hours each brain is snapshotted, and only the newest Keep scheduled
+// snapshots of a brain are kept. Snapshots taken on demand are never pruned.
+type SnapshotPolicy struct {
+	Enabled       bool `json:"enabled"`
+	IntervalHours int  `json:"interval_hours"`
+	Keep          int  `json:"keep"`
+}
+
+// GetSnapshotPolicy returns the brain snapshot policy
+func (c *Config) GetSnapshotPolicy() SnapshotPolicy {
+	policy := SnapshotPolicy{IntervalHours: 24, Keep: 7} // Defaults (disabled)
+	policy.Enabled = c.getValue("snapshot_enabled") == "true"
+	if hours, _ := strconv.Atoi(c.getValue("snapshot_interval_hours")); hours >= 1 && hours <= 720 {
+		policy.IntervalHours = hours
+	}
+	if keep, _ := strconv.Atoi(c.getValue("snapshot_keep")); keep >= 1 && keep <= 100 {
+		policy.Keep = keep
+	}
+	return policy
+}
+
+// SetSnapshotPolicy sets the brain snapshot policy (interval 1-720 hours,
+// keep 1-100 snapshots)
+func (c *Config) SetSnapshotPolicy(policy SnapshotPolicy) error {
+	if err := c.setValue("snapshot_enabled", strconv.FormatBool(policy.Enabled)); err != nil {
+		return err
+	}
+	if err := c.setValue("snapshot_interval_hours", strconv.Itoa(clamp(policy.IntervalHours, 1, 720))); err != nil {
+		return err
+	}
+	return c.setValue("snapshot_keep", strconv.Itoa(clamp(policy.Keep, 1, 100)))
+}
+
+// DefaultMaxOpenBrains is how many brain databases are kept open at once
+// unless configured otherwise
+const DefaultMaxOpenBrains = 50
+
+// GetMaxOpenBrains returns how many brain databases may be kept open at once
+// before the least recently used idle ones are closed (0 = no limit)
+func (c *Config) GetMaxOpenBrains() int {
+	n, err := strconv.Atoi(c.getValue("max_open_brains"))
+	if err != nil || n < 0 {
+		return DefaultMaxOpenBrains
+	}
+	return n
+}
+
+// SetMaxOpenBrains sets how many brain databases may be kept open at once
+// (0 = no limit, otherwise 5-1000)
+func (c *Config) SetMaxOpenBrains(n int) error {
+	if n != 0 {
+		n = clamp(n, 5, 1000)
+	}
+	return c.setValue("max_open_brains", strconv.Itoa(n))
+}
+
+// MaxMessageChars is the longest chat message Twitch accepts
+const MaxMessageChars = 500
+
+// GenerationSettings tune how a channel's messages are generated. A message
+// is generated with up to MaxWords words and rejected (and retried, up to
+// Retries attempts in total) if it has fewer than MinWords words or more than
+// MaxChars characters. Each next word is sampled from the TopK most common
+// candidates (0 = all) with weights sharpened (Temperature < 1) or flattened
+// (Temperature > 1).
+type GenerationSettings struct {
+	MinWords    int     `json:"min_words"`
+	MaxWords    int     `json:"max_words"`
+	MaxChars    int     `json:"max_chars"`
+	Temperature float64 `json:"temperature"`
+	TopK        int     `json:"top_k"`
+	Retries     int     `json:"retries"`
+}
+
+// DefaultGenerationSettings returns the generation settings of a new channel
+func DefaultGenerationSettings() GenerationSettings {
+	return GenerationSettings{MinWords: 1, MaxWords: 20, MaxChars: MaxMessageChars, Temperature: 1, TopK: 0, Retries: 5}
+}
+
+// GetChannelGenerationSettings returns the generation settings for a channel
+func (c *Config) GetChannelGenerationSettings(channel string) GenerationSettings {
+	settings := DefaultGenerationSettings()
+	db := database.GetDB()
+	var stored GenerationSettings
+	err := db.QueryRow("SELECT gen_min_words, gen_max_words, gen_max_chars, gen_temperature, gen_top_k, gen_retries FROM channels WHERE name = ?",
+		strings.ToLower(channel)).Scan(&stored.MinWords, &stored.MaxWords, &stored.MaxChars, &stored.Temperature, &stored.TopK, &stored.Retries)
+	if err != nil {
+		return settings
+	}
+	return clampGenerationSettings(stored)
+}
+
+// SetChannelGenerationSettings sets the generation settings for a channel
+// (words 1-100 with min <= max, max chars 20-500, temperature 0.1-3, top-k
+// 0-100, retries 1-20)
+func (c *Config) SetChannelGenerationSettings(channel string, settings GenerationSettings) error {
+	settings = clampGenerationSettings(settings)
+	db := database.GetDB()
+	_, err := db.Exec("UPDATE channels SET gen_min_words = ?, gen_max_words = ?, gen_max_chars = ?, gen_temperature = ?, gen_top_k = ?, gen_retries = ? WHERE name = ?",
+		settings.MinWords, settings.MaxWords, settings.MaxChars, settings.Temperature, settings.TopK, settings.Retries, strings.ToLower(channel))
+	return err
+}
+
+// clampGenerationSettings brings generation settings into their valid ranges
+func clampGenerationSettings(s GenerationSettings) GenerationSettings {
+	s.MaxWords = clamp(s.MaxWords, 1, 100)
+	s.MinWords = clamp(s.MinWords, 1, s.MaxWords)
+	s.MaxChars = clamp(s.MaxChars, 20, MaxMessageChars)
+	if !(s.Temperature >= 0.1) { // Also catches NaN
+		s.Temperature = 0.1
+	}
+	if s.Temperature > 3 {
+		s.Temperature = 3
+	}
+	s.TopK = clamp(s.TopK, 0, 100)
+	s.Retries = clamp(s.Retries, 1, 20)
+	return s
+}
+
+// clamp limits v to the range [lo, hi]
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// Brain groups
+
+// BrainGroupMember is a channel whose brain is part of a brain group. Its
+// transition counts are multiplied by Weight when the group generates.
+type BrainGroupMember struct {
+	Channel string  `json:"channel"`
+	Weight  float64 `json:"weight"`
+}
+
+// BrainGroup is a named set of channel brains that channels can generate
+// from together instead of from every brain in global mode
+type BrainGroup struct {
+	Name     string             `json:"name"`
+	Members  []BrainGroupMember `json:"members"`
+	Channels []string           `json:"channels"` // Channels generating from the group
+}
+
+// NormalizeBrainGroupName trims and lowercases a brain group name
+func NormalizeBrainGroupName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// clampGroupWeight brings a member weight into the range 0.1-10
+func clampGroupWeight(weight float64) float64 {
+	if !(weight >= 0.1) { // Also catches NaN
+		return 0.1
+	}
+	if weight > 10 {
+		return 10
+	}
+	return weight
+}
+
+// GetBrainGroups returns all brain groups with their members
+func (c *Config) GetBrainGroups() []BrainGroup {
+	db := database.GetDB()
+	rows, err := db.Query("SELECT name FROM brain_groups ORDER BY name")
+	if err != nil {
+		return []BrainGroup{}
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if rows.Scan(&name) == nil {
+			names = append(names, name)
+		}
+	}
+	rows.Close()
+
+	groups := make([]BrainGroup, 0, len(names))
+	for _, name := range names {
+		if group := c.GetBrainGroup(name); group != nil {
+			groups = append(groups, *group)
+		}
+	}
+	return groups
+}
+
+// GetBrainGroup returns a brain group with its members, or nil if it doesn't exist
+func (c *Config) GetBrainGroup(name string) *BrainGroup {
+	name = NormalizeBrainGroupName(name)
+	if !c.BrainGroupExists(name) {
+		return nil
+	}
+	group := &BrainGroup{Name: name, Members: []BrainGroupMember{}, Channels: []string{}}
+
+	db := database.GetDB()
+	rows, err := db.Query("SELECT channel, weight FROM brain_group_members WHERE group_name = ? ORDER BY channel", name)
+	if err == nil {
+		for rows.Next() {
+			var member BrainGroupMember
+			if rows.Scan(&member.Channel, &member.Weight) == nil {
+				group.Members = append(group.Members, member)
+			}
+		}
+		rows.Close()
+	}
+
+	rows, err = db.Query("SELECT name FROM channels WHERE brain_group = ? ORDER BY name", name)
+	if err == nil {
+		for rows.Next() {
+			var channel string
+			if rows.Scan(&channel) == nil {
+				group.Channels = append(group.Channels, channel)
+			}
+		}
+		rows.Close()
+	}
+	return group
+}
+
+// BrainGroupExists checks if a brain group exists
+func (c *Config) BrainGroupExists(name string) bool {
+	db := database.GetDB()
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM brain_groups WHERE name = ?", NormalizeBrainGroupName(name)).Scan(&count)
+	return count > 0
+}
+
+// CreateBrainGroup creates an empty brain group
+func (c *Config) CreateBrainGroup(name string) error {
+	name = NormalizeBrainGroupName(name)
+	if name == "" {
+		return fmt.Errorf("brain group name required")
+	}
+	if c.BrainGroupExists(name) {
+		return fmt.Errorf("brain group %q already exists", name)
+	}
+	db := database.GetDB()
+	_, err := db.Exec("INSERT INTO brain_groups (name) VALUES (?)", name)
+	return err
+}
+
+// SetBrainGroupMembers replaces the members of a brain group (weights 0.1-10)
+func (c *Config) SetBrainGroupMembers(name string, members []BrainGroupMember) error {
+	name = NormalizeBrainGroupName(name)
+	if !c.BrainGroupExists(name) {
+		return fmt.Errorf("brain group %q does not exist", name)
+	}
+
+	db := database.GetDB()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM brain_group_members WHERE group_name = ?", name); err != nil {
+		return err
+	}
+	for _, member := range members {
+		channel := strings.ToLower(strings.TrimSpace(member.Channel))
+		if channel == "" {
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO brain_group_members (group_name, channel, weight) VALUES (?, ?, ?)",
+			name, channel, clampGroupWeight(member.Weight)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// IsBrainGroupMember reports whether a channel's brain is a member of any brain group
+func (c *Config) IsBrainGroupMember(channel string) bool {
+	db := database.GetDB()
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM brain_group_members WHERE channel = ?", strings.ToLower(channel)).Scan(&count)
+	return count > 0
+}
+
+// DeleteBrainGroup deletes a brain group. Channels generating from it go back
+// to their own brain.
+func (c *Config) DeleteBrainGroup(name string) error {
+	name = NormalizeBrainGroupName(name)
+	db := database.GetDB()
+	if _, err := db.Exec("UPDATE channels SET brain_group = '' WHERE brain_group = ?", name); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM brain_group_members WHERE group_name = ?", name); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM brain_groups WHERE name = ?", name)
+	return err
+}
+
 // GetAllowTimerCommand returns whether !timer command is enabled for users
 func (c *Config) GetAllowTimerCommand() bool {
 	val := c.getValue("allow_timer_command")
@@ -393,6 +1144,20 @@ func (c *Config) SetAllowTimerCommand(allow bool) error {
 	return c.setValue("allow_timer_command", strconv.FormatBool(allow))
 }
 
+// GetAllowBlacklistCommand returns whether !blacklist command is enabled for users
+func (c *Config) GetAllowBlacklistCommand() bool {
+	val := c.getValue("allow_blacklist_command")
+	if val == "" {
+		return true // Default to enabled
+	}
+	return val == "true"
+}
+
+// SetAllowBlacklistCommand sets whether !blacklist command is enabled for users
+func (c *Config) SetAllowBlacklistCommand(allow bool) error {
+	return c.setValue("allow_blacklist_command", strconv.FormatBool(allow))
+}
+
 // GetDefaultTimerEnabled returns the default timer enabled state for new channels
 func (c *Config) GetDefaultTimerEnabled() bool {
 	val := c.getValue("default_timer_enabled")
@@ -500,6 +1265,216 @@ func (c *Config) IsBlacklistedWord(word string) bool {
 	return count > 0
 }
 
+// GetChannelBlacklistedWords returns a channel's own blacklisted words
+func (c *Config) GetChannelBlacklistedWords(channel string) []string {
+	db := database.GetDB()
+	rows, err := db.Query("SELECT word FROM channel_blacklist WHERE channel = ? ORDER BY word", strings.ToLower(channel))
+	if err != nil {
+		return []string{}
+	}
+	defer rows.Close()
+
+	words := []string{}
+	for rows.Next() {
+		var word string
+		if err := rows.Scan(&word); err == nil {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// AddChannelBlacklistedWord adds a word to a channel's own blacklist
+func (c *Config) AddChannelBlacklistedWord(channel, word string) error {
+	db := database.GetDB()
+	_, err := db.Exec("INSERT OR IGNORE INTO channel_blacklist (channel, word) VALUES (?, ?)",
+		strings.ToLower(channel), strings.ToLower(word))
+	return err
+}
+
+// RemoveChannelBlacklistedWord removes a word from a channel's own blacklist
+func (c *Config) RemoveChannelBlacklistedWord(channel, word string) error {
+	db := database.GetDB()
+	_, err := db.Exec("DELETE FROM channel_blacklist WHERE channel = ? AND word = ?",
+		strings.ToLower(channel), strings.ToLower(word))
+	return err
+}
+
+// GetBlacklistedWordsFor returns the words blacklisted in a channel: the
+// global blacklist followed by the channel's own entries
+func (c *Config) GetBlacklistedWordsFor(channel string) []string {
+	words := c.GetBlacklistedWords()
+	seen := make(map[string]bool, len(words))
+	for _, word := range words {
+		seen[word] = true
+	}
+	for _, word := range c.GetChannelBlacklistedWords(channel) {
+		if !seen[word] {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// Link allowlist
+
+// GetLinkAllowlist returns the domains whose links are always learned
+func (c *Config) GetLinkAllowlist() []string {
+	db := database.GetDB()
+	rows, err := db.Query("SELECT domain FROM link_allowlist ORDER BY domain")
+	if err != nil {
+		return []string{}
+	}
+	defer rows.Close()
+
+	domains := []string{}
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err == nil {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// AddLinkAllowlistDomain adds a domain (and its subdomains) to the link allowlist
+func (c *Config) AddLinkAllowlistDomain(domain string) error {
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return fmt.Errorf("domain required")
+	}
+	db := database.GetDB()
+	_, err := db.Exec("INSERT OR IGNORE INTO link_allowlist (domain) VALUES (?)", domain)
+	return err
+}
+
+// RemoveLinkAllowlistDomain removes a domain from the link allowlist
+func (c *Config) RemoveLinkAllowlistDomain(domain string) error {
+	db := database.GetDB()
+	_, err := db.Exec("DELETE FROM link_allowlist WHERE domain = ?", normalizeDomain(domain))
+	return err
+}
+
+// normalizeDomain lowercases a domain and strips any scheme, www. and path
+func normalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if i := strings.Index(domain, "://"); i >= 0 {
+		domain = domain[i+3:]
+	}
+	if i := strings.IndexAny(domain, "/?#"); i >= 0 {
+		domain = domain[:i]
+	}
+	return strings.TrimPrefix(domain, "www.")
+}
+
+// DomainAllowed reports whether a host is one of the allowlisted domains or a subdomain of one
+func DomainAllowed(host string, allowlist []string) bool {
+	host = strings.TrimPrefix(strings.ToLower(host), "www.")
+	for _, domain := range allowlist {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter rules
+
+// Filter rule kinds: how a rule's pattern is matched
+const (
+	FilterKindWord  = "word"  // Word or phrase, matched whole like a blacklist entry
+	FilterKindGlob  = "glob"  // Single word with * (any run of characters) and ? (one character)
+	FilterKindRegex = "regex" // Regular expression over the message's words joined by single spaces
+)
+
+// Filter rule actions: what happens when a rule matches
+const (
+	FilterBlockLearning = "block_learning" // Don't learn the message (or say it), and remove it from brains when cleaning
+	FilterBlockOutput   = "block_output"   // Don't send generated messages that match
+	FilterMask          = "mask"           // Send generated messages with the matching words masked
+)
+
+// FilterRule is a pattern-based filter applied to learned and generated
+// messages. With Normalize set, words are matched after undoing leetspeak
+// and look-alike characters and collapsing repeated letters, on both the
+// pattern and the message, so "sh1iit" matches "shit".
+type FilterRule struct {
+	ID        int64  `json:"id"`
+	Pattern   string `json:"pattern"`
+	Kind      string `json:"kind"`
+	Normalize bool   `json:"normalize"`
+	Action    string `json:"action"`
+}
+
+// GetFilterRules returns all filter rules in the order they were added
+func (c *Config) GetFilterRules() []FilterRule {
+	db := database.GetDB()
+	rows, err := db.Query("SELECT id, pattern, kind, normalize, action FROM filter_rules ORDER BY id")
+	if err != nil {
+		return []FilterRule{}
+	}
+	defer rows.Close()
+
+	rules := []FilterRule{}
+	for rows.Next() {
+		var rule FilterRule
+		var normalize int
+		if rows.Scan(&rule.ID, &rule.Pattern, &rule.Kind, &normalize, &rule.Action) == nil {
+			rule.Normalize = normalize == 1
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// AddFilterRule validates and adds a filter rule, returning it with its ID
+func (c *Config) AddFilterRule(rule FilterRule) (FilterRule, error) {
+	rule.Pattern = strings.TrimSpace(rule.Pattern)
+	if rule.Kind == "" {
+		rule.Kind = FilterKindWord
+	}
+	if rule.Action == "" {
+		rule.Action = FilterBlockLearning
+	}
+	if rule.Pattern == "" {
+		return rule, fmt.Errorf("pattern required")
+	}
+	switch rule.Kind {
+	case FilterKindWord, FilterKindGlob:
+	case FilterKindRegex:
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return rule, fmt.Errorf("invalid regex: %v", err)
+		}
+	default:
+		return rule, fmt.Errorf("unknown rule kind %q", rule.Kind)
+	}
+	switch rule.Action {
+	case FilterBlockLearning, FilterBlockOutput, FilterMask:
+	default:
+		return rule, fmt.Errorf("unknown rule action %q", rule.Action)
+	}
+
+	normalize := 0
+	if rule.Normalize {
+		normalize = 1
+	}
+	db := database.GetDB()
+	res, err := db.Exec("INSERT INTO filter_rules (pattern, kind, normalize, action) VALUES (?, ?, ?, ?)",
+		rule.Pattern, rule.Kind, normalize, rule.Action)
+	if err != nil {
+		return rule, err
+	}
+	rule.ID, _ = res.LastInsertId()
+	return rule, nil
+}
+
+// RemoveFilterRule removes a filter rule
+func (c *Config) RemoveFilterRule(id int64) error {
+	db := database.GetDB()
+	_, err := db.Exec("DELETE FROM filter_rules WHERE id = ?", id)
+	return err
+}
+
 // User Blacklist Management
 
 // GetBlacklistedUsers returns all blacklisted usernames
@@ -543,6 +1518,48 @@ func (c *Config) IsBlacklistedUser(username string) bool {
 	return count > 0
 }
 
+// Emotes
+
+// RecordEmotes stores the Twitch emote ID for each emote code seen in chat
+func (c *Config) RecordEmotes(emotes map[string]string) {
+	db := database.GetDB()
+	for name, id := range emotes {
+		db.Exec(`
+			INSERT INTO emotes (name, emote_id) VALUES (?, ?)
+			ON CONFLICT(name) DO UPDATE SET emote_id = excluded.emote_id, updated_at = CURRENT_TIMESTAMP
+			WHERE emote_id != excluded.emote_id
+		`, name, id)
+	}
+}
+
+// GetEmoteIDs returns the emote IDs of those words that are known emote codes
+func (c *Config) GetEmoteIDs(words []string) map[string]string {
+	result := make(map[string]string)
+	if len(words) == 0 {
+		return result
+	}
+
+	db := database.GetDB()
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(words)), ",")
+	args := make([]interface{}, len(words))
+	for i, w := range words {
+		args[i] = w
+	}
+	rows, err := db.Query("SELECT name, emote_id FROM emotes WHERE name IN ("+placeholders+")", args...)
+	if err != nil {
+		return result
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, id string
+		if rows.Scan(&name, &id) == nil {
+			result[name] = id
+		}
+	}
+	return result
+}
+
 // Twitch User ID Tracking
 
 // GetUsernameByID returns the stored username for a Twitch user ID
@@ -571,15 +1588,61 @@ func (c *Config) GetUserIDByUsername(username string) string {
 	return twitchID
 }
 
+// RecordForgottenUser records that a user's contributions were forgotten now
+func (c *Config) RecordForgottenUser(userID string) error {
+	db := database.GetDB()
+	_, err := db.Exec(`
+		INSERT INTO forgotten_users (user_id, forgotten_at) VALUES (?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET forgotten_at = excluded.forgotten_at
+	`, userID, time.Now().Unix())
+	return err
+}
+
+// GetUsersForgottenSince returns the IDs of the users whose contributions
+// were last forgotten at or after since
+func (c *Config) GetUsersForgottenSince(since time.Time) []string {
+	db := database.GetDB()
+	rows, err := db.Query("SELECT user_id FROM forgotten_users WHERE forgotten_at >= ?", since.Unix())
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if rows.Scan(&userID) == nil {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs
+}
+
 // RenameChannel updates all references when a username changes
 func (c *Config) RenameChannel(oldName, newName string) error {
 	db := database.GetDB()
 	oldName = strings.ToLower(oldName)
 	newName = strings.ToLower(newName)
 
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// Update channels table
-	_, err := db.Exec("UPDATE channels SET name = ? WHERE name = ?", newName, oldName)
-	return err
+	if _, err := tx.Exec("UPDATE channels SET name = ? WHERE name = ?", newName, oldName); err != nil {
+		return err
+	}
+	// The channel's own blacklist follows it to the new name
+	if _, err := tx.Exec("UPDATE OR REPLACE channel_blacklist SET channel = ? WHERE channel = ?", newName, oldName); err != nil {
+		return err
+	}
+	// So do its brain group memberships
+	if _, err := tx.Exec("UPDATE OR REPLACE brain_group_members SET channel = ? WHERE channel = ?", newName, oldName); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // ActivityEntry represents a recent activity log entry
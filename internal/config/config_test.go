@@ -129,3 +129,96 @@ func TestVerifyAdminPassword_NoPasswordSet(t *testing.T) {
 		t.Error("expected verification to fail when no password is set")
 	}
 }
+
+// Channels that existed before a setting was added keep its column default,
+// while AddChannel opts new channels into it.
+func TestAddChannelDefaultsDifferFromUpgradedChannels(t *testing.T) {
+	cfg := New()
+	db := database.GetDB()
+	if _, err := db.Exec("INSERT INTO channels (name) VALUES ('upgraded_channel')"); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	defer cfg.RemoveChannel("upgraded_channel")
+	if err := cfg.AddChannel("new_channel"); err != nil {
+		t.Fatalf("AddChannel: %v", err)
+	}
+	defer cfg.RemoveChannel("new_channel")
+
+	if cfg.GetChannelSpamDampening("upgraded_channel") || cfg.GetChannelMentionReplies("upgraded_channel") {
+		t.Error("upgraded channel had spam dampening or mention replies turned on")
+	}
+	if cfg.GetChannelMentionReplies("never_joined_channel") {
+		t.Error("a channel that was never joined answers mentions")
+	}
+	if !cfg.GetChannelSpamDampening("new_channel") || !cfg.GetChannelMentionReplies("new_channel") {
+		t.Error("new channel doesn't have spam dampening and mention replies on")
+	}
+	if got := cfg.GetChannelOriginalityThreshold("upgraded_channel"); got != 0 {
+		t.Errorf("upgraded channel originality threshold = %d, want 0 (off)", got)
+	}
+	if got := cfg.GetChannelOriginalityThreshold("never_joined_channel"); got != 0 {
+		t.Errorf("never joined channel originality threshold = %d, want 0 (off)", got)
+	}
+	if got := cfg.GetChannelOriginalityThreshold("new_channel"); got != 80 {
+		t.Errorf("new channel originality threshold = %d, want 80", got)
+	}
+}
+
+func TestChannelBlacklistFollowsRenameAndRemove(t *testing.T) {
+	cfg := New()
+	if err := cfg.AddChannel("blacklist_old"); err != nil {
+		t.Fatalf("AddChannel: %v", err)
+	}
+	defer cfg.RemoveChannel("blacklist_new")
+	cfg.AddChannelBlacklistedWord("blacklist_old", "spoiler")
+
+	if err := cfg.RenameChannel("blacklist_old", "blacklist_new"); err != nil {
+		t.Fatalf("RenameChannel: %v", err)
+	}
+	if words := cfg.GetChannelBlacklistedWords("blacklist_new"); len(words) != 1 || words[0] != "spoiler" {
+		t.Errorf("blacklist after rename = %v, want [spoiler]", words)
+	}
+	if words := cfg.GetChannelBlacklistedWords("blacklist_old"); len(words) != 0 {
+		t.Errorf("old name still has blacklist %v", words)
+	}
+
+	// Leaving and joining again starts from an empty blacklist
+	if err := cfg.RemoveChannel("blacklist_new"); err != nil {
+		t.Fatalf("RemoveChannel: %v", err)
+	}
+	cfg.AddChannel("blacklist_new")
+	if words := cfg.GetChannelBlacklistedWords("blacklist_new"); len(words) != 0 {
+		t.Errorf("blacklist after leaving and rejoining = %v", words)
+	}
+}
+
+func TestBrainGroupMembershipFollowsRenameAndRemove(t *testing.T) {
+	cfg := New()
+	if err := cfg.AddChannel("member_old"); err != nil {
+		t.Fatalf("AddChannel: %v", err)
+	}
+	defer cfg.RemoveChannel("member_new")
+	if err := cfg.CreateBrainGroup("rename test group"); err != nil {
+		t.Fatalf("CreateBrainGroup: %v", err)
+	}
+	defer cfg.DeleteBrainGroup("rename test group")
+	cfg.SetBrainGroupMembers("rename test group", []BrainGroupMember{{Channel: "member_old", Weight: 2}})
+
+	if err := cfg.RenameChannel("member_old", "member_new"); err != nil {
+		t.Fatalf("RenameChannel: %v", err)
+	}
+	group := cfg.GetBrainGroup("rename test group")
+	if len(group.Members) != 1 || group.Members[0].Channel != "member_new" || group.Members[0].Weight != 2 {
+		t.Errorf("members after rename = %+v, want member_new at weight 2", group.Members)
+	}
+	if cfg.IsBrainGroupMember("member_old") {
+		t.Error("old name is still a brain group member")
+	}
+
+	if err := cfg.RemoveChannel("member_new"); err != nil {
+		t.Fatalf("RemoveChannel: %v", err)
+	}
+	if cfg.IsBrainGroupMember("member_new") {
+		t.Error("removed channel is still a brain group member")
+	}
+}
@@ -91,6 +91,30 @@ func createTables() error {
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`,
 
+		// Per-channel blacklist entries, applied on top of the global blacklist
+		`CREATE TABLE IF NOT EXISTS channel_blacklist (
+			channel TEXT NOT NULL,
+			word TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (channel, word)
+		)`,
+
+		// Domains whose links are learned despite a channel's link policy
+		`CREATE TABLE IF NOT EXISTS link_allowlist (
+			domain TEXT PRIMARY KEY,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Filter rules: regex, glob and normalized word patterns with an action
+		`CREATE TABLE IF NOT EXISTS filter_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			pattern TEXT NOT NULL,
+			kind TEXT NOT NULL DEFAULT 'word',
+			normalize INTEGER DEFAULT 0,
+			action TEXT NOT NULL DEFAULT 'block_learning',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+
 		// User blacklist table for ignored users
 		`CREATE TABLE IF NOT EXISTS user_blacklist (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -105,6 +129,20 @@ func createTables() error {
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`,
 
+		// Users whose contributions were forgotten, so restoring a brain
+		// snapshot taken before then can forget them again
+		`CREATE TABLE IF NOT EXISTS forgotten_users (
+			user_id TEXT PRIMARY KEY,
+			forgotten_at INTEGER NOT NULL
+		)`,
+
+		// Emotes seen in chat, from the IRC emotes tag (emote code -> Twitch emote ID)
+		`CREATE TABLE IF NOT EXISTS emotes (
+			name TEXT PRIMARY KEY,
+			emote_id TEXT NOT NULL,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+
 		// Activity log table for recent messages
 		`CREATE TABLE IF NOT EXISTS activity (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -132,6 +170,20 @@ func createTables() error {
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`,
 
+		// Named brain groups channels can generate from
+		`CREATE TABLE IF NOT EXISTS brain_groups (
+			name TEXT PRIMARY KEY,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		// Channels whose brains make up each brain group, with their weights
+		`CREATE TABLE IF NOT EXISTS brain_group_members (
+			group_name TEXT NOT NULL,
+			channel TEXT NOT NULL,
+			weight REAL DEFAULT 1.0,
+			PRIMARY KEY (group_name, channel)
+		)`,
+
 		// Quote votes table for +1 system
 		`CREATE TABLE IF NOT EXISTS quote_votes (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -163,6 +215,63 @@ func createTables() error {
 	db.Exec("ALTER TABLE channels ADD COLUMN timer_enabled INTEGER DEFAULT 0")
 	db.Exec("ALTER TABLE channels ADD COLUMN timer_minutes INTEGER DEFAULT 15")
 
+	// Migration: add markov_order column for per-channel chain order (1-4)
+	db.Exec("ALTER TABLE channels ADD COLUMN markov_order INTEGER DEFAULT 2")
+
+	// Migration: add spam_dampening column for dampening copypasta floods before
+	// learning. Off for channels that existed before it, so their learning
+	// doesn't change on upgrade; AddChannel turns it on for new channels.
+	db.Exec("ALTER TABLE channels ADD COLUMN spam_dampening INTEGER DEFAULT 0")
+
+	// Migration: add learn_quota column for capping how much of each chatter is learned
+	db.Exec("ALTER TABLE channels ADD COLUMN learn_quota INTEGER DEFAULT 0")
+
+	// Migration: add seeded_replies column for keyword-seeded generation
+	db.Exec("ALTER TABLE channels ADD COLUMN seeded_replies INTEGER DEFAULT 0")
+
+	// Migration: add mention reply columns for answering @mentions and reply
+	// threads. Off for channels that existed before it, so the bot doesn't
+	// start talking more on upgrade; AddChannel turns it on for new channels.
+	db.Exec("ALTER TABLE channels ADD COLUMN mention_replies INTEGER DEFAULT 0")
+	db.Exec("ALTER TABLE channels ADD COLUMN mention_cooldown INTEGER DEFAULT 30")
+
+	// Migration: add brain decay policy columns
+	db.Exec("ALTER TABLE channels ADD COLUMN decay_enabled INTEGER DEFAULT 0")
+	db.Exec("ALTER TABLE channels ADD COLUMN decay_days INTEGER DEFAULT 30")
+	db.Exec("ALTER TABLE channels ADD COLUMN decay_keep_percent INTEGER DEFAULT 50")
+	db.Exec("ALTER TABLE channels ADD COLUMN decay_prune_below INTEGER DEFAULT 1")
+
+	// Migration: add strip_emotes column for removing emotes the bot can't use from its messages
+	db.Exec("ALTER TABLE channels ADD COLUMN strip_emotes INTEGER DEFAULT 0")
+
+	// Migration: add originality_threshold column for rejecting copies of recent
+	// chat. Off (0) for channels that existed before it, so their replies don't
+	// change on upgrade; AddChannel sets the default 80% for new channels.
+	db.Exec("ALTER TABLE channels ADD COLUMN originality_threshold INTEGER DEFAULT 0")
+
+	// Migration: add generation tuning columns
+	db.Exec("ALTER TABLE channels ADD COLUMN gen_min_words INTEGER DEFAULT 1")
+	db.Exec("ALTER TABLE channels ADD COLUMN gen_max_words INTEGER DEFAULT 20")
+	db.Exec("ALTER TABLE channels ADD COLUMN gen_max_chars INTEGER DEFAULT 500")
+	db.Exec("ALTER TABLE channels ADD COLUMN gen_temperature REAL DEFAULT 1.0")
+	db.Exec("ALTER TABLE channels ADD COLUMN gen_top_k INTEGER DEFAULT 0")
+	db.Exec("ALTER TABLE channels ADD COLUMN gen_retries INTEGER DEFAULT 5")
+
+	// Migration: add global_opt_out column for keeping a channel's brain out of the global index
+	db.Exec("ALTER TABLE channels ADD COLUMN global_opt_out INTEGER DEFAULT 0")
+
+	// Migration: add brain_group column for generating from a named brain group
+	db.Exec("ALTER TABLE channels ADD COLUMN brain_group TEXT DEFAULT ''")
+
+	// Migration: add link_policy column for how chat links are learned
+	db.Exec("ALTER TABLE channels ADD COLUMN link_policy TEXT DEFAULT 'skip'")
+
+	// Migration: add allowed_scripts column for the writing systems a channel learns
+	db.Exec("ALTER TABLE channels ADD COLUMN allowed_scripts TEXT DEFAULT 'latin'")
+
+	// Migration: add storage column for where a channel's brain keeps its transitions
+	db.Exec("ALTER TABLE channels ADD COLUMN storage TEXT DEFAULT 'sqlite'")
+
 	// Insert default config values if not exists
 	defaults := map[string]string{
 		"client_id":        "",
@@ -0,0 +1,288 @@
+package markov
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"twitchbot/internal/database"
+)
+
+// analyticsCacheTTL is how long an analytics report is reused. The report
+// scans the whole brain, so it's cached longer than GetStats.
+const analyticsCacheTTL = 10 * time.Minute
+
+// Analytics report sizes
+const (
+	analyticsTopWords   = 20
+	analyticsTopNgrams  = 20
+	analyticsGrowthDays = 90
+)
+
+// Health verdicts. A sparse brain has too few transitions, or too few choices
+// per state, to do more than repeat chat lines back; a bloated brain is mostly
+// transitions seen once, which cost space without shaping what it says.
+const (
+	HealthSparse  = "sparse"
+	HealthHealthy = "healthy"
+	HealthBloated = "bloated"
+)
+
+// Health thresholds
+const (
+	sparseMinTransitions = 5000
+	sparseMaxBranching   = 1.3
+	bloatedMinEntries    = 500000
+	bloatedMinSingletons = 0.8
+)
+
+// statsHistoryTable holds a brain's size each day, for the growth history
+const statsHistoryTable = `
+	CREATE TABLE IF NOT EXISTS stats_history (
+		day TEXT PRIMARY KEY,
+		unique_pairs INTEGER DEFAULT 0,
+		total_entries INTEGER DEFAULT 0,
+		message_count INTEGER DEFAULT 0
+	);
+`
+
+// WordCount is a word and how often it was learned
+type WordCount struct {
+	Word  string `json:"word"`
+	Count int    `json:"count"`
+}
+
+// NgramCount is a run of order+1 words (a state and its next word) and how
+// often it was learned
+type NgramCount struct {
+	Words []string `json:"words"`
+	Count int      `json:"count"`
+}
+
+// GrowthPoint is the size of a brain on a given day
+type GrowthPoint struct {
+	Day          string `json:"day"` // YYYY-MM-DD
+	UniquePairs  int    `json:"unique_pairs"`
+	TotalEntries int    `json:"total_entries"`
+	MessageCount int64  `json:"message_count"`
+}
+
+// BrainAnalytics describes the shape of a brain at its channel's current
+// Markov order, to tell brains too sparse to generate well from bloated ones
+type BrainAnalytics struct {
+	Channel         string        `json:"channel"`
+	Order           int           `json:"order"`
+	GeneratedAt     time.Time     `json:"generated_at"`
+	Transitions     int           `json:"transitions"`      // Transitions at the current order
+	States          int           `json:"states"`           // Distinct states at the current order
+	BranchingFactor float64       `json:"branching_factor"` // Average next words per state
+	DeadEndShare    float64       `json:"dead_end_share"`   // Share of transitions leading to a state with no next words
+	SingletonShare  float64       `json:"singleton_share"`  // Share of transitions seen only once
+	Health          string        `json:"health"`
+	TopWords        []WordCount   `json:"top_words"`
+	TopNgrams       []NgramCount  `json:"top_ngrams"`
+	Growth          []GrowthPoint `json:"growth"` // Daily sizes, oldest first
+}
+
+// nextStateWord1 returns a SQL expression for the word1 of the state a
+// transition t leads to at the given order: its state shifted by one word
+func nextStateWord1(order int) string {
+	switch {
+	case order <= 1:
+		return "''"
+	case order == 2:
+		return "t.word2"
+	default:
+		return "substr(t.word1, instr(t.word1, ' ') + 1) || ' ' || t.word2"
+	}
+}
+
+// Analytics returns the brain's analytics report, cached for analyticsCacheTTL.
+// The report scans the whole brain over its own read-only connection, without
+// the brain's lock, so learning and generation carry on while it runs.
+func (b *Brain) Analytics() BrainAnalytics {
+	b.mu.RLock()
+	if b.analytics != nil && time.Since(b.analyticsAt) < analyticsCacheTTL {
+		cached := *b.analytics
+		b.mu.RUnlock()
+		return cached
+	}
+	closed := b.db == nil
+	b.mu.RUnlock()
+
+	order := b.cfg.GetChannelMarkovOrder(b.Channel)
+	report := BrainAnalytics{
+		Channel:     b.Channel,
+		Order:       order,
+		GeneratedAt: time.Now(),
+		TopWords:    []WordCount{},
+		TopNgrams:   []NgramCount{},
+		Growth:      []GrowthPoint{},
+	}
+	if closed {
+		return report
+	}
+
+	dbPath := filepath.Join(database.GetDataDir(), "brains", b.Channel+".db")
+	db, err := openReadOnly(dbPath, "&_pragma=temp_store(memory)")
+	if err != nil {
+		log.Printf("[%s] Failed to open brain for analytics: %v", b.Channel, err)
+		return report
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	analyzeBrain(db, order, &report)
+
+	b.mu.Lock()
+	b.analytics = &report
+	b.analyticsAt = report.GeneratedAt
+	b.mu.Unlock()
+	return report
+}
+
+// analyzeBrain fills in an analytics report for the transitions at the given
+// order from a brain database
+func analyzeBrain(db *sql.DB, order int, report *BrainAnalytics) {
+	cond := orderCondition(order)
+
+	var singletons int
+	db.QueryRow(fmt.Sprintf(`
+		SELECT COUNT(*), COALESCE(SUM(count = 1), 0) FROM transitions WHERE %s
+	`, cond)).Scan(&report.Transitions, &singletons)
+	db.QueryRow(fmt.Sprintf(`
+		SELECT COUNT(*) FROM (SELECT DISTINCT word1, word2 FROM transitions WHERE %s)
+	`, cond)).Scan(&report.States)
+
+	// A transition is a dead end if nothing was learned after the state it
+	// leads to. Transitions into the end of a message are where chains are
+	// meant to stop, so they don't count.
+	var deadEnds int
+	db.QueryRow(fmt.Sprintf(`
+		SELECT COUNT(*) FROM transitions t
+		WHERE %s AND t.next_word != ? AND NOT EXISTS (
+			SELECT 1 FROM transitions u WHERE u.word1 = %s AND u.word2 = t.next_word
+		)
+	`, cond, nextStateWord1(order)), endToken).Scan(&deadEnds)
+
+	if report.States > 0 {
+		report.BranchingFactor = float64(report.Transitions) / float64(report.States)
+	}
+	if report.Transitions > 0 {
+		report.DeadEndShare = float64(deadEnds) / float64(report.Transitions)
+		report.SingletonShare = float64(singletons) / float64(report.Transitions)
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT next_word, SUM(count) AS total FROM transitions
+		WHERE %s AND next_word != ?
+		GROUP BY next_word ORDER BY total DESC LIMIT ?
+	`, cond), endToken, analyticsTopWords)
+	if err == nil {
+		for rows.Next() {
+			var w WordCount
+			if rows.Scan(&w.Word, &w.Count) == nil {
+				report.TopWords = append(report.TopWords, w)
+			}
+		}
+		rows.Close()
+	}
+
+	rows, err = db.Query(fmt.Sprintf(`
+		SELECT word1, word2, next_word, count FROM transitions
+		WHERE %s ORDER BY count DESC LIMIT ?
+	`, cond), analyticsTopNgrams)
+	if err == nil {
+		for rows.Next() {
+			var word1, word2, next string
+			var n NgramCount
+			if rows.Scan(&word1, &word2, &next, &n.Count) == nil {
+				n.Words = append(splitState(word1, word2), next)
+				report.TopNgrams = append(report.TopNgrams, n)
+			}
+		}
+		rows.Close()
+	}
+
+	rows, err = db.Query(`
+		SELECT day, unique_pairs, total_entries, message_count FROM (
+			SELECT * FROM stats_history ORDER BY day DESC LIMIT ?
+		) ORDER BY day
+	`, analyticsGrowthDays)
+	if err == nil {
+		for rows.Next() {
+			var p GrowthPoint
+			if rows.Scan(&p.Day, &p.UniquePairs, &p.TotalEntries, &p.MessageCount) == nil {
+				report.Growth = append(report.Growth, p)
+			}
+		}
+		rows.Close()
+	}
+
+	switch {
+	case report.Transitions < sparseMinTransitions || report.BranchingFactor < sparseMaxBranching:
+		report.Health = HealthSparse
+	case report.Transitions >= bloatedMinEntries && report.SingletonShare >= bloatedMinSingletons:
+		report.Health = HealthBloated
+	default:
+		report.Health = HealthHealthy
+	}
+}
+
+// recordGrowth saves the brain's size for today, for the analytics growth
+// history (must be called with lock held)
+func (b *Brain) recordGrowth(stats BrainStats) {
+	if b.db != nil {
+		saveGrowth(b.db, stats)
+	}
+}
+
+// saveGrowth saves a brain's size for today in its database
+func saveGrowth(db *sql.DB, stats BrainStats) error {
+	_, err := db.Exec(`
+		INSERT INTO stats_history (day, unique_pairs, total_entries, message_count) VALUES (?, ?, ?, ?)
+		ON CONFLICT(day) DO UPDATE SET unique_pairs = excluded.unique_pairs,
+			total_entries = excluded.total_entries, message_count = excluded.message_count
+	`, time.Now().Format("2006-01-02"), stats.UniquePairs, stats.TotalEntries, stats.MessageCount)
+	return err
+}
+
+// recordAllGrowth saves every brain's size for today, so the growth history
+// has a point for each day whether or not anyone looked at the brain. Brains
+// that aren't open are written through their file rather than opened.
+func (m *Manager) recordAllGrowth() {
+	brainsDir := filepath.Join(database.GetDataDir(), "brains")
+	for _, stats := range m.ListBrains() {
+		m.mu.RLock()
+		brain, open := m.brains[stats.Channel]
+		m.mu.RUnlock()
+
+		if open {
+			brain.mu.Lock()
+			brain.recordGrowth(stats)
+			brain.mu.Unlock()
+			continue
+		}
+
+		dbPath := filepath.Join(brainsDir, stats.Channel+".db")
+		if _, err := os.Stat(dbPath); err != nil {
+			continue
+		}
+		db, err := sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(5000)")
+		if err != nil {
+			continue
+		}
+		db.SetMaxOpenConns(1)
+		// Brains not opened since growth history was added don't have the table yet
+		_, err = db.Exec(statsHistoryTable)
+		if err == nil {
+			err = saveGrowth(db, stats)
+		}
+		if err != nil {
+			log.Printf("[%s] Failed to record brain growth: %v", stats.Channel, err)
+		}
+		db.Close()
+	}
+}
@@ -2,13 +2,19 @@ package markov
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	_ "modernc.org/sqlite"
 
@@ -16,17 +22,49 @@ import (
 	"twitchbot/internal/database"
 )
 
+// ErrBrainClosed is returned by a brain used after it was closed, for example
+// by a caller that kept it from Manager.GetBrain past its eviction
+var ErrBrainClosed = errors.New("brain is closed")
+
 // Brain represents a Markov chain brain for a single channel with its own database
 type Brain struct {
 	Channel      string
 	cfg          *config.Config
 	db           *sql.DB
+	store        TransitionStore // The brain's transitions (see store.go)
 	mu           sync.RWMutex
-	msgCounter   int
 	statsCache   *BrainStats
 	statsCacheAt time.Time
+	analytics    *BrainAnalytics // Cached analytics report (see analytics.go)
+	analyticsAt  time.Time
+	index        *globalIndex                    // Global index learned chat is added to, if any
+	recentIn     func(channel string) [][]string // Other brains' recent chat, for the originality check (set by the manager)
+	lastUsed     atomic.Int64                    // When the manager last handed the brain out (unix nanoseconds)
+	dampen       dampener                        // Recent chat, to dampen floods before learning (see dampen.go)
+	quota        learnQuota                      // Each chatter's recent learning, for the channel's quota (see quota.go)
+
+	// Chat handling state, kept apart from mu so handling a message never
+	// waits on a learning batch or other work holding the brain's lock
+	chatMu     sync.Mutex
+	msgCounter int      // Messages learned since the bot last spoke, persisted with each learning batch
+	recent     []string // Last few learned messages, used to pick reply seeds
+
+	// Learning queue, flushed in the background (see learnqueue.go)
+	queueMu   sync.Mutex
+	queue     []pendingMessage
+	shut      bool // Set once the brain is closed; queueLearn refuses messages after
+	flushNow  chan struct{}
+	stopFlush chan struct{}
+	flushDone chan struct{}
+	stopOnce  sync.Once
 }
 
+// Generator produces a response of up to maxWords words. When seed words are
+// given it tries to build the response through one of them, falling back to
+// an unseeded response if none of them can be used. If trace is non-nil, the
+// word choices are recorded in it.
+type Generator func(maxWords int, trace *Trace, seeds ...string) string
+
 // BrainStats holds statistics about a brain
 type BrainStats struct {
 	Channel      string `json:"channel"`
@@ -34,6 +72,7 @@ type BrainStats struct {
 	TotalEntries int    `json:"total_entries"`
 	MessageCount int64  `json:"message_count"`
 	DbSize       int64  `json:"db_size"`
+	QueueDepth   int    `json:"queue_depth"` // Messages waiting to be learned
 }
 
 // CleanWordResult holds the result of cleaning a single blacklisted word
@@ -49,6 +88,13 @@ type CleanResult struct {
 	Words        []CleanWordResult `json:"words"`
 }
 
+// openReadOnly opens a brain database file read-only, failing instead of
+// creating it if it's missing. The driver only passes mode=ro on to SQLite
+// for file: URIs; extra is appended to the query (e.g. "&_pragma=...").
+func openReadOnly(path, extra string) (*sql.DB, error) {
+	return sql.Open("sqlite", "file:"+path+"?mode=ro&_pragma=busy_timeout(5000)"+extra)
+}
+
 // NewBrain creates a new brain for a channel with its own database
 func NewBrain(channel string, cfg *config.Config) (*Brain, error) {
 	channel = strings.ToLower(channel)
@@ -61,10 +107,26 @@ func NewBrain(channel string, cfg *config.Config) (*Brain, error) {
 	if err := brain.initDB(); err != nil {
 		return nil, err
 	}
+	brain.startFlusher()
 
 	return brain, nil
 }
 
+// newMemoryBrain creates a brain without a database file that keeps its
+// transitions in a memory-only store, for tests. Learning, generation and
+// editing transitions work as usual; everything else kept in the brain file
+// (contributions, recent messages, decay, snapshots, exports, ...) is
+// unavailable and reports the brain as closed.
+func newMemoryBrain(channel string, cfg *config.Config) *Brain {
+	brain := &Brain{
+		Channel: strings.ToLower(channel),
+		cfg:     cfg,
+		store:   newMemoryStore(),
+	}
+	brain.startFlusher()
+	return brain
+}
+
 // initDB initializes the brain's database
 func (b *Brain) initDB() error {
 	brainsDir := filepath.Join(database.GetDataDir(), "brains")
@@ -91,17 +153,50 @@ func (b *Brain) initDB() error {
 			word2 TEXT NOT NULL,
 			next_word TEXT NOT NULL,
 			count INTEGER DEFAULT 1,
+			last_seen INTEGER DEFAULT 0,
 			PRIMARY KEY (word1, word2, next_word)
 		);
 		CREATE INDEX IF NOT EXISTS idx_word1_word2 ON transitions(word1, word2);
+		CREATE INDEX IF NOT EXISTS idx_next_word_word2 ON transitions(next_word, word2);
+
+		CREATE TABLE IF NOT EXISTS contributions (
+			user_id TEXT NOT NULL,
+			word1 TEXT NOT NULL,
+			word2 TEXT NOT NULL,
+			next_word TEXT NOT NULL,
+			count INTEGER DEFAULT 1,
+			PRIMARY KEY (user_id, word1, word2, next_word)
+		);
 		
+		CREATE TABLE IF NOT EXISTS recent_messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT DEFAULT '',
+			username TEXT DEFAULT '',
+			message TEXT NOT NULL
+		);
+
 		CREATE TABLE IF NOT EXISTS state (
 			key TEXT PRIMARY KEY,
 			value INTEGER DEFAULT 0,
 			value_text TEXT DEFAULT ''
 		);
-	`)
+	` + statsHistoryTable)
+	if err != nil {
+		return err
+	}
+
+	// Migration: add last_seen column (unix seconds) for decay, stamping
+	// existing transitions as seen now so they don't all decay at once
+	if _, err := b.db.Exec(`ALTER TABLE transitions ADD COLUMN last_seen INTEGER DEFAULT 0`); err == nil {
+		b.db.Exec(`UPDATE transitions SET last_seen = strftime('%s', 'now')`)
+	}
+
+	// Migration: add username column to recent_messages for the chatter report
+	b.db.Exec(`ALTER TABLE recent_messages ADD COLUMN username TEXT DEFAULT ''`)
+
+	b.store, err = openStore(b.cfg.GetChannelStorage(b.Channel), b.db)
 	if err != nil {
+		b.db.Close()
 		return err
 	}
 
@@ -109,41 +204,121 @@ func (b *Brain) initDB() error {
 	var counter int
 	err = b.db.QueryRow("SELECT value FROM state WHERE key = 'msg_counter'").Scan(&counter)
 	if err == nil {
+		b.chatMu.Lock()
 		b.msgCounter = counter
+		b.chatMu.Unlock()
 	}
 
 	return nil
 }
 
-// Close closes the brain's database connection
+// Close learns any queued messages, saves the message counter and closes the
+// brain's database connection, after waiting for any operation in progress to
+// finish
 func (b *Brain) Close() error {
-	if b.db != nil {
-		return b.db.Close()
+	b.shutQueue()
+	b.stopFlusher()
+	b.Flush()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.store = nil
+	if b.db == nil {
+		return nil
 	}
-	return nil
+	// Learning batches persist the counter, but not a reset after the last one
+	b.saveCounter()
+	err := b.db.Close()
+	b.db = nil
+	return err
 }
 
 // GenerationResult contains details about a generation attempt
 type GenerationResult struct {
-	Triggered     bool   `json:"triggered"`      // Whether generation was triggered (counter reached)
-	Success       bool   `json:"success"`        // Whether a message was generated
-	Response      string `json:"response"`       // The generated message (if any)
-	Attempts      int    `json:"attempts"`       // Number of generation attempts
-	FailureReason string `json:"failure_reason"` // Why generation failed (if it did)
-	Counter       int    `json:"counter"`        // Current counter value
-	Interval      int    `json:"interval"`       // Channel interval setting
-	UsingGlobal   bool   `json:"using_global"`   // Whether global brain was used
+	Triggered     bool   `json:"triggered"`       // Whether generation was triggered (counter reached)
+	Success       bool   `json:"success"`         // Whether a message was generated
+	Response      string `json:"response"`        // The generated message (if any)
+	Attempts      int    `json:"attempts"`        // Number of generation attempts
+	FailureReason string `json:"failure_reason"`  // Why generation failed (if it did)
+	Counter       int    `json:"counter"`         // Current counter value
+	Interval      int    `json:"interval"`        // Channel interval setting
+	UsingGlobal   bool   `json:"using_global"`    // Whether global brain was used
+	ReplyTo       string `json:"reply_to"`        // User being answered, if the bot was mentioned or replied to
+	Trace         *Trace `json:"trace,omitempty"` // How the last attempt's response was generated
+
+	// How chat was dampened since the bot last spoke, if the channel dampens spam
+	Dampening *DampeningStats `json:"dampening,omitempty"`
 }
 
 // ProcessMessage learns from a message and optionally generates a response
 // If globalGenerator is provided, it will be used instead of the local Generate function
-func (b *Brain) ProcessMessage(message, username, botUsername string, globalGenerator func(int) string) string {
-	result := b.ProcessMessageWithInfo(message, username, botUsername, globalGenerator)
+func (b *Brain) ProcessMessage(message, username, userID, emotes, botUsername string, globalGenerator Generator) string {
+	result := b.ProcessMessageWithInfo(message, username, userID, emotes, botUsername, globalGenerator)
 	return result.Response
 }
 
-// ProcessMessageWithInfo learns from a message and returns detailed generation info
-func (b *Brain) ProcessMessageWithInfo(message, username, botUsername string, globalGenerator func(int) string) GenerationResult {
+// ProcessMessageWithInfo learns from a message and returns detailed generation info.
+// userID is the sender's Twitch user ID, recorded so their contributions can
+// later be forgotten, and emotes is the message's IRC emotes tag; either may
+// be empty if unknown. The response isn't recorded as the bot's last message:
+// the caller may filter it further, so it passes what it sends to
+// SaveLastMessage.
+func (b *Brain) ProcessMessageWithInfo(message, username, userID, emotes, botUsername string, globalGenerator Generator) GenerationResult {
+	// A mention that isn't answered (e.g. during the mention cooldown) still
+	// shouldn't teach the bot its own name
+	emoteIDs := ParseEmotes(message, emotes)
+	return b.process(stripMention(message, botUsername), username, userID, emoteIDs, botUsername, globalGenerator, false)
+}
+
+// ReplyWithInfo handles a message addressed to the bot (an @mention or a reply
+// to one of its messages). It learns from the message like
+// ProcessMessageWithInfo, minus the bot's own name, but always generates an
+// answer instead of waiting for the message counter to reach the interval.
+func (b *Brain) ReplyWithInfo(message, username, userID, emotes, botUsername string, globalGenerator Generator) GenerationResult {
+	emoteIDs := ParseEmotes(message, emotes)
+	return b.process(stripMention(message, botUsername), username, userID, emoteIDs, botUsername, globalGenerator, true)
+}
+
+// mentionTrailing holds the punctuation that may follow an @mention, as in
+// "@bot, hi". It leaves out characters Twitch allows in login names.
+const mentionTrailing = ".,!?;:'\")"
+
+// isMention reports whether a chat word is an @mention of the bot
+func isMention(word, botUsername string) bool {
+	return botUsername != "" && strings.EqualFold(strings.TrimRight(word, mentionTrailing), "@"+botUsername)
+}
+
+// MentionsBot reports whether a chat message @mentions the bot
+func MentionsBot(message, botUsername string) bool {
+	for _, w := range strings.Fields(message) {
+		if isMention(w, botUsername) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripMention removes @mentions of the bot from a message
+func stripMention(message, botUsername string) string {
+	if !MentionsBot(message, botUsername) {
+		return message
+	}
+	words := strings.Fields(message)
+	kept := words[:0]
+	for _, w := range words {
+		if !isMention(w, botUsername) {
+			kept = append(kept, w)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+// process learns from a message and generates a response when the message
+// counter reaches the channel interval or when reply is set. Messages that
+// fail the learning filters are not learned but still get a reply. emotes
+// holds the message's emote codes, which are learned as-is but left out of
+// the content filters.
+func (b *Brain) process(message, username, userID string, emotes map[string]string, botUsername string, globalGenerator Generator, reply bool) GenerationResult {
 	result := GenerationResult{}
 
 	// Skip commands
@@ -166,104 +341,215 @@ func (b *Brain) ProcessMessageWithInfo(message, username, botUsername string, gl
 		return result
 	}
 
-	// Skip messages with links
-	if containsLink(message) {
-		return result
-	}
-
-	// Skip non-English messages
-	if !isMostlyEnglish(message) {
-		return result
-	}
-
-	// Skip messages with blacklisted words
-	if b.containsBlacklistedWord(message) {
+	shouldRespond := reply
+	message, linksOK := b.filterLinks(message, emotes)
+	if linksOK && b.shouldLearn(message, emotes) && !b.overQuota(username) && b.undampened(username, message) {
+		// Normalize smart quotes and other Unicode to ASCII before learning
+		message = normalizeASCII(message)
+		b.cfg.RecordEmotes(emotes)
+
+		// Learn from the message (always local)
+		if err := b.queueLearn(message, userID, username); err != nil {
+			log.Printf("[%s] Not learning message: %v", b.Channel, err)
+			if !reply {
+				return result
+			}
+		} else {
+			b.chargeQuota(username)
+			b.rememberRecent(message)
+
+			// Increment message count
+			b.cfg.IncrementChannelMessages(b.Channel)
+
+			// Check if we should respond (use per-channel interval). The
+			// counter is persisted with the next learning batch.
+			channelInterval := b.cfg.GetChannelMessageInterval(b.Channel)
+			b.chatMu.Lock()
+			b.msgCounter++
+			result.Counter = b.msgCounter
+			result.Interval = channelInterval
+			if b.msgCounter >= channelInterval {
+				shouldRespond = true
+				b.msgCounter = 0
+				result.Counter = 0
+			}
+			b.chatMu.Unlock()
+		}
+	} else if !reply {
 		return result
 	}
 
-	// Normalize smart quotes and other Unicode to ASCII before learning
-	message = normalizeASCII(message)
-
-	// Learn from the message (always local)
-	b.learn(message)
-
-	// Increment message count
-	b.cfg.IncrementChannelMessages(b.Channel)
-
-	// Check if we should respond (use per-channel interval)
-	b.mu.Lock()
-	b.msgCounter++
-	channelInterval := b.cfg.GetChannelMessageInterval(b.Channel)
-	result.Counter = b.msgCounter
-	result.Interval = channelInterval
-	shouldRespond := b.msgCounter >= channelInterval
 	if shouldRespond {
-		b.msgCounter = 0
-		result.Counter = 0
-	}
-	// Persist counter to database
-	b.saveCounter()
-	b.mu.Unlock()
+		// Learn the queue first so the reply can build on the latest chat
+		b.Flush()
 
-	if shouldRespond {
 		result.Triggered = true
 		result.UsingGlobal = globalGenerator != nil
+		if reply {
+			result.ReplyTo = username
+		}
+		if b.cfg.GetChannelSpamDampening(b.Channel) {
+			stats := b.dampen.take()
+			result.Dampening = &stats
+		}
 
 		// Choose generator based on setting
-		generator := b.Generate
+		generator := Generator(b.GenerateTraced)
 		if globalGenerator != nil {
 			generator = globalGenerator
 		}
 
-		// Try up to 5 times to generate a clean response
-		for i := 0; i < 5; i++ {
-			result.Attempts = i + 1
-			response := generator(20)
-			if response == "" {
-				result.FailureReason = "empty_generation"
-				continue
-			}
-			if b.containsBlacklistedWord(response) {
-				result.FailureReason = "blacklisted_word"
-				continue
-			}
-			// Don't let the bot accidentally invoke chat commands
-			if strings.HasPrefix(strings.TrimSpace(response), "!") {
-				result.FailureReason = "starts_with_command"
-				continue
-			}
-			// Success!
-			result.Success = true
-			result.Response = response
-			result.FailureReason = ""
-			b.saveLastMessage(response)
-			return result
-		}
-		// All attempts failed
-		if result.FailureReason == "" {
-			result.FailureReason = "unknown"
+		// Build the reply through a word from the conversation if enabled
+		var seeds []string
+		if b.cfg.GetChannelSeededReplies(b.Channel) {
+			seeds = b.seedWords(message)
 		}
+
+		b.generateResponse(&result, generator, seeds)
+	}
+
+	return result
+}
+
+// shouldLearn reports whether a message passes the content filters for
+// learning. Links are handled before this by the channel's link policy (see
+// filterLinks). Emote codes are not words: they are exempt from the script
+// check and matched verbatim against the blacklist.
+func (b *Brain) shouldLearn(message string, emotes map[string]string) bool {
+	text := withoutEmotes(message, emotes)
+
+	// Skip messages written outside the channel's allowed scripts
+	if !b.scripts().allowed(text) {
+		return false
+	}
+
+	// Skip messages with blacklisted words
+	if b.containsBlacklistedWord(message, emotes) {
+		return false
 	}
 
+	// Skip messages matching filter rules that block learning
+	return !b.matchesRules(message, emotes, config.FilterBlockLearning)
+}
+
+// GenerateWithInfo generates a message outside of chat processing (e.g. for
+// the inactivity timer) with the same settings and checks as a chat response.
+// If globalGenerator is provided, it is used instead of Generate. Like a chat
+// response, the caller records what it sends with SaveLastMessage.
+func (b *Brain) GenerateWithInfo(globalGenerator Generator) GenerationResult {
+	result := GenerationResult{Triggered: true, UsingGlobal: globalGenerator != nil}
+	generator := Generator(b.GenerateTraced)
+	if globalGenerator != nil {
+		generator = globalGenerator
+	}
+	b.generateResponse(&result, generator, nil)
 	return result
 }
 
+// Preview generates a message like GenerateWithInfo without it counting as
+// sent, so the result's trace can be inspected. If generator is nil, the
+// brain's own Generator is used.
+func (b *Brain) Preview(generator Generator) GenerationResult {
+	result := GenerationResult{Triggered: true, UsingGlobal: generator != nil}
+	if generator == nil {
+		generator = b.GenerateTraced
+	}
+	b.generateResponse(&result, generator, nil)
+	return result
+}
+
+// generateResponse generates a clean response with the channel's generation
+// settings, retrying up to the configured number of attempts and recording
+// the outcome in result. Responses that mostly repeat a recently learned chat
+// message, in this brain or any brain the response was drawn from, are
+// rejected so the bot doesn't quote chatters out of context.
+func (b *Brain) generateResponse(result *GenerationResult, generator Generator, seeds []string) {
+	settings := b.cfg.GetChannelGenerationSettings(b.Channel)
+	threshold := b.cfg.GetChannelOriginalityThreshold(b.Channel)
+	recent := make(map[string][][]string) // Recent chat of each source brain checked so far
+
+	for i := 0; i < settings.Retries; i++ {
+		result.Attempts = i + 1
+		result.Trace = &Trace{Steps: []TraceStep{}}
+		response := generator(settings.MaxWords, result.Trace, seeds...)
+		if response == "" {
+			result.FailureReason = "empty_generation"
+			continue
+		}
+		generated := response
+		// Never send links, whatever the brain learned
+		emotes := b.cfg.GetEmoteIDs(strings.Fields(response))
+		if response = stripLinks(response, emotes, nil); strings.TrimSpace(response) == "" {
+			result.FailureReason = "only_links"
+			continue
+		}
+		linksStripped := response != generated
+		if len(strings.Fields(response)) < settings.MinWords {
+			result.FailureReason = "too_short"
+			continue
+		}
+		if utf8.RuneCountInString(response) > settings.MaxChars {
+			result.FailureReason = "too_long"
+			continue
+		}
+		if b.containsBlacklistedWord(response, emotes) {
+			result.FailureReason = "blacklisted_word"
+			continue
+		}
+		if b.matchesRules(response, emotes, config.FilterBlockLearning, config.FilterBlockOutput) {
+			result.FailureReason = "filter_rule"
+			continue
+		}
+		// Don't let the bot accidentally invoke chat commands
+		if strings.HasPrefix(strings.TrimSpace(response), "!") {
+			result.FailureReason = "starts_with_command"
+			continue
+		}
+		if threshold > 0 && b.copiesSource(response, result.Trace, threshold, recent) {
+			result.FailureReason = "too_similar"
+			continue
+		}
+		// Success!
+		masked := b.maskRules(response, emotes)
+		if linksStripped || masked != response {
+			result.Trace.Generated = generated
+			if linksStripped {
+				result.Trace.Changes = append(result.Trace.Changes, TraceLinksStripped)
+			}
+			if masked != response {
+				result.Trace.Changes = append(result.Trace.Changes, TraceMasked)
+			}
+		}
+		response = masked
+		result.Success = true
+		result.Response = response
+		result.FailureReason = ""
+		return
+	}
+	// All attempts failed
+	if result.FailureReason == "" {
+		result.FailureReason = "unknown"
+	}
+}
+
 // GetMessageCounter returns the current message counter
 func (b *Brain) GetMessageCounter() int {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+	b.chatMu.Lock()
+	defer b.chatMu.Unlock()
 	return b.msgCounter
 }
 
-// saveCounter persists the message counter to the database (must be called with lock held)
+// saveCounter persists the message counter to the database (must be called
+// with lock held)
 func (b *Brain) saveCounter() {
 	if b.db == nil {
 		return
 	}
+	counter := b.GetMessageCounter()
 	b.db.Exec(`
 		INSERT INTO state (key, value) VALUES ('msg_counter', ?)
 		ON CONFLICT(key) DO UPDATE SET value = ?
-	`, b.msgCounter, b.msgCounter)
+	`, counter, counter)
 }
 
 // saveLastMessage persists the last bot message to the database
@@ -277,13 +563,19 @@ func (b *Brain) saveLastMessage(message string) {
 	`, message, message)
 }
 
-// SaveLastMessage is the exported version for external callers (e.g. timer messages)
+// SaveLastMessage records a message the bot sent in this channel, after any
+// filtering by the caller, as its last message
 func (b *Brain) SaveLastMessage(message string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	b.saveLastMessage(message)
 }
 
-// GetLastMessage returns the last message the bot sent in this channel
+// GetLastMessage returns the last message the bot sent in this channel, or
+// "" if the brain is closed
 func (b *Brain) GetLastMessage() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	if b.db == nil {
 		return ""
 	}
@@ -295,111 +587,317 @@ func (b *Brain) GetLastMessage() string {
 	return msg
 }
 
-// learn adds a message to the brain
-func (b *Brain) learn(message string) {
-	words := strings.Fields(message)
-	if len(words) < 3 {
-		return
+// Boundary tokens mark where a learned message started and ended. learn pads
+// every message with order start tokens in front and one end token behind, so
+// generation can begin from a real message opening and stop at a real ending.
+// They are ASCII control characters, which never reach the brain as words
+// (learn drops any that slip through in chat).
+const (
+	startToken = "\x02"
+	endToken   = "\x03"
+)
+
+// isBoundary reports whether a word is a start or end token
+func isBoundary(word string) bool {
+	return word == startToken || word == endToken
+}
+
+// startState returns the chain context that precedes the first word of a message
+func startState(order int) []string {
+	state := make([]string, order)
+	for i := range state {
+		state[i] = startToken
 	}
+	return state
+}
 
-	b.mu.Lock()
-	defer b.mu.Unlock()
+// joinChain joins a generated word sequence, dropping boundary tokens
+func joinChain(words []string) string {
+	out := make([]string, 0, len(words))
+	for _, w := range words {
+		if !isBoundary(w) {
+			out = append(out, w)
+		}
+	}
+	return strings.Join(out, " ")
+}
 
-	for i := 0; i < len(words)-2; i++ {
-		word1 := words[i]
-		word2 := words[i+1]
-		nextWord := words[i+2]
+// learn adds a message to the brain right away. Chat goes through the
+// learning queue instead (see queueLearn).
+func (b *Brain) learn(message, userID string) {
+	b.learnBatch([]pendingMessage{{message: message, userID: userID}})
+}
 
-		// Skip loop transitions (all three words the same) to avoid infinite loops
-		if word1 == word2 && word2 == nextWord {
+// learnBatch adds messages to the brain at the channel's configured Markov
+// order in a single store transaction, persisting the message counter with
+// them. If a message's userID is set, each of
+// its transitions is also counted as that user's contribution so ForgetUser
+// can take it back out; contributions are written with the transitions, so
+// they never count transitions that weren't learned. Once committed, the
+// learned counts are also added to the global index.
+func (b *Brain) learnBatch(batch []pendingMessage) {
+	order := b.cfg.GetChannelMarkovOrder(b.Channel)
+	learned := make(map[transitionKey]int)
+	contributed := make(map[Contribution]int)
+	var messages []RecentMessage
+
+	for _, msg := range batch {
+		var words []string
+		for _, w := range strings.Fields(msg.message) {
+			if !isBoundary(w) {
+				words = append(words, w)
+			}
+		}
+		if len(words) < 3 {
 			continue
 		}
+		messages = append(messages, RecentMessage{UserID: msg.userID, Username: msg.username, Message: strings.Join(words, " ")})
+		words = append(append(startState(order), words...), endToken)
+
+		for i := 0; i+order < len(words); i++ {
+			context := words[i : i+order]
+			nextWord := words[i+order]
 
-		// Insert or update count
-		b.db.Exec(`
-			INSERT INTO transitions (word1, word2, next_word, count)
-			VALUES (?, ?, ?, 1)
-			ON CONFLICT(word1, word2, next_word) DO UPDATE SET count = count + 1
-		`, word1, word2, nextWord)
+			// Skip loop transitions (context and next word all the same) to avoid infinite loops
+			if isLoop(context, nextWord) {
+				continue
+			}
+
+			word1, word2 := stateKey(context)
+
+			learned[transitionKey{word1, word2, nextWord}]++
+			if msg.userID != "" {
+				contributed[Contribution{UserID: msg.userID, Word1: word1, Word2: word2, NextWord: nextWord}]++
+			}
+		}
+	}
+
+	learn := LearnBatch{Messages: messages, SeenAt: time.Now().Unix(), Counter: b.GetMessageCounter()}
+	for key, count := range learned {
+		learn.Transitions = append(learn.Transitions, Transition{Word1: key.word1, Word2: key.word2, NextWord: key.nextWord, Count: count})
+	}
+	for c, count := range contributed {
+		c.Count = count
+		learn.Contributions = append(learn.Contributions, c)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.store == nil {
+		return
+	}
+	if err := b.store.Learn(learn); err != nil {
+		log.Printf("[%s] Failed to learn batch of %d messages: %v", b.Channel, len(batch), err)
+		return
+	}
+	if b.index != nil {
+		b.index.add(b.Channel, learned)
 	}
 }
 
-// Generate creates a sentence using the Markov chain
-func (b *Brain) Generate(maxWords int) string {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+// stateKey packs a chain context into the (word1, word2) columns of the
+// transitions table. word2 always holds the last context word and word1 the
+// words before it joined by spaces, so a second-order context maps onto the
+// original two-column layout unchanged, a first-order context has an empty
+// word1, and third/fourth-order contexts pack two or three words into word1.
+// Words come from strings.Fields and never contain spaces, so the packing is
+// unambiguous and transitions learned at different orders never collide.
+func stateKey(context []string) (word1, word2 string) {
+	return strings.Join(context[:len(context)-1], " "), context[len(context)-1]
+}
 
-	// Get a random starting pair using rowid trick — O(1) vs O(n log n) for ORDER BY RANDOM()
-	var word1, word2 string
-	err := b.db.QueryRow(`
-		SELECT word1, word2 FROM transitions
-		WHERE rowid >= (abs(random()) % (SELECT max(rowid) FROM transitions) + 1)
-		LIMIT 1
-	`).Scan(&word1, &word2)
-	// Fallback in case rowid has gaps that land past all rows
-	if err != nil {
-		err = b.db.QueryRow(`
-			SELECT word1, word2 FROM transitions ORDER BY rowid LIMIT 1
-		`).Scan(&word1, &word2)
+// splitState is the inverse of stateKey
+func splitState(word1, word2 string) []string {
+	return append(strings.Fields(word1), word2)
+}
+
+// transitionOrder returns the Markov order a transition was learned at
+func transitionOrder(word1 string) int {
+	if word1 == "" {
+		return 1
 	}
+	return strings.Count(word1, " ") + 2
+}
 
-	if err != nil {
-		return ""
+// orderCondition returns a SQL condition matching transitions learned at the given order
+func orderCondition(order int) string {
+	if order <= 1 {
+		return "word1 = ''"
 	}
+	return fmt.Sprintf("word1 != '' AND length(word1) - length(replace(word1, ' ', '')) = %d", order-2)
+}
 
-	result := []string{word1, word2}
+// isLoop reports whether a context and its next word are all the same word
+func isLoop(context []string, nextWord string) bool {
+	for _, w := range context {
+		if w != nextWord {
+			return false
+		}
+	}
+	return true
+}
 
-	for i := 0; i < maxWords; i++ {
-		// Get possible next words weighted by count
-		rows, err := b.db.Query(`
-			SELECT next_word, count FROM transitions
-			WHERE word1 = ? AND word2 = ?
-		`, word1, word2)
+// candidateLookup returns the possible next words and their weights for a chain state
+type candidateLookup func(word1, word2 string) (candidates []string, weights []int)
 
-		if err != nil {
+// walkChain extends a word sequence by up to maxWords words, using its last
+// order words as the chain state and stopping early at a dead end or a learned
+// message ending. It returns the full sequence including the start (the end
+// token itself is not included).
+func walkChain(start []string, order, maxWords int, lookup candidateLookup, pick sampler, trace *Trace) []string {
+	result := append([]string(nil), start...)
+
+	for i := 0; i < maxWords; i++ {
+		state := result[len(result)-order:]
+		word1, word2 := stateKey(state)
+		candidates, weights := lookup(word1, word2)
+		if len(candidates) == 0 {
+			break
+		}
+		idx, p := pick.choose(weights)
+		trace.pick(TraceForward, state, candidates, weights, idx, p)
+		next := candidates[idx]
+		if next == endToken {
 			break
 		}
+		result = append(result, next)
+	}
+
+	return result
+}
 
-		var candidates []string
-		var weights []int
-		totalWeight := 0
+// chooseWeighted makes a weighted random selection, returning the chosen
+// index and its probability. Uses the top-level math/rand functions (backed
+// by a lock-protected global source) rather than a per-Brain *rand.Rand,
+// since RLock allows concurrent readers to generate simultaneously and a
+// plain rand.Rand is not safe for concurrent use.
+func chooseWeighted(weights []int) (int, float64) {
+	totalWeight := 0
+	for _, w := range weights {
+		totalWeight += w
+	}
+	if totalWeight <= 0 {
+		return rand.Intn(len(weights)), 1 / float64(len(weights))
+	}
 
-		for rows.Next() {
-			var nextWord string
-			var count int
-			if rows.Scan(&nextWord, &count) == nil {
-				candidates = append(candidates, nextWord)
-				weights = append(weights, count)
-				totalWeight += count
-			}
+	r := rand.Intn(totalWeight)
+	cumulative := 0
+	for i, w := range weights {
+		cumulative += w
+		if r < cumulative {
+			return i, float64(w) / float64(totalWeight)
 		}
-		rows.Close()
+	}
+	last := len(weights) - 1
+	return last, float64(weights[last]) / float64(totalWeight)
+}
 
-		if len(candidates) == 0 {
-			break
+// sampler picks the next word of a chain from its weighted candidates using
+// a channel's temperature and top-k settings
+type sampler struct {
+	temperature float64
+	topK        int
+}
+
+// newSampler returns the sampler for a channel's generation settings
+func newSampler(settings config.GenerationSettings) sampler {
+	return sampler{temperature: settings.Temperature, topK: settings.TopK}
+}
+
+// pick makes a weighted random selection among the topK heaviest candidates
+// (all if topK is 0), with each weight raised to the power 1/temperature: a
+// temperature below 1 favors common words, above 1 gives rare words a chance.
+func (s sampler) pick(candidates []string, weights []int) string {
+	i, _ := s.choose(weights)
+	return candidates[i]
+}
+
+// choose is pick by weights alone: it returns the index of the chosen
+// candidate and the probability it had of being chosen
+func (s sampler) choose(weights []int) (int, float64) {
+	if (s.topK <= 0 || s.topK >= len(weights)) && (s.temperature == 1 || s.temperature <= 0) {
+		return chooseWeighted(weights)
+	}
+
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	if s.topK > 0 && s.topK < len(order) {
+		sort.SliceStable(order, func(a, b int) bool { return weights[order[a]] > weights[order[b]] })
+		order = order[:s.topK]
+	}
+
+	scaled := make([]float64, len(order))
+	total := 0.0
+	for i, idx := range order {
+		w := float64(weights[idx])
+		if w < 1 {
+			w = 1
+		}
+		if s.temperature > 0 {
+			w = math.Pow(w, 1/s.temperature)
 		}
+		scaled[i] = w
+		total += w
+	}
 
-		// Weighted random selection. Uses the top-level math/rand functions
-		// (backed by a lock-protected global source) rather than a per-Brain
-		// *rand.Rand, since RLock allows concurrent readers to call Generate
-		// simultaneously and a plain rand.Rand is not safe for concurrent use.
-		r := rand.Intn(totalWeight)
-		cumulative := 0
-		var nextWord string
-		for i, w := range weights {
-			cumulative += w
-			if r < cumulative {
-				nextWord = candidates[i]
-				break
-			}
+	r := rand.Float64() * total
+	for i, w := range scaled {
+		r -= w
+		if r < 0 {
+			return order[i], w / total
 		}
+	}
+	last := len(order) - 1
+	return order[last], scaled[last] / total
+}
 
-		result = append(result, nextWord)
-		word1 = word2
-		word2 = nextWord
+// Generate creates a sentence using the Markov chain at the channel's configured
+// order, starting from a learned message opening and stopping at a learned
+// ending. If seed words are given, the sentence is built through the first
+// seed the brain knows, generating backward and forward from it.
+func (b *Brain) Generate(maxWords int, seeds ...string) string {
+	return b.GenerateTraced(maxWords, nil, seeds...)
+}
+
+// GenerateTraced is Generate, recording each word choice in trace if it is
+// non-nil. It is the brain's Generator.
+func (b *Brain) GenerateTraced(maxWords int, trace *Trace, seeds ...string) string {
+	order := b.cfg.GetChannelMarkovOrder(b.Channel)
+	trace.begin("channel", order)
+	pick := newSampler(b.cfg.GetChannelGenerationSettings(b.Channel))
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.store == nil {
+		return ""
 	}
 
-	return strings.Join(result, " ")
+	lookup := b.store.Next
+	predecessors := b.store.Previous
+
+	for _, seed := range seeds {
+		if seq := b.store.SeedState(order, seed); seq != nil {
+			return joinChain(seededChain(seq, maxWords, lookup, predecessors, pick, trace))
+		}
+	}
+
+	result := walkChain(startState(order), order, maxWords, lookup, pick, trace)
+	if len(result) > order {
+		return joinChain(result)
+	}
+	trace.reset()
+
+	// No learned openings at this order (brain predates boundary tokens):
+	// fall back to a random starting state
+	start := b.store.RandomStart(order)
+	if start == nil {
+		return ""
+	}
+	trace.state(TraceStart, start)
+	return joinChain(walkChain(start, order, maxWords, lookup, pick, trace))
 }
 
 // GetStats returns statistics about the brain, with a 60-second cache for expensive counts.
@@ -409,6 +907,7 @@ func (b *Brain) GetStats() BrainStats {
 		cached := *b.statsCache
 		// Always refresh message count and file size (cheap)
 		cached.MessageCount, _, _ = b.cfg.GetChannelStats(b.Channel)
+		cached.QueueDepth = b.QueueDepth()
 		brainsDir := filepath.Join(database.GetDataDir(), "brains")
 		dbPath := filepath.Join(brainsDir, b.Channel+".db")
 		if info, err := os.Stat(dbPath); err == nil {
@@ -425,16 +924,11 @@ func (b *Brain) GetStats() BrainStats {
 	stats := BrainStats{
 		Channel: b.Channel,
 	}
+	if b.store == nil {
+		return stats
+	}
 
-	// Count distinct pairs without string concatenation overhead
-	b.db.QueryRow(`
-		SELECT COUNT(*) FROM (SELECT DISTINCT word1, word2 FROM transitions)
-	`).Scan(&stats.UniquePairs)
-
-	// Get total entries
-	b.db.QueryRow(`
-		SELECT COUNT(*) FROM transitions
-	`).Scan(&stats.TotalEntries)
+	stats.UniquePairs, stats.TotalEntries = b.store.Stats()
 
 	// Get message count from channels table
 	stats.MessageCount, _, _ = b.cfg.GetChannelStats(b.Channel)
@@ -448,26 +942,34 @@ func (b *Brain) GetStats() BrainStats {
 
 	b.statsCache = &stats
 	b.statsCacheAt = time.Now()
+	b.recordGrowth(stats)
+	stats.QueueDepth = b.QueueDepth()
 
 	return stats
 }
 
-// Clean removes all transitions containing blacklisted words
+// Clean removes all transitions containing words blacklisted globally or in
+// this channel, or matching filter rules that block learning
 func (b *Brain) Clean() CleanResult {
 	result := CleanResult{
 		Channel: b.Channel,
 		Words:   []CleanWordResult{},
 	}
 
-	blacklist := b.cfg.GetBlacklistedWords()
+	blacklist := b.cfg.GetBlacklistedWordsFor(b.Channel)
+	rules := b.rulesWithActions(config.FilterBlockLearning)
 
-	if len(blacklist) == 0 {
+	if len(blacklist) == 0 && len(rules) == 0 {
 		return result
 	}
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if b.db == nil {
+		return result
+	}
 
+	removedByWord := make(map[string]int, len(blacklist))
 	for _, word := range blacklist {
 		wordRemoved := 0
 		// Check if this is a multi-word phrase
@@ -520,23 +1022,121 @@ func (b *Brain) Clean() CleanResult {
 			}
 		}
 
-		if wordRemoved > 0 {
+		removedByWord[word] = wordRemoved
+	}
+
+	// Third- and fourth-order transitions pack several context words into
+	// word1, which the column-wise matches above can't see into. Check those
+	// rows word by word.
+	b.cleanPackedContexts(blacklist, removedByWord)
+
+	// Filter rules can match any part of a word, so they're checked row by row
+	if len(rules) > 0 {
+		b.cleanRules(rules, removedByWord)
+		listed := make(map[string]bool, len(blacklist))
+		for _, word := range blacklist {
+			listed[word] = true
+		}
+		for _, m := range rules {
+			if !listed[m.rule.Pattern] {
+				listed[m.rule.Pattern] = true
+				blacklist = append(blacklist, m.rule.Pattern)
+			}
+		}
+	}
+
+	b.dropOrphanContributions()
+	b.transitionsChanged()
+
+	for _, word := range blacklist {
+		if removed := removedByWord[word]; removed > 0 {
 			result.Words = append(result.Words, CleanWordResult{
 				Word:    word,
-				Removed: wordRemoved,
+				Removed: removed,
 			})
-			result.TotalRemoved += wordRemoved
+			result.TotalRemoved += removed
 		}
 	}
 
 	return result
 }
 
-// CleanNonASCII removes transitions containing non-ASCII characters (excluding emoji)
-// and also removes loop transitions where all three words are the same
+// cleanPackedContexts removes transitions whose packed word1 context (orders
+// 3 and 4) contains a blacklisted word or phrase, adding the number of rows
+// removed per blacklist entry to removed. Must be called with the write lock held.
+func (b *Brain) cleanPackedContexts(blacklist []string, removed map[string]int) {
+	rows, err := b.db.Query(`SELECT rowid, word1, word2, next_word FROM transitions WHERE word1 LIKE '% %'`)
+	if err != nil {
+		return
+	}
+
+	type match struct {
+		rowid int64
+		word  string
+	}
+	var matches []match
+
+	for rows.Next() {
+		var rowid int64
+		var word1, word2, nextWord string
+		if err := rows.Scan(&rowid, &word1, &word2, &nextWord); err != nil {
+			continue
+		}
+		seq := cleanWordList(append(splitState(word1, word2), nextWord))
+		for _, entry := range blacklist {
+			phrase := cleanWordList(strings.Fields(entry))
+			if len(phrase) > 0 && (containsRun(seq, phrase) || containsRun(phrase, seq)) {
+				matches = append(matches, match{rowid, entry})
+				break
+			}
+		}
+	}
+	rows.Close()
+
+	for _, m := range matches {
+		if _, err := b.db.Exec(`DELETE FROM transitions WHERE rowid = ?`, m.rowid); err == nil {
+			removed[m.word]++
+		}
+	}
+}
+
+// cleanWordList lowercases words and strips their surrounding punctuation
+func cleanWordList(words []string) []string {
+	clean := make([]string, len(words))
+	for i, w := range words {
+		clean[i] = stripWordPunctuation(strings.ToLower(w))
+	}
+	return clean
+}
+
+// containsRun reports whether needle appears as a contiguous run of words in haystack
+func containsRun(haystack, needle []string) bool {
+	for i := 0; i+len(needle) <= len(haystack); i++ {
+		match := true
+		for j := range needle {
+			if haystack[i+j] != needle[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanNonASCII removes transitions with words written outside the channel's
+// allowed scripts (ASCII and emoji are always allowed) and also removes loop
+// transitions where the context and next word are all the same
 func (b *Brain) CleanNonASCII() (rowsRemoved int) {
+	scripts := b.scripts()
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if b.db == nil {
+		return 0
+	}
 
 	// Get all transitions
 	rows, err := b.db.Query(`SELECT rowid, word1, word2, next_word FROM transitions`)
@@ -559,15 +1159,15 @@ func (b *Brain) CleanNonASCII() (rowsRemoved int) {
 			continue
 		}
 
-		// Check for loop (all three words are the same)
-		if word1 == word2 && word2 == nextWord {
+		// Check for loop (context and next word all the same)
+		if isLoop(splitState(word1, word2), nextWord) {
 			toDelete = append(toDelete, transitionToDelete{rowid, word1, word2, nextWord, "loop"})
 			continue
 		}
 
-		// Check if any word contains non-ASCII (excluding emoji)
-		if containsNonASCII(word1) || containsNonASCII(word2) || containsNonASCII(nextWord) {
-			toDelete = append(toDelete, transitionToDelete{rowid, word1, word2, nextWord, "non-ascii"})
+		// Check if any word is written outside the allowed scripts
+		if !scripts.allowed(word1) || !scripts.allowed(word2) || !scripts.allowed(nextWord) {
+			toDelete = append(toDelete, transitionToDelete{rowid, word1, word2, nextWord, "script"})
 		}
 	}
 
@@ -580,21 +1180,21 @@ func (b *Brain) CleanNonASCII() (rowsRemoved int) {
 			} else {
 				// Find and log the offending word(s)
 				var badWords []string
-				if containsNonASCII(t.word1) {
-					badWords = append(badWords, t.word1)
-				}
-				if containsNonASCII(t.word2) {
-					badWords = append(badWords, t.word2)
+				for _, w := range []string{t.word1, t.word2, t.next} {
+					if !scripts.allowed(w) {
+						badWords = append(badWords, w)
+					}
 				}
-				if containsNonASCII(t.next) {
-					badWords = append(badWords, t.next)
-				}
-				log.Printf("[%s] Removed non-ASCII transition: %q -> %q -> %q (bad: %v)", b.Channel, t.word1, t.word2, t.next, badWords)
+				log.Printf("[%s] Removed transition outside allowed scripts: %q -> %q -> %q (bad: %v)", b.Channel, t.word1, t.word2, t.next, badWords)
 			}
 			rowsRemoved++
 		}
 	}
 
+	if rowsRemoved > 0 {
+		b.dropOrphanContributions()
+		b.transitionsChanged()
+	}
 	return rowsRemoved
 }
 
@@ -627,22 +1227,6 @@ func isEmoji(r rune) bool {
 		(r >= 0x200D && r <= 0x200D) // Zero width joiner (used in compound emoji)
 }
 
-// containsNonASCII checks if a string contains any non-ASCII characters (excluding emoji and Portuguese accents)
-func containsNonASCII(s string) bool {
-	for _, r := range s {
-		if r > 127 && !isEmoji(r) && !isPortugueseAccent(r) {
-			return true
-		}
-	}
-	return false
-}
-
-// isPortugueseAccent checks if a rune is an accented character common in Portuguese
-// (covers the Latin-1 Supplement block U+00C0–U+00FF, used by Portuguese and other Western European languages)
-func isPortugueseAccent(r rune) bool {
-	return r >= 0x00C0 && r <= 0x00FF
-}
-
 // normalizeASCII converts common Unicode characters to their ASCII equivalents
 // Smart quotes, dashes, ellipses, etc. are converted to standard ASCII
 func normalizeASCII(s string) string {
@@ -689,21 +1273,40 @@ func normalizeASCII(s string) string {
 
 // Erase clears all brain data but keeps the database file
 func (b *Brain) Erase() error {
+	b.dropQueue()
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if b.db == nil {
+		return ErrBrainClosed
+	}
 
 	// Delete all data from tables
 	_, err := b.db.Exec("DELETE FROM transitions")
 	if err != nil {
 		return err
 	}
+	_, err = b.db.Exec("DELETE FROM contributions")
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("DELETE FROM recent_messages")
+	if err != nil {
+		return err
+	}
 	_, err = b.db.Exec("DELETE FROM state")
 	if err != nil {
 		return err
 	}
+	_, err = b.db.Exec("DELETE FROM stats_history")
+	if err != nil {
+		return err
+	}
 	// Reset in-memory counter and stats cache to match the cleared state table
+	b.chatMu.Lock()
 	b.msgCounter = 0
-	b.statsCache = nil
+	b.chatMu.Unlock()
+	b.transitionsChanged()
 
 	// Vacuum to reclaim space
 	_, err = b.db.Exec("VACUUM")
@@ -712,10 +1315,15 @@ func (b *Brain) Erase() error {
 
 // Delete removes all brain data for this channel (deletes the database file)
 func (b *Brain) Delete() error {
+	b.shutQueue()
+	b.stopFlusher()
+	b.dropQueue()
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
 	// Close the database connection first
+	b.store = nil
 	if b.db != nil {
 		if err := b.db.Close(); err != nil {
 			log.Printf("Warning: error closing brain DB for %s: %v", b.Channel, err)
@@ -744,17 +1352,23 @@ func (b *Brain) Delete() error {
 func (b *Brain) Optimize() error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if b.db == nil {
+		return ErrBrainClosed
+	}
 
 	_, err := b.db.Exec("VACUUM")
 	return err
 }
 
-// Transition represents a single transition entry
+// Transition represents a single transition entry. For orders other than 2,
+// Word1 holds the packed leading context words (see stateKey).
 type Transition struct {
 	Word1    string `json:"word1"`
 	Word2    string `json:"word2"`
 	NextWord string `json:"next_word"`
 	Count    int    `json:"count"`
+	Order    int    `json:"order"`
+	LastSeen int64  `json:"last_seen,omitempty"` // Unix time the transition was last learned
 }
 
 // TransitionsResult contains paginated transitions
@@ -763,6 +1377,7 @@ type TransitionsResult struct {
 	Total       int          `json:"total"`
 	Page        int          `json:"page"`
 	PageSize    int          `json:"page_size"`
+	Order       int          `json:"order"` // The channel's current Markov order
 }
 
 // GetTransitions returns paginated transitions, optionally filtered by search
@@ -774,59 +1389,32 @@ func (b *Brain) GetTransitions(search string, page, pageSize int) TransitionsRes
 		Transitions: []Transition{},
 		Page:        page,
 		PageSize:    pageSize,
+		Order:       b.cfg.GetChannelMarkovOrder(b.Channel),
 	}
-
-	offset := (page - 1) * pageSize
-
-	// Count total
-	var countQuery string
-	var countArgs []interface{}
-	if search != "" {
-		countQuery = `SELECT COUNT(*) FROM transitions WHERE word1 LIKE ? OR word2 LIKE ? OR next_word LIKE ?`
-		searchPattern := "%" + search + "%"
-		countArgs = []interface{}{searchPattern, searchPattern, searchPattern}
-	} else {
-		countQuery = `SELECT COUNT(*) FROM transitions`
-	}
-	b.db.QueryRow(countQuery, countArgs...).Scan(&result.Total)
-
-	// Fetch transitions
-	var query string
-	var args []interface{}
-	if search != "" {
-		query = `SELECT word1, word2, next_word, count FROM transitions 
-			WHERE word1 LIKE ? OR word2 LIKE ? OR next_word LIKE ?
-			ORDER BY count DESC LIMIT ? OFFSET ?`
-		searchPattern := "%" + search + "%"
-		args = []interface{}{searchPattern, searchPattern, searchPattern, pageSize, offset}
-	} else {
-		query = `SELECT word1, word2, next_word, count FROM transitions ORDER BY count DESC LIMIT ? OFFSET ?`
-		args = []interface{}{pageSize, offset}
-	}
-
-	rows, err := b.db.Query(query, args...)
-	if err != nil {
+	if b.store == nil {
 		return result
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var t Transition
-		if err := rows.Scan(&t.Word1, &t.Word2, &t.NextWord, &t.Count); err == nil {
-			result.Transitions = append(result.Transitions, t)
-		}
+	transitions, total := b.store.Page(search, page, pageSize)
+	if transitions != nil {
+		result.Transitions = transitions
 	}
-
+	result.Total = total
 	return result
 }
 
-// DeleteTransition removes a specific transition
+// DeleteTransition removes a specific transition and the contributions to it
 func (b *Brain) DeleteTransition(word1, word2, nextWord string) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if b.store == nil {
+		return ErrBrainClosed
+	}
 
-	_, err := b.db.Exec(`DELETE FROM transitions WHERE word1 = ? AND word2 = ? AND next_word = ?`,
-		word1, word2, nextWord)
+	err := b.store.Delete(word1, word2, nextWord)
+	if err == nil && b.index != nil {
+		b.index.set(b.Channel, transitionKey{word1, word2, nextWord}, 0)
+	}
 	return err
 }
 
@@ -838,9 +1426,14 @@ func (b *Brain) UpdateTransitionCount(word1, word2, nextWord string, count int)
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if b.store == nil {
+		return ErrBrainClosed
+	}
 
-	_, err := b.db.Exec(`UPDATE transitions SET count = ? WHERE word1 = ? AND word2 = ? AND next_word = ?`,
-		count, word1, word2, nextWord)
+	err := b.store.SetCount(word1, word2, nextWord, count)
+	if err == nil && b.index != nil {
+		b.index.set(b.Channel, transitionKey{word1, word2, nextWord}, count)
+	}
 	return err
 }
 
@@ -852,18 +1445,25 @@ func stripWordPunctuation(word string) string {
 	return strings.Trim(word, punctuationChars)
 }
 
-func (b *Brain) containsBlacklistedWord(message string) bool {
-	lowerMessage := strings.ToLower(message)
-	words := strings.Fields(lowerMessage)
+// containsBlacklistedWord reports whether a message contains a word or phrase
+// blacklisted globally or in this channel. Words are compared with punctuation
+// stripped, except the emote codes in emotes, which are compared whole so <3
+// doesn't become 3.
+func (b *Brain) containsBlacklistedWord(message string, emotes map[string]string) bool {
+	words := strings.Fields(message)
 
 	// Strip punctuation from message words for comparison
 	cleanWords := make([]string, len(words))
 	for i, w := range words {
-		cleanWords[i] = stripWordPunctuation(w)
+		if _, ok := emotes[w]; ok {
+			cleanWords[i] = strings.ToLower(w)
+		} else {
+			cleanWords[i] = stripWordPunctuation(strings.ToLower(w))
+		}
 	}
 	cleanMessage := strings.Join(cleanWords, " ")
 
-	blacklist := b.cfg.GetBlacklistedWords()
+	blacklist := b.cfg.GetBlacklistedWordsFor(b.Channel)
 
 	for _, blacklisted := range blacklist {
 		blacklisted = strings.ToLower(blacklisted)
@@ -892,56 +1492,3 @@ func (b *Brain) containsBlacklistedWord(message string) bool {
 	}
 	return false
 }
-
-func isMostlyEnglish(text string) bool {
-	for _, r := range text {
-		// Allow ASCII characters, emoji, and Portuguese/Latin accented characters
-		if r > 127 && !isEmoji(r) && !isPortugueseAccent(r) {
-			return false
-		}
-	}
-	return true
-}
-
-func containsLink(text string) bool {
-	lower := strings.ToLower(text)
-	// Check for common URL patterns
-	linkPatterns := []string{
-		"http://",
-		"https://",
-		"www.",
-		".com",
-		".org",
-		".net",
-		".tv",
-		".gg",
-		".io",
-		".co",
-		".me",
-		".be",
-		".ru",
-		".xyz",
-		".info",
-		".link",
-		".click",
-		".site",
-		".online",
-		".top",
-		".ly",
-		".gl",
-		".to",
-		".live",
-		".stream",
-		".uk",
-		".de",
-		".fr",
-		".shop",
-		".store",
-	}
-	for _, pattern := range linkPatterns {
-		if strings.Contains(lower, pattern) {
-			return true
-		}
-	}
-	return false
-}
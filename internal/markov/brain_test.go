@@ -0,0 +1,1898 @@
+package markov
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"twitchbot/internal/config"
+	"twitchbot/internal/database"
+)
+
+// TestMain points the database at an isolated temp directory (via
+// TWITCHBOT_DATA_DIR) before any test runs, so brain files are created there
+// instead of in a real ~/.twitchbot install.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "twitchbot-markov-test-*")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Setenv("TWITCHBOT_DATA_DIR", dir); err != nil {
+		panic(err)
+	}
+	if err := database.Init(); err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+// testBrains numbers the brains created by newTestBrain so every one gets its own channel
+var testBrains int
+
+// newTestBrain creates an empty brain for a fresh channel at the given order
+func newTestBrain(t *testing.T, order int) *Brain {
+	t.Helper()
+	cfg := config.New()
+	testBrains++
+	channel := fmt.Sprintf("test%d_order%d", testBrains, order)
+	if err := cfg.AddChannel(channel); err != nil {
+		t.Fatalf("AddChannel: %v", err)
+	}
+	if err := cfg.SetChannelMarkovOrder(channel, order); err != nil {
+		t.Fatalf("SetChannelMarkovOrder: %v", err)
+	}
+	b, err := NewBrain(channel, cfg)
+	if err != nil {
+		t.Fatalf("NewBrain: %v", err)
+	}
+	t.Cleanup(func() { b.Delete() })
+	return b
+}
+
+// newMemoryTestBrain creates an empty brain without a database file for a
+// fresh channel at the given order
+func newMemoryTestBrain(t *testing.T, order int) *Brain {
+	t.Helper()
+	cfg := config.New()
+	testBrains++
+	channel := fmt.Sprintf("test%d_memory%d", testBrains, order)
+	if err := cfg.AddChannel(channel); err != nil {
+		t.Fatalf("AddChannel: %v", err)
+	}
+	if err := cfg.SetChannelMarkovOrder(channel, order); err != nil {
+		t.Fatalf("SetChannelMarkovOrder: %v", err)
+	}
+	b := newMemoryBrain(channel, cfg)
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func TestGenerateStartsAndEndsAtMessageBoundaries(t *testing.T) {
+	// No word is shared between the messages, so every generation must
+	// reproduce one learned message exactly: starting mid-message or running
+	// past an ending would produce something else.
+	messages := map[string]bool{
+		"the quick brown fox jumps":        true,
+		"pineapple belongs on pizza today": true,
+		"nice play streamer":               true,
+	}
+
+	for order := 1; order <= 4; order++ {
+		b := newMemoryTestBrain(t, order)
+		for msg := range messages {
+			b.learn(msg, "")
+		}
+		for i := 0; i < 50; i++ {
+			got := b.Generate(20)
+			if !messages[got] {
+				t.Fatalf("order %d: Generate returned %q, want a complete learned message", order, got)
+			}
+		}
+	}
+}
+
+func TestLearnIgnoresBoundaryTokensInChat(t *testing.T) {
+	b := newMemoryTestBrain(t, 2)
+	b.learn("hello "+endToken+" there chat friends", "")
+
+	for i := 0; i < 20; i++ {
+		if got := b.Generate(20); got != "hello there chat friends" {
+			t.Fatalf("Generate returned %q, want %q", got, "hello there chat friends")
+		}
+	}
+}
+
+func TestGenerateFallsBackWithoutLearnedOpenings(t *testing.T) {
+	b := newTestBrain(t, 2)
+	// Simulate a brain learned before boundary tokens existed
+	if _, err := b.db.Exec(`INSERT INTO transitions (word1, word2, next_word, count) VALUES ('old', 'brain', 'data', 1)`); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	if got := b.Generate(20); got != "old brain data" {
+		t.Errorf("Generate returned %q, want %q", got, "old brain data")
+	}
+}
+
+func TestGenerateSeededBuildsThroughSeed(t *testing.T) {
+	messages := map[string]bool{
+		"the quick brown fox jumps":        true,
+		"pineapple belongs on pizza today": true,
+		"nice play streamer":               true,
+	}
+
+	for order := 1; order <= 4; order++ {
+		b := newMemoryTestBrain(t, order)
+		for msg := range messages {
+			b.learn(msg, "")
+		}
+		for i := 0; i < 20; i++ {
+			got := b.Generate(20, "unknownword", "pizza")
+			if got != "pineapple belongs on pizza today" {
+				t.Fatalf("order %d: Generate seeded with %q returned %q", order, "pizza", got)
+			}
+		}
+	}
+}
+
+func TestSeedWordsPrefersTriggeringMessage(t *testing.T) {
+	b := newMemoryTestBrain(t, 2)
+	b.rememberRecent("earlier chat about speedruns")
+
+	seeds := b.seedWords("the @someone lol pizza")
+	want := []string{"pizza", "earlier", "chat", "speedruns"}
+	if len(seeds) != len(want) || seeds[0] != "pizza" {
+		t.Fatalf("seedWords = %v, want pizza first then %v in any order", seeds, want[1:])
+	}
+}
+
+func TestReplyWithInfoAnswersImmediately(t *testing.T) {
+	b := newTestBrain(t, 2)
+	if err := b.cfg.SetChannelMessageInterval(b.Channel, 1000); err != nil {
+		t.Fatalf("SetChannelMessageInterval: %v", err)
+	}
+	// A one-message brain can only repeat that message
+	if err := b.cfg.SetChannelOriginalityThreshold(b.Channel, 0); err != nil {
+		t.Fatalf("SetChannelOriginalityThreshold: %v", err)
+	}
+
+	result := b.ReplyWithInfo("@TestBot, what do you think about pizza", "viewer", "", "", "testbot", nil)
+	if !result.Triggered || !result.Success || result.ReplyTo != "viewer" {
+		t.Fatalf("ReplyWithInfo = %+v, want a successful reply to viewer", result)
+	}
+	if result.Response != "what do you think about pizza" {
+		t.Errorf("Response = %q, want the learned message without the mention", result.Response)
+	}
+	// The client filters the response before sending, then saves what it sent
+	if got := b.GetLastMessage(); got != "" {
+		t.Errorf("last message = %q before the response was sent", got)
+	}
+
+	if result := b.ProcessMessageWithInfo("just another chat line here", "viewer", "", "", "testbot", nil); result.Triggered {
+		t.Errorf("ProcessMessageWithInfo triggered before the interval: %+v", result)
+	}
+}
+
+func TestUnansweredMentionIsNotLearned(t *testing.T) {
+	b := newTestBrain(t, 2)
+	// An unanswered mention, e.g. during the mention cooldown
+	b.ProcessMessageWithInfo("hey @TestBot! nice stream", "viewer", "", "", "testbot", nil)
+	b.Flush()
+	if got := b.GetTransitions("testbot", 1, 100).Total; got != 0 {
+		t.Errorf("learned %d transitions with the bot's name", got)
+	}
+	if got := b.GetTransitions("nice", 1, 100).Total; got == 0 {
+		t.Error("the rest of the message wasn't learned")
+	}
+}
+
+func TestMentionsBot(t *testing.T) {
+	tests := []struct {
+		message string
+		want    bool
+	}{
+		{"@testbot hi", true},
+		{"hi @TestBot, how are you", true},
+		{"(@testbot)", false},
+		{"hi @testbot_", false},
+		{"hi testbot", false},
+		{"@testbotfan hello", false},
+	}
+	for _, tt := range tests {
+		if got := MentionsBot(tt.message, "testbot"); got != tt.want {
+			t.Errorf("MentionsBot(%q) = %v, want %v", tt.message, got, tt.want)
+		}
+	}
+	if MentionsBot("@ hello", "") {
+		t.Error("MentionsBot matched a message without a bot username")
+	}
+	if got := stripMention("@testbot_ says @testbot: hi", "testbot_"); got != "says @testbot: hi" {
+		t.Errorf("stripMention = %q", got)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src := newTestBrain(t, 3)
+	src.learn("pineapple belongs on pizza today", "")
+	src.learn("pineapple belongs on pizza today", "")
+
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	exported := buf.Bytes()
+
+	dst := newTestBrain(t, 3)
+	dst.learn("nice play streamer", "")
+	result, err := dst.Import(bytes.NewReader(exported), false)
+	if err != nil {
+		t.Fatalf("Import merge: %v", err)
+	}
+	if result.SourceChannel != src.Channel || result.Order != 3 || result.Imported != src.GetTransitions("", 1, 100).Total {
+		t.Errorf("Import merge result = %+v", result)
+	}
+	// "nice play streamer" at order 3 is four transitions including its boundaries
+	if got, want := dst.GetTransitions("", 1, 100).Total, result.Imported+4; got != want {
+		t.Errorf("after merge: %d transitions, want %d", got, want)
+	}
+
+	// Merging again adds counts instead of duplicating rows
+	if _, err := dst.Import(bytes.NewReader(exported), false); err != nil {
+		t.Fatalf("Import merge again: %v", err)
+	}
+	for _, tr := range dst.GetTransitions("pizza", 1, 100).Transitions {
+		if tr.Count != 4 {
+			t.Errorf("transition %+v: count %d, want 4", tr, tr.Count)
+		}
+	}
+
+	if _, err := dst.Import(bytes.NewReader(exported), true); err != nil {
+		t.Fatalf("Import replace: %v", err)
+	}
+	if got := dst.GetTransitions("play", 1, 100).Total; got != 0 {
+		t.Errorf("after replace: %d transitions from the old brain remain", got)
+	}
+
+	if _, err := dst.Import(strings.NewReader("not gzip"), false); err == nil {
+		t.Error("Import accepted a non-gzip stream")
+	}
+}
+
+func TestImportReplaceClearsRecentMessages(t *testing.T) {
+	src := newTestBrain(t, 2)
+	src.learn("pineapple belongs on pizza today", "")
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	dst := newTestBrain(t, 2)
+	dst.learn("nice play streamer", "42")
+	if _, err := dst.Import(bytes.NewReader(buf.Bytes()), true); err != nil {
+		t.Fatalf("Import replace: %v", err)
+	}
+	var recent, contributions int
+	dst.db.QueryRow(`SELECT COUNT(*) FROM recent_messages`).Scan(&recent)
+	dst.db.QueryRow(`SELECT COUNT(*) FROM contributions`).Scan(&contributions)
+	if recent != 0 || contributions != 0 {
+		t.Errorf("replace left %d recent messages and %d contributions", recent, contributions)
+	}
+}
+
+func TestImportDecodesBeforeLocking(t *testing.T) {
+	b := newTestBrain(t, 2)
+	b.mu.Lock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.Import(strings.NewReader("not gzip"), false)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Import accepted a non-gzip stream")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Import waited for the brain lock before reading the export")
+	}
+	b.mu.Unlock()
+}
+
+func TestMergeBrains(t *testing.T) {
+	src := newTestBrain(t, 2)
+	dst := newTestBrain(t, 2)
+	src.learn("pineapple belongs on pizza today", "")
+	src.learn("pineapple belongs on pizza today", "")
+	dst.learn("pineapple belongs on pizza today", "")
+	dst.learn("nice play streamer", "")
+
+	m := NewManager(src.cfg)
+	m.brains[src.Channel] = src
+	m.brains[dst.Channel] = dst
+
+	var lastProgress, total int
+	result, err := m.MergeBrains(src.Channel, dst.Channel, 1.5, false, false, func(current, n int, channel string) {
+		lastProgress, total = current, n
+	})
+	if err != nil {
+		t.Fatalf("MergeBrains: %v", err)
+	}
+	if result.Merged != 6 || lastProgress != 6 || total != 6 {
+		t.Errorf("MergeBrains = %+v, progress %d/%d; want 6 rows merged", result, lastProgress, total)
+	}
+	for _, tr := range dst.GetTransitions("pizza", 1, 100).Transitions {
+		if tr.Count != 4 { // 1 learned + round(2 * 1.5)
+			t.Errorf("transition %+v: count %d, want 4", tr, tr.Count)
+		}
+	}
+
+	if _, err := m.MergeBrains(src.Channel, src.Channel, 1, false, false, nil); err == nil {
+		t.Error("MergeBrains merged a brain into itself")
+	}
+	if _, err := m.MergeBrains(src.Channel, dst.Channel, 1, true, false, nil); err == nil {
+		t.Error("MergeBrains deleted the brain of a joined channel")
+	}
+}
+
+func TestMergeBrainsAtDifferentOrdersNeedsConfirmation(t *testing.T) {
+	src := newTestBrain(t, 3)
+	dst := newTestBrain(t, 2)
+	src.learn("pineapple belongs on pizza today", "")
+	m := NewManager(src.cfg)
+	m.brains[src.Channel] = src
+	m.brains[dst.Channel] = dst
+
+	result, err := m.MergeBrains(src.Channel, dst.Channel, 1, false, false, nil)
+	if !errors.Is(err, ErrMergeOrderMismatch) || result.SourceOrder != 3 || result.DestinationOrder != 2 {
+		t.Fatalf("unconfirmed merge = %+v, %v; want ErrMergeOrderMismatch reporting orders 3 and 2", result, err)
+	}
+	if got := dst.GetTransitions("pizza", 1, 100).Total; got != 0 {
+		t.Errorf("refused merge added %d transitions", got)
+	}
+
+	result, err = m.MergeBrains(src.Channel, dst.Channel, 1, false, true, nil)
+	if err != nil || result.Merged == 0 {
+		t.Errorf("confirmed merge = %+v, %v", result, err)
+	}
+}
+
+func TestMergeBrainsRejectsInvalidDestination(t *testing.T) {
+	src := newTestBrain(t, 2)
+	src.learn("pineapple belongs on pizza today", "")
+	m := NewManager(src.cfg)
+	m.brains[src.Channel] = src
+
+	unknown := fmt.Sprintf("nobody%d", testBrains)
+	for _, dst := range []string{"", "../escape", "UPPER/../x", unknown} {
+		if _, err := m.MergeBrains(src.Channel, dst, 1, false, false, nil); err == nil {
+			t.Errorf("MergeBrains accepted destination %q", dst)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(database.GetDataDir(), "escape.db")); err == nil {
+		t.Error("MergeBrains wrote a brain outside the brains directory")
+	}
+	if _, err := os.Stat(filepath.Join(database.GetDataDir(), "brains", unknown+".db")); err == nil {
+		t.Errorf("MergeBrains created a brain for unknown channel %s", unknown)
+	}
+	if _, err := m.MergeBrains(src.Channel, strings.ToUpper(src.Channel), 1, false, false, nil); err == nil {
+		t.Error("MergeBrains merged a brain into itself with a differently cased name")
+	}
+}
+
+func TestDecayAgesAndPrunesStaleTransitions(t *testing.T) {
+	b := newTestBrain(t, 2)
+	for i := 0; i < 4; i++ {
+		b.learn("pineapple belongs on pizza today", "")
+	}
+	b.learn("nice play streamer", "")
+
+	// Age everything learned so far by a year, then learn something fresh
+	old := time.Now().AddDate(-1, 0, 0).Unix()
+	if _, err := b.db.Exec(`UPDATE transitions SET last_seen = ?`, old); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	b.learn("fresh chat message", "")
+
+	result := b.Decay(config.DecayPolicy{Enabled: true, Days: 30, KeepPercent: 50, PruneBelow: 1})
+	if result.Decayed != 10 {
+		t.Errorf("Decay aged %d transitions, want 10", result.Decayed)
+	}
+	for _, tr := range b.GetTransitions("pizza", 1, 100).Transitions {
+		if tr.Count != 2 {
+			t.Errorf("stale transition %+v: count %d, want 2", tr, tr.Count)
+		}
+	}
+	// The count-1 "nice play streamer" transitions decay to 0 and are pruned
+	if result.Pruned != 4 || len(result.PrunedSample) != 4 || b.GetTransitions("play", 1, 100).Total != 0 {
+		t.Errorf("Decay pruned %d (%+v), want the 4 stale count-1 transitions", result.Pruned, result.PrunedSample)
+	}
+	if got := b.GetTransitions("fresh", 1, 100).Total; got != 3 {
+		t.Errorf("fresh transitions: %d left, want 3", got)
+	}
+
+	last := b.LastDecay()
+	if last == nil || last.Pruned != result.Pruned {
+		t.Errorf("LastDecay = %+v, want the report just produced", last)
+	}
+}
+
+func TestForgetUserSubtractsOnlyTheirContributions(t *testing.T) {
+	b := newTestBrain(t, 2)
+	b.learn("pineapple belongs on pizza today", "111")
+	b.learn("pineapple belongs on pizza today", "222")
+	b.learn("nice play streamer", "111")
+
+	reduced, removed, err := b.ForgetUser("111")
+	if err != nil {
+		t.Fatalf("ForgetUser: %v", err)
+	}
+	// Six pizza transitions drop to count 1, four "nice play streamer" ones go
+	if reduced != 10 || removed != 4 {
+		t.Errorf("ForgetUser = %d reduced, %d removed; want 10 and 4", reduced, removed)
+	}
+	for _, tr := range b.GetTransitions("pizza", 1, 100).Transitions {
+		if tr.Count != 1 {
+			t.Errorf("transition %+v: count %d, want 1", tr, tr.Count)
+		}
+	}
+	if got := b.GetTransitions("play", 1, 100).Total; got != 0 {
+		t.Errorf("%d transitions only user 111 contributed remain", got)
+	}
+
+	if reduced, _, _ := b.ForgetUser("111"); reduced != 0 {
+		t.Errorf("forgetting user 111 again reduced %d transitions", reduced)
+	}
+}
+
+func TestParseEmotesKeepsEmoteCodesWhole(t *testing.T) {
+	message := "gg <3 Kappa nice.tv Kappa 😀 PogChamp"
+	// Positions count characters, so the emoji before PogChamp is one position
+	emotes := ParseEmotes(message, "9:3-4/25:6-10,20-24/88:28-35/1:0-0")
+	want := map[string]string{"<3": "9", "Kappa": "25", "PogChamp": "88"}
+	if len(emotes) != len(want) {
+		t.Fatalf("ParseEmotes = %v, want %v", emotes, want)
+	}
+	for name, id := range want {
+		if emotes[name] != id {
+			t.Errorf("ParseEmotes[%q] = %q, want %q", name, emotes[name], id)
+		}
+	}
+
+	b := newTestBrain(t, 2)
+	b.cfg.AddBlacklistedWord("3")
+	if !b.shouldLearn("gg <3 Kappa", emotes) {
+		t.Error("shouldLearn rejected a message because an emote looked like a blacklisted word")
+	}
+	if b.shouldLearn("gg <3 Kappa", nil) {
+		t.Error("shouldLearn accepted a blacklisted word that isn't an emote")
+	}
+	b.cfg.RemoveBlacklistedWord("3")
+
+	if got := StripEmotes("hi <3 Kappa PogChamp", emotes, func(id string) bool { return id == "25" }); got != "hi Kappa" {
+		t.Errorf("StripEmotes = %q, want %q", got, "hi Kappa")
+	}
+}
+
+func TestLearningQueueFlushesInOneBatch(t *testing.T) {
+	b := newTestBrain(t, 2)
+	b.queueLearn("pineapple belongs on pizza today", "", "")
+	b.queueLearn("pineapple belongs on pizza today", "", "")
+
+	if got := b.GetStats().QueueDepth; got != 2 {
+		t.Errorf("QueueDepth = %d, want 2", got)
+	}
+	if got := b.GetTransitions("pizza", 1, 100).Total; got != 0 {
+		t.Fatalf("%d transitions learned before the queue was flushed", got)
+	}
+
+	b.Flush()
+	if got := b.QueueDepth(); got != 0 {
+		t.Errorf("QueueDepth after Flush = %d, want 0", got)
+	}
+	for _, tr := range b.GetTransitions("pizza", 1, 100).Transitions {
+		if tr.Count != 2 {
+			t.Errorf("transition %+v: count %d, want 2", tr, tr.Count)
+		}
+	}
+}
+
+func TestChatHandlingDoesNotWaitOnBrainLock(t *testing.T) {
+	b := newTestBrain(t, 2)
+	if err := b.cfg.SetChannelMessageInterval(b.Channel, 1000); err != nil {
+		t.Fatalf("SetChannelMessageInterval: %v", err)
+	}
+
+	// A flush or other maintenance holding the brain's lock doesn't hold up chat
+	b.mu.Lock()
+	done := make(chan GenerationResult, 1)
+	go func() {
+		done <- b.ProcessMessageWithInfo("pineapple belongs on pizza today", "viewer", "42", "", "testbot", nil)
+	}()
+	select {
+	case result := <-done:
+		if result.Counter != 1 {
+			t.Errorf("Counter = %d, want 1", result.Counter)
+		}
+	case <-time.After(5 * time.Second):
+		b.mu.Unlock()
+		t.Fatal("ProcessMessageWithInfo waited on the brain's lock")
+	}
+	b.mu.Unlock()
+
+	// The counter is persisted with the learning batch
+	b.Flush()
+	var counter int
+	b.db.QueryRow(`SELECT value FROM state WHERE key = 'msg_counter'`).Scan(&counter)
+	if counter != 1 {
+		t.Errorf("persisted counter = %d after flush, want 1", counter)
+	}
+
+	// A closed brain can't learn the message, but still answers it
+	b.Close()
+	if got := b.GetLastMessage(); got != "" {
+		t.Errorf("GetLastMessage on a closed brain = %q", got)
+	}
+	answer := func(maxWords int, trace *Trace, seeds ...string) string { return "hello there viewer" }
+	result := b.ReplyWithInfo("@testbot are you still there", "viewer", "42", "", "testbot", answer)
+	if !result.Success || result.Response != "hello there viewer" {
+		t.Errorf("ReplyWithInfo on a closed brain = %+v, want an answer", result)
+	}
+}
+
+func TestGenerateResponseRejectsCopiesOfChat(t *testing.T) {
+	b := newTestBrain(t, 2)
+	b.learn("pineapple belongs on pizza today", "")
+
+	var result GenerationResult
+	b.generateResponse(&result, b.GenerateTraced, nil)
+	if result.Success || result.FailureReason != "too_similar" {
+		t.Errorf("generateResponse = %+v, want a too_similar failure", result)
+	}
+
+	recent := [][]string{originalityWords("Pineapple belongs on pizza, today!")}
+	if !tooSimilar("pineapple belongs on pizza", recent, 80) {
+		t.Error("tooSimilar accepted a response copied from chat")
+	}
+	if tooSimilar("pineapple belongs in the trash not on pizza", recent, 80) {
+		t.Error("tooSimilar rejected a response sharing only a short run with chat")
+	}
+}
+
+func TestGlobalResponseRejectsCopiesOfSourceChat(t *testing.T) {
+	b := newTestBrain(t, 2)
+	other := newTestBrain(t, 2)
+	m := NewManager(b.cfg)
+	defer m.index.close()
+	m.brains[b.Channel] = b
+	b.recentIn = m.recentLearned
+
+	// The other brain isn't loaded by the manager; its recent chat is read from its file
+	other.learn("zanzibar quokka festival starts tonight", "")
+	m.RefreshGlobalIndex(other.Channel)
+
+	settings := b.cfg.GetChannelGenerationSettings(b.Channel)
+	global := func(maxWords int, trace *Trace, seeds ...string) string {
+		return m.GenerateGlobalTraced(2, settings, maxWords, trace, "zanzibar")
+	}
+	var result GenerationResult
+	b.generateResponse(&result, global, nil)
+	if result.Success || result.FailureReason != "too_similar" {
+		t.Errorf("generateResponse = %+v, want a too_similar failure from the source brain's chat", result)
+	}
+}
+
+func TestTraceRecordsChangesBeforeSending(t *testing.T) {
+	b := newMemoryTestBrain(t, 2)
+	if err := b.cfg.SetChannelOriginalityThreshold(b.Channel, 0); err != nil {
+		t.Fatalf("SetChannelOriginalityThreshold: %v", err)
+	}
+	withLink := func(maxWords int, trace *Trace, seeds ...string) string {
+		return "look at https://example.com/clip right now"
+	}
+	var result GenerationResult
+	b.generateResponse(&result, withLink, nil)
+	if !result.Success || strings.Contains(result.Response, "example.com") {
+		t.Fatalf("generateResponse = %+v, want the link stripped", result)
+	}
+	if result.Trace.Generated != "look at https://example.com/clip right now" ||
+		len(result.Trace.Changes) != 1 || result.Trace.Changes[0] != TraceLinksStripped {
+		t.Errorf("trace = %+v, want the generated text and a links_stripped change", result.Trace)
+	}
+
+	plain := func(maxWords int, trace *Trace, seeds ...string) string { return "nothing to change here" }
+	result = GenerationResult{}
+	b.generateResponse(&result, plain, nil)
+	if result.Trace.Generated != "" || result.Trace.Changes != nil {
+		t.Errorf("trace = %+v for an unchanged response", result.Trace)
+	}
+}
+
+func TestSamplerTopKOnlyPicksMostCommon(t *testing.T) {
+	pick := sampler{temperature: 0.5, topK: 2}
+	candidates := []string{"rare", "common", "often", "never"}
+	weights := []int{1, 50, 20, 1}
+	for i := 0; i < 200; i++ {
+		if got := pick.pick(candidates, weights); got != "common" && got != "often" {
+			t.Fatalf("pick with top-k 2 returned %q", got)
+		}
+	}
+}
+
+func TestGenerateResponseAppliesLengthLimits(t *testing.T) {
+	b := newMemoryTestBrain(t, 2)
+	if err := b.cfg.SetChannelOriginalityThreshold(b.Channel, 0); err != nil {
+		t.Fatalf("SetChannelOriginalityThreshold: %v", err)
+	}
+	b.learn("pineapple belongs on pizza today", "")
+
+	settings := config.DefaultGenerationSettings()
+	settings.MinWords = 6
+	settings.Retries = 3
+	if err := b.cfg.SetChannelGenerationSettings(b.Channel, settings); err != nil {
+		t.Fatalf("SetChannelGenerationSettings: %v", err)
+	}
+	result := b.GenerateWithInfo(nil)
+	if result.Success || result.FailureReason != "too_short" || result.Attempts != 3 {
+		t.Errorf("GenerateWithInfo = %+v, want 3 too_short attempts", result)
+	}
+
+	settings.MinWords = 1
+	settings.MaxChars = 20
+	b.cfg.SetChannelGenerationSettings(b.Channel, settings)
+	if result := b.GenerateWithInfo(nil); result.Success || result.FailureReason != "too_long" {
+		t.Errorf("GenerateWithInfo = %+v, want a too_long failure", result)
+	}
+}
+
+func TestGlobalIndexPoolsBrainsAndHonorsOptOut(t *testing.T) {
+	shared := newTestBrain(t, 2)
+	private := newTestBrain(t, 2)
+	m := NewManager(shared.cfg)
+	defer m.index.close()
+
+	// Brains learn into the index as they go, loaded by the manager or not
+	m.brains[shared.Channel] = shared
+	shared.index = m.index
+	shared.learn("pineapple belongs on pizza today", "")
+	private.learn("secret channel words only", "")
+	m.RefreshGlobalIndex(private.Channel)
+
+	settings := shared.cfg.GetChannelGenerationSettings(shared.Channel)
+	if got := m.GenerateGlobal(2, settings, 20, "pineapple"); got != "pineapple belongs on pizza today" {
+		t.Errorf("GenerateGlobal(pineapple) = %q", got)
+	}
+	if got := m.GenerateGlobal(2, settings, 20, "secret"); got != "secret channel words only" {
+		t.Errorf("GenerateGlobal(secret) = %q, want the unloaded brain's message", got)
+	}
+
+	if err := private.cfg.SetChannelGlobalOptOut(private.Channel, true); err != nil {
+		t.Fatalf("SetChannelGlobalOptOut: %v", err)
+	}
+	m.RefreshGlobalIndex(private.Channel)
+	if got := m.GenerateGlobal(2, settings, 20, "secret"); strings.Contains(got, "secret") {
+		t.Errorf("GenerateGlobal(secret) = %q after opting out", got)
+	}
+}
+
+func TestGlobalGenerationOnlyUsesJoinedChannels(t *testing.T) {
+	left := newTestBrain(t, 2)
+	m := NewManager(left.cfg)
+	defer m.index.close()
+
+	left.learn("farewell stream highlights reel", "")
+	m.RefreshGlobalIndex(left.Channel)
+	settings := left.cfg.GetChannelGenerationSettings(left.Channel)
+	if got := m.GenerateGlobal(2, settings, 20, "farewell"); got != "farewell stream highlights reel" {
+		t.Fatalf("GenerateGlobal(farewell) = %q while joined", got)
+	}
+
+	// Once the channel is left its rows are ignored, even before they're reindexed away
+	if err := left.cfg.RemoveChannel(left.Channel); err != nil {
+		t.Fatalf("RemoveChannel: %v", err)
+	}
+	if got := m.GenerateGlobal(2, settings, 20, "farewell"); strings.Contains(got, "farewell") {
+		t.Errorf("GenerateGlobal(farewell) = %q after leaving the channel", got)
+	}
+	m.RefreshGlobalIndex(left.Channel)
+	var rows int
+	m.index.db.QueryRow(`SELECT COUNT(*) FROM transitions WHERE channel = ?`, left.Channel).Scan(&rows)
+	if rows != 0 {
+		t.Errorf("%d index rows left for a channel that was left", rows)
+	}
+}
+
+func TestGenerateGroupOnlyUsesMembers(t *testing.T) {
+	member := newTestBrain(t, 2)
+	outsider := newTestBrain(t, 2)
+	m := NewManager(member.cfg)
+	defer m.index.close()
+
+	member.learn("speedrun any percent world record", "")
+	outsider.learn("speedrun glitchless category", "")
+	m.RefreshGlobalIndex(member.Channel)
+	m.RefreshGlobalIndex(outsider.Channel)
+
+	cfg := member.cfg
+	group := fmt.Sprintf("friends of %s", member.Channel)
+	if err := cfg.CreateBrainGroup(group); err != nil {
+		t.Fatalf("CreateBrainGroup: %v", err)
+	}
+	defer cfg.DeleteBrainGroup(group)
+	if err := cfg.SetBrainGroupMembers(group, []config.BrainGroupMember{{Channel: member.Channel, Weight: 2}}); err != nil {
+		t.Fatalf("SetBrainGroupMembers: %v", err)
+	}
+	if err := cfg.SetChannelBrainGroup(outsider.Channel, group); err != nil {
+		t.Fatalf("SetChannelBrainGroup: %v", err)
+	}
+
+	// The outsider's channel generates from the group, which only has the member's brain
+	gen := m.GeneratorFor(outsider.Channel)
+	for i := 0; i < 10; i++ {
+		if got := gen(20, nil, "speedrun"); got != "speedrun any percent world record" {
+			t.Fatalf("group generation = %q, want only the member's message", got)
+		}
+	}
+
+	if err := cfg.SetChannelBrainGroup(outsider.Channel, "no such group"); err == nil {
+		t.Error("SetChannelBrainGroup accepted a group that doesn't exist")
+	}
+	cfg.DeleteBrainGroup(group)
+	if got := cfg.GetChannelBrainGroup(outsider.Channel); got != "" || m.GeneratorFor(outsider.Channel) != nil {
+		t.Errorf("channel still uses group %q after it was deleted", got)
+	}
+}
+
+func TestGroupMemberOptedOutOfGlobal(t *testing.T) {
+	member := newTestBrain(t, 2)
+	m := NewManager(member.cfg)
+	defer m.index.close()
+	cfg := member.cfg
+
+	member.learn("marathon charity stream tonight", "")
+	if err := cfg.SetChannelGlobalOptOut(member.Channel, true); err != nil {
+		t.Fatalf("SetChannelGlobalOptOut: %v", err)
+	}
+	group := fmt.Sprintf("private %s", member.Channel)
+	if err := cfg.CreateBrainGroup(group); err != nil {
+		t.Fatalf("CreateBrainGroup: %v", err)
+	}
+	defer cfg.DeleteBrainGroup(group)
+	if err := cfg.SetBrainGroupMembers(group, []config.BrainGroupMember{{Channel: member.Channel, Weight: 1}}); err != nil {
+		t.Fatalf("SetBrainGroupMembers: %v", err)
+	}
+	m.RefreshGlobalIndex(member.Channel)
+
+	settings := cfg.GetChannelGenerationSettings(member.Channel)
+	if got := m.GenerateGroup(group, 2, settings, 20, "marathon"); got != "marathon charity stream tonight" {
+		t.Errorf("GenerateGroup = %q, want the opted out member's message", got)
+	}
+	if got := m.GenerateGlobal(2, settings, 20, "marathon"); strings.Contains(got, "marathon") {
+		t.Errorf("GenerateGlobal = %q, used a brain that opted out", got)
+	}
+
+	// Leaving the group drops the opted out brain from the index again
+	cfg.DeleteBrainGroup(group)
+	m.RefreshGlobalIndex(member.Channel)
+	var rows int
+	m.index.db.QueryRow(`SELECT COUNT(*) FROM transitions WHERE channel = ?`, member.Channel).Scan(&rows)
+	if rows != 0 {
+		t.Errorf("%d index rows left for an opted out brain outside any group", rows)
+	}
+}
+
+func TestFilterRulesBlockMaskAndClean(t *testing.T) {
+	b := newTestBrain(t, 2)
+	cfg := b.cfg
+	var added []config.FilterRule
+	for _, rule := range []config.FilterRule{
+		{Pattern: "darn", Kind: config.FilterKindWord, Normalize: true, Action: config.FilterBlockLearning},
+		{Pattern: "heck*", Kind: config.FilterKindGlob, Action: config.FilterMask},
+		{Pattern: `free \w+ here`, Kind: config.FilterKindRegex, Action: config.FilterBlockOutput},
+	} {
+		rule, err := cfg.AddFilterRule(rule)
+		if err != nil {
+			t.Fatalf("AddFilterRule(%q): %v", rule.Pattern, err)
+		}
+		added = append(added, rule)
+	}
+	defer func() {
+		for _, rule := range added {
+			cfg.RemoveFilterRule(rule.ID)
+		}
+	}()
+	if _, err := cfg.AddFilterRule(config.FilterRule{Pattern: "(", Kind: config.FilterKindRegex}); err == nil {
+		t.Error("AddFilterRule accepted an invalid regex")
+	}
+
+	// Leetspeak, look-alike letters and repeated letters are all caught
+	for _, msg := range []string{"oh d4rn it", "oh dаaarn!", "DARN"} {
+		if b.shouldLearn(msg, nil) {
+			t.Errorf("shouldLearn(%q) = true, want blocked", msg)
+		}
+	}
+	if !b.shouldLearn("the yarn is darned nice", nil) {
+		t.Error("shouldLearn blocked a message that only contains darn inside another word")
+	}
+
+	if b.matchesRules("claim your free skins here", nil, config.FilterBlockLearning) {
+		t.Error("a block_output rule blocked learning")
+	}
+	if !b.matchesRules("claim your free skins here", nil, config.FilterBlockOutput) {
+		t.Error("regex rule didn't match across words")
+	}
+	if got := b.maskRules("what the heckin chonk", nil); got != "what the ****** chonk" {
+		t.Errorf("maskRules = %q", got)
+	}
+
+	// Cleaning applies the learning rule to what was learned before it
+	if _, err := b.db.Exec(`INSERT INTO transitions (word1, word2, next_word, count) VALUES ('oh', 'd4rn', 'it', 1), ('oh', 'no', 'it', 1)`); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	result := b.Clean()
+	if result.TotalRemoved != 1 || len(result.Words) != 1 || result.Words[0].Word != "darn" {
+		t.Errorf("Clean = %+v, want the one darn transition removed", result)
+	}
+
+	// A removed rule stops matching and leaves the compiled rule cache
+	cfg.RemoveFilterRule(added[1].ID)
+	if got := b.maskRules("what the heckin chonk", nil); got != "what the heckin chonk" {
+		t.Errorf("maskRules after removing the rule = %q", got)
+	}
+	ruleCache.Lock()
+	_, cached := ruleCache.matchers[added[1].ID]
+	ruleCache.Unlock()
+	if cached {
+		t.Error("removed rule is still in the compiled rule cache")
+	}
+}
+
+func TestChannelBlacklistOnlyAppliesToItsChannel(t *testing.T) {
+	spoilers := newTestBrain(t, 2)
+	other := newTestBrain(t, 2)
+	cfg := spoilers.cfg
+	if err := cfg.AddChannelBlacklistedWord(spoilers.Channel, "Rosebud"); err != nil {
+		t.Fatalf("AddChannelBlacklistedWord: %v", err)
+	}
+
+	if !spoilers.containsBlacklistedWord("it was rosebud all along!", nil) {
+		t.Error("channel blacklist entry didn't match in its channel")
+	}
+	if other.containsBlacklistedWord("it was rosebud all along!", nil) {
+		t.Error("channel blacklist entry matched in another channel")
+	}
+
+	spoilers.learn("nice play", "")
+	if _, err := spoilers.db.Exec(`INSERT INTO transitions (word1, word2, next_word, count) VALUES ('was', 'rosebud', 'all', 1)`); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if result := spoilers.Clean(); result.TotalRemoved != 1 {
+		t.Errorf("Clean = %+v, want the one rosebud transition removed", result)
+	}
+
+	cfg.RemoveChannelBlacklistedWord(spoilers.Channel, "rosebud")
+	if spoilers.containsBlacklistedWord("rosebud", nil) {
+		t.Error("removed channel blacklist entry still matches")
+	}
+}
+
+func TestLinkDetection(t *testing.T) {
+	links := []string{
+		"https://example.com/path", "www.example.org", "check example.dev", "go to 192.168.0.1:8080",
+		"free skins at example dot com", "free skins at example dot com/skins now", "example(.)net", "see repo.rs/crate", "bit.ly/abc",
+		"free followers at example dot com now", "my site example dot gg has it", "go to shop dot example dot net today",
+	}
+	for _, msg := range links {
+		if stripLinks(msg, nil, nil) == msg {
+			t.Errorf("no link found in %q", msg)
+		}
+	}
+	notLinks := []string{
+		"that's so .co ol", "node.js is fine", "edit main.rs then", "ok.so what", "1.5 seconds", "e.g. this",
+		"a dot com bubble", "connect the dots", "dot dot dot", "polka dot dress", "the dot com era is over",
+		"an old dot com company", "hit the red dot in the corner", "version two dot one is out", "that dot com startup failed",
+	}
+	for _, msg := range notLinks {
+		if got := stripLinks(msg, nil, nil); got != msg {
+			t.Errorf("stripLinks(%q) = %q, want no link found", msg, got)
+		}
+	}
+}
+
+func TestLinkPolicyAndAllowlist(t *testing.T) {
+	b := newTestBrain(t, 2)
+	cfg := b.cfg
+	if err := cfg.AddLinkAllowlistDomain("https://clips.twitch.tv/"); err != nil {
+		t.Fatalf("AddLinkAllowlistDomain: %v", err)
+	}
+	defer cfg.RemoveLinkAllowlistDomain("clips.twitch.tv")
+
+	clip := "what a clip clips.twitch.tv/abc lol"
+	spam := "cheap followers at spam.example.com now"
+
+	if msg, ok := b.filterLinks(clip, nil); !ok || msg != clip {
+		t.Errorf("skip policy: filterLinks(clip) = %q, %v; want the allowlisted link learned", msg, ok)
+	}
+	if _, ok := b.filterLinks(spam, nil); ok {
+		t.Error("skip policy learned a message with a link")
+	}
+
+	cfg.SetChannelLinkPolicy(b.Channel, config.LinkPolicyStrip)
+	if msg, ok := b.filterLinks(spam, nil); !ok || msg != "cheap followers at now" {
+		t.Errorf("strip policy: filterLinks(spam) = %q, %v", msg, ok)
+	}
+
+	cfg.SetChannelLinkPolicy(b.Channel, config.LinkPolicyLearn)
+	if msg, ok := b.filterLinks(spam, nil); !ok || msg != spam {
+		t.Errorf("learn policy: filterLinks(spam) = %q, %v", msg, ok)
+	}
+
+	// Learned links never make it into output
+	b.learn(spam, "")
+	var result GenerationResult
+	b.generateResponse(&result, func(int, *Trace, ...string) string { return spam }, nil)
+	if !result.Success || result.Response != "cheap followers at now" {
+		t.Errorf("generateResponse = %+v, want the link stripped", result)
+	}
+}
+
+func TestAllowedScripts(t *testing.T) {
+	b := newTestBrain(t, 2)
+	cfg := b.cfg
+
+	polish := "zażółć gęślą jaźń"
+	japanese := "こんにちは、世界！"
+	russian := "всем привет чат"
+
+	// The default Latin set keeps Latin-1 accents but nothing beyond
+	if !b.shouldLearn("ação rápida", nil) {
+		t.Error("latin: rejected Latin-1 accents")
+	}
+	for _, msg := range []string{polish, japanese, russian} {
+		if b.shouldLearn(msg, nil) {
+			t.Errorf("latin: learned %q", msg)
+		}
+	}
+
+	if err := cfg.SetChannelAllowedScripts(b.Channel, []string{"cjk", "latin-extended", "cjk"}); err != nil {
+		t.Fatalf("SetChannelAllowedScripts: %v", err)
+	}
+	if got := cfg.GetChannelAllowedScripts(b.Channel); strings.Join(got, ",") != "latin-extended,cjk" {
+		t.Errorf("GetChannelAllowedScripts = %v", got)
+	}
+	if !b.shouldLearn(polish, nil) || !b.shouldLearn(japanese, nil) || !b.shouldLearn("¿qué pasa?", nil) {
+		t.Error("latin-extended,cjk: rejected a Polish, Japanese or Spanish message")
+	}
+	if b.shouldLearn(russian, nil) {
+		t.Error("latin-extended,cjk: learned a Cyrillic message")
+	}
+	if err := cfg.SetChannelAllowedScripts(b.Channel, []string{"klingon"}); err == nil {
+		t.Error("SetChannelAllowedScripts accepted an unknown script")
+	}
+
+	// Cleaning removes what the channel's scripts no longer allow
+	b.learn(polish, "")
+	b.learn(russian, "")
+	if removed := b.CleanNonASCII(); removed == 0 {
+		t.Error("CleanNonASCII removed nothing")
+	}
+	var cyrillic int
+	b.db.QueryRow(`SELECT COUNT(*) FROM transitions WHERE next_word = 'чат'`).Scan(&cyrillic)
+	var polishLeft int
+	b.db.QueryRow(`SELECT COUNT(*) FROM transitions WHERE next_word = 'jaźń'`).Scan(&polishLeft)
+	if cyrillic != 0 || polishLeft == 0 {
+		t.Errorf("after CleanNonASCII: %d Cyrillic and %d Polish transitions, want 0 and more", cyrillic, polishLeft)
+	}
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	b := newTestBrain(t, 2)
+	m := NewManager(b.cfg)
+	defer m.Close()
+	m.brains[b.Channel] = b
+	b.index = m.index
+	defer os.RemoveAll(snapshotDir(b.Channel))
+
+	b.learn("before the raid everything was fine", "")
+	before, err := m.SnapshotBrain(b.Channel, SnapshotManual)
+	if err != nil {
+		t.Fatalf("SnapshotBrain: %v", err)
+	}
+	var wantTotal int
+	b.db.QueryRow(`SELECT COUNT(*) FROM transitions`).Scan(&wantTotal)
+	b.learn("raid spam raid spam raid spam", "")
+
+	undo, err := m.RestoreSnapshot(b.Channel, before.ID, false)
+	if err != nil {
+		t.Fatalf("RestoreSnapshot: %v", err)
+	}
+	if undo.Kind != SnapshotPreRestore {
+		t.Errorf("RestoreSnapshot returned a %q snapshot, want pre-restore", undo.Kind)
+	}
+	restored := m.GetBrain(b.Channel)
+	if restored == b {
+		t.Fatal("brain was not reloaded after the restore")
+	}
+	var got int
+	restored.db.QueryRow(`SELECT COUNT(*) FROM transitions`).Scan(&got)
+	if got != wantTotal {
+		t.Errorf("restored brain has %d transitions, want %d", got, wantTotal)
+	}
+
+	// Scheduled and pre-restore snapshots are pruned, manual ones kept
+	for i := 0; i < 3; i++ {
+		if _, err := m.SnapshotBrain(b.Channel, SnapshotScheduled); err != nil {
+			t.Fatalf("SnapshotBrain: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	m.pruneSnapshots(b.Channel, 1)
+	kinds := make(map[string]int)
+	for _, s := range m.ListSnapshots(b.Channel) {
+		kinds[s.Kind]++
+	}
+	if kinds[SnapshotManual] != 1 || kinds[SnapshotScheduled] != 1 || kinds[SnapshotPreRestore] != 1 {
+		t.Errorf("snapshots after pruning = %v, want one of each kind", kinds)
+	}
+
+	if _, err := m.RestoreSnapshot(b.Channel, "../../twitchbot", false); err == nil {
+		t.Error("RestoreSnapshot accepted an invalid ID")
+	}
+}
+
+func TestRestoreForgetsUsersAgainAndChecksOrder(t *testing.T) {
+	b := newTestBrain(t, 2)
+	m := NewManager(b.cfg)
+	defer m.Close()
+	m.brains[b.Channel] = b
+	b.index = m.index
+	defer os.RemoveAll(snapshotDir(b.Channel))
+
+	b.learn("pineapple belongs on pizza today", "restore-forget-1")
+	b.learn("nice play streamer", "restore-keep-2")
+	snapshot, err := m.SnapshotBrain(b.Channel, SnapshotManual)
+	if err != nil {
+		t.Fatalf("SnapshotBrain: %v", err)
+	}
+	if _, err := m.ForgetUser("restore-forget-1"); err != nil {
+		t.Fatalf("ForgetUser: %v", err)
+	}
+
+	// The snapshot still has the forgotten user's data, but the restore doesn't bring it back
+	if _, err := m.RestoreSnapshot(b.Channel, snapshot.ID, false); err != nil {
+		t.Fatalf("RestoreSnapshot: %v", err)
+	}
+	restored := m.GetBrain(b.Channel)
+	if got := restored.GetTransitions("pizza", 1, 100).Total; got != 0 {
+		t.Errorf("restore brought back %d transitions of a forgotten user", got)
+	}
+	if got := restored.GetTransitions("play", 1, 100).Total; got == 0 {
+		t.Error("restore lost the transitions of a user who wasn't forgotten")
+	}
+	var contributions int
+	restored.db.QueryRow(`SELECT COUNT(*) FROM contributions WHERE user_id = 'restore-forget-1'`).Scan(&contributions)
+	if contributions != 0 {
+		t.Errorf("restore brought back %d contributions of a forgotten user", contributions)
+	}
+
+	// A snapshot taken at another order needs confirming
+	if err := b.cfg.SetChannelMarkovOrder(b.Channel, 3); err != nil {
+		t.Fatalf("SetChannelMarkovOrder: %v", err)
+	}
+	if _, err := m.RestoreSnapshot(b.Channel, snapshot.ID, false); !errors.Is(err, ErrSnapshotOrderMismatch) {
+		t.Errorf("RestoreSnapshot at another order = %v, want ErrSnapshotOrderMismatch", err)
+	}
+	if _, err := m.RestoreSnapshot(b.Channel, snapshot.ID, true); err != nil {
+		t.Errorf("confirmed RestoreSnapshot at another order: %v", err)
+	}
+}
+
+func TestGenerationTrace(t *testing.T) {
+	b := newTestBrain(t, 2)
+	m := NewManager(b.cfg)
+	defer m.index.close()
+	m.brains[b.Channel] = b
+	b.index = m.index
+
+	b.learn("zebracorn traces every single word", "")
+
+	var trace Trace
+	got := b.GenerateTraced(20, &trace)
+	if got != "zebracorn traces every single word" {
+		t.Fatalf("GenerateTraced = %q", got)
+	}
+	if trace.Source != "channel" || trace.Order != 2 {
+		t.Errorf("trace source/order = %q/%d, want channel/2", trace.Source, trace.Order)
+	}
+	// With one learned message every pick is certain, and the picks spell the response
+	var words []string
+	for _, step := range trace.Steps {
+		if step.Direction != TraceForward || step.Probability != 1 || step.Candidates != 1 {
+			t.Errorf("step %+v, want a certain forward pick", step)
+		}
+		if step.NextWord != step.Chosen {
+			t.Errorf("step transition ends in %q, want the chosen word %q", step.NextWord, step.Chosen)
+		}
+		words = append(words, step.Chosen)
+	}
+	if joined := joinChain(words); joined != got {
+		t.Errorf("trace spells %q, want %q", joined, got)
+	}
+
+	// Seeded global generation goes backward from the seed, and each step names the brains it came from
+	settings := b.cfg.GetChannelGenerationSettings(b.Channel)
+	trace = Trace{}
+	if got := m.GenerateGlobalTraced(2, settings, 20, &trace, "every"); got != "zebracorn traces every single word" {
+		t.Fatalf("GenerateGlobalTraced(every) = %q", got)
+	}
+	if trace.Source != "global" || len(trace.Steps) == 0 || trace.Steps[0].Direction != TraceSeed {
+		t.Fatalf("global trace = %+v, want a seeded global trace", trace)
+	}
+	var backward bool
+	for _, step := range trace.Steps {
+		backward = backward || step.Direction == TraceBackward
+		if step.Channels[b.Channel] == 0 {
+			t.Errorf("step %s %q doesn't credit %s", step.Direction, step.Chosen, b.Channel)
+		}
+	}
+	if !backward {
+		t.Error("seeded trace has no backward steps")
+	}
+
+	// Previews are traced but don't count as the last message sent. (This one
+	// fails the originality check, since it can only repeat the one message.)
+	result := b.Preview(nil)
+	if result.Trace == nil || len(result.Trace.Steps) == 0 {
+		t.Errorf("Preview = %+v, want a trace", result)
+	}
+	if last := b.GetLastMessage(); last != "" {
+		t.Errorf("Preview saved %q as the last message", last)
+	}
+}
+
+func TestOpenReadOnlyRefusesWrites(t *testing.T) {
+	b := newTestBrain(t, 2)
+	b.learn("pineapple belongs on pizza today", "")
+
+	db, err := openReadOnly(filepath.Join(database.GetDataDir(), "brains", b.Channel+".db"), "&_pragma=temp_store(memory)")
+	if err != nil {
+		t.Fatalf("openReadOnly: %v", err)
+	}
+	defer db.Close()
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM transitions`).Scan(&count); err != nil || count == 0 {
+		t.Errorf("read-only query = %d, %v", count, err)
+	}
+	if _, err := db.Exec(`DELETE FROM transitions`); err == nil {
+		t.Error("write succeeded on a read-only connection")
+	}
+
+	missing := filepath.Join(database.GetDataDir(), "brains", "no_such_brain.db")
+	if db, err := openReadOnly(missing, ""); err == nil {
+		db.Ping()
+		db.Close()
+	}
+	if _, err := os.Stat(missing); err == nil {
+		os.Remove(missing)
+		t.Error("openReadOnly created a missing brain file")
+	}
+}
+
+func TestBrainAnalytics(t *testing.T) {
+	b := newTestBrain(t, 2)
+	b.learn("the cat sat down", "")
+	b.learn("the cat ran off", "")
+	b.learn("the cat sat down", "")
+
+	a := b.Analytics()
+	if a.Order != 2 || a.Health != HealthSparse {
+		t.Errorf("order/health = %d/%q, want 2/sparse", a.Order, a.Health)
+	}
+	var states, transitions int
+	b.db.QueryRow(`SELECT COUNT(*) FROM (SELECT DISTINCT word1, word2 FROM transitions)`).Scan(&states)
+	b.db.QueryRow(`SELECT COUNT(*) FROM transitions`).Scan(&transitions)
+	if a.States != states || a.Transitions != transitions {
+		t.Errorf("states/transitions = %d/%d, want %d/%d", a.States, a.Transitions, states, transitions)
+	}
+	// Every message ends at the end marker, so nothing is a dead end
+	if a.DeadEndShare != 0 {
+		t.Errorf("dead-end share = %v, want 0", a.DeadEndShare)
+	}
+	if len(a.TopWords) == 0 || a.TopWords[0].Count != 3 {
+		t.Errorf("top words = %+v, want one learned 3 times first", a.TopWords)
+	}
+
+	// A transition whose next state was never continued is a dead end
+	b.db.Exec(`INSERT INTO transitions (word1, word2, next_word, count) VALUES ('cat', 'ran', 'nowhere', 1)`)
+	b.analytics = nil
+	a = b.Analytics()
+	if a.DeadEndShare == 0 || a.SingletonShare == 0 {
+		t.Errorf("dead-end/singleton shares = %v/%v, want both above 0", a.DeadEndShare, a.SingletonShare)
+	}
+
+	// Stats refreshes record the day's size for the growth history
+	b.GetStats()
+	b.analytics = nil
+	if a = b.Analytics(); len(a.Growth) != 1 || a.Growth[0].TotalEntries != transitions+1 {
+		t.Errorf("growth = %+v, want today's size", a.Growth)
+	}
+}
+
+func TestIdleBrainsAreEvicted(t *testing.T) {
+	cfg := config.New()
+	m := NewManager(cfg)
+	defer m.Close()
+	if err := cfg.SetMaxOpenBrains(5); err != nil {
+		t.Fatalf("SetMaxOpenBrains: %v", err)
+	}
+	defer cfg.SetMaxOpenBrains(config.DefaultMaxOpenBrains)
+
+	var channels []string
+	for i := 0; i < 5; i++ {
+		testBrains++
+		channels = append(channels, fmt.Sprintf("test%d_evict", testBrains))
+		defer m.DeleteBrain(channels[i])
+		m.GetBrain(channels[i])
+	}
+	first := m.GetBrain(channels[0])
+	first.learn("remember me after eviction", "")
+	first.msgCounter = 3
+	first.mu.Lock()
+	first.saveCounter()
+	first.mu.Unlock()
+	first.SaveLastMessage("see you later")
+
+	// Over the limit, only brains idle past the grace period are closed
+	testBrains++
+	extra := fmt.Sprintf("test%d_evict", testBrains)
+	defer m.DeleteBrain(extra)
+	m.GetBrain(extra)
+	if got := m.OpenBrains(); got != 6 {
+		t.Fatalf("%d brains open, want all 6 while none are idle", got)
+	}
+
+	idle := time.Now().Add(-2 * brainIdleGrace).UnixNano()
+	m.brains[channels[0]].lastUsed.Store(idle - 1)
+	m.brains[channels[1]].lastUsed.Store(idle)
+	testBrains++
+	another := fmt.Sprintf("test%d_evict", testBrains)
+	defer m.DeleteBrain(another)
+	m.GetBrain(another)
+	if got := m.OpenBrains(); got != 5 {
+		t.Errorf("%d brains open, want 5", got)
+	}
+	if _, open := m.brains[channels[0]]; open {
+		t.Error("least recently used brain is still open")
+	}
+	if _, open := m.brains[channels[1]]; open {
+		t.Error("second least recently used brain is still open")
+	}
+
+	// Closed brains still report their state and reopen on demand
+	if until, interval := m.GetChannelCountdown(channels[0]); interval-until != 3 {
+		t.Errorf("countdown = %d of %d, want the persisted counter of 3", until, interval)
+	}
+	if got := m.GetLastMessage(channels[0]); got != "see you later" {
+		t.Errorf("GetLastMessage = %q after eviction", got)
+	}
+	reopened := m.GetBrain(channels[0])
+	if reopened == first {
+		t.Fatal("GetBrain returned the closed brain")
+	}
+	if got := reopened.GetMessageCounter(); got != 3 {
+		t.Errorf("reopened brain counter = %d, want 3", got)
+	}
+	if result := reopened.GetTransitions("eviction", 1, 10); result.Total == 0 {
+		t.Error("reopened brain lost what it learned")
+	}
+}
+
+func TestMemoryStorageMatchesSQLite(t *testing.T) {
+	cfg := config.New()
+	testBrains++
+	channel := fmt.Sprintf("test%d_memory", testBrains)
+	if err := cfg.AddChannel(channel); err != nil {
+		t.Fatalf("AddChannel: %v", err)
+	}
+	if err := cfg.SetChannelStorage(channel, "tape"); err == nil {
+		t.Error("SetChannelStorage accepted an unknown backend")
+	}
+	if err := cfg.SetChannelStorage(channel, config.StorageMemory); err != nil {
+		t.Fatalf("SetChannelStorage: %v", err)
+	}
+	hot, err := NewBrain(channel, cfg)
+	if err != nil {
+		t.Fatalf("NewBrain: %v", err)
+	}
+	defer hot.Delete()
+	if _, ok := hot.store.(*memoryStore); !ok {
+		t.Fatalf("store is %T, want the memory store", hot.store)
+	}
+	disk := newTestBrain(t, 2)
+
+	for _, b := range []*Brain{hot, disk} {
+		for i := 0; i < 3; i++ {
+			b.learn("pineapple belongs on pizza today", "")
+		}
+		b.learn("nice play streamer", "")
+		b.learn("pizza party tonight chat", "")
+	}
+
+	hotStats, diskStats := hot.GetStats(), disk.GetStats()
+	if hotStats.UniquePairs != diskStats.UniquePairs || hotStats.TotalEntries != diskStats.TotalEntries {
+		t.Errorf("memory stats %+v, sqlite stats %+v", hotStats, diskStats)
+	}
+	hotPage, diskPage := hot.GetTransitions("pizza", 1, 100), disk.GetTransitions("pizza", 1, 100)
+	if hotPage.Total != diskPage.Total || len(hotPage.Transitions) == 0 || hotPage.Transitions[0].Count != diskPage.Transitions[0].Count {
+		t.Errorf("memory page %+v, sqlite page %+v", hotPage, diskPage)
+	}
+	for i := 0; i < 20; i++ {
+		if got := hot.Generate(20); got == "" {
+			t.Fatal("memory brain generated nothing")
+		}
+	}
+	if words := hot.Generate(20, "pizza"); !strings.Contains(words, "pizza") {
+		t.Errorf("Generate(20, pizza) = %q", words)
+	}
+
+	// Edits go through to the file, so a reopened brain sees them
+	tr := hotPage.Transitions[0]
+	if err := hot.UpdateTransitionCount(tr.Word1, tr.Word2, tr.NextWord, 42); err != nil {
+		t.Fatalf("UpdateTransitionCount: %v", err)
+	}
+	var count int
+	hot.db.QueryRow(`SELECT count FROM transitions WHERE word1 = ? AND word2 = ? AND next_word = ?`,
+		tr.Word1, tr.Word2, tr.NextWord).Scan(&count)
+	if count != 42 {
+		t.Errorf("count on disk = %d after update, want 42", count)
+	}
+
+	// Maintenance that works on the table directly is reloaded into memory
+	old := time.Now().AddDate(-1, 0, 0).Unix()
+	if _, err := hot.db.Exec(`UPDATE transitions SET last_seen = ? WHERE next_word = 'streamer'`, old); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	hot.Decay(config.DecayPolicy{Enabled: true, Days: 30, KeepPercent: 50, PruneBelow: 1})
+	if got := hot.GetTransitions("streamer", 1, 100).Total; got != 1 {
+		t.Errorf("%d transitions into streamer after decay, want the 1 not aged", got)
+	}
+	hot.learn("only viewer42 ever said zebras", "42")
+	if _, _, err := hot.ForgetUser("42"); err != nil {
+		t.Fatalf("ForgetUser: %v", err)
+	}
+	if got := hot.GetTransitions("zebras", 1, 100).Total; got != 0 {
+		t.Errorf("%d forgotten transitions still in memory", got)
+	}
+	if err := hot.Erase(); err != nil {
+		t.Fatalf("Erase: %v", err)
+	}
+	if stats := hot.GetStats(); stats.TotalEntries != 0 {
+		t.Errorf("memory still holds %d transitions after Erase", stats.TotalEntries)
+	}
+}
+
+func TestMemoryBrainNeedsNoFile(t *testing.T) {
+	b := newMemoryTestBrain(t, 2)
+	b.queueLearn("pineapple belongs on pizza today", "42", "viewer")
+	b.queueLearn("pizza party tonight chat", "42", "viewer")
+	b.Flush()
+
+	if _, err := os.Stat(filepath.Join(database.GetDataDir(), "brains", b.Channel+".db")); !os.IsNotExist(err) {
+		t.Errorf("memory brain has a database file (stat: %v)", err)
+	}
+	if stats := b.GetStats(); stats.TotalEntries != 11 {
+		t.Errorf("TotalEntries = %d, want 11", stats.TotalEntries)
+	}
+	if got := b.Generate(20, "party"); got != "pizza party tonight chat" {
+		t.Errorf("Generate(20, party) = %q", got)
+	}
+
+	page := b.GetTransitions("tonight", 1, 10)
+	if page.Total != 3 {
+		t.Fatalf("%d transitions with tonight, want 3", page.Total)
+	}
+	tr := page.Transitions[0]
+	if err := b.UpdateTransitionCount(tr.Word1, tr.Word2, tr.NextWord, 7); err != nil {
+		t.Fatalf("UpdateTransitionCount: %v", err)
+	}
+	if got := b.GetTransitions("tonight", 1, 10).Transitions[0].Count; got != 7 {
+		t.Errorf("count = %d after update, want 7", got)
+	}
+	if err := b.DeleteTransition(tr.Word1, tr.Word2, tr.NextWord); err != nil {
+		t.Fatalf("DeleteTransition: %v", err)
+	}
+	if got := b.GetTransitions("tonight", 1, 10).Total; got != 2 {
+		t.Errorf("%d transitions with tonight after delete, want 2", got)
+	}
+
+	// What lives in the brain file isn't there to work on
+	if _, _, err := b.ForgetUser("42"); !errors.Is(err, ErrBrainClosed) {
+		t.Errorf("ForgetUser = %v, want ErrBrainClosed", err)
+	}
+
+	b.Close()
+	if got := b.Generate(20); got != "" {
+		t.Errorf("closed memory brain generated %q", got)
+	}
+	if err := b.DeleteTransition("a", "b", "c"); !errors.Is(err, ErrBrainClosed) {
+		t.Errorf("DeleteTransition after Close = %v, want ErrBrainClosed", err)
+	}
+}
+
+func TestLearnBatchIsOneTransaction(t *testing.T) {
+	b := newTestBrain(t, 2)
+	// Make learning transitions fail, after contributions were written
+	if _, err := b.db.Exec(`ALTER TABLE transitions RENAME TO transitions_gone`); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	b.learn("this message cannot be learned", "42")
+	if _, err := b.db.Exec(`ALTER TABLE transitions_gone RENAME TO transitions`); err != nil {
+		t.Fatalf("rename back: %v", err)
+	}
+
+	var contributions, recent int
+	b.db.QueryRow(`SELECT COUNT(*) FROM contributions`).Scan(&contributions)
+	b.db.QueryRow(`SELECT COUNT(*) FROM recent_messages`).Scan(&recent)
+	if contributions != 0 || recent != 0 {
+		t.Errorf("failed batch left %d contributions and %d recent messages", contributions, recent)
+	}
+}
+
+func TestSpamDampening(t *testing.T) {
+	b := newTestBrain(t, 2)
+	now := time.Now()
+
+	// A flood of copies from different users: the 1st, 2nd, 4th and 8th are learned
+	var learned []int
+	for i := 1; i <= 10; i++ {
+		copypasta := "this is the best stream on twitch KEKW"
+		if i%2 == 0 {
+			copypasta = "KEKW this is the best stream on twitch KEKW KEKW"
+		}
+		if b.dampen.allow(fmt.Sprintf("viewer%d", i), copypasta, now.Add(time.Duration(i)*time.Second)) {
+			learned = append(learned, i)
+		}
+	}
+	if fmt.Sprint(learned) != "[1 2 4 8]" {
+		t.Errorf("learned copies %v, want [1 2 4 8]", learned)
+	}
+
+	// A user repeating themselves is throttled, other messages aren't
+	if !b.dampen.allow("spammer", "buy followers at example dot com", now) {
+		t.Error("first message from spammer was dampened")
+	}
+	if b.dampen.allow("Spammer", "buy followers at example dot com !!", now.Add(time.Minute)) {
+		t.Error("spammer's repeat was learned")
+	}
+	if !b.dampen.allow("viewer1", "what game is this", now.Add(time.Minute)) {
+		t.Error("an unrelated message was dampened")
+	}
+	// After the window, copies count afresh
+	if !b.dampen.allow("late", "this is the best stream on twitch KEKW", now.Add(10*time.Minute)) {
+		t.Error("copy long after the flood was dampened")
+	}
+
+	stats := b.dampen.take()
+	if stats != (DampeningStats{Learned: 7, Dampened: 6, Throttled: 1}) {
+		t.Errorf("stats = %+v", stats)
+	}
+	if stats := b.dampen.take(); stats != (DampeningStats{}) {
+		t.Errorf("stats after take = %+v, want them reset", stats)
+	}
+
+	// Dampened messages don't advance the message counter, and the next
+	// generation reports them
+	b.cfg.SetChannelMessageInterval(b.Channel, 3)
+	for i := 0; i < 3; i++ {
+		b.ProcessMessageWithInfo("same old line again", "repeater", "", "", "testbot", nil)
+	}
+	if got := b.GetMessageCounter(); got != 1 {
+		t.Errorf("counter = %d after a user repeated twice, want 1", got)
+	}
+	b.ProcessMessageWithInfo("something new entirely", "viewer", "", "", "testbot", nil)
+	result := b.ProcessMessageWithInfo("and one more thing", "viewer2", "", "", "testbot", nil)
+	if !result.Triggered || result.Dampening == nil || result.Dampening.Throttled != 2 || result.Dampening.Learned != 3 {
+		t.Errorf("result = %+v, dampening %+v", result, result.Dampening)
+	}
+}
+
+func TestLearnQuotaAndTopChatters(t *testing.T) {
+	b := newTestBrain(t, 2)
+	if err := b.cfg.SetChannelLearnQuota(b.Channel, 3); err != nil {
+		t.Fatalf("SetChannelLearnQuota: %v", err)
+	}
+	b.cfg.SetChannelMessageInterval(b.Channel, 1000)
+
+	for i := 0; i < 6; i++ {
+		b.ProcessMessageWithInfo(fmt.Sprintf("chatterbox says message number %d here", i), "Chatterbox", "100", "", "testbot", nil)
+	}
+	b.ProcessMessageWithInfo("a quiet viewer says hello", "quiet", "200", "", "testbot", nil)
+	b.Flush()
+
+	report := b.TopChatters(10)
+	if report.Quota != 3 || report.RecentMessages != 4 || len(report.Chatters) != 2 {
+		t.Fatalf("report = %+v, want 4 messages from 2 chatters", report)
+	}
+	top := report.Chatters[0]
+	if top.Username != "Chatterbox" || top.Messages != 3 || top.OverQuota != 3 || top.Share != 0.75 || top.Transitions == 0 {
+		t.Errorf("top chatter = %+v, want Chatterbox with 3 of 4 messages and 3 over quota", top)
+	}
+
+	// The quota counts over a sliding window
+	now := time.Now()
+	if !b.quota.full("chatterbox", 3, now) {
+		t.Error("chatterbox allowed past the quota")
+	}
+	if b.quota.full("chatterbox", 3, now.Add(learnQuotaWindow)) {
+		t.Error("chatterbox still over quota after the window")
+	}
+
+	// Spam the dampener drops doesn't use up the quota
+	for i := 0; i < 5; i++ {
+		b.ProcessMessageWithInfo("the same copypasta over and over", "spammy", "300", "", "testbot", nil)
+	}
+	b.ProcessMessageWithInfo("finally something worth learning", "spammy", "300", "", "testbot", nil)
+	b.Flush()
+	if got := b.GetTransitions("worth", 1, 10).Total; got == 0 {
+		t.Error("a real message was refused after the chatter's repeats were dampened")
+	}
+}
+
+func TestEvictedBrainRefusesUse(t *testing.T) {
+	cfg := config.New()
+	m := NewManager(cfg)
+	defer m.Close()
+	if err := cfg.SetMaxOpenBrains(5); err != nil {
+		t.Fatalf("SetMaxOpenBrains: %v", err)
+	}
+	defer cfg.SetMaxOpenBrains(config.DefaultMaxOpenBrains)
+
+	var channels []string
+	for i := 0; i < 6; i++ {
+		testBrains++
+		channels = append(channels, fmt.Sprintf("test%d_evicted", testBrains))
+		defer m.DeleteBrain(channels[i])
+	}
+	held := m.GetBrain(channels[0])
+	held.learn("learned before the eviction", "")
+	held.lastUsed.Store(time.Now().Add(-2 * brainIdleGrace).UnixNano())
+	for _, channel := range channels[1:] {
+		m.GetBrain(channel)
+	}
+	if _, open := m.brains[channels[0]]; open {
+		t.Fatal("idle brain wasn't evicted")
+	}
+
+	// A caller that kept the brain can't lose messages into its dead queue
+	if err := held.queueLearn("learned after the eviction", "", ""); err != ErrBrainClosed {
+		t.Errorf("queueLearn after eviction = %v, want ErrBrainClosed", err)
+	}
+	if result := held.ProcessMessageWithInfo("learned after the eviction", "viewer", "", "", "testbot", nil); result.Triggered {
+		t.Errorf("closed brain generated: %+v", result)
+	}
+	if err := held.UpdateTransitionCount("a", "b", "c", 2); err != ErrBrainClosed {
+		t.Errorf("UpdateTransitionCount after eviction = %v, want ErrBrainClosed", err)
+	}
+	if got := held.Generate(20); got != "" {
+		t.Errorf("closed brain generated %q", got)
+	}
+	if _, _, err := held.ForgetUser("1"); err != ErrBrainClosed {
+		t.Errorf("ForgetUser after eviction = %v, want ErrBrainClosed", err)
+	}
+
+	// The reopened brain has what was learned before, and nothing after
+	reopened := m.GetBrain(channels[0])
+	if reopened.GetTransitions("before", 1, 10).Total == 0 {
+		t.Error("reopened brain lost what it learned before the eviction")
+	}
+	if reopened.GetTransitions("after", 1, 10).Total != 0 {
+		t.Error("reopened brain learned a message sent to the closed one")
+	}
+}
+
+func TestRemoveBrainClosesWithoutManagerLock(t *testing.T) {
+	cfg := config.New()
+	m := NewManager(cfg)
+	defer m.Close()
+	testBrains++
+	slow := fmt.Sprintf("test%d_remove_slow", testBrains)
+	other := slow + "_other"
+	defer m.DeleteBrain(slow)
+	defer m.DeleteBrain(other)
+
+	brain := m.GetBrain(slow)
+	brain.queueLearn("queued until the brain closes", "", "")
+	m.GetBrain(other)
+
+	// Hold the brain's lock so its closing flush can't finish
+	brain.mu.Lock()
+	removed := make(chan struct{})
+	go func() {
+		m.RemoveBrain(slow)
+		close(removed)
+	}()
+
+	for closing := false; !closing; {
+		m.mu.RLock()
+		_, closing = m.closing[slow]
+		m.mu.RUnlock()
+	}
+
+	// Other channels keep working while it closes
+	got := make(chan *Brain, 1)
+	go func() { got <- m.GetBrain(other) }()
+	select {
+	case b := <-got:
+		if b == nil {
+			t.Error("GetBrain returned nil for the other channel")
+		}
+	case <-time.After(5 * time.Second):
+		brain.mu.Unlock()
+		t.Fatal("GetBrain for another channel waited on a brain closing")
+	}
+	if m.GetLastMessage(other) != "" {
+		t.Error("unexpected last message for the other channel")
+	}
+
+	brain.mu.Unlock()
+	<-removed
+	if reopened := m.GetBrain(slow); reopened.GetTransitions("closes", 1, 10).Total == 0 {
+		t.Error("the brain's queue wasn't flushed as it closed")
+	}
+}
+
+func TestGrowthIsRecordedForClosedBrains(t *testing.T) {
+	cfg := config.New()
+	m := NewManager(cfg)
+	defer m.Close()
+	testBrains++
+	channel := fmt.Sprintf("test%d_growth", testBrains)
+	defer m.DeleteBrain(channel)
+
+	m.GetBrain(channel).learn("growing every single day", "")
+	m.RemoveBrain(channel)
+	m.invalidateListCache()
+	m.recordAllGrowth()
+
+	growth := m.GetBrain(channel).Analytics().Growth
+	if len(growth) != 1 || growth[0].Day != time.Now().Format("2006-01-02") || growth[0].TotalEntries == 0 {
+		t.Errorf("growth = %+v, want today's size recorded while the brain was closed", growth)
+	}
+}
+
+func TestForgetUserOpensOnlyBrainsTheyContributedTo(t *testing.T) {
+	cfg := config.New()
+	m := NewManager(cfg)
+	defer m.Close()
+	testBrains++
+	contributed := fmt.Sprintf("test%d_forget", testBrains)
+	untouched := contributed + "_other"
+	defer m.DeleteBrain(contributed)
+	defer m.DeleteBrain(untouched)
+
+	m.GetBrain(contributed).learn("pineapple belongs on pizza today", "forget-me-111")
+	m.GetBrain(untouched).learn("nice play streamer", "someone-else")
+	m.RemoveBrain(contributed)
+	m.RemoveBrain(untouched)
+	m.invalidateListCache()
+
+	result, err := m.ForgetUser("forget-me-111")
+	if err != nil {
+		t.Fatalf("ForgetUser: %v", err)
+	}
+	if len(result.Channels) != 1 || result.Channels[contributed] == 0 {
+		t.Errorf("ForgetUser changed %v, want only %s", result.Channels, contributed)
+	}
+	m.mu.RLock()
+	_, opened := m.brains[untouched]
+	m.mu.RUnlock()
+	if opened {
+		t.Errorf("ForgetUser opened %s, which the user never contributed to", untouched)
+	}
+
+	// Nothing is left to forget, so a second request opens nothing
+	m.RemoveBrain(contributed)
+	if result, _ := m.ForgetUser("forget-me-111"); len(result.Channels) != 0 || m.OpenBrains() != 0 {
+		t.Errorf("forgetting again changed %v and left %d brains open", result.Channels, m.OpenBrains())
+	}
+}
+
+func TestForgetUserReportsBrainsThatFailed(t *testing.T) {
+	cfg := config.New()
+	m := NewManager(cfg)
+	defer m.Close()
+	testBrains++
+	good := fmt.Sprintf("test%d_forget_good", testBrains)
+	broken := fmt.Sprintf("test%d_forget_broken", testBrains)
+	defer m.DeleteBrain(good)
+	defer m.DeleteBrain(broken)
+
+	// Neither brain is loaded when the user is forgotten
+	m.GetBrain(good).learn("pineapple belongs on pizza today", "forget-me-222")
+	m.RemoveBrain(good)
+	brokenPath := filepath.Join(database.GetDataDir(), "brains", broken+".db")
+	if err := os.WriteFile(brokenPath, []byte("not a brain database at all"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	m.invalidateListCache()
+
+	result, err := m.ForgetUser("forget-me-222")
+	if err == nil || !strings.Contains(err.Error(), broken) {
+		t.Fatalf("ForgetUser error = %v, want one naming %s", err, broken)
+	}
+	if len(result.Failed) != 1 || result.Failed[0] != broken {
+		t.Errorf("Failed = %v, want [%s]", result.Failed, broken)
+	}
+	// The brain that could be forgotten still was
+	if result.Channels[good] == 0 {
+		t.Errorf("ForgetUser changed %v, want %s forgotten", result.Channels, good)
+	}
+	if got := m.GetBrain(good).GetTransitions("pizza", 1, 100).Total; got != 0 {
+		t.Errorf("%d transitions of the forgotten user remain in %s", got, good)
+	}
+}
+
+func TestRemovingTransitionsDropsTheirContributions(t *testing.T) {
+	b := newTestBrain(t, 2)
+	b.learn("pineapple belongs on pizza today", "333")
+	b.learn("nice play streamer", "333")
+	contributions := func() (n int) {
+		b.db.QueryRow(`SELECT COUNT(*) FROM contributions WHERE user_id = '333'`).Scan(&n)
+		return n
+	}
+	if got := contributions(); got != 10 {
+		t.Fatalf("%d contributions, want 10", got)
+	}
+
+	tr := b.GetTransitions("streamer", 1, 100).Transitions[0]
+	if err := b.DeleteTransition(tr.Word1, tr.Word2, tr.NextWord); err != nil {
+		t.Fatalf("DeleteTransition: %v", err)
+	}
+	if got := contributions(); got != 9 {
+		t.Errorf("%d contributions after deleting a transition, want 9", got)
+	}
+
+	if err := b.cfg.AddChannelBlacklistedWord(b.Channel, "pineapple"); err != nil {
+		t.Fatalf("AddChannelBlacklistedWord: %v", err)
+	}
+	if result := b.Clean(); result.TotalRemoved != 3 {
+		t.Errorf("Clean removed %d transitions, want 3", result.TotalRemoved)
+	}
+	if got := contributions(); got != 6 {
+		t.Errorf("%d contributions after cleaning, want 6", got)
+	}
+
+	if _, err := b.db.Exec(`INSERT INTO contributions (user_id, word1, word2, next_word) VALUES ('333', 'лишний', 'переход', 'здесь')`); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if _, err := b.db.Exec(`INSERT INTO transitions (word1, word2, next_word) VALUES ('лишний', 'переход', 'здесь')`); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if removed := b.CleanNonASCII(); removed != 1 {
+		t.Errorf("CleanNonASCII removed %d transitions, want 1", removed)
+	}
+	if got := contributions(); got != 6 {
+		t.Errorf("%d contributions after CleanNonASCII, want 6", got)
+	}
+}
+
+func TestChangingOrderOfLearnedBrainNeedsConfirmation(t *testing.T) {
+	for _, order := range []int{1, 3, 4} {
+		cfg := config.New()
+		m := NewManager(cfg)
+		testBrains++
+		channel := fmt.Sprintf("test%d_reorder%d", testBrains, order)
+		if err := cfg.AddChannel(channel); err != nil {
+			t.Fatalf("AddChannel: %v", err)
+		}
+		cfg.SetChannelMarkovOrder(channel, 2)
+		m.GetBrain(channel).learn("pineapple belongs on pizza today", "")
+
+		stranded, err := m.SetChannelOrder(channel, order, false)
+		if !errors.Is(err, ErrOrderChangeStrands) || stranded == 0 {
+			t.Errorf("order %d: unconfirmed change = %d, %v; want it refused", order, stranded, err)
+		}
+		if got := cfg.GetChannelMarkovOrder(channel); got != 2 {
+			t.Errorf("order %d: refused change left the order at %d", order, got)
+		}
+
+		if _, err := m.SetChannelOrder(channel, order, true); err != nil {
+			t.Fatalf("order %d: confirmed change: %v", order, err)
+		}
+		brain := m.GetBrain(channel)
+		if got := brain.Generate(20); got != "" {
+			t.Errorf("order %d: generated %q from transitions learned at order 2", order, got)
+		}
+		brain.learn("nice play streamer", "")
+		if got := brain.Generate(20); got != "nice play streamer" {
+			t.Errorf("order %d: Generate = %q, want what was learned at the new order", order, got)
+		}
+
+		// Changing back needs confirming too, and brings the old transitions back
+		if _, err := m.SetChannelOrder(channel, 2, false); !errors.Is(err, ErrOrderChangeStrands) {
+			t.Errorf("order %d: changing back without confirming: %v", order, err)
+		}
+		m.SetChannelOrder(channel, 2, true)
+		if got := m.GetBrain(channel).Generate(20); got != "pineapple belongs on pizza today" {
+			t.Errorf("order %d: after changing back, Generate = %q", order, got)
+		}
+
+		m.DeleteBrain(channel)
+		cfg.RemoveChannel(channel)
+		m.Close()
+	}
+}
+
+func TestOrderChangeChecksQueuedAndUnloadedBrains(t *testing.T) {
+	cfg := config.New()
+	m := NewManager(cfg)
+	defer m.Close()
+	testBrains++
+	channel := fmt.Sprintf("test%d_reorder_queued", testBrains)
+	if err := cfg.AddChannel(channel); err != nil {
+		t.Fatalf("AddChannel: %v", err)
+	}
+	defer cfg.RemoveChannel(channel)
+	defer m.DeleteBrain(channel)
+	cfg.SetChannelMarkovOrder(channel, 2)
+	cfg.SetChannelMessageInterval(channel, 1000)
+
+	// A brain that hasn't learned anything changes order without asking
+	if stranded, err := m.SetChannelOrder(channel, 3, false); err != nil || stranded != 0 {
+		t.Fatalf("changing an empty brain's order = %d, %v", stranded, err)
+	}
+
+	// Chat still waiting in the learning queue counts as learned
+	m.GetBrain(channel).ProcessMessageWithInfo("pineapple belongs on pizza today", "viewer", "", "", "testbot", nil)
+	if _, err := m.SetChannelOrder(channel, 2, false); !errors.Is(err, ErrOrderChangeStrands) {
+		t.Errorf("unconfirmed change with queued learning = %v, want ErrOrderChangeStrands", err)
+	}
+
+	// So does a brain that isn't loaded
+	m.RemoveBrain(channel)
+	if _, err := m.SetChannelOrder(channel, 2, false); !errors.Is(err, ErrOrderChangeStrands) {
+		t.Errorf("unconfirmed change of an unloaded brain = %v, want ErrOrderChangeStrands", err)
+	}
+	if got := cfg.GetChannelMarkovOrder(channel); got != 3 {
+		t.Errorf("refused changes left the order at %d, want 3", got)
+	}
+}
+
+func TestForgetUserAfterRestore(t *testing.T) {
+	b := newTestBrain(t, 2)
+	m := NewManager(b.cfg)
+	defer m.Close()
+	m.brains[b.Channel] = b
+	b.index = m.index
+	defer os.RemoveAll(snapshotDir(b.Channel))
+
+	b.learn("pineapple belongs on pizza today", "after-restore-1")
+	snapshot, err := m.SnapshotBrain(b.Channel, SnapshotManual)
+	if err != nil {
+		t.Fatalf("SnapshotBrain: %v", err)
+	}
+	if _, err := m.RestoreSnapshot(b.Channel, snapshot.ID, false); err != nil {
+		t.Fatalf("RestoreSnapshot: %v", err)
+	}
+
+	// The restored brain is a different file, left unloaded; forgetting still reaches it
+	m.RemoveBrain(b.Channel)
+	m.invalidateListCache()
+	result, err := m.ForgetUser("after-restore-1")
+	if err != nil {
+		t.Fatalf("ForgetUser: %v", err)
+	}
+	if result.Channels[b.Channel] == 0 {
+		t.Errorf("ForgetUser changed %v, want the restored brain", result.Channels)
+	}
+	if got := m.GetBrain(b.Channel).GetTransitions("pizza", 1, 100).Total; got != 0 {
+		t.Errorf("%d transitions of the forgotten user left in the restored brain", got)
+	}
+}
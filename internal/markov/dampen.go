@@ -0,0 +1,158 @@
+package markov
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spam dampening limits. Copies of a message chat is spamming are learned with
+// diminishing weight: the 1st, 2nd, 4th, 8th... copy seen within floodWindow
+// of the previous one, so a copypasta posted a hundred times counts about as
+// much as one posted seven times. A user repeating their own message within
+// repeatWindow isn't learned at all.
+const (
+	floodWindow     = 30 * time.Second
+	repeatWindow    = 5 * time.Minute
+	floodSimilarity = 80  // Percent of distinct words two messages must share to be copies
+	floodTracked    = 200 // Most distinct messages remembered
+)
+
+// DampeningStats counts how a channel's chat was dampened before learning
+type DampeningStats struct {
+	Learned   int `json:"learned"`   // Messages learned
+	Dampened  int `json:"dampened"`  // Copies of a message chat is spamming that weren't learned
+	Throttled int `json:"throttled"` // Messages users repeated themselves that weren't learned
+}
+
+// floodEntry is a message seen recently and the copies of it since
+type floodEntry struct {
+	words  []string             // Distinct lowercase words, sorted
+	seen   time.Time            // When the last copy was seen
+	copies int                  // Copies seen, each within floodWindow of the previous one
+	users  map[string]time.Time // When each user last sent a copy
+}
+
+// dampener tracks recent chat messages to spot floods and repeats
+type dampener struct {
+	mu      sync.Mutex
+	entries []*floodEntry // Oldest first
+	stats   DampeningStats
+}
+
+// floodWords returns a message's distinct words, lowercase and sorted, so
+// emote walls and reordered copies compare equal
+func floodWords(message string) []string {
+	words := originalityWords(message)
+	sort.Strings(words)
+	distinct := words[:0]
+	for i, w := range words {
+		if i == 0 || w != words[i-1] {
+			distinct = append(distinct, w)
+		}
+	}
+	return distinct
+}
+
+// similarWords reports whether two sorted word sets share at least
+// floodSimilarity percent of their combined words
+func similarWords(a, b []string) bool {
+	shared, i, j := 0, 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			shared++
+			i++
+			j++
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	union := len(a) + len(b) - shared
+	return union > 0 && shared*100 >= floodSimilarity*union
+}
+
+// allow reports whether a message from user should be learned, recording it
+// either way
+func (d *dampener) allow(user, message string, now time.Time) bool {
+	words := floodWords(message)
+	user = strings.ToLower(user)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(words) == 0 {
+		d.stats.Learned++
+		return true
+	}
+
+	// Forget messages nobody has copied or repeated for a while
+	kept := d.entries[:0]
+	for _, e := range d.entries {
+		if now.Sub(e.seen) < repeatWindow {
+			kept = append(kept, e)
+		}
+	}
+	d.entries = kept
+
+	var match *floodEntry
+	for i := len(d.entries) - 1; i >= 0; i-- {
+		if similarWords(words, d.entries[i].words) {
+			match = d.entries[i]
+			break
+		}
+	}
+	if match == nil {
+		if len(d.entries) >= floodTracked {
+			d.entries = d.entries[1:]
+		}
+		d.entries = append(d.entries, &floodEntry{
+			words:  words,
+			seen:   now,
+			copies: 1,
+			users:  map[string]time.Time{user: now},
+		})
+		d.stats.Learned++
+		return true
+	}
+
+	if last, ok := match.users[user]; ok && now.Sub(last) < repeatWindow {
+		match.users[user] = now
+		match.seen = now
+		d.stats.Throttled++
+		return false
+	}
+	match.users[user] = now
+
+	// A copy long after the last one starts a new count
+	if now.Sub(match.seen) >= floodWindow {
+		match.copies = 0
+	}
+	match.seen = now
+	match.copies++
+	if match.copies&(match.copies-1) != 0 {
+		d.stats.Dampened++
+		return false
+	}
+	d.stats.Learned++
+	return true
+}
+
+// take returns the stats gathered since it was last called and resets them
+func (d *dampener) take() DampeningStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := d.stats
+	d.stats = DampeningStats{}
+	return stats
+}
+
+// undampened reports whether a message passes the channel's spam dampening
+func (b *Brain) undampened(username, message string) bool {
+	if !b.cfg.GetChannelSpamDampening(b.Channel) {
+		return true
+	}
+	return b.dampen.allow(username, message, time.Now())
+}
@@ -0,0 +1,175 @@
+package markov
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"twitchbot/internal/config"
+)
+
+// decayCheckInterval is how often the background job looks for brains whose
+// decay policy is due
+const decayCheckInterval = time.Hour
+
+// decayReportSample is how many pruned transitions a decay report lists
+const decayReportSample = 50
+
+// DecayResult reports what a decay run did to a brain
+type DecayResult struct {
+	Channel      string             `json:"channel"`
+	RanAt        time.Time          `json:"ran_at"`
+	Policy       config.DecayPolicy `json:"policy"`
+	Decayed      int                `json:"decayed"`       // Stale transitions whose count was reduced
+	Pruned       int                `json:"pruned"`        // Transitions deleted for falling below the threshold
+	PrunedSample []Transition       `json:"pruned_sample"` // Up to decayReportSample of the pruned transitions
+}
+
+// Decay ages the brain by the given policy: transitions not seen in the last
+// policy.Days days keep policy.KeepPercent of their count, and those that fall
+// below policy.PruneBelow are deleted. The report is saved as the brain's last
+// decay report.
+func (b *Brain) Decay(policy config.DecayPolicy) DecayResult {
+	result := DecayResult{
+		Channel:      b.Channel,
+		RanAt:        time.Now(),
+		Policy:       policy,
+		PrunedSample: []Transition{},
+	}
+	cutoff := result.RanAt.Add(-time.Duration(policy.Days) * 24 * time.Hour).Unix()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.db == nil {
+		return result
+	}
+
+	res, err := b.db.Exec(`
+		UPDATE transitions SET count = count * ? / 100 WHERE last_seen < ?
+	`, policy.KeepPercent, cutoff)
+	if err == nil {
+		affected, _ := res.RowsAffected()
+		result.Decayed = int(affected)
+	}
+
+	rows, err := b.db.Query(`
+		SELECT word1, word2, next_word, count, last_seen FROM transitions
+		WHERE last_seen < ? AND count < ? LIMIT ?
+	`, cutoff, policy.PruneBelow, decayReportSample)
+	if err == nil {
+		for rows.Next() {
+			var t Transition
+			if rows.Scan(&t.Word1, &t.Word2, &t.NextWord, &t.Count, &t.LastSeen) == nil {
+				t.Order = transitionOrder(t.Word1)
+				result.PrunedSample = append(result.PrunedSample, t)
+			}
+		}
+		rows.Close()
+	}
+
+	res, err = b.db.Exec(`DELETE FROM transitions WHERE last_seen < ? AND count < ?`, cutoff, policy.PruneBelow)
+	if err == nil {
+		affected, _ := res.RowsAffected()
+		result.Pruned = int(affected)
+	}
+	if result.Pruned > 0 {
+		b.dropOrphanContributions()
+	}
+
+	b.transitionsChanged()
+	b.saveDecayReport(result)
+	return result
+}
+
+// saveDecayReport persists a decay report and its run time (must be called with lock held)
+func (b *Brain) saveDecayReport(result DecayResult) {
+	report, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	b.db.Exec(`
+		INSERT INTO state (key, value, value_text) VALUES ('last_decay', ?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value, value_text = excluded.value_text
+	`, result.RanAt.Unix(), string(report))
+}
+
+// LastDecay returns the report of the brain's most recent decay run, or nil if it never ran
+func (b *Brain) LastDecay() *DecayResult {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.db == nil {
+		return nil
+	}
+	var report string
+	if err := b.db.QueryRow("SELECT value_text FROM state WHERE key = 'last_decay'").Scan(&report); err != nil {
+		return nil
+	}
+	var result DecayResult
+	if err := json.Unmarshal([]byte(report), &result); err != nil {
+		return nil
+	}
+	return &result
+}
+
+// DecayBrain runs a channel's decay policy on its brain now, regardless of
+// whether the policy is enabled or due
+func (m *Manager) DecayBrain(channel string) DecayResult {
+	brain := m.GetBrain(channel)
+	if brain == nil {
+		return DecayResult{Channel: channel, PrunedSample: []Transition{}}
+	}
+	result := brain.Decay(m.cfg.GetChannelDecayPolicy(channel))
+	m.reindexGlobal(channel)
+	m.invalidateListCache()
+	return result
+}
+
+// StartDecayJob starts the hourly background job that runs each brain's decay
+// policy once every policy.Days days, and records every brain's size for the
+// analytics growth history. report, if non-nil, is called after each decay
+// run. The job stops when the manager is closed; calling this again is a no-op.
+func (m *Manager) StartDecayJob(report func(DecayResult)) {
+	m.decayOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(decayCheckInterval)
+			defer ticker.Stop()
+
+			for {
+				m.runDueDecay(report)
+				m.recordAllGrowth()
+				select {
+				case <-m.stopChan:
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	})
+}
+
+// runDueDecay decays every brain whose enabled policy is due
+func (m *Manager) runDueDecay(report func(DecayResult)) {
+	for _, stat := range m.ListBrains() {
+		policy := m.cfg.GetChannelDecayPolicy(stat.Channel)
+		if !policy.Enabled {
+			continue
+		}
+		brain := m.GetBrain(stat.Channel)
+		if brain == nil {
+			continue
+		}
+		if last := brain.LastDecay(); last != nil && time.Since(last.RanAt) < time.Duration(policy.Days)*24*time.Hour {
+			continue
+		}
+
+		result := brain.Decay(policy)
+		log.Printf("[%s] Decay: %d transitions aged, %d pruned", stat.Channel, result.Decayed, result.Pruned)
+		m.reindexGlobal(stat.Channel)
+		m.invalidateListCache()
+		if report != nil {
+			report(result)
+		}
+	}
+}
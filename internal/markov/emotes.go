@@ -0,0 +1,88 @@
+package markov
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ParseEmotes reads the IRC emotes tag of a message and returns the emote
+// codes it marks, mapped to their Twitch emote IDs. The tag has the form
+// "id:start-end,start-end/id:start-end" with inclusive character positions.
+// Only positions that cover a whole whitespace-separated word are accepted,
+// so a malformed tag can never split a word into a bogus emote.
+func ParseEmotes(message, tag string) map[string]string {
+	emotes := make(map[string]string)
+	if tag == "" {
+		return emotes
+	}
+
+	runes := []rune(message)
+	for _, entry := range strings.Split(tag, "/") {
+		id, positions, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			continue
+		}
+		for _, pos := range strings.Split(positions, ",") {
+			start, end, ok := parseRange(pos)
+			if !ok || start < 0 || end < start || end >= len(runes) {
+				continue
+			}
+			if start > 0 && !unicode.IsSpace(runes[start-1]) || end+1 < len(runes) && !unicode.IsSpace(runes[end+1]) {
+				continue
+			}
+			name := string(runes[start : end+1])
+			if strings.ContainsFunc(name, unicode.IsSpace) {
+				continue
+			}
+			emotes[name] = id
+		}
+	}
+	return emotes
+}
+
+// parseRange parses a "start-end" emote position
+func parseRange(s string) (start, end int, ok bool) {
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err1 := strconv.Atoi(from)
+	end, err2 := strconv.Atoi(to)
+	return start, end, err1 == nil && err2 == nil
+}
+
+// withoutEmotes returns a message with its emote codes removed, for content
+// checks that would otherwise trip over emote names (or strip their
+// punctuation, as with <3 or :) emotes)
+func withoutEmotes(message string, emotes map[string]string) string {
+	if len(emotes) == 0 {
+		return message
+	}
+	words := strings.Fields(message)
+	kept := words[:0]
+	for _, w := range words {
+		if _, ok := emotes[w]; !ok {
+			kept = append(kept, w)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+// StripEmotes removes the emotes a message contains that the bot can't use.
+// emotes maps emote codes to IDs (as returned by ParseEmotes or
+// Config.GetEmoteIDs) and usable reports whether the bot may send an emote ID.
+func StripEmotes(message string, emotes map[string]string, usable func(id string) bool) string {
+	if len(emotes) == 0 {
+		return message
+	}
+	words := strings.Fields(message)
+	kept := words[:0]
+	for _, w := range words {
+		if id, ok := emotes[w]; ok && !usable(id) {
+			continue
+		}
+		kept = append(kept, w)
+	}
+	return strings.Join(kept, " ")
+}
@@ -0,0 +1,133 @@
+package markov
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"twitchbot/internal/database"
+)
+
+// brainIdleGrace is how long a brain must go unused before it can be closed
+// to make room for others. Callers only hold a brain from GetBrain for the
+// length of one operation, so a brain idle this long is no longer in use.
+const brainIdleGrace = time.Minute
+
+// closedBrain is the dashboard state of a brain that isn't open: its message
+// counter and the last message the bot sent. Neither changes while the brain
+// is closed, so it's remembered rather than read from the file every time.
+type closedBrain struct {
+	counter     int
+	lastMessage string
+}
+
+// evictIdle takes the least recently used brains, oldest first, out of the
+// open brains until no more than max are left (0 = no limit), and returns
+// them for closeEvicted. Brains used within brainIdleGrace are never evicted,
+// so more than max may stay open while busy. Must be called with m.mu held
+// for writing.
+func (m *Manager) evictIdle(max int) []*Brain {
+	if max <= 0 || len(m.brains) <= max {
+		return nil
+	}
+
+	idle := make([]*Brain, 0, len(m.brains))
+	cutoff := time.Now().Add(-brainIdleGrace).UnixNano()
+	for _, brain := range m.brains {
+		if brain.lastUsed.Load() < cutoff {
+			idle = append(idle, brain)
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].lastUsed.Load() < idle[j].lastUsed.Load() })
+
+	var evicted []*Brain
+	for _, brain := range idle {
+		if len(m.brains) <= max {
+			break
+		}
+		m.takeBrain(brain.Channel)
+		evicted = append(evicted, brain)
+	}
+	return evicted
+}
+
+// takeBrain takes an open brain out of the open brains so it can be closed
+// without holding m.mu, and returns it (nil if it isn't open). GetBrain waits
+// for it to finish closing (see closeBrain) before opening its file again.
+// Must be called with m.mu held for writing.
+func (m *Manager) takeBrain(channel string) *Brain {
+	brain, exists := m.brains[channel]
+	if !exists {
+		return nil
+	}
+	delete(m.brains, channel)
+	m.closing[channel] = make(chan struct{})
+	return brain
+}
+
+// closeBrain closes a brain taken out with takeBrain and lets GetBrain open
+// its file again. If state is non-nil, it's remembered as the closed brain's
+// dashboard state. Must be called without m.mu held: closing flushes the
+// brain's learning queue, which shouldn't hold up other channels.
+func (m *Manager) closeBrain(brain *Brain, state *closedBrain) error {
+	err := brain.Close()
+
+	m.mu.Lock()
+	if state != nil {
+		m.closed[brain.Channel] = *state
+	}
+	close(m.closing[brain.Channel])
+	delete(m.closing, brain.Channel)
+	m.mu.Unlock()
+	return err
+}
+
+// closeEvicted closes brains taken out by evictIdle, remembering their
+// dashboard state
+func (m *Manager) closeEvicted(evicted []*Brain) {
+	for _, brain := range evicted {
+		state := closedBrain{counter: brain.GetMessageCounter(), lastMessage: brain.GetLastMessage()}
+		if err := m.closeBrain(brain, &state); err != nil {
+			log.Printf("[%s] Error closing idle brain: %v", brain.Channel, err)
+		}
+	}
+}
+
+// OpenBrains returns how many brain databases are open
+func (m *Manager) OpenBrains() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.brains)
+}
+
+// closedState returns the dashboard state of a brain that isn't open, read
+// from its file the first time it's asked for
+func (m *Manager) closedState(channel string) closedBrain {
+	m.mu.RLock()
+	state, known := m.closed[channel]
+	m.mu.RUnlock()
+	if known {
+		return state
+	}
+
+	dbPath := filepath.Join(database.GetDataDir(), "brains", channel+".db")
+	if _, err := os.Stat(dbPath); err != nil {
+		return state
+	}
+	db, err := openReadOnly(dbPath, "")
+	if err != nil {
+		return state
+	}
+	defer db.Close()
+	db.QueryRow("SELECT value FROM state WHERE key = 'msg_counter'").Scan(&state.counter)
+	db.QueryRow("SELECT value_text FROM state WHERE key = 'last_message'").Scan(&state.lastMessage)
+
+	m.mu.Lock()
+	if _, open := m.brains[channel]; !open {
+		m.closed[channel] = state
+	}
+	m.mu.Unlock()
+	return state
+}
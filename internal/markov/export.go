@@ -0,0 +1,233 @@
+package markov
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Brain export format: a gzip-compressed JSONL stream whose first line is an
+// ExportHeader and every following line is one Transition. The version is
+// bumped whenever a change would make older builds misread an export.
+const (
+	exportFormat  = "twitchbot-brain"
+	exportVersion = 1
+)
+
+// ExportHeader is the first line of a brain export
+type ExportHeader struct {
+	Format      string    `json:"format"`
+	Version     int       `json:"version"`
+	Channel     string    `json:"channel"`
+	Order       int       `json:"order"`
+	Transitions int       `json:"transitions"`
+	TotalCount  int64     `json:"total_count"`
+	ExportedAt  time.Time `json:"exported_at"`
+}
+
+// ImportResult holds the result of importing a brain export
+type ImportResult struct {
+	Channel       string `json:"channel"`
+	SourceChannel string `json:"source_channel"`
+	Order         int    `json:"order"`
+	Mode          string `json:"mode"`
+	Imported      int    `json:"imported"`
+	Skipped       int    `json:"skipped"`
+}
+
+// Export writes the brain as a versioned, gzip-compressed JSONL stream
+func (b *Brain) Export(w io.Writer) error {
+	b.Flush()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.db == nil {
+		return ErrBrainClosed
+	}
+
+	header := ExportHeader{
+		Format:     exportFormat,
+		Version:    exportVersion,
+		Channel:    b.Channel,
+		Order:      b.cfg.GetChannelMarkovOrder(b.Channel),
+		ExportedAt: time.Now().UTC(),
+	}
+	if err := b.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(count), 0) FROM transitions`).Scan(&header.Transitions, &header.TotalCount); err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+
+	rows, err := b.db.Query(`SELECT word1, word2, next_word, count, last_seen FROM transitions`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Transition
+		if err := rows.Scan(&t.Word1, &t.Word2, &t.NextWord, &t.Count, &t.LastSeen); err != nil {
+			return err
+		}
+		t.Order = transitionOrder(t.Word1)
+		if err := enc.Encode(t); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// Import reads a brain export into this brain in a single transaction. With
+// replace the brain's transitions are erased first; otherwise imported counts
+// are added to existing ones. Lines that don't hold a usable transition are
+// skipped and counted. The whole export is decoded before the brain is locked.
+func (b *Brain) Import(r io.Reader, replace bool) (ImportResult, error) {
+	staged, err := readExport(r)
+	if err != nil {
+		return ImportResult{Channel: b.Channel, Mode: importMode(replace)}, err
+	}
+	return b.applyImport(staged, replace)
+}
+
+// stagedImport is a fully decoded brain export, held in memory so the brain is
+// only locked while it's written, never while a slow upload is still arriving
+type stagedImport struct {
+	header      ExportHeader
+	transitions []Transition
+	skipped     int
+}
+
+func importMode(replace bool) string {
+	if replace {
+		return "replace"
+	}
+	return "merge"
+}
+
+// readExport decodes and validates a gzipped export. Malformed or invalid
+// transition lines are counted as skipped rather than failing the import.
+func readExport(r io.Reader) (*stagedImport, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a gzip brain export: %w", err)
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("brain export is empty")
+	}
+	staged := &stagedImport{}
+	if err := json.Unmarshal(scanner.Bytes(), &staged.header); err != nil || staged.header.Format != exportFormat {
+		return nil, fmt.Errorf("missing brain export header")
+	}
+	if staged.header.Version < 1 || staged.header.Version > exportVersion {
+		return nil, fmt.Errorf("unsupported brain export version %d", staged.header.Version)
+	}
+
+	now := time.Now().Unix()
+	for scanner.Scan() {
+		var t Transition
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil || !validTransition(t) {
+			staged.skipped++
+			continue
+		}
+		// Exports from before last_seen existed count as seen at import time
+		if t.LastSeen <= 0 {
+			t.LastSeen = now
+		}
+		staged.transitions = append(staged.transitions, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return staged, nil
+}
+
+// applyImport writes a decoded export into the brain in one transaction.
+// Replacing also clears recent_messages, since the originality check would
+// otherwise compare replies against chat the new brain never learned.
+func (b *Brain) applyImport(staged *stagedImport, replace bool) (ImportResult, error) {
+	result := ImportResult{
+		Channel:       b.Channel,
+		Mode:          importMode(replace),
+		SourceChannel: staged.header.Channel,
+		Order:         staged.header.Order,
+		Skipped:       staged.skipped,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.db == nil {
+		return result, ErrBrainClosed
+	}
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	if replace {
+		for _, table := range []string{"transitions", "contributions", "recent_messages"} {
+			if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO transitions (word1, word2, next_word, count, last_seen)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(word1, word2, next_word) DO UPDATE SET count = count + excluded.count, last_seen = MAX(last_seen, excluded.last_seen)
+	`)
+	if err != nil {
+		return result, err
+	}
+	defer stmt.Close()
+
+	for _, t := range staged.transitions {
+		if _, err := stmt.Exec(t.Word1, t.Word2, t.NextWord, t.Count, t.LastSeen); err != nil {
+			return result, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+	result.Imported = len(staged.transitions)
+
+	b.transitionsChanged()
+	return result, nil
+}
+
+// validTransition reports whether an imported transition fits the packed
+// (word1, word2, next_word) layout described at stateKey
+func validTransition(t Transition) bool {
+	if t.Count < 1 || t.Word2 == "" || t.NextWord == "" {
+		return false
+	}
+	if strings.ContainsAny(t.Word2, " \t\r\n") || strings.ContainsAny(t.NextWord, " \t\r\n") {
+		return false
+	}
+	return t.Word1 == strings.Join(strings.Fields(t.Word1), " ") && transitionOrder(t.Word1) <= 4
+}
@@ -0,0 +1,199 @@
+package markov
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"twitchbot/internal/database"
+)
+
+// ForgetResult holds the result of forgetting a user's contributions
+type ForgetResult struct {
+	UserID   string         `json:"user_id"`
+	Username string         `json:"username,omitempty"`
+	Brains   int            `json:"brains"`  // Brains the user had contributed to
+	Reduced  int            `json:"reduced"` // Transitions whose count went down
+	Removed  int            `json:"removed"` // Transitions left with no count and deleted
+	Channels map[string]int `json:"channels"`
+	Failed   []string       `json:"failed,omitempty"` // Brains the user couldn't be forgotten from
+}
+
+// ForgetUser subtracts everything a user contributed from the brain and
+// returns how many transitions were reduced and how many were removed because
+// nothing else supported them. A transition that decay or a manual edit has
+// lowered below what the user added is removed outright.
+func (b *Brain) ForgetUser(userID string) (reduced, removed int, err error) {
+	if userID == "" {
+		return 0, 0, fmt.Errorf("user ID required")
+	}
+
+	// Queued messages from the user have to be in the brain to be taken out
+	b.Flush()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.db == nil {
+		return 0, 0, ErrBrainClosed
+	}
+
+	reduced, removed, err = forgetInDB(b.db, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	b.transitionsChanged()
+	return reduced, removed, nil
+}
+
+// forgetInDB subtracts a user's contributions from a brain database in one
+// transaction, like Brain.ForgetUser
+func forgetInDB(db *sql.DB, userID string) (reduced, removed int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE transitions SET count = transitions.count - c.count
+		FROM contributions c
+		WHERE c.user_id = ? AND c.word1 = transitions.word1 AND c.word2 = transitions.word2 AND c.next_word = transitions.next_word
+	`, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	affected, _ := res.RowsAffected()
+	reduced = int(affected)
+
+	res, err = tx.Exec(`DELETE FROM transitions WHERE count <= 0`)
+	if err != nil {
+		return 0, 0, err
+	}
+	affected, _ = res.RowsAffected()
+	removed = int(affected)
+
+	if _, err := tx.Exec(`DELETE FROM contributions WHERE user_id = ?`, userID); err != nil {
+		return 0, 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM recent_messages WHERE user_id = ?`, userID); err != nil {
+		return 0, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return reduced, removed, nil
+}
+
+// dropOrphanContributions deletes the contributions to transitions that are
+// no longer in the brain, so nothing is kept about a chatter once what they
+// taught it was cleaned, pruned or deleted. Must be called with the write
+// lock held.
+func (b *Brain) dropOrphanContributions() {
+	_, err := b.db.Exec(`
+		DELETE FROM contributions WHERE NOT EXISTS (
+			SELECT 1 FROM transitions t
+			WHERE t.word1 = contributions.word1 AND t.word2 = contributions.word2 AND t.next_word = contributions.next_word
+		)
+	`)
+	if err != nil {
+		log.Printf("[%s] Failed to drop contributions to removed transitions: %v", b.Channel, err)
+	}
+}
+
+// hasContributed reports whether a user has anything in the brain to forget,
+// learned or still queued
+func (b *Brain) hasContributed(userID string) bool {
+	b.queueMu.Lock()
+	for _, msg := range b.queue {
+		if msg.userID == userID {
+			b.queueMu.Unlock()
+			return true
+		}
+	}
+	b.queueMu.Unlock()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.db == nil {
+		return false
+	}
+	var found int
+	return b.db.QueryRow(`SELECT 1 FROM contributions WHERE user_id = ? LIMIT 1`, userID).Scan(&found) == nil
+}
+
+// contributedTo reports whether a user has anything to forget in a channel's
+// brain, reading the file directly if the brain isn't open so forgetting
+// doesn't open every brain
+func (m *Manager) contributedTo(channel, userID string) bool {
+	m.mu.RLock()
+	brain, open := m.brains[channel]
+	m.mu.RUnlock()
+	if open {
+		return brain.hasContributed(userID)
+	}
+
+	dbPath := filepath.Join(database.GetDataDir(), "brains", channel+".db")
+	if _, err := os.Stat(dbPath); err != nil {
+		return false
+	}
+	db, err := openReadOnly(dbPath, "")
+	if err != nil {
+		return true // Let ForgetUser open it and report the error
+	}
+	defer db.Close()
+	var found int
+	err = db.QueryRow(`SELECT 1 FROM contributions WHERE user_id = ? LIMIT 1`, userID).Scan(&found)
+	return err != sql.ErrNoRows
+}
+
+// ForgetUser removes a user's contributions from every brain on disk, loaded
+// or not, and records the user as forgotten so restoring an older brain
+// snapshot forgets them again (see RestoreSnapshot). Channels maps each brain the user had contributed to onto the
+// number of transitions changed there. Brains the user never contributed to
+// are skipped without being opened. If any brain fails, the others are still
+// forgotten, Failed lists the ones that failed and an error naming them is
+// returned, so callers never report a partial forget as complete.
+func (m *Manager) ForgetUser(userID string) (ForgetResult, error) {
+	result := ForgetResult{UserID: userID, Channels: map[string]int{}}
+	if userID == "" {
+		return result, fmt.Errorf("user ID required")
+	}
+	if err := m.cfg.RecordForgottenUser(userID); err != nil {
+		log.Printf("Failed to record user %s as forgotten: %v", userID, err)
+	}
+
+	for _, stat := range m.ListBrains() {
+		if !m.contributedTo(stat.Channel, userID) {
+			continue
+		}
+		brain := m.GetBrain(stat.Channel)
+		if brain == nil {
+			result.Failed = append(result.Failed, stat.Channel)
+			continue
+		}
+		reduced, removed, err := brain.ForgetUser(userID)
+		if err != nil {
+			log.Printf("[%s] Failed to forget user %s: %v", stat.Channel, userID, err)
+			result.Failed = append(result.Failed, stat.Channel)
+			continue
+		}
+		if reduced > 0 {
+			result.Brains++
+			result.Reduced += reduced
+			result.Removed += removed
+			result.Channels[stat.Channel] = reduced
+			m.reindexGlobal(stat.Channel)
+		}
+	}
+
+	m.invalidateListCache()
+	if len(result.Failed) > 0 {
+		return result, fmt.Errorf("failed to forget user %s in %d brain(s): %s", userID, len(result.Failed), strings.Join(result.Failed, ", "))
+	}
+	return result, nil
+}
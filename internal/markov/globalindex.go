@@ -0,0 +1,411 @@
+package markov
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"twitchbot/internal/config"
+	"twitchbot/internal/database"
+)
+
+// globalIndexFile is the global index database, kept next to the brains
+// directory rather than in it so it's never listed as a brain
+const globalIndexFile = "global.db"
+
+// transitionKey identifies a transition within a brain
+type transitionKey struct {
+	word1, word2, nextWord string
+}
+
+// globalIndex is the consolidated model global and group generation draw
+// from: the transitions of every brain that hasn't opted out or is a brain
+// group member, tagged with their channel, in one database. A generation step is then a single lookup that covers
+// brains that aren't loaded as well. Learned chat is added as brains flush
+// their queues; anything else that rewrites a brain (cleaning, decay,
+// imports, ...) copies that channel's rows again with reindex.
+type globalIndex struct {
+	db  *sql.DB
+	cfg *config.Config
+	mu  sync.Mutex // Serializes reindexing
+}
+
+// openGlobalIndex opens (creating if needed) the global index database
+func openGlobalIndex(cfg *config.Config) (*globalIndex, error) {
+	dbPath := filepath.Join(database.GetDataDir(), globalIndexFile)
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=cache_size(-8192)&_pragma=temp_store(memory)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, err
+	}
+
+	// One connection for writes plus one so generation isn't stuck behind a reindex
+	db.SetMaxOpenConns(2)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxIdleTime(5 * time.Minute)
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS transitions (
+			word1 TEXT NOT NULL,
+			word2 TEXT NOT NULL,
+			next_word TEXT NOT NULL,
+			channel TEXT NOT NULL,
+			count INTEGER DEFAULT 1,
+			PRIMARY KEY (word1, word2, next_word, channel)
+		);
+		CREATE INDEX IF NOT EXISTS idx_next_word_word2 ON transitions(next_word, word2);
+		CREATE INDEX IF NOT EXISTS idx_channel ON transitions(channel);
+
+		CREATE TABLE IF NOT EXISTS state (
+			key TEXT PRIMARY KEY,
+			value INTEGER DEFAULT 0
+		);
+	`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &globalIndex{db: db, cfg: cfg}, nil
+}
+
+// pooled reports whether a channel's transitions belong in the index: those
+// of joined channels that haven't opted out, which global generation draws
+// on, and those of brain group members, which their groups draw on even if
+// they opted out or aren't joined (see channelFilter)
+func (g *globalIndex) pooled(channel string) bool {
+	if g.cfg.IsBrainGroupMember(channel) {
+		return true
+	}
+	return g.cfg.ChannelExists(channel) && !g.cfg.GetChannelGlobalOptOut(channel)
+}
+
+// add adds newly learned transition counts for a channel
+func (g *globalIndex) add(channel string, counts map[transitionKey]int) {
+	if len(counts) == 0 || !g.pooled(channel) {
+		return
+	}
+
+	tx, err := g.db.Begin()
+	if err != nil {
+		log.Printf("[%s] Failed to update global index: %v", channel, err)
+		return
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO transitions (word1, word2, next_word, channel, count)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(word1, word2, next_word, channel) DO UPDATE SET count = count + excluded.count
+	`)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	for key, count := range counts {
+		stmt.Exec(key.word1, key.word2, key.nextWord, channel, count)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("[%s] Failed to update global index: %v", channel, err)
+	}
+}
+
+// set sets the count of one of a channel's transitions, removing it if count is below 1
+func (g *globalIndex) set(channel string, key transitionKey, count int) {
+	if count < 1 {
+		g.db.Exec(`DELETE FROM transitions WHERE word1 = ? AND word2 = ? AND next_word = ? AND channel = ?`,
+			key.word1, key.word2, key.nextWord, channel)
+		return
+	}
+	if g.pooled(channel) {
+		g.db.Exec(`UPDATE transitions SET count = ? WHERE word1 = ? AND word2 = ? AND next_word = ? AND channel = ?`,
+			count, key.word1, key.word2, key.nextWord, channel)
+	}
+}
+
+// reindex replaces a channel's rows with the transitions currently in its
+// brain file, or just drops them if the channel opted out or has no brain.
+// The brain file is attached to a pinned connection and copied in bulk, so
+// the brain doesn't have to be loaded.
+func (g *globalIndex) reindex(channel string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	srcPath := filepath.Join(database.GetDataDir(), "brains", channel+".db")
+	if _, err := os.Stat(srcPath); err != nil || !g.pooled(channel) {
+		_, err := g.db.Exec(`DELETE FROM transitions WHERE channel = ?`, channel)
+		return err
+	}
+
+	// ATTACH applies to a single connection, so pin one for the whole copy
+	ctx := context.Background()
+	conn, err := g.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS index_src`, srcPath); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE index_src`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM transitions WHERE channel = ?`, channel); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO transitions (word1, word2, next_word, channel, count)
+		SELECT word1, word2, next_word, ?, count FROM index_src.transitions WHERE count > 0
+	`, channel); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// built reports whether the index has been filled from the brains on disk
+func (g *globalIndex) built() bool {
+	var value int
+	g.db.QueryRow(`SELECT value FROM state WHERE key = 'built'`).Scan(&value)
+	return value == 1
+}
+
+// markBuilt records that the index has been filled from the brains on disk
+func (g *globalIndex) markBuilt() {
+	g.db.Exec(`INSERT OR REPLACE INTO state (key, value) VALUES ('built', 1)`)
+}
+
+// close closes the index database
+func (g *globalIndex) close() error {
+	return g.db.Close()
+}
+
+// channelFilter returns a SQL condition (with its arguments) limiting index
+// rows to the channels in weights, or, if weights is nil, to the channels in
+// the global pool. Rows of any other channel (group members that opted out,
+// channels that were left or renamed) never reach global generation.
+func (g *globalIndex) channelFilter(weights map[string]float64) (string, []interface{}) {
+	var args []interface{}
+	if weights == nil {
+		for _, channel := range g.cfg.GetGlobalPoolChannels() {
+			args = append(args, channel)
+		}
+	} else {
+		for channel := range weights {
+			args = append(args, channel)
+		}
+	}
+	if len(args) == 0 {
+		return " AND 0", nil
+	}
+	return " AND channel IN (?" + strings.Repeat(", ?", len(args)-1) + ")", args
+}
+
+// weighted runs a query selecting (word, channel, count) rows and combines the
+// rows different channels contributed for the same word into one candidate,
+// keeping first-seen order. With weights set, each channel's counts are
+// multiplied by its weight (never dropping a row below 1).
+func (g *globalIndex) weighted(query string, args []interface{}, weights map[string]float64) ([]string, []int) {
+	rows, err := g.db.Query(query, args...)
+	if err != nil {
+		return nil, nil
+	}
+	defer rows.Close()
+
+	seen := make(map[string]int)
+	var words []string
+	var totals []int
+	for rows.Next() {
+		var word, channel string
+		var count int
+		if rows.Scan(&word, &channel, &count) != nil {
+			continue
+		}
+		if weights != nil {
+			count = int(math.Round(float64(count) * weights[channel]))
+			if count < 1 {
+				count = 1
+			}
+		}
+		if i, ok := seen[word]; ok {
+			totals[i] += count
+			continue
+		}
+		seen[word] = len(words)
+		words = append(words, word)
+		totals = append(totals, count)
+	}
+	return words, totals
+}
+
+// generate builds a response from the index at the given order, drawing on
+// the channels in weights with their counts scaled by their weight, or on
+// every pooled channel if weights is nil. See Manager.GenerateGlobal. If
+// trace is non-nil, each step also records the brains its transition came from.
+func (g *globalIndex) generate(order int, pick sampler, maxWords int, weights map[string]float64, trace *Trace, seeds ...string) string {
+	if weights != nil && len(weights) == 0 {
+		return ""
+	}
+	if trace != nil {
+		trace.begin("global", order)
+		if weights != nil {
+			trace.Source = "group"
+		}
+		defer g.traceChannels(trace, weights)
+	}
+	filter, filterArgs := g.channelFilter(weights)
+	withFilter := func(args ...interface{}) []interface{} {
+		return append(args, filterArgs...)
+	}
+
+	lookup := func(w1, w2 string) ([]string, []int) {
+		return g.weighted(`
+			SELECT next_word, channel, count FROM transitions
+			WHERE word1 = ? AND word2 = ?`+filter,
+			withFilter(w1, w2), weights)
+	}
+	predecessors := func(state []string) ([]string, []int) {
+		column, where, args := predecessorQuery(state)
+		return g.weighted(`SELECT `+column+`, channel, count FROM transitions WHERE `+where+filter,
+			withFilter(args...), weights)
+	}
+
+	for _, seed := range seeds {
+		word1, word2, err := g.sampleState(`next_word = ? AND `+orderCondition(order)+filter, withFilter(seed)...)
+		if err == nil {
+			seq := append(splitState(word1, word2), seed)
+			return joinChain(seededChain(seq, maxWords, lookup, predecessors, pick, trace))
+		}
+	}
+
+	result := walkChain(startState(order), order, maxWords, lookup, pick, trace)
+	if len(result) > order {
+		return joinChain(result)
+	}
+	trace.reset()
+
+	// No learned openings anywhere at this order: start from a random state
+	word1, word2, err := g.sampleState(orderCondition(order)+filter, filterArgs...)
+	if err != nil {
+		return ""
+	}
+
+	start := splitState(word1, word2)
+	trace.state(TraceStart, start)
+	return joinChain(walkChain(start, order, maxWords, lookup, pick, trace))
+}
+
+// sampleState picks the state of a random row matching where with the rowid
+// trick sqliteStore.RandomStart uses, so a pick doesn't sort every matching
+// row of the whole index like ORDER BY RANDOM() would
+func (g *globalIndex) sampleState(where string, args ...interface{}) (word1, word2 string, err error) {
+	err = g.db.QueryRow(`
+		SELECT word1, word2 FROM transitions
+		WHERE rowid >= (abs(random()) % (SELECT max(rowid) FROM transitions) + 1) AND `+where+`
+		LIMIT 1
+	`, args...).Scan(&word1, &word2)
+	// Fallback in case the random rowid lands past every matching row
+	if err != nil {
+		err = g.db.QueryRow(`
+			SELECT word1, word2 FROM transitions WHERE `+where+` ORDER BY rowid LIMIT 1
+		`, args...).Scan(&word1, &word2)
+	}
+	return word1, word2, err
+}
+
+// traceChannels fills in the brains each traced transition came from and
+// their counts, limited to the channels in weights if it isn't nil
+func (g *globalIndex) traceChannels(trace *Trace, weights map[string]float64) {
+	filter, filterArgs := g.channelFilter(weights)
+	for i := range trace.Steps {
+		step := &trace.Steps[i]
+		if step.NextWord == "" {
+			continue
+		}
+		rows, err := g.db.Query(`
+			SELECT channel, count FROM transitions
+			WHERE word1 = ? AND word2 = ? AND next_word = ?`+filter,
+			append([]interface{}{step.Word1, step.Word2, step.NextWord}, filterArgs...)...)
+		if err != nil {
+			continue
+		}
+		step.Channels = make(map[string]int)
+		for rows.Next() {
+			var channel string
+			var count int
+			if rows.Scan(&channel, &count) == nil {
+				step.Channels[channel] = count
+			}
+		}
+		rows.Close()
+	}
+}
+
+// reindexGlobal copies a channel's brain into the global index again after
+// something other than learning changed it. A loaded brain is read-locked
+// for the copy so a learning batch can't land in both the copy and add.
+func (m *Manager) reindexGlobal(channel string) {
+	m.mu.RLock()
+	index := m.index
+	brain := m.brains[channel]
+	m.mu.RUnlock()
+
+	if index == nil {
+		return
+	}
+	if brain != nil {
+		brain.mu.RLock()
+		defer brain.mu.RUnlock()
+	}
+	if err := index.reindex(channel); err != nil {
+		log.Printf("[%s] Failed to reindex global brain: %v", channel, err)
+	}
+}
+
+// RefreshGlobalIndex brings a channel's rows in the global index up to date,
+// adding or dropping them after the channel's opt-out setting or brain group
+// membership changes or its brain file is replaced behind the manager's back
+func (m *Manager) RefreshGlobalIndex(channel string) {
+	m.reindexGlobal(strings.ToLower(channel))
+}
+
+// StartGlobalIndex fills the global index from every brain on disk in the
+// background the first time it runs. After that the index is kept up to date
+// as brains change, so this is a no-op; calling it again is too.
+func (m *Manager) StartGlobalIndex() {
+	m.indexOnce.Do(func() {
+		if m.index == nil || m.index.built() {
+			return
+		}
+		go func() {
+			stats := m.ListBrains()
+			log.Printf("Building global index from %d brains", len(stats))
+			for _, stat := range stats {
+				select {
+				case <-m.stopChan:
+					return
+				default:
+				}
+				m.reindexGlobal(stat.Channel)
+			}
+			m.mu.RLock()
+			if m.index != nil {
+				m.index.markBuilt()
+			}
+			m.mu.RUnlock()
+			log.Printf("Global index built")
+		}()
+	})
+}
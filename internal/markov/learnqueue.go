@@ -0,0 +1,106 @@
+package markov
+
+import (
+	"time"
+)
+
+// Chat is learned write-behind: process queues each message and a goroutine
+// per brain writes the queue out in one transaction every learnFlushInterval,
+// so the IRC read loop never waits on SQLite or the brain's write lock.
+const (
+	learnFlushInterval = 2 * time.Second
+	learnFlushSize     = 500 // Queue depth that triggers a flush before the interval
+)
+
+// pendingMessage is a chat message waiting in the learning queue
+type pendingMessage struct {
+	message  string
+	userID   string
+	username string
+}
+
+// queueLearn adds a message to the learning queue. It fails with
+// ErrBrainClosed once the brain is closed, since nothing would flush it.
+func (b *Brain) queueLearn(message, userID, username string) error {
+	b.queueMu.Lock()
+	if b.shut {
+		b.queueMu.Unlock()
+		return ErrBrainClosed
+	}
+	b.queue = append(b.queue, pendingMessage{message: message, userID: userID, username: username})
+	full := len(b.queue) >= learnFlushSize
+	b.queueMu.Unlock()
+
+	if full {
+		select {
+		case b.flushNow <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// shutQueue stops queueLearn accepting messages, before the brain is closed
+func (b *Brain) shutQueue() {
+	b.queueMu.Lock()
+	b.shut = true
+	b.queueMu.Unlock()
+}
+
+// QueueDepth returns the number of messages waiting to be learned
+func (b *Brain) QueueDepth() int {
+	b.queueMu.Lock()
+	defer b.queueMu.Unlock()
+	return len(b.queue)
+}
+
+// Flush learns every queued message now, in a single transaction
+func (b *Brain) Flush() {
+	b.queueMu.Lock()
+	batch := b.queue
+	b.queue = nil
+	b.queueMu.Unlock()
+
+	if len(batch) > 0 {
+		b.learnBatch(batch)
+	}
+}
+
+// dropQueue discards queued messages without learning them
+func (b *Brain) dropQueue() {
+	b.queueMu.Lock()
+	b.queue = nil
+	b.queueMu.Unlock()
+}
+
+// startFlusher starts the goroutine that flushes the learning queue
+func (b *Brain) startFlusher() {
+	b.flushNow = make(chan struct{}, 1)
+	b.stopFlush = make(chan struct{})
+	b.flushDone = make(chan struct{})
+
+	go func() {
+		defer close(b.flushDone)
+		ticker := time.NewTicker(learnFlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-b.flushNow:
+			case <-b.stopFlush:
+				return
+			}
+			b.Flush()
+		}
+	}()
+}
+
+// stopFlusher stops the flush goroutine, waiting for a flush in progress to
+// finish. Safe to call more than once.
+func (b *Brain) stopFlusher() {
+	b.stopOnce.Do(func() {
+		close(b.stopFlush)
+		<-b.flushDone
+	})
+}
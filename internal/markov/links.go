@@ -0,0 +1,220 @@
+package markov
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"twitchbot/internal/config"
+)
+
+// topLevelDomains holds the TLDs a bare domain (no scheme or www.) must end
+// in to count as a link: the common generic ones and every country code
+var topLevelDomains = makeSet(`
+	com org net edu gov mil int info biz name pro mobi asia aero coop jobs museum tel travel
+	xyz top site online live stream link click shop store app dev page art blog cloud club
+	design fun games group icu life ltd media news one plus run space tech today video vip
+	website wiki work world zone fyi lol wtf gay porn sex xxx bet casino win bid buzz cam
+	chat download email free host lat loan men monster network party review rocks science
+	social stream support team trade webcam zip mov
+	ac ad ae af ag ai al am ao aq ar as at au aw ax az ba bb bd be bf bg bh bi bj bm bn bo
+	br bs bt bw by bz ca cc cd cf cg ch ci ck cl cm cn co cr cu cv cw cx cy cz de dj dk dm
+	do dz ec ee eg er es et eu fi fj fk fm fo fr ga gd ge gf gg gh gi gl gm gn gp gq gr gs
+	gt gu gw gy hk hm hn hr ht hu id ie il im in io iq ir is it je jm jo jp ke kg kh ki km
+	kn kp kr kw ky kz la lb lc li lk lr ls lt lu lv ly ma mc md me mg mh mk ml mm mn mo mp
+	mq mr ms mt mu mv mw mx my mz na nc ne nf ng ni nl no np nr nu nz om pa pe pf pg ph pk
+	pl pm pn pr ps pt pw py qa re ro rs ru rw sa sb sc sd se sg sh si sk sl sm sn so sr ss
+	st su sv sx sy sz tc td tf tg th tj tk tl tm tn to tr tt tv tw tz ua ug uk us uy uz va
+	vc ve vg vi vn vu wf ws ye yt za zm zw
+`)
+
+// ambiguousTLDs are TLDs that are more often file extensions ("main.rs",
+// "notes.md") or words ("ok.so") in chat. A bare domain ending in one only
+// counts as a link with a path after it.
+var ambiguousTLDs = makeSet(`am as cc md ml mov no pl pm ps py rs sc sh so zip`)
+
+// wordTLDs are TLDs that are also common words, so a spelled-out "dot" before
+// one is often prose ("the red dot in the corner", "two dot one"). Like the
+// ambiguous ones, they only count at the end of a phrase when spelled out.
+var wordTLDs = makeSet(`
+	am as at be by do id in is it me my no so to us
+	art bet bid blog buzz cam chat click download email free fun games group host life link
+	live loan media men name network news one page party plus pro review rocks run science
+	shop site social space store stream support team today top trade video win work world zone
+`)
+
+// spelledDomainStopLabels are words that come before "dot com" in prose ("the
+// dot com era", "a dot com bubble"), so they never start a spelled-out domain
+var spelledDomainStopLabels = makeSet(`a an the this that these those old new big early late whole first`)
+
+// makeSet builds a set from whitespace-separated words
+func makeSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
+
+// Patterns for link detection
+var (
+	schemePattern = regexp.MustCompile(`^[a-z][a-z0-9+.-]*://`)
+	labelPattern  = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+	// "example(dot)com", "example[.]com" and similar
+	obfuscatedDot = regexp.MustCompile(`(?i)([a-z0-9])\s*[(\[{]\s*(?:dot|\.)\s*[)\]}]\s*([a-z0-9])`)
+	// "example dot com": only a domain if it ends in a TLD (see deobfuscateLinks)
+	spelledDomain = regexp.MustCompile(`(?i)\b[a-z0-9][a-z0-9-]*(?:\s+dot\s+[a-z0-9][a-z0-9-]*)+`)
+	spelledDot    = regexp.MustCompile(`(?i)\s+dot\s+`)
+)
+
+// linkHost returns the host a word links to, and whether the word is a link
+// at all: anything with a scheme, a www. address, an IPv4 address, or a
+// domain ending in a known TLD
+func linkHost(word string) (string, bool) {
+	w := strings.ToLower(strings.Trim(word, `"'()[]<>{},;!?*`))
+	w = strings.TrimRight(w, ".:")
+
+	hasScheme := schemePattern.MatchString(w)
+	if hasScheme {
+		w = w[strings.Index(w, "://")+3:]
+	}
+	host, rest := w, ""
+	if i := strings.IndexAny(w, "/?#"); i >= 0 {
+		host, rest = w[:i], w[i:]
+	}
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		host = host[i+1:]
+	}
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		if _, err := strconv.Atoi(host[i+1:]); err == nil {
+			host = host[:i]
+		}
+	}
+	host = strings.TrimSuffix(host, ".")
+
+	if hasScheme {
+		return host, host != ""
+	}
+	if strings.HasPrefix(host, "www.") && len(host) > 4 {
+		return host, true
+	}
+	if isIPv4(host) {
+		return host, true
+	}
+
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return "", false
+	}
+	for _, label := range labels {
+		if !labelPattern.MatchString(label) {
+			return "", false
+		}
+	}
+	tld := labels[len(labels)-1]
+	if !topLevelDomains[tld] {
+		return "", false
+	}
+	if ambiguousTLDs[tld] && len(rest) < 2 {
+		return "", false
+	}
+	return host, true
+}
+
+// isIPv4 reports whether a host is a dotted IPv4 address
+func isIPv4(host string) bool {
+	parts := strings.Split(host, ".")
+	if len(parts) != 4 {
+		return false
+	}
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > 255 || len(p) > 3 {
+			return false
+		}
+	}
+	return true
+}
+
+// deobfuscateLinks joins domains written out to dodge link filters, like
+// "example dot com" or "example(.)com", back into plain domains. A spelled-out
+// domain counts wherever it appears if its last label is an unambiguous TLD,
+// unless its first label is a word like "the" ("the dot com era"). TLDs that
+// are also words only count when they end the message or are followed by
+// punctuation or a path, so prose like "the red dot in the corner" or "dot dot
+// dot" is left alone.
+func deobfuscateLinks(text string) string {
+	text = obfuscatedDot.ReplaceAllString(text, "$1.$2")
+
+	matches := spelledDomain.FindAllStringIndex(text, -1)
+	if matches == nil {
+		return text
+	}
+	var out strings.Builder
+	last := 0
+	for _, m := range matches {
+		domain := text[m[0]:m[1]]
+		labels := spelledDot.Split(domain, -1)
+		tld := strings.ToLower(labels[len(labels)-1])
+		if !topLevelDomains[tld] || spelledDomainStopLabels[strings.ToLower(labels[0])] {
+			continue
+		}
+		if ambiguousTLDs[tld] || wordTLDs[tld] {
+			next := text[m[1]:]
+			if strings.TrimSpace(next) != "" && unicode.IsSpace(rune(next[0])) {
+				continue
+			}
+		}
+		out.WriteString(text[last:m[0]])
+		out.WriteString(strings.Join(labels, "."))
+		last = m[1]
+	}
+	out.WriteString(text[last:])
+	return out.String()
+}
+
+// stripLinks removes the links from a message, except those keep returns true
+// for (keep may be nil). If the message had no links it is returned unchanged.
+func stripLinks(message string, emotes map[string]string, keep func(host string) bool) string {
+	words := strings.Fields(deobfuscateLinks(message))
+	kept := make([]string, 0, len(words))
+	stripped := false
+	for _, w := range words {
+		if _, ok := emotes[w]; !ok {
+			if host, ok := linkHost(w); ok && (keep == nil || !keep(host)) {
+				stripped = true
+				continue
+			}
+		}
+		kept = append(kept, w)
+	}
+	if !stripped {
+		return message
+	}
+	return strings.Join(kept, " ")
+}
+
+// filterLinks applies the channel's link policy to a chat message before it's
+// learned. Links to allowlisted domains are always kept. Other links make the
+// message unlearnable (skip policy), are removed from it (strip policy) or are
+// kept (learn policy). It returns the message to learn and whether to learn it.
+func (b *Brain) filterLinks(message string, emotes map[string]string) (string, bool) {
+	policy := b.cfg.GetChannelLinkPolicy(b.Channel)
+	if policy == config.LinkPolicyLearn {
+		return message, true
+	}
+
+	allowlist := b.cfg.GetLinkAllowlist()
+	allowed := func(host string) bool { return config.DomainAllowed(host, allowlist) }
+	filtered := stripLinks(message, emotes, allowed)
+	if filtered == message {
+		return message, true
+	}
+	if policy == config.LinkPolicyStrip {
+		return filtered, strings.TrimSpace(filtered) != ""
+	}
+
+	// Skip policy: the message links somewhere not allowlisted
+	return message, false
+}
@@ -2,8 +2,10 @@ package markov
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,22 +20,41 @@ import (
 
 // Manager manages multiple channel brains, each with its own database
 type Manager struct {
-	brains      map[string]*Brain
-	cfg         *config.Config
-	mu          sync.RWMutex
-	listCache   []BrainStats
-	listCacheAt time.Time
+	brains       map[string]*Brain
+	cfg          *config.Config
+	mu           sync.RWMutex
+	listCache    []BrainStats
+	listCacheAt  time.Time
+	mergeMu      sync.Mutex // Serializes MergeBrains
+	decayOnce    sync.Once
+	snapshotOnce sync.Once
+	stopChan     chan struct{} // Closed by Close to stop background jobs
+	closeOnce    sync.Once
+	index        *globalIndex // Consolidated model for global generation (nil if it failed to open)
+	indexOnce    sync.Once
+	closed       map[string]closedBrain   // Dashboard state of brains that aren't open (see evict.go)
+	closing      map[string]chan struct{} // Evicted brains still closing, closed when they're done
 }
 
 // NewManager creates a new brain manager
 func NewManager(cfg *config.Config) *Manager {
+	index, err := openGlobalIndex(cfg)
+	if err != nil {
+		log.Printf("Error opening global index, global generation is unavailable: %v", err)
+	}
 	return &Manager{
-		brains: make(map[string]*Brain),
-		cfg:    cfg,
+		brains:   make(map[string]*Brain),
+		closed:   make(map[string]closedBrain),
+		closing:  make(map[string]chan struct{}),
+		cfg:      cfg,
+		stopChan: make(chan struct{}),
+		index:    index,
 	}
 }
 
-// GetBrain gets or creates a brain for a channel
+// GetBrain gets or creates a brain for a channel, opening its database if it
+// isn't open. Only as many brains as the configured limit are kept open, so
+// callers should fetch the brain again for each operation rather than keep it.
 func (m *Manager) GetBrain(channel string) *Brain {
 	channel = strings.ToLower(channel)
 
@@ -42,37 +63,103 @@ func (m *Manager) GetBrain(channel string) *Brain {
 	m.mu.RUnlock()
 
 	if exists {
+		brain.lastUsed.Store(time.Now().UnixNano())
 		return brain
 	}
 
 	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	// Double-check after acquiring write lock
-	if brain, exists = m.brains[channel]; exists {
-		return brain
+	for {
+		// Double-check after acquiring write lock
+		if brain, exists = m.brains[channel]; exists {
+			m.mu.Unlock()
+			brain.lastUsed.Store(time.Now().UnixNano())
+			return brain
+		}
+		// Don't open the file while an evicted brain is still flushing to it
+		done, closing := m.closing[channel]
+		if !closing {
+			break
+		}
+		m.mu.Unlock()
+		<-done
+		m.mu.Lock()
 	}
 
 	var err error
 	brain, err = NewBrain(channel, m.cfg)
 	if err != nil {
+		m.mu.Unlock()
 		log.Printf("Error creating brain for %s: %v", channel, err)
 		return nil
 	}
+	brain.index = m.index
+	brain.recentIn = m.recentLearned
+	brain.lastUsed.Store(time.Now().UnixNano())
 	m.brains[channel] = brain
+	delete(m.closed, channel)
+	evicted := m.evictIdle(m.cfg.GetMaxOpenBrains())
+	m.mu.Unlock()
+
+	m.closeEvicted(evicted)
 	return brain
 }
 
-// RemoveBrain removes a brain from memory and closes its database
+// ErrOrderChangeStrands is returned by SetChannelOrder when the brain has
+// learned transitions at its current order and the change wasn't confirmed
+var ErrOrderChangeStrands = errors.New("brain has transitions learned at its current order")
+
+// SetChannelOrder changes a channel's Markov order. Transitions are stored per
+// order, so everything learned at the old order goes unused until the order is
+// changed back; unless confirm is set, a brain that has learned anything at its
+// current order is left alone and ErrOrderChangeStrands returned. It returns
+// how many transitions were (or would be) left unused.
+func (m *Manager) SetChannelOrder(channel string, order int, confirm bool) (int, error) {
+	channel = strings.ToLower(channel)
+	current := m.cfg.GetChannelMarkovOrder(channel)
+	if order == current {
+		return 0, nil
+	}
+
+	brain := m.GetBrain(channel)
+	if brain == nil {
+		return 0, fmt.Errorf("failed to open brain for %s", channel)
+	}
+	brain.Flush()
+
+	brain.mu.Lock()
+	defer brain.mu.Unlock()
+	if brain.db == nil {
+		return 0, ErrBrainClosed
+	}
+	var stranded int
+	if err := brain.db.QueryRow(`SELECT COUNT(*) FROM transitions WHERE ` + orderCondition(current)).Scan(&stranded); err != nil {
+		return 0, err
+	}
+	if stranded > 0 && !confirm {
+		return stranded, ErrOrderChangeStrands
+	}
+	if err := m.cfg.SetChannelMarkovOrder(channel, order); err != nil {
+		return stranded, err
+	}
+	brain.transitionsChanged()
+	return stranded, nil
+}
+
+// RemoveBrain removes a brain from memory and closes its database. The
+// brain is closed without holding the manager's lock, so other channels
+// aren't held up while it flushes its learning queue.
 func (m *Manager) RemoveBrain(channel string) {
 	channel = strings.ToLower(channel)
 
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	brain := m.takeBrain(channel)
+	delete(m.closed, channel)
+	m.mu.Unlock()
 
-	if brain, exists := m.brains[channel]; exists {
-		brain.Close()
-		delete(m.brains, channel)
+	if brain != nil {
+		if err := m.closeBrain(brain, nil); err != nil {
+			log.Printf("[%s] Error closing brain: %v", channel, err)
+		}
 	}
 }
 
@@ -85,11 +172,12 @@ func (m *Manager) GetChannelCountdown(channel string) (messagesUntilResponse int
 	brain, exists := m.brains[channel]
 	m.mu.RUnlock()
 
-	if !exists || brain == nil {
-		return interval, interval
+	var counter int
+	if exists && brain != nil {
+		counter = brain.GetMessageCounter()
+	} else {
+		counter = m.closedState(channel).counter
 	}
-
-	counter := brain.GetMessageCounter()
 	messagesUntilResponse = interval - counter
 	if messagesUntilResponse < 0 {
 		messagesUntilResponse = 0
@@ -106,7 +194,7 @@ func (m *Manager) GetLastMessage(channel string) string {
 	m.mu.RUnlock()
 
 	if !exists || brain == nil {
-		return ""
+		return m.closedState(channel).lastMessage
 	}
 
 	return brain.GetLastMessage()
@@ -215,6 +303,7 @@ func (m *Manager) EraseBrain(channel string) error {
 		return nil
 	}
 	err := brain.Erase()
+	m.reindexGlobal(channel)
 	m.invalidateListCache()
 	return err
 }
@@ -228,8 +317,12 @@ func (m *Manager) DeleteBrain(channel string) error {
 	if exists {
 		delete(m.brains, channel)
 	}
+	delete(m.closed, channel)
 	m.mu.Unlock()
 
+	// Drop the channel from the global index once its file is gone
+	defer m.reindexGlobal(channel)
+
 	if exists {
 		log.Printf("Deleting loaded brain for %s", channel)
 		return brain.Delete()
@@ -260,6 +353,37 @@ func (m *Manager) DeleteBrain(channel string) error {
 	return nil
 }
 
+// ExportBrain writes a channel's brain to w in the portable export format
+func (m *Manager) ExportBrain(channel string, w io.Writer) error {
+	brain := m.GetBrain(channel)
+	if brain == nil {
+		return fmt.Errorf("failed to load brain for %s", channel)
+	}
+	return brain.Export(w)
+}
+
+// ImportBrain reads a brain export into a channel's brain, creating the brain
+// if needed. When replacing, the channel also adopts the export's Markov order
+// so the imported transitions are the ones used for generation. The export is
+// read in full before the brain is loaded, so a slow upload can't hold it open.
+func (m *Manager) ImportBrain(channel string, r io.Reader, replace bool) (ImportResult, error) {
+	staged, err := readExport(r)
+	if err != nil {
+		return ImportResult{Channel: channel, Mode: importMode(replace)}, err
+	}
+	brain := m.GetBrain(channel)
+	if brain == nil {
+		return ImportResult{Channel: channel}, fmt.Errorf("failed to load brain for %s", channel)
+	}
+	result, err := brain.applyImport(staged, replace)
+	if err == nil && replace && result.Order >= 1 && result.Order <= 4 {
+		m.cfg.SetChannelMarkovOrder(channel, result.Order)
+	}
+	m.reindexGlobal(channel)
+	m.invalidateListCache()
+	return result, err
+}
+
 // CleanBrain cleans a specific brain of blacklisted words
 func (m *Manager) CleanBrain(channel string) CleanResult {
 	brain := m.GetBrain(channel)
@@ -267,6 +391,9 @@ func (m *Manager) CleanBrain(channel string) CleanResult {
 		return CleanResult{Channel: channel, Words: []CleanWordResult{}}
 	}
 	result := brain.Clean()
+	if result.TotalRemoved > 0 {
+		m.reindexGlobal(channel)
+	}
 	m.invalidateListCache()
 	return result
 }
@@ -284,6 +411,7 @@ func (m *Manager) CleanAllBrains(progress func(current, total int, channel strin
 			result := brain.Clean()
 			if result.TotalRemoved > 0 {
 				results = append(results, result)
+				m.reindexGlobal(stat.Channel)
 			}
 		}
 		if progress != nil {
@@ -309,15 +437,19 @@ func (m *Manager) OptimizeAll(progress func(current, total int, channel string))
 	}
 }
 
-// CleanNonASCIIAll removes non-ASCII transitions from all brains. See
-// CleanAllBrains for the progress callback semantics.
+// CleanNonASCIIAll removes transitions outside each channel's allowed scripts,
+// and loop transitions, from all brains. See CleanAllBrains for the progress
+// callback semantics.
 func (m *Manager) CleanNonASCIIAll(progress func(current, total int, channel string)) int {
 	stats := m.ListBrains()
 	totalRemoved := 0
 	for i, stat := range stats {
 		brain := m.GetBrain(stat.Channel)
 		if brain != nil {
-			totalRemoved += brain.CleanNonASCII()
+			if removed := brain.CleanNonASCII(); removed > 0 {
+				totalRemoved += removed
+				m.reindexGlobal(stat.Channel)
+			}
 		}
 		if progress != nil {
 			progress(i+1, len(stats), stat.Channel)
@@ -326,114 +458,117 @@ func (m *Manager) CleanNonASCIIAll(progress func(current, total int, channel str
 	return totalRemoved
 }
 
-// Close closes all brain database connections
+// Close stops background jobs and closes all brain database connections
 func (m *Manager) Close() {
+	m.closeOnce.Do(func() { close(m.stopChan) })
+
+	m.mu.Lock()
+	brains := make([]*Brain, 0, len(m.brains))
+	for channel := range m.brains {
+		brains = append(brains, m.takeBrain(channel))
+	}
+	m.mu.Unlock()
+
+	for _, brain := range brains {
+		if err := m.closeBrain(brain, nil); err != nil {
+			log.Printf("[%s] Error closing brain: %v", brain.Channel, err)
+		}
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	for _, brain := range m.brains {
-		brain.Close()
+	// Closed last: brains add their final queued chat to it as they close
+	if m.index != nil {
+		m.index.close()
+		m.index = nil
 	}
-	m.brains = make(map[string]*Brain)
 }
 
-// GenerateGlobal generates a response using transitions from all loaded brains
-func (m *Manager) GenerateGlobal(maxWords int) string {
+// GenerateGlobal generates a response at the given Markov order from the
+// global index, which pools the brains of every joined channel that hasn't
+// opted out, loaded or not, sampling words with the given settings'
+// temperature and top-k. If seed words are given, the response is built
+// through the first seed any pooled brain knows.
+func (m *Manager) GenerateGlobal(order int, settings config.GenerationSettings, maxWords int, seeds ...string) string {
+	return m.GenerateGlobalTraced(order, settings, maxWords, nil, seeds...)
+}
+
+// GenerateGlobalTraced is GenerateGlobal, recording each word choice and the
+// brains it came from in trace if it is non-nil
+func (m *Manager) GenerateGlobalTraced(order int, settings config.GenerationSettings, maxWords int, trace *Trace, seeds ...string) string {
 	m.mu.RLock()
-	brains := make([]*Brain, 0, len(m.brains))
-	for _, brain := range m.brains {
-		brains = append(brains, brain)
-	}
+	index := m.index
 	m.mu.RUnlock()
 
-	if len(brains) == 0 {
+	if index == nil {
 		return ""
 	}
+	return index.generate(order, newSampler(settings), maxWords, nil, trace, seeds...)
+}
 
-	// Pick a random brain to start from. Uses the top-level math/rand
-	// functions (lock-protected global source) rather than a brain's own
-	// rng, since multiple channels can call GenerateGlobal concurrently.
-	startBrain := brains[rand.Intn(len(brains))]
-
-	// Get a random starting pair from the starting brain. Hold the brain's
-	// own RLock while touching its db so a concurrent Brain.Delete() (which
-	// closes and nils b.db under Lock) can't race with this read.
-	var word1, word2 string
-	startBrain.mu.RLock()
-	var err error
-	if startBrain.db == nil {
-		err = sql.ErrNoRows
-	} else {
-		err = startBrain.db.QueryRow(`
-			SELECT word1, word2 FROM transitions
-			ORDER BY RANDOM() LIMIT 1
-		`).Scan(&word1, &word2)
+// GlobalGenerator returns a generator function for a channel that draws from
+// the global index at that channel's current Markov order and generation settings
+func (m *Manager) GlobalGenerator(channel string) Generator {
+	return func(maxWords int, trace *Trace, seeds ...string) string {
+		return m.GenerateGlobalTraced(m.cfg.GetChannelMarkovOrder(channel), m.cfg.GetChannelGenerationSettings(channel), maxWords, trace, seeds...)
 	}
-	startBrain.mu.RUnlock()
+}
 
-	if err != nil {
+// GenerateGroup generates a response like GenerateGlobal, but only from the
+// brains of a brain group's members, with each member's transition counts
+// multiplied by its weight. Members contribute even if they opted out of
+// global generation.
+func (m *Manager) GenerateGroup(group string, order int, settings config.GenerationSettings, maxWords int, seeds ...string) string {
+	return m.GenerateGroupTraced(group, order, settings, maxWords, nil, seeds...)
+}
+
+// GenerateGroupTraced is GenerateGroup, recording each word choice and the
+// member brains it came from in trace if it is non-nil
+func (m *Manager) GenerateGroupTraced(group string, order int, settings config.GenerationSettings, maxWords int, trace *Trace, seeds ...string) string {
+	g := m.cfg.GetBrainGroup(group)
+	if g == nil {
 		return ""
 	}
+	weights := make(map[string]float64, len(g.Members))
+	for _, member := range g.Members {
+		weights[member.Channel] = member.Weight
+	}
 
-	result := []string{word1, word2}
-
-	for i := 0; i < maxWords; i++ {
-		// Collect candidates from all brains
-		var allCandidates []string
-		var allWeights []int
-		totalWeight := 0
-
-		for _, brain := range brains {
-			brain.mu.RLock()
-			if brain.db == nil {
-				brain.mu.RUnlock()
-				continue
-			}
-			rows, err := brain.db.Query(`
-				SELECT next_word, count FROM transitions
-				WHERE word1 = ? AND word2 = ?
-			`, word1, word2)
-
-			if err != nil {
-				brain.mu.RUnlock()
-				continue
-			}
-
-			for rows.Next() {
-				var nextWord string
-				var count int
-				if rows.Scan(&nextWord, &count) == nil {
-					allCandidates = append(allCandidates, nextWord)
-					allWeights = append(allWeights, count)
-					totalWeight += count
-				}
-			}
-			rows.Close()
-			brain.mu.RUnlock()
-		}
-
-		if len(allCandidates) == 0 {
-			break
-		}
+	m.mu.RLock()
+	index := m.index
+	m.mu.RUnlock()
 
-		// Weighted random selection
-		r := rand.Intn(totalWeight)
-		cumulative := 0
-		var nextWord string
-		for i, w := range allWeights {
-			cumulative += w
-			if r < cumulative {
-				nextWord = allCandidates[i]
-				break
-			}
-		}
+	if index == nil {
+		return ""
+	}
+	response := index.generate(order, newSampler(settings), maxWords, weights, trace, seeds...)
+	if trace != nil {
+		trace.Group = g.Name
+	}
+	return response
+}
 
-		result = append(result, nextWord)
-		word1 = word2
-		word2 = nextWord
+// GroupGenerator returns a generator function for a channel that draws from
+// its current brain group at that channel's Markov order and generation settings
+func (m *Manager) GroupGenerator(channel string) Generator {
+	return func(maxWords int, trace *Trace, seeds ...string) string {
+		return m.GenerateGroupTraced(m.cfg.GetChannelBrainGroup(channel), m.cfg.GetChannelMarkovOrder(channel),
+			m.cfg.GetChannelGenerationSettings(channel), maxWords, trace, seeds...)
 	}
+}
 
-	return strings.Join(result, " ")
+// GeneratorFor returns the generator a channel's messages currently come
+// from: its brain group's if it has one, otherwise the global brain's if it
+// uses global mode, otherwise nil for the channel's own brain
+func (m *Manager) GeneratorFor(channel string) Generator {
+	if m.cfg.GetChannelBrainGroup(channel) != "" {
+		return m.GroupGenerator(channel)
+	}
+	if m.cfg.GetChannelUseGlobalBrain(channel) {
+		return m.GlobalGenerator(channel)
+	}
+	return nil
 }
 
 // GetDatabaseStats returns overall database statistics
@@ -451,6 +586,7 @@ func (m *Manager) GetDatabaseStats() map[string]interface{} {
 
 	stats["total_transitions"] = totalTransitions
 	stats["unique_channels"] = len(brainStats)
+	stats["open_brains"] = m.OpenBrains()
 	stats["total_size"] = totalSize
 	stats["data_directory"] = filepath.Join(database.GetDataDir(), "brains")
 
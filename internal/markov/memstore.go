@@ -0,0 +1,252 @@
+package markov
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryStore keeps transitions in memory. On its own it's a store without a
+// file, for tests: it keeps only transitions, and drops the contributions,
+// recent messages and counter of each learning batch. As a caching store it's
+// loaded from a brain's database for busy channels, so generation never has
+// to wait on the disk; every write goes to the database first and is then
+// applied to the cache, and maintenance that changes the file directly makes
+// the brain reload the whole cache (see transitionsChanged).
+type memoryStore struct {
+	mu      sync.RWMutex
+	next    map[[2]string]map[string]*memoryEntry // State (word1, word2) -> next word
+	prev    map[string]map[[2]string]bool         // Next word -> the states it was learned after
+	total   int
+	backing *sqliteStore // The database being cached (nil: memory only)
+}
+
+// memoryEntry is one transition's count and when it was last learned
+type memoryEntry struct {
+	count    int
+	lastSeen int64
+}
+
+// newMemoryStore creates an empty memory-only store
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		next: make(map[[2]string]map[string]*memoryEntry),
+		prev: make(map[string]map[[2]string]bool),
+	}
+}
+
+// newCachingStore creates a memory store caching a brain database's transitions
+func newCachingStore(backing *sqliteStore) (*memoryStore, error) {
+	s := newMemoryStore()
+	s.backing = backing
+	return s, s.reload()
+}
+
+// reload replaces the cache with the transitions in the backing database
+func (s *memoryStore) reload() error {
+	if s.backing == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.next = make(map[[2]string]map[string]*memoryEntry)
+	s.prev = make(map[string]map[[2]string]bool)
+	s.total = 0
+	return s.backing.each(func(t Transition) {
+		s.add(t.Word1, t.Word2, t.NextWord, t.Count, t.LastSeen)
+	})
+}
+
+// add adds count to a transition (must be called with lock held)
+func (s *memoryStore) add(word1, word2, nextWord string, count int, seenAt int64) {
+	state := [2]string{word1, word2}
+	nexts := s.next[state]
+	if nexts == nil {
+		nexts = make(map[string]*memoryEntry)
+		s.next[state] = nexts
+	}
+	entry := nexts[nextWord]
+	if entry == nil {
+		entry = &memoryEntry{}
+		nexts[nextWord] = entry
+		s.total++
+		if s.prev[nextWord] == nil {
+			s.prev[nextWord] = make(map[[2]string]bool)
+		}
+		s.prev[nextWord][state] = true
+	}
+	entry.count += count
+	entry.lastSeen = seenAt
+}
+
+// remove deletes a transition (must be called with lock held)
+func (s *memoryStore) remove(word1, word2, nextWord string) {
+	state := [2]string{word1, word2}
+	nexts := s.next[state]
+	if _, ok := nexts[nextWord]; !ok {
+		return
+	}
+	delete(nexts, nextWord)
+	if len(nexts) == 0 {
+		delete(s.next, state)
+	}
+	delete(s.prev[nextWord], state)
+	if len(s.prev[nextWord]) == 0 {
+		delete(s.prev, nextWord)
+	}
+	s.total--
+}
+
+func (s *memoryStore) Learn(batch LearnBatch) error {
+	if s.backing != nil {
+		if err := s.backing.Learn(batch); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range batch.Transitions {
+		s.add(t.Word1, t.Word2, t.NextWord, t.Count, batch.SeenAt)
+	}
+	return nil
+}
+
+func (s *memoryStore) Next(word1, word2 string) (candidates []string, weights []int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for word, entry := range s.next[[2]string{word1, word2}] {
+		candidates = append(candidates, word)
+		weights = append(weights, entry.count)
+	}
+	return candidates, weights
+}
+
+// Previous matches the transitions (c0 .. ck-1 -> next) where c1 .. ck-1 +
+// next equals the state, like predecessorQuery
+func (s *memoryStore) Previous(state []string) (candidates []string, weights []int) {
+	order := len(state)
+	last := state[order-1]
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for from := range s.prev[last] {
+		context := splitState(from[0], from[1])
+		if len(context) != order {
+			continue
+		}
+		matches := true
+		for i := 1; i < order; i++ {
+			if context[i] != state[i-1] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			candidates = append(candidates, context[0])
+			weights = append(weights, s.next[from][last].count)
+		}
+	}
+	return candidates, weights
+}
+
+func (s *memoryStore) SeedState(order int, word string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var states [][2]string
+	for from := range s.prev[word] {
+		if transitionOrder(from[0]) == order {
+			states = append(states, from)
+		}
+	}
+	if len(states) == 0 {
+		return nil
+	}
+	from := states[rand.Intn(len(states))]
+	return append(splitState(from[0], from[1]), word)
+}
+
+func (s *memoryStore) RandomStart(order int) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var states [][2]string
+	for state := range s.next {
+		if transitionOrder(state[0]) == order {
+			states = append(states, state)
+		}
+	}
+	if len(states) == 0 {
+		return nil
+	}
+	state := states[rand.Intn(len(states))]
+	return splitState(state[0], state[1])
+}
+
+func (s *memoryStore) Page(search string, page, pageSize int) (transitions []Transition, total int) {
+	s.mu.RLock()
+	var matched []Transition
+	for state, nexts := range s.next {
+		for word, entry := range nexts {
+			t := Transition{Word1: state[0], Word2: state[1], NextWord: word, Count: entry.count}
+			if search == "" || searchMatches(t, search) {
+				matched = append(matched, t)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return strings.Join([]string{a.Word1, a.Word2, a.NextWord}, " ") < strings.Join([]string{b.Word1, b.Word2, b.NextWord}, " ")
+	})
+
+	start := (page - 1) * pageSize
+	if start < 0 || start >= len(matched) {
+		return nil, len(matched)
+	}
+	end := start + pageSize
+	if end > len(matched) {
+		end = len(matched)
+	}
+	for _, t := range matched[start:end] {
+		t.Order = transitionOrder(t.Word1)
+		transitions = append(transitions, t)
+	}
+	return transitions, len(matched)
+}
+
+func (s *memoryStore) Delete(word1, word2, nextWord string) error {
+	if s.backing != nil {
+		if err := s.backing.Delete(word1, word2, nextWord); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(word1, word2, nextWord)
+	return nil
+}
+
+func (s *memoryStore) SetCount(word1, word2, nextWord string, count int) error {
+	if s.backing != nil {
+		if err := s.backing.SetCount(word1, word2, nextWord, count); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry := s.next[[2]string{word1, word2}][nextWord]; entry != nil {
+		entry.count = count
+	}
+	return nil
+}
+
+func (s *memoryStore) Stats() (uniquePairs, totalEntries int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.next), s.total
+}
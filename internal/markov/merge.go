@@ -0,0 +1,214 @@
+package markov
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"twitchbot/internal/database"
+)
+
+// mergeBatchSize is how many source rows are merged between progress reports
+const mergeBatchSize = 10000
+
+// channelNamePattern matches Twitch login names, which are also brain file names
+var channelNamePattern = regexp.MustCompile(`^[a-z0-9_]{1,25}$`)
+
+// ErrMergeOrderMismatch is returned by MergeBrains when the source brain is
+// used at another Markov order than the destination and the merge wasn't
+// confirmed
+var ErrMergeOrderMismatch = errors.New("brains are used at different Markov orders")
+
+// MergeResult holds the result of merging one brain into another
+type MergeResult struct {
+	Source           string  `json:"source"`
+	Destination      string  `json:"destination"`
+	SourceOrder      int     `json:"source_order"`
+	DestinationOrder int     `json:"destination_order"`
+	Weight           float64 `json:"weight"`
+	Merged           int     `json:"merged"`
+	SourceDeleted    bool    `json:"source_deleted"`
+}
+
+// MergeBrains adds the transition counts of the src brain into the dst brain
+// in a single transaction. Each source count is multiplied by weight and
+// rounded; rows that round to zero are skipped. If deleteSource is set the
+// source brain is deleted after a successful merge, which is refused while
+// the bot is still in the source channel. The destination must be a joined
+// channel or already have a brain; merging never creates one. If the source
+// is used at another Markov order than the destination, its transitions
+// would be added but never used, so the merge is refused with
+// ErrMergeOrderMismatch unless confirm is set. progress, if non-nil, is
+// called after each batch with (rows merged so far, total source rows, src).
+func (m *Manager) MergeBrains(src, dst string, weight float64, deleteSource, confirm bool, progress func(current, total int, channel string)) (MergeResult, error) {
+	src = strings.ToLower(src)
+	dst = strings.ToLower(dst)
+	result := MergeResult{Source: src, Destination: dst, Weight: weight}
+
+	if !channelNamePattern.MatchString(src) || !channelNamePattern.MatchString(dst) {
+		return result, fmt.Errorf("invalid channel name")
+	}
+	if src == dst {
+		return result, fmt.Errorf("cannot merge a brain into itself")
+	}
+	if weight <= 0 || weight > 100 {
+		return result, fmt.Errorf("weight must be greater than 0 and at most 100")
+	}
+	if deleteSource && m.cfg.ChannelExists(src) {
+		return result, fmt.Errorf("leave %s before deleting its brain", src)
+	}
+
+	srcPath := filepath.Join(database.GetDataDir(), "brains", src+".db")
+	if _, err := os.Stat(srcPath); err != nil {
+		return result, fmt.Errorf("no brain for %s", src)
+	}
+	dstPath := filepath.Join(database.GetDataDir(), "brains", dst+".db")
+	if _, err := os.Stat(dstPath); err != nil && !m.cfg.ChannelExists(dst) {
+		return result, fmt.Errorf("no channel or brain named %s", dst)
+	}
+
+	// Serialize merges so two opposite merges can't deadlock on brain locks
+	m.mergeMu.Lock()
+	defer m.mergeMu.Unlock()
+
+	srcBrain := m.GetBrain(src)
+	dstBrain := m.GetBrain(dst)
+	if srcBrain == nil || dstBrain == nil {
+		return result, fmt.Errorf("failed to load brains")
+	}
+	result.SourceOrder = m.usedOrder(srcBrain)
+	result.DestinationOrder = m.usedOrder(dstBrain)
+	if result.SourceOrder != result.DestinationOrder && !confirm {
+		return result, fmt.Errorf("%w: %s is at order %d and %s at order %d, so the merged transitions won't be used",
+			ErrMergeOrderMismatch, src, result.SourceOrder, dst, result.DestinationOrder)
+	}
+
+	merged, err := dstBrain.mergeFrom(srcBrain, srcPath, weight, progress)
+	result.Merged = merged
+	m.reindexGlobal(dst)
+	m.invalidateListCache()
+	if err != nil {
+		return result, err
+	}
+
+	if deleteSource {
+		if err := m.DeleteBrain(src); err != nil {
+			return result, fmt.Errorf("merged, but failed to delete %s: %w", src, err)
+		}
+		result.SourceDeleted = true
+	}
+
+	return result, nil
+}
+
+// usedOrder returns the Markov order a brain's transitions are used at: its
+// channel's order if the channel is joined, otherwise the order most of its
+// transitions were learned at
+func (m *Manager) usedOrder(b *Brain) int {
+	if m.cfg.ChannelExists(b.Channel) {
+		return m.cfg.GetChannelMarkovOrder(b.Channel)
+	}
+	b.Flush()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	order, most := m.cfg.GetChannelMarkovOrder(b.Channel), 0
+	if b.db == nil {
+		return order
+	}
+	for o := 1; o <= 4; o++ {
+		var count int
+		b.db.QueryRow(`SELECT COUNT(*) FROM transitions WHERE ` + orderCondition(o)).Scan(&count)
+		if count > most {
+			order, most = o, count
+		}
+	}
+	return order
+}
+
+// mergeFrom merges src's transitions into b. The source database file is
+// attached to b's connection so rows are upserted in bulk by SQLite, a batch
+// of rowids at a time, all within one transaction.
+func (b *Brain) mergeFrom(src *Brain, srcPath string, weight float64, progress func(current, total int, channel string)) (int, error) {
+	src.Flush()
+
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if src.db == nil || b.db == nil {
+		return 0, ErrBrainClosed
+	}
+
+	var total int
+	var maxRowid int64
+	if err := src.db.QueryRow(`SELECT COUNT(*), COALESCE(MAX(rowid), 0) FROM transitions`).Scan(&total, &maxRowid); err != nil {
+		return 0, err
+	}
+
+	// ATTACH applies to a single connection, so pin one for the whole merge
+	ctx := context.Background()
+	conn, err := b.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS merge_src`, srcPath); err != nil {
+		return 0, err
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE merge_src`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	merged := 0
+	processed := 0
+	for lo := int64(0); lo < maxRowid; lo += mergeBatchSize {
+		hi := lo + mergeBatchSize
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO transitions (word1, word2, next_word, count, last_seen)
+			SELECT word1, word2, next_word, CAST(ROUND(count * ?) AS INTEGER), last_seen FROM merge_src.transitions
+			WHERE rowid > ? AND rowid <= ? AND CAST(ROUND(count * ?) AS INTEGER) > 0
+			ON CONFLICT(word1, word2, next_word) DO UPDATE SET count = count + excluded.count, last_seen = MAX(last_seen, excluded.last_seen)
+		`, weight, lo, hi, weight)
+		if err != nil {
+			return 0, err
+		}
+		affected, _ := res.RowsAffected()
+		merged += int(affected)
+
+		var batch int
+		tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM merge_src.transitions WHERE rowid > ? AND rowid <= ?`, lo, hi).Scan(&batch)
+		processed += batch
+		if progress != nil {
+			progress(processed, total, src.Channel)
+		}
+	}
+
+	// Carry per-user contributions over so chatters can still be forgotten
+	// from the destination brain
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO contributions (user_id, word1, word2, next_word, count)
+		SELECT user_id, word1, word2, next_word, CAST(ROUND(count * ?) AS INTEGER) FROM merge_src.contributions
+		WHERE CAST(ROUND(count * ?) AS INTEGER) > 0
+		ON CONFLICT(user_id, word1, word2, next_word) DO UPDATE SET count = count + excluded.count
+	`, weight, weight); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	b.transitionsChanged()
+	return merged, nil
+}
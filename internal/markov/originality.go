@@ -0,0 +1,157 @@
+package markov
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"twitchbot/internal/database"
+)
+
+// originalityWindow is how many recently learned messages a brain keeps to
+// check generated responses against
+const originalityWindow = 1000
+
+// originalityWords splits a message into lowercase words without surrounding
+// punctuation, so "Nice play!" and "nice play" compare equal
+func originalityWords(message string) []string {
+	var words []string
+	for _, w := range strings.Fields(strings.ToLower(message)) {
+		if w = stripWordPunctuation(w); w != "" {
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+// longestSharedRun returns the length of the longest run of consecutive
+// words that a and b have in common
+func longestSharedRun(a, b []string) int {
+	longest := 0
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				cur[j] = prev[j-1] + 1
+				if cur[j] > longest {
+					longest = cur[j]
+				}
+			} else {
+				cur[j] = 0
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return longest
+}
+
+// tooSimilar reports whether at least threshold percent of a response was
+// copied word for word from one of the given messages
+func tooSimilar(response string, recent [][]string, threshold int) bool {
+	words := originalityWords(response)
+	if threshold <= 0 || len(words) == 0 {
+		return false
+	}
+	for _, msg := range recent {
+		if longestSharedRun(words, msg)*100 >= threshold*len(words) {
+			return true
+		}
+	}
+	return false
+}
+
+// copiesSource reports whether a response copies too much of a recent chat
+// message in one of the brains it could have come from: this brain, plus in
+// global and group mode each brain a traced transition came from. recent
+// caches each brain's messages across retries.
+func (b *Brain) copiesSource(response string, trace *Trace, threshold int, recent map[string][][]string) bool {
+	for _, channel := range originalitySources(b.Channel, trace) {
+		messages, cached := recent[channel]
+		if !cached {
+			if channel == b.Channel {
+				messages = b.recentLearned()
+			} else if b.recentIn != nil {
+				messages = b.recentIn(channel)
+			}
+			recent[channel] = messages
+		}
+		if tooSimilar(response, messages, threshold) {
+			return true
+		}
+	}
+	return false
+}
+
+// originalitySources returns channel followed by every other brain that
+// contributed a transition to the traced response
+func originalitySources(channel string, trace *Trace) []string {
+	sources := []string{channel}
+	seen := map[string]bool{channel: true}
+	if trace == nil {
+		return sources
+	}
+	for _, step := range trace.Steps {
+		for source := range step.Channels {
+			if !seen[source] {
+				seen[source] = true
+				sources = append(sources, source)
+			}
+		}
+	}
+	return sources
+}
+
+// recentLearned returns the brain's recently learned messages, split with
+// originalityWords
+func (b *Brain) recentLearned() [][]string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.db == nil {
+		return nil
+	}
+	return readRecentLearned(b.db)
+}
+
+// readRecentLearned reads the recent_messages table of a brain database
+func readRecentLearned(db *sql.DB) [][]string {
+	rows, err := db.Query(`SELECT message FROM recent_messages`)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var recent [][]string
+	for rows.Next() {
+		var message string
+		if rows.Scan(&message) == nil {
+			recent = append(recent, originalityWords(message))
+		}
+	}
+	return recent
+}
+
+// recentLearned returns a channel's recently learned messages from its loaded
+// brain, or read straight from its brain file so checking a global or group
+// response doesn't load every brain that fed it
+func (m *Manager) recentLearned(channel string) [][]string {
+	m.mu.RLock()
+	brain, open := m.brains[channel]
+	m.mu.RUnlock()
+	if open {
+		return brain.recentLearned()
+	}
+
+	dbPath := filepath.Join(database.GetDataDir(), "brains", channel+".db")
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil
+	}
+	db, err := openReadOnly(dbPath, "")
+	if err != nil {
+		return nil
+	}
+	defer db.Close()
+	return readRecentLearned(db)
+}
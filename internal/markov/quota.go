@@ -0,0 +1,167 @@
+package markov
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// learnQuotaWindow is the window a channel's per-chatter learning quota
+// counts over: with a quota of N, each chatter has at most N messages learned
+// in any learnQuotaWindow, so one very active chatter can't drown out the rest
+const learnQuotaWindow = 10 * time.Minute
+
+// learnQuota tracks when each chatter's messages were learned
+type learnQuota struct {
+	mu        sync.Mutex
+	learned   map[string][]time.Time // Chatter -> when their messages were learned, oldest first
+	overQuota map[string]int         // Chatter -> messages not learned since the brain was opened
+	swept     time.Time              // When chatters who went quiet were last dropped
+}
+
+// inWindow returns user's learning still inside the window at now, dropping
+// the rest (must be called with lock held)
+func (q *learnQuota) inWindow(user string, now time.Time) []time.Time {
+	times := q.learned[user]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= learnQuotaWindow {
+		i++
+	}
+	if i == len(times) {
+		delete(q.learned, user)
+		return nil
+	}
+	q.learned[user] = times[i:]
+	return times[i:]
+}
+
+// full reports whether user already had max messages learned in the last
+// learnQuotaWindow, counting the message as over the quota if so
+func (q *learnQuota) full(user string, max int, now time.Time) bool {
+	user = strings.ToLower(user)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.learned == nil {
+		q.learned = make(map[string][]time.Time)
+		q.overQuota = make(map[string]int)
+	}
+
+	// Once a window, drop the chatters who have gone quiet
+	if now.Sub(q.swept) >= learnQuotaWindow {
+		for chatter := range q.learned {
+			q.inWindow(chatter, now)
+		}
+		q.swept = now
+	}
+
+	if len(q.inWindow(user, now)) >= max {
+		q.overQuota[user]++
+		return true
+	}
+	return false
+}
+
+// charge counts a message learned from user against their quota
+func (q *learnQuota) charge(user string, now time.Time) {
+	user = strings.ToLower(user)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.learned == nil {
+		q.learned = make(map[string][]time.Time)
+		q.overQuota = make(map[string]int)
+	}
+	q.learned[user] = append(q.learned[user], now)
+}
+
+// skipped returns how many of user's messages were over the quota
+func (q *learnQuota) skipped(user string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.overQuota[strings.ToLower(user)]
+}
+
+// overQuota reports whether username has used up the channel's learning
+// quota. Only messages that are learned count against it (see chargeQuota),
+// so spam the dampener drops doesn't use it up.
+func (b *Brain) overQuota(username string) bool {
+	max := b.cfg.GetChannelLearnQuota(b.Channel)
+	return max > 0 && b.quota.full(username, max, time.Now())
+}
+
+// chargeQuota counts a message from username that is being learned against
+// the channel's learning quota
+func (b *Brain) chargeQuota(username string) {
+	if b.cfg.GetChannelLearnQuota(b.Channel) > 0 {
+		b.quota.charge(username, time.Now())
+	}
+}
+
+// ChatterShare is how much of a brain's recent learning came from one chatter
+type ChatterShare struct {
+	UserID      string  `json:"user_id"`
+	Username    string  `json:"username"`
+	Messages    int     `json:"messages"`    // Messages learned among the recent ones
+	Share       float64 `json:"share"`       // Messages as a share of all recent ones
+	Transitions int     `json:"transitions"` // Transitions contributed in all, if the user ID is known
+	OverQuota   int     `json:"over_quota"`  // Messages not learned for being over the quota since the brain was opened
+}
+
+// ChatterReport lists the chatters most represented in a brain's recent
+// learning (the last originalityWindow messages)
+type ChatterReport struct {
+	Channel        string         `json:"channel"`
+	Quota          int            `json:"quota"`        // Messages per chatter per quota window (0 = no quota)
+	QuotaWindow    int            `json:"quota_window"` // Minutes
+	RecentMessages int            `json:"recent_messages"`
+	Chatters       []ChatterShare `json:"chatters"` // Most messages first
+}
+
+// TopChatters returns the limit chatters with the most recently learned
+// messages. Messages learned without a chatter (imports, merges) count
+// towards the total but aren't listed.
+func (b *Brain) TopChatters(limit int) ChatterReport {
+	report := ChatterReport{
+		Channel:     b.Channel,
+		Quota:       b.cfg.GetChannelLearnQuota(b.Channel),
+		QuotaWindow: int(learnQuotaWindow / time.Minute),
+		Chatters:    []ChatterShare{},
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.db == nil {
+		return report
+	}
+
+	b.db.QueryRow(`SELECT COUNT(*) FROM recent_messages`).Scan(&report.RecentMessages)
+	rows, err := b.db.Query(`
+		SELECT MAX(user_id), MAX(username), COUNT(*) AS messages FROM recent_messages
+		WHERE user_id != '' OR username != ''
+		GROUP BY CASE WHEN user_id != '' THEN user_id ELSE lower(username) END
+		ORDER BY messages DESC LIMIT ?
+	`, limit)
+	if err != nil {
+		return report
+	}
+	for rows.Next() {
+		var c ChatterShare
+		if rows.Scan(&c.UserID, &c.Username, &c.Messages) == nil {
+			c.Share = float64(c.Messages) / float64(report.RecentMessages)
+			report.Chatters = append(report.Chatters, c)
+		}
+	}
+	rows.Close()
+
+	for i := range report.Chatters {
+		c := &report.Chatters[i]
+		if c.UserID != "" {
+			b.db.QueryRow(`SELECT COALESCE(SUM(count), 0) FROM contributions WHERE user_id = ?`, c.UserID).Scan(&c.Transitions)
+		}
+		if c.Username != "" {
+			c.OverQuota = b.quota.skipped(c.Username)
+		}
+	}
+	return report
+}
@@ -0,0 +1,325 @@
+package markov
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"twitchbot/internal/config"
+)
+
+// lookalikes maps leetspeak digits and symbols, look-alike letters from other
+// scripts and accented letters to the plain letter they stand in for
+var lookalikes = map[rune]rune{
+	// Leetspeak
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '9': 'g',
+	'@': 'a', '$': 's', '!': 'i', '|': 'l', '+': 't', '€': 'e', '£': 'l',
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p',
+	'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ї': 'i', 'ј': 'j', 'ѕ': 's',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x',
+	// Accented Latin
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a', 'ç': 'c', 'è': 'e', 'é': 'e',
+	'ê': 'e', 'ë': 'e', 'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i', 'ñ': 'n', 'ò': 'o', 'ó': 'o',
+	'ô': 'o', 'õ': 'o', 'ö': 'o', 'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u', 'ý': 'y', 'ÿ': 'y',
+}
+
+// foldRunes maps look-alike characters to plain letters and collapses runs of
+// the same letter, so "ѕh1iit" and "shit" fold to the same string. Text must
+// already be lowercase.
+func foldRunes(text string) string {
+	var sb strings.Builder
+	var last rune
+	for _, r := range text {
+		if r >= 0xFF01 && r <= 0xFF5E { // Fullwidth ASCII
+			r -= 0xFEE0
+			if r >= 'A' && r <= 'Z' {
+				r += 'a' - 'A'
+			}
+		}
+		if plain, ok := lookalikes[r]; ok {
+			r = plain
+		}
+		if r == last {
+			continue
+		}
+		sb.WriteRune(r)
+		last = r
+	}
+	return sb.String()
+}
+
+// filterWord returns a word as filter rules see it: lowercased with its
+// surrounding punctuation stripped and, if fold is set, folded (see foldRunes)
+func filterWord(word string, fold bool) string {
+	word = stripWordPunctuation(strings.ToLower(word))
+	if fold {
+		word = foldRunes(word)
+	}
+	return word
+}
+
+// filterText is a message split into words as filter rules see them, both
+// plain and folded. Emote codes are kept whole.
+type filterText struct {
+	plain, folded         []string
+	plainText, foldedText string
+}
+
+// newFilterText prepares a message's words for matching against filter rules
+func newFilterText(words []string, emotes map[string]string) filterText {
+	t := filterText{plain: make([]string, len(words)), folded: make([]string, len(words))}
+	for i, w := range words {
+		if _, ok := emotes[w]; ok {
+			t.plain[i] = strings.ToLower(w)
+			t.folded[i] = t.plain[i]
+			continue
+		}
+		t.plain[i] = filterWord(w, false)
+		t.folded[i] = filterWord(w, true)
+	}
+	t.plainText = strings.Join(t.plain, " ")
+	t.foldedText = strings.Join(t.folded, " ")
+	return t
+}
+
+// ruleMatcher is a compiled filter rule
+type ruleMatcher struct {
+	rule   config.FilterRule
+	phrase []string       // Word rules: the phrase's words as seen by the rule
+	re     *regexp.Regexp // Glob rules: matches one word; regex rules: matches the text
+}
+
+// ruleCache holds compiled filter rules by rule ID. Rules are only ever added
+// or removed, never edited, so a rule ID always compiles the same way; rules
+// that have been removed are dropped from the cache (see rulesWithActions).
+var ruleCache struct {
+	sync.Mutex
+	matchers map[int64]*ruleMatcher // nil for rules with an invalid pattern
+}
+
+// compileRule compiles a filter rule, or returns nil if its pattern is invalid
+func compileRule(rule config.FilterRule) *ruleMatcher {
+	m := &ruleMatcher{rule: rule}
+	switch rule.Kind {
+	case config.FilterKindWord:
+		for _, w := range strings.Fields(rule.Pattern) {
+			if w = filterWord(w, rule.Normalize); w != "" {
+				m.phrase = append(m.phrase, w)
+			}
+		}
+		if len(m.phrase) == 0 {
+			return nil
+		}
+	case config.FilterKindGlob:
+		// Fold the literal parts around the wildcards
+		var sb strings.Builder
+		sb.WriteString("^")
+		literal := func(s string) {
+			s = strings.ToLower(s)
+			if rule.Normalize {
+				s = foldRunes(s)
+			}
+			sb.WriteString(regexp.QuoteMeta(s))
+		}
+		start := 0
+		for i, r := range rule.Pattern {
+			if r == '*' || r == '?' {
+				literal(rule.Pattern[start:i])
+				if r == '*' {
+					sb.WriteString(".*")
+				} else {
+					sb.WriteString(".")
+				}
+				start = i + 1
+			}
+		}
+		literal(rule.Pattern[start:])
+		sb.WriteString("$")
+		m.re = regexp.MustCompile(sb.String())
+	case config.FilterKindRegex:
+		re, err := regexp.Compile("(?i)" + rule.Pattern)
+		if err != nil {
+			return nil
+		}
+		m.re = re
+	default:
+		return nil
+	}
+	return m
+}
+
+// spans returns the word ranges [start, end) of a text that the rule matches
+func (m *ruleMatcher) spans(t filterText) [][2]int {
+	words, text := t.plain, t.plainText
+	if m.rule.Normalize {
+		words, text = t.folded, t.foldedText
+	}
+
+	var spans [][2]int
+	switch m.rule.Kind {
+	case config.FilterKindWord:
+		for i := 0; i+len(m.phrase) <= len(words); i++ {
+			if containsRun(words[i:i+len(m.phrase)], m.phrase) {
+				spans = append(spans, [2]int{i, i + len(m.phrase)})
+			}
+		}
+	case config.FilterKindGlob:
+		for i, w := range words {
+			if w != "" && m.re.MatchString(w) {
+				spans = append(spans, [2]int{i, i + 1})
+			}
+		}
+	case config.FilterKindRegex:
+		// Map byte offsets in the joined text back to words
+		for _, loc := range m.re.FindAllStringIndex(text, -1) {
+			if loc[0] == loc[1] {
+				continue
+			}
+			span := [2]int{-1, -1}
+			offset := 0
+			for i, w := range words {
+				end := offset + len(w)
+				if loc[0] < end && loc[1] > offset {
+					if span[0] < 0 {
+						span[0] = i
+					}
+					span[1] = i + 1
+				}
+				offset = end + 1
+			}
+			if span[0] >= 0 {
+				spans = append(spans, span)
+			}
+		}
+	}
+	return spans
+}
+
+// rulesWithActions returns the compiled filter rules with any of the given actions
+func (b *Brain) rulesWithActions(actions ...string) []*ruleMatcher {
+	rules := b.cfg.GetFilterRules()
+
+	ruleCache.Lock()
+	defer ruleCache.Unlock()
+	if ruleCache.matchers == nil {
+		ruleCache.matchers = make(map[int64]*ruleMatcher)
+	}
+	// Drop the rules that have been removed
+	if len(ruleCache.matchers) > len(rules) {
+		current := make(map[int64]bool, len(rules))
+		for _, rule := range rules {
+			current[rule.ID] = true
+		}
+		for id := range ruleCache.matchers {
+			if !current[id] {
+				delete(ruleCache.matchers, id)
+			}
+		}
+	}
+
+	var matchers []*ruleMatcher
+	for _, rule := range rules {
+		for _, action := range actions {
+			if rule.Action == action {
+				m, ok := ruleCache.matchers[rule.ID]
+				if !ok {
+					m = compileRule(rule)
+					ruleCache.matchers[rule.ID] = m
+				}
+				if m != nil {
+					matchers = append(matchers, m)
+				}
+				break
+			}
+		}
+	}
+	return matchers
+}
+
+// matchesRules reports whether a message matches any filter rule with one of
+// the given actions. Emote codes in emotes are matched whole.
+func (b *Brain) matchesRules(message string, emotes map[string]string, actions ...string) bool {
+	matchers := b.rulesWithActions(actions...)
+	if len(matchers) == 0 {
+		return false
+	}
+	t := newFilterText(strings.Fields(message), emotes)
+	for _, m := range matchers {
+		if len(m.spans(t)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// maskRules replaces the words of a message matched by mask rules with asterisks
+func (b *Brain) maskRules(message string, emotes map[string]string) string {
+	matchers := b.rulesWithActions(config.FilterMask)
+	if len(matchers) == 0 {
+		return message
+	}
+	words := strings.Fields(message)
+	t := newFilterText(words, emotes)
+	masked := false
+	for _, m := range matchers {
+		for _, span := range m.spans(t) {
+			for i := span[0]; i < span[1]; i++ {
+				words[i] = strings.Repeat("*", utf8.RuneCountInString(words[i]))
+				masked = true
+			}
+		}
+	}
+	if !masked {
+		return message
+	}
+	return strings.Join(words, " ")
+}
+
+// cleanRules removes transitions matched by filter rules that block learning,
+// adding the number of rows removed per rule pattern to removed. Boundary
+// tokens are left out of the words a transition is matched on. Must be called
+// with the write lock held.
+func (b *Brain) cleanRules(matchers []*ruleMatcher, removed map[string]int) {
+	rows, err := b.db.Query(`SELECT rowid, word1, word2, next_word FROM transitions`)
+	if err != nil {
+		return
+	}
+
+	type match struct {
+		rowid   int64
+		pattern string
+	}
+	var matches []match
+
+	for rows.Next() {
+		var rowid int64
+		var word1, word2, nextWord string
+		if err := rows.Scan(&rowid, &word1, &word2, &nextWord); err != nil {
+			continue
+		}
+		var words []string
+		for _, w := range append(splitState(word1, word2), nextWord) {
+			if !isBoundary(w) {
+				words = append(words, w)
+			}
+		}
+		t := newFilterText(words, nil)
+		for _, m := range matchers {
+			if len(m.spans(t)) > 0 {
+				matches = append(matches, match{rowid, m.rule.Pattern})
+				break
+			}
+		}
+	}
+	rows.Close()
+
+	for _, m := range matches {
+		if _, err := b.db.Exec(`DELETE FROM transitions WHERE rowid = ?`, m.rowid); err == nil {
+			removed[m.pattern]++
+		}
+	}
+}
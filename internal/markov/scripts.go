@@ -0,0 +1,87 @@
+package markov
+
+import (
+	"unicode"
+
+	"twitchbot/internal/config"
+)
+
+// Extra ranges that go with a script set but belong to Unicode's shared
+// "Common" script, so aren't in the script's own table
+var (
+	// Latin-1 Supplement letters (plus × and ÷), the original accent allowance
+	latin1Letters = &unicode.RangeTable{
+		R16:         []unicode.Range16{{Lo: 0x00C0, Hi: 0x00FF, Stride: 1}},
+		LatinOffset: 1,
+	}
+	// Latin-1 punctuation (¡ ¿ « » °) and General Punctuation (smart quotes, dashes)
+	latinPunctuation = &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{Lo: 0x00A0, Hi: 0x00BF, Stride: 1},
+			{Lo: 0x2010, Hi: 0x205E, Stride: 1},
+		},
+		LatinOffset: 1,
+	}
+	// CJK Symbols and Punctuation (、。「」), the kana prolonged sound mark and
+	// halfwidth/fullwidth forms
+	cjkPunctuation = &unicode.RangeTable{
+		R16: []unicode.Range16{
+			{Lo: 0x3000, Hi: 0x303F, Stride: 1},
+			{Lo: 0x30FC, Hi: 0x30FC, Stride: 1},
+			{Lo: 0xFF00, Hi: 0xFFEF, Stride: 1},
+		},
+	}
+)
+
+// scriptTables maps each script set to the Unicode ranges it allows
+var scriptTables = map[string][]*unicode.RangeTable{
+	config.ScriptLatin:         {latin1Letters},
+	config.ScriptLatinExtended: {unicode.Latin, unicode.Inherited, latinPunctuation},
+	config.ScriptCyrillic:      {unicode.Cyrillic, unicode.Inherited},
+	config.ScriptGreek:         {unicode.Greek, unicode.Inherited},
+	config.ScriptCJK:           {unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul, unicode.Bopomofo, cjkPunctuation},
+	config.ScriptArabic:        {unicode.Arabic, unicode.Inherited},
+	config.ScriptHebrew:        {unicode.Hebrew, unicode.Inherited},
+	config.ScriptThai:          {unicode.Thai},
+	config.ScriptDevanagari:    {unicode.Devanagari, unicode.Inherited},
+}
+
+// scriptChecker reports whether a word is written only in a set of scripts
+type scriptChecker struct {
+	any    bool
+	tables []*unicode.RangeTable
+}
+
+// newScriptChecker builds a checker for the given script sets
+func newScriptChecker(scripts []string) scriptChecker {
+	var c scriptChecker
+	for _, s := range scripts {
+		if s == config.ScriptAny {
+			c.any = true
+		}
+		c.tables = append(c.tables, scriptTables[s]...)
+	}
+	return c
+}
+
+// allowed reports whether every character of text is ASCII, emoji or in one
+// of the checker's scripts
+func (c scriptChecker) allowed(text string) bool {
+	if c.any {
+		return true
+	}
+	for _, r := range text {
+		if r <= 127 || isEmoji(r) {
+			continue
+		}
+		if !unicode.IsOneOf(c.tables, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// scripts returns the checker for the brain's channel's allowed scripts
+func (b *Brain) scripts() scriptChecker {
+	return newScriptChecker(b.cfg.GetChannelAllowedScripts(b.Channel))
+}
@@ -0,0 +1,129 @@
+package markov
+
+import (
+	"math/rand"
+	"strings"
+	"unicode"
+)
+
+// recentMessages is how many learned chat lines a brain keeps for picking reply seeds
+const recentMessages = 5
+
+// stopWords are common words that make poor reply seeds: building a sentence
+// through "the" or "lol" doesn't make a reply feel connected to the chat.
+var stopWords = map[string]bool{
+	"the": true, "and": true, "but": true, "for": true, "you": true, "your": true,
+	"are": true, "was": true, "were": true, "with": true, "this": true, "that": true,
+	"have": true, "has": true, "had": true, "not": true, "just": true, "what": true,
+	"how": true, "why": true, "who": true, "when": true, "where": true, "its": true,
+	"it's": true, "i'm": true, "im": true, "can": true, "get": true, "got": true,
+	"all": true, "out": true, "they": true, "them": true, "there": true, "then": true,
+	"than": true, "from": true, "like": true, "about": true, "would": true, "could": true,
+	"should": true, "will": true, "dont": true, "don't": true, "yes": true, "yeah": true,
+	"lol": true, "lmao": true, "omg": true, "too": true, "very": true, "really": true,
+	"also": true, "some": true, "one": true, "now": true, "here": true, "been": true,
+	"his": true, "her": true, "she": true, "him": true, "our": true, "off": true,
+}
+
+// rememberRecent records a learned message for later seed selection
+func (b *Brain) rememberRecent(message string) {
+	b.chatMu.Lock()
+	defer b.chatMu.Unlock()
+	b.recent = append(b.recent, message)
+	if len(b.recent) > recentMessages {
+		b.recent = b.recent[len(b.recent)-recentMessages:]
+	}
+}
+
+// seedWords returns candidate reply seeds: content words from the triggering
+// message in random order, followed by content words from the last few chat
+// lines. Words are returned as they appeared in chat, since that is how the
+// brain stores them.
+func (b *Brain) seedWords(message string) []string {
+	b.chatMu.Lock()
+	recent := append([]string(nil), b.recent...)
+	b.chatMu.Unlock()
+
+	seen := make(map[string]bool)
+	seeds := contentWords(message, seen)
+	var older []string
+	for i := len(recent) - 1; i >= 0; i-- {
+		older = append(older, contentWords(recent[i], seen)...)
+	}
+	return append(seeds, older...)
+}
+
+// contentWords returns the shuffled content words of a message that are not yet in seen
+func contentWords(message string, seen map[string]bool) []string {
+	var words []string
+	for _, w := range strings.Fields(message) {
+		stripped := strings.ToLower(stripWordPunctuation(w))
+		if seen[w] || isBoundary(w) || strings.HasPrefix(w, "@") {
+			continue
+		}
+		if len([]rune(stripped)) < 3 || stopWords[stripped] || strings.IndexFunc(stripped, unicode.IsLetter) < 0 {
+			continue
+		}
+		seen[w] = true
+		words = append(words, w)
+	}
+	rand.Shuffle(len(words), func(i, j int) { words[i], words[j] = words[j], words[i] })
+	return words
+}
+
+// predecessorLookup returns the possible words before a chain state and their
+// weights; it is the reverse of candidateLookup
+type predecessorLookup func(state []string) (candidates []string, weights []int)
+
+// walkBackward extends a word sequence at the front by up to maxWords words,
+// using its first order words as the chain state and stopping early at a dead
+// end or a learned message opening.
+func walkBackward(start []string, order, maxWords int, lookup predecessorLookup, pick sampler, trace *Trace) []string {
+	result := append([]string(nil), start...)
+
+	for i := 0; i < maxWords && result[0] != startToken; i++ {
+		state := result[:order]
+		candidates, weights := lookup(state)
+		if len(candidates) == 0 {
+			break
+		}
+		idx, p := pick.choose(weights)
+		trace.pick(TraceBackward, state, candidates, weights, idx, p)
+		result = append([]string{candidates[idx]}, result...)
+	}
+
+	return result
+}
+
+// seededChain builds a sentence through a seed sequence of order+1 words (a
+// learned context plus the seed word that followed it), generating backward
+// to a message opening and forward to a message ending.
+func seededChain(seq []string, maxWords int, forward candidateLookup, backward predecessorLookup, pick sampler, trace *Trace) []string {
+	order := len(seq) - 1
+	trace.state(TraceSeed, seq)
+	result := walkBackward(seq[:order], order, maxWords/2, backward, pick, trace)
+	result = append(result, seq[order])
+
+	generated := len(result) - len(seq)
+	return walkChain(result, order, maxWords-generated, forward, pick, trace)
+}
+
+// predecessorQuery returns the column holding the predecessor word and the
+// condition (with its arguments) matching the transitions that precede a chain
+// state. A transition (c0 .. ck-1 -> next) precedes state s when c1 .. ck-1 +
+// next equals s, so the condition matches next_word and word2 through the
+// idx_next_word_word2 reverse index and checks the rest of the packed word1
+// column; c0 is the predecessor.
+func predecessorQuery(state []string) (column, where string, args []interface{}) {
+	order := len(state)
+	switch order {
+	case 1:
+		return "word2", "next_word = ? AND word1 = ''", []interface{}{state[0]}
+	case 2:
+		return "word1", "next_word = ? AND word2 = ? AND " + orderCondition(2), []interface{}{state[1], state[0]}
+	default:
+		return "substr(word1, 1, instr(word1, ' ') - 1)",
+			"next_word = ? AND word2 = ? AND " + orderCondition(order) + " AND substr(word1, instr(word1, ' ') + 1) = ?",
+			[]interface{}{state[order-1], state[order-2], strings.Join(state[:order-2], " ")}
+	}
+}
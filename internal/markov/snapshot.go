@@ -0,0 +1,430 @@
+package markov
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+
+	"twitchbot/internal/database"
+)
+
+// snapshotCheckInterval is how often the background job looks for brains
+// whose scheduled snapshot is due
+const snapshotCheckInterval = time.Hour
+
+// Snapshot kinds
+const (
+	SnapshotManual     = "manual"      // Taken on demand; kept until deleted
+	SnapshotScheduled  = "scheduled"   // Taken by the snapshot job
+	SnapshotPreRestore = "pre-restore" // The brain as it was before a restore, so the restore can be undone
+)
+
+// snapshotTimeFormat is the timestamp a snapshot ID starts with. IDs sort in
+// the order the snapshots were taken.
+const snapshotTimeFormat = "20060102-150405.000"
+
+// snapshotIDPattern matches snapshot IDs: the time taken and the kind
+var snapshotIDPattern = regexp.MustCompile(`^(\d{8}-\d{6}\.\d{3})-(manual|scheduled|pre-restore)$`)
+
+// Snapshot describes a point-in-time copy of a brain database
+type Snapshot struct {
+	ID        string    `json:"id"`
+	Channel   string    `json:"channel"`
+	Kind      string    `json:"kind"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+// snapshotDir is the directory a channel's snapshots are kept in
+func snapshotDir(channel string) string {
+	return filepath.Join(database.GetDataDir(), "brains", "snapshots", strings.ToLower(channel))
+}
+
+// snapshotPath returns the file of a channel's snapshot, or an error if the ID
+// isn't a valid snapshot ID
+func snapshotPath(channel, id string) (string, error) {
+	if !snapshotIDPattern.MatchString(id) {
+		return "", fmt.Errorf("invalid snapshot ID %q", id)
+	}
+	return filepath.Join(snapshotDir(channel), id+".db"), nil
+}
+
+// backup copies the brain's database into a new database file at path using
+// SQLite's online backup, so chat can keep being learned while it runs
+func (b *Brain) backup(path string) error {
+	b.Flush()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.db == nil {
+		return fmt.Errorf("brain for %s is closed", b.Channel)
+	}
+	conn, err := b.db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		src, ok := driverConn.(interface {
+			NewBackup(dstURI string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return fmt.Errorf("database driver does not support online backup")
+		}
+		bk, err := src.NewBackup(path)
+		if err != nil {
+			return err
+		}
+		_, stepErr := bk.Step(-1)
+		if err := bk.Finish(); stepErr == nil {
+			stepErr = err
+		}
+		return stepErr
+	})
+}
+
+// SnapshotBrain takes a snapshot of a channel's brain
+func (m *Manager) SnapshotBrain(channel, kind string) (Snapshot, error) {
+	channel = strings.ToLower(channel)
+	brain := m.GetBrain(channel)
+	if brain == nil {
+		return Snapshot{}, fmt.Errorf("failed to load brain for %s", channel)
+	}
+
+	dir := snapshotDir(channel)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Snapshot{}, err
+	}
+	now := time.Now()
+	id := now.Format(snapshotTimeFormat) + "-" + kind
+	path, err := snapshotPath(channel, id)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	// Back up under a temporary name so a partial snapshot is never listed
+	tmpPath := path + ".tmp"
+	if err := brain.backup(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return Snapshot{}, fmt.Errorf("failed to snapshot brain for %s: %w", channel, err)
+	}
+	if err := stampSnapshotOrder(tmpPath, m.cfg.GetChannelMarkovOrder(channel)); err != nil {
+		os.Remove(tmpPath)
+		return Snapshot{}, fmt.Errorf("failed to snapshot brain for %s: %w", channel, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return Snapshot{}, err
+	}
+
+	snapshot := Snapshot{ID: id, Channel: channel, Kind: kind, CreatedAt: now}
+	if info, err := os.Stat(path); err == nil {
+		snapshot.Size = info.Size()
+	}
+	log.Printf("[%s] Took %s brain snapshot %s", channel, kind, id)
+	return snapshot, nil
+}
+
+// ListSnapshots returns a channel's brain snapshots, newest first. Snapshots
+// outlive the brain, so a deleted brain can be restored.
+func (m *Manager) ListSnapshots(channel string) []Snapshot {
+	channel = strings.ToLower(channel)
+	snapshots := []Snapshot{}
+
+	entries, err := os.ReadDir(snapshotDir(channel))
+	if err != nil {
+		return snapshots
+	}
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".db")
+		match := snapshotIDPattern.FindStringSubmatch(id)
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".db") || match == nil {
+			continue
+		}
+		createdAt, err := time.ParseInLocation(snapshotTimeFormat, match[1], time.Local)
+		if err != nil {
+			continue
+		}
+		snapshot := Snapshot{ID: id, Channel: channel, Kind: match[2], CreatedAt: createdAt}
+		if info, err := entry.Info(); err == nil {
+			snapshot.Size = info.Size()
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID > snapshots[j].ID })
+	return snapshots
+}
+
+// DeleteSnapshot deletes one of a channel's brain snapshots
+func (m *Manager) DeleteSnapshot(channel, id string) error {
+	path, err := snapshotPath(channel, id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("snapshot %s not found", id)
+		}
+		return err
+	}
+	return nil
+}
+
+// ErrSnapshotOrderMismatch is returned by RestoreSnapshot when the snapshot
+// was taken at another Markov order than the channel's and the restore wasn't
+// confirmed
+var ErrSnapshotOrderMismatch = errors.New("snapshot was taken at another Markov order")
+
+// stampSnapshotOrder records the channel's Markov order in a snapshot file, so
+// a restore can tell whether the snapshot's transitions are the ones in use
+func stampSnapshotOrder(path string, order int) error {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(`
+		INSERT INTO state (key, value) VALUES ('markov_order', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, order)
+	return err
+}
+
+// snapshotOrder returns the Markov order a snapshot was taken at. Snapshots
+// from before the order was recorded report the order most of their
+// transitions were learned at, or 0 if they have none.
+func snapshotOrder(path string) (int, error) {
+	db, err := openReadOnly(path, "")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var order int
+	err = db.QueryRow(`SELECT value FROM state WHERE key = 'markov_order'`).Scan(&order)
+	if err == sql.ErrNoRows {
+		err = db.QueryRow(`
+			SELECT CASE WHEN word1 = '' THEN 1 ELSE length(word1) - length(replace(word1, ' ', '')) + 2 END AS ord
+			FROM transitions GROUP BY ord ORDER BY COUNT(*) DESC LIMIT 1
+		`).Scan(&order)
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+	}
+	return order, err
+}
+
+// RestoreSnapshot rolls a channel's brain back to a snapshot. The current
+// brain is snapshotted first and that snapshot is returned, so the restore can
+// itself be undone. Users forgotten since the snapshot was taken are forgotten
+// again in the restored copy before it's used, so a rollback never brings
+// their data back. A snapshot taken at another Markov order than the
+// channel's is refused with ErrSnapshotOrderMismatch unless confirm is set,
+// since its transitions would go unused. The brain is unloaded while its
+// database file is swapped for the restored copy, and is loaded again from it
+// on next use. Anything holding the old *Brain must fetch it again with
+// GetBrain.
+func (m *Manager) RestoreSnapshot(channel, id string, confirm bool) (Snapshot, error) {
+	channel = strings.ToLower(channel)
+	src, err := snapshotPath(channel, id)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if _, err := os.Stat(src); err != nil {
+		return Snapshot{}, fmt.Errorf("snapshot %s not found", id)
+	}
+	takenAt, err := time.ParseInLocation(snapshotTimeFormat, snapshotIDPattern.FindStringSubmatch(id)[1], time.Local)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("invalid snapshot ID %q", id)
+	}
+
+	order, err := snapshotOrder(src)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to read snapshot %s: %w", id, err)
+	}
+	if current := m.cfg.GetChannelMarkovOrder(channel); order != 0 && order != current && !confirm {
+		return Snapshot{}, fmt.Errorf("%w: order %d, while %s is at order %d, so its transitions won't be used until the order is changed back",
+			ErrSnapshotOrderMismatch, order, channel, current)
+	}
+
+	undo, err := m.SnapshotBrain(channel, SnapshotPreRestore)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	// Prepare the restored file before unloading the brain
+	dbPath := filepath.Join(database.GetDataDir(), "brains", channel+".db")
+	tmpPath := dbPath + ".restore"
+	if err := copyFile(src, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return undo, fmt.Errorf("failed to restore snapshot %s: %w", id, err)
+	}
+	if err := forgetAgain(tmpPath, m.cfg.GetUsersForgottenSince(takenAt)); err != nil {
+		os.Remove(tmpPath)
+		return undo, fmt.Errorf("failed to restore snapshot %s: %w", id, err)
+	}
+
+	// Keep GetBrain from opening the file until the swap is done, waiting for
+	// an evicted brain that's still closing like GetBrain does
+	m.mu.Lock()
+	for {
+		done, closing := m.closing[channel]
+		if !closing {
+			break
+		}
+		m.mu.Unlock()
+		<-done
+		m.mu.Lock()
+	}
+	brain := m.takeBrain(channel)
+	if brain == nil {
+		m.closing[channel] = make(chan struct{})
+	}
+	m.mu.Unlock()
+
+	if brain != nil {
+		if err := brain.Close(); err != nil {
+			log.Printf("[%s] Error closing brain for restore: %v", channel, err)
+		}
+	}
+	// The old WAL belongs to the old file
+	os.Remove(dbPath + "-wal")
+	os.Remove(dbPath + "-shm")
+	err = os.Rename(tmpPath, dbPath)
+
+	m.mu.Lock()
+	delete(m.closed, channel)
+	m.listCache = nil
+	close(m.closing[channel])
+	delete(m.closing, channel)
+	m.mu.Unlock()
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return undo, fmt.Errorf("failed to restore snapshot %s: %w", id, err)
+	}
+	log.Printf("[%s] Restored brain snapshot %s", channel, id)
+
+	m.reindexGlobal(channel)
+	m.pruneSnapshots(channel, m.cfg.GetSnapshotPolicy().Keep)
+	return undo, nil
+}
+
+// copyFile copies src to a new file at dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// forgetAgain forgets users in a brain database file that isn't loaded
+func forgetAgain(path string, userIDs []string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, userID := range userIDs {
+		if _, _, err := forgetInDB(db, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneSnapshots deletes all but the newest keep scheduled and pre-restore
+// snapshots of each kind for a channel. Manual snapshots are never pruned.
+func (m *Manager) pruneSnapshots(channel string, keep int) {
+	kept := make(map[string]int)
+	for _, snapshot := range m.ListSnapshots(channel) {
+		if snapshot.Kind == SnapshotManual {
+			continue
+		}
+		kept[snapshot.Kind]++
+		if kept[snapshot.Kind] <= keep {
+			continue
+		}
+		if err := m.DeleteSnapshot(channel, snapshot.ID); err != nil {
+			log.Printf("[%s] Failed to prune brain snapshot %s: %v", channel, snapshot.ID, err)
+		}
+	}
+}
+
+// StartSnapshotJob starts the background job that snapshots every brain once
+// per the snapshot policy's interval and prunes old snapshots. The job stops
+// when the manager is closed; calling this again is a no-op.
+func (m *Manager) StartSnapshotJob() {
+	m.snapshotOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(snapshotCheckInterval)
+			defer ticker.Stop()
+
+			for {
+				m.runDueSnapshots()
+				select {
+				case <-m.stopChan:
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	})
+}
+
+// runDueSnapshots snapshots every brain whose last scheduled snapshot is
+// older than the policy's interval
+func (m *Manager) runDueSnapshots() {
+	policy := m.cfg.GetSnapshotPolicy()
+	if !policy.Enabled {
+		return
+	}
+	// Allow for the time taken snapshotting each round, which would otherwise
+	// push every snapshot back by a check interval
+	interval := time.Duration(policy.IntervalHours)*time.Hour - snapshotCheckInterval/2
+
+	for _, stat := range m.ListBrains() {
+		due := true
+		for _, snapshot := range m.ListSnapshots(stat.Channel) {
+			if snapshot.Kind == SnapshotScheduled {
+				due = time.Since(snapshot.CreatedAt) >= interval
+				break
+			}
+		}
+		if !due {
+			continue
+		}
+		if _, err := m.SnapshotBrain(stat.Channel, SnapshotScheduled); err != nil {
+			log.Printf("[%s] Scheduled snapshot failed: %v", stat.Channel, err)
+			continue
+		}
+		m.pruneSnapshots(stat.Channel, policy.Keep)
+	}
+}
@@ -0,0 +1,329 @@
+package markov
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+
+	"twitchbot/internal/config"
+)
+
+// TransitionStore is how a brain keeps its Markov transitions. Stores take
+// and return plain values, so a backend doesn't have to be database/sql: the
+// SQLite store keeps everything in the brain's database file, and the memory
+// store either caches that file or, on its own, keeps transitions in memory
+// only (see memoryStore). Bulk maintenance (decay, cleaning, forgetting,
+// merging, importing) and analytics work on the brain file directly and then
+// call transitionsChanged so a caching store reloads.
+type TransitionStore interface {
+	// Learn writes one flush of the learning queue, all of it or nothing
+	Learn(batch LearnBatch) error
+	// Next returns the words learned after a state and their counts
+	Next(word1, word2 string) (candidates []string, weights []int)
+	// Previous returns the words learned before a chain state and their
+	// counts (see predecessorQuery)
+	Previous(state []string) (candidates []string, weights []int)
+	// SeedState returns a random learned state at the given order that was
+	// followed by word, together with word, or nil if there is none
+	SeedState(order int, word string) []string
+	// RandomStart returns a random learned state at the given order, or nil
+	// if there are none
+	RandomStart(order int) []string
+	// Page returns a page of transitions, most common first, optionally only
+	// those with search in one of their words, and how many there are in all
+	Page(search string, page, pageSize int) (transitions []Transition, total int)
+	// Delete removes a transition, with any per-chatter contributions to it
+	Delete(word1, word2, nextWord string) error
+	// SetCount sets a transition's count
+	SetCount(word1, word2, nextWord string, count int) error
+	// Stats returns the number of distinct states and of transitions
+	Stats() (uniquePairs, totalEntries int)
+}
+
+// LearnBatch is what one flush of the learning queue writes to a store
+type LearnBatch struct {
+	Transitions   []Transition    // Counts to add to the brain's transitions
+	Contributions []Contribution  // The same counts by chatter, so they can be forgotten
+	Messages      []RecentMessage // The learned messages, for the originality check
+	SeenAt        int64           // When the batch was learned (unix seconds)
+	Counter       int             // The brain's message counter, persisted with the batch
+}
+
+// Contribution is how many times a chatter taught the brain a transition
+type Contribution struct {
+	UserID   string
+	Word1    string
+	Word2    string
+	NextWord string
+	Count    int
+}
+
+// RecentMessage is a learned message kept for the originality check
+type RecentMessage struct {
+	UserID   string
+	Username string
+	Message  string
+}
+
+// reloader is implemented by stores that cache the transitions table and
+// must reload it after the table is changed other than through the store
+type reloader interface {
+	reload() error
+}
+
+// openStore opens the transition store a channel is configured for on top of
+// its brain database
+func openStore(storage string, db *sql.DB) (TransitionStore, error) {
+	store := &sqliteStore{db: db}
+	if storage == config.StorageMemory {
+		return newCachingStore(store)
+	}
+	return store, nil
+}
+
+// transitionsChanged drops what's cached about the brain's transitions after
+// they were changed other than through the store. Must be called with the
+// write lock held.
+func (b *Brain) transitionsChanged() {
+	b.statsCache = nil
+	b.analytics = nil
+	if r, ok := b.store.(reloader); ok {
+		if err := r.reload(); err != nil {
+			log.Printf("[%s] Failed to reload transitions into memory: %v", b.Channel, err)
+		}
+	}
+}
+
+// sqliteStore keeps transitions in the transitions table of a brain database
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// Learn writes the batch in one transaction. Recent messages beyond
+// originalityWindow are dropped as new ones are added.
+func (s *sqliteStore) Learn(batch LearnBatch) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	contribStmt, err := tx.Prepare(`
+		INSERT INTO contributions (user_id, word1, word2, next_word, count)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, word1, word2, next_word) DO UPDATE SET count = count + excluded.count
+	`)
+	if err != nil {
+		return err
+	}
+	defer contribStmt.Close()
+	for _, c := range batch.Contributions {
+		if _, err := contribStmt.Exec(c.UserID, c.Word1, c.Word2, c.NextWord, c.Count); err != nil {
+			return err
+		}
+	}
+
+	recentStmt, err := tx.Prepare(`INSERT INTO recent_messages (user_id, username, message) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer recentStmt.Close()
+	for _, msg := range batch.Messages {
+		if _, err := recentStmt.Exec(msg.UserID, msg.Username, msg.Message); err != nil {
+			return err
+		}
+	}
+	// Keep only the newest messages for the originality check
+	if _, err := tx.Exec(`DELETE FROM recent_messages WHERE id <= (SELECT MAX(id) FROM recent_messages) - ?`, originalityWindow); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO state (key, value) VALUES ('msg_counter', ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, batch.Counter); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO transitions (word1, word2, next_word, count, last_seen)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(word1, word2, next_word) DO UPDATE SET count = count + excluded.count, last_seen = excluded.last_seen
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, t := range batch.Transitions {
+		if _, err := stmt.Exec(t.Word1, t.Word2, t.NextWord, t.Count, batch.SeenAt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Next(word1, word2 string) (candidates []string, weights []int) {
+	rows, err := s.db.Query(`
+		SELECT next_word, count FROM transitions
+		WHERE word1 = ? AND word2 = ?
+	`, word1, word2)
+	if err != nil {
+		return nil, nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var nextWord string
+		var count int
+		if rows.Scan(&nextWord, &count) == nil {
+			candidates = append(candidates, nextWord)
+			weights = append(weights, count)
+		}
+	}
+	return candidates, weights
+}
+
+func (s *sqliteStore) Previous(state []string) (candidates []string, weights []int) {
+	column, where, args := predecessorQuery(state)
+	rows, err := s.db.Query(`SELECT `+column+`, count FROM transitions WHERE `+where, args...)
+	if err != nil {
+		return nil, nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var word string
+		var count int
+		if rows.Scan(&word, &count) == nil {
+			candidates = append(candidates, word)
+			weights = append(weights, count)
+		}
+	}
+	return candidates, weights
+}
+
+// SeedState uses the idx_next_word_word2 reverse index
+func (s *sqliteStore) SeedState(order int, word string) []string {
+	var word1, word2 string
+	err := s.db.QueryRow(`
+		SELECT word1, word2 FROM transitions
+		WHERE next_word = ? AND `+orderCondition(order)+`
+		ORDER BY RANDOM() LIMIT 1
+	`, word).Scan(&word1, &word2)
+	if err != nil {
+		return nil
+	}
+	return append(splitState(word1, word2), word)
+}
+
+// RandomStart uses the rowid trick — O(1) vs O(n log n) for ORDER BY RANDOM()
+func (s *sqliteStore) RandomStart(order int) []string {
+	cond := orderCondition(order)
+	var word1, word2 string
+	err := s.db.QueryRow(`
+		SELECT word1, word2 FROM transitions
+		WHERE rowid >= (abs(random()) % (SELECT max(rowid) FROM transitions) + 1) AND `+cond+`
+		LIMIT 1
+	`).Scan(&word1, &word2)
+	// Fallback in case rowid has gaps that land past all rows
+	if err != nil {
+		err = s.db.QueryRow(`
+			SELECT word1, word2 FROM transitions WHERE `+cond+` ORDER BY rowid LIMIT 1
+		`).Scan(&word1, &word2)
+	}
+	if err != nil {
+		return nil
+	}
+	return splitState(word1, word2)
+}
+
+func (s *sqliteStore) Page(search string, page, pageSize int) (transitions []Transition, total int) {
+	offset := (page - 1) * pageSize
+	where := ""
+	var args []interface{}
+	if search != "" {
+		where = ` WHERE word1 LIKE ? OR word2 LIKE ? OR next_word LIKE ?`
+		searchPattern := "%" + search + "%"
+		args = []interface{}{searchPattern, searchPattern, searchPattern}
+	}
+	s.db.QueryRow(`SELECT COUNT(*) FROM transitions`+where, args...).Scan(&total)
+
+	rows, err := s.db.Query(`SELECT word1, word2, next_word, count FROM transitions`+where+`
+		ORDER BY count DESC LIMIT ? OFFSET ?`, append(args, pageSize, offset)...)
+	if err != nil {
+		return transitions, total
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Transition
+		if err := rows.Scan(&t.Word1, &t.Word2, &t.NextWord, &t.Count); err == nil {
+			t.Order = transitionOrder(t.Word1)
+			transitions = append(transitions, t)
+		}
+	}
+	return transitions, total
+}
+
+func (s *sqliteStore) Delete(word1, word2, nextWord string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM transitions WHERE word1 = ? AND word2 = ? AND next_word = ?`,
+		word1, word2, nextWord); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM contributions WHERE word1 = ? AND word2 = ? AND next_word = ?`,
+		word1, word2, nextWord); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) SetCount(word1, word2, nextWord string, count int) error {
+	_, err := s.db.Exec(`UPDATE transitions SET count = ? WHERE word1 = ? AND word2 = ? AND next_word = ?`,
+		count, word1, word2, nextWord)
+	return err
+}
+
+func (s *sqliteStore) Stats() (uniquePairs, totalEntries int) {
+	// Count distinct pairs without string concatenation overhead
+	s.db.QueryRow(`
+		SELECT COUNT(*) FROM (SELECT DISTINCT word1, word2 FROM transitions)
+	`).Scan(&uniquePairs)
+	s.db.QueryRow(`
+		SELECT COUNT(*) FROM transitions
+	`).Scan(&totalEntries)
+	return uniquePairs, totalEntries
+}
+
+// each calls fn for every transition in the table
+func (s *sqliteStore) each(fn func(t Transition)) error {
+	rows, err := s.db.Query(`SELECT word1, word2, next_word, count, last_seen FROM transitions`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Transition
+		if err := rows.Scan(&t.Word1, &t.Word2, &t.NextWord, &t.Count, &t.LastSeen); err != nil {
+			return err
+		}
+		fn(t)
+	}
+	return rows.Err()
+}
+
+// searchMatches reports whether search appears in one of a transition's words,
+// ignoring ASCII case like SQLite's LIKE
+func searchMatches(t Transition, search string) bool {
+	search = strings.ToLower(search)
+	return strings.Contains(strings.ToLower(t.Word1), search) ||
+		strings.Contains(strings.ToLower(t.Word2), search) ||
+		strings.Contains(strings.ToLower(t.NextWord), search)
+}
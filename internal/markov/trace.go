@@ -0,0 +1,102 @@
+package markov
+
+// Trace step directions
+const (
+	TraceSeed     = "seed"     // A learned context picked at random for the seed word
+	TraceStart    = "start"    // A random starting state, for brains without learned openings
+	TraceForward  = "forward"  // A next word picked toward a message ending
+	TraceBackward = "backward" // A previous word picked toward a message opening (seeded replies)
+)
+
+// Changes made to a generated response before it was sent
+const (
+	TraceLinksStripped = "links_stripped" // Links were removed
+	TraceMasked        = "masked"         // Filter rules masked words
+)
+
+// Trace records how a response was generated, one word choice at a time, so
+// an odd response can be followed back to the transitions that produced it
+type Trace struct {
+	Source string      `json:"source"`          // "channel", "global" or "group"
+	Group  string      `json:"group,omitempty"` // The brain group, in group mode
+	Order  int         `json:"order"`
+	Steps  []TraceStep `json:"steps"`
+
+	// The chain's output and what changed it, when the sent response differs
+	Generated string   `json:"generated,omitempty"`
+	Changes   []string `json:"changes,omitempty"`
+}
+
+// TraceStep is one word choice. State is the chain state the candidates were
+// looked up for; the chosen transition is (Word1, Word2) -> NextWord as stored
+// in the transitions table, which going backward is the transition from the
+// chosen word into State.
+type TraceStep struct {
+	Direction   string         `json:"direction"`
+	State       []string       `json:"state"`
+	Chosen      string         `json:"chosen"`
+	Candidates  int            `json:"candidates"`
+	Count       int            `json:"count"`       // The chosen word's (weighted) count
+	Probability float64        `json:"probability"` // Chance of the pick under the temperature and top-k settings
+	Word1       string         `json:"word1"`
+	Word2       string         `json:"word2"`
+	NextWord    string         `json:"next_word"`
+	Channels    map[string]int `json:"channels,omitempty"` // Global and group mode: each brain's count of the chosen transition
+}
+
+// begin starts tracing a generation from the given source at the given order,
+// clearing any earlier steps. Safe to call on a nil trace.
+func (t *Trace) begin(source string, order int) {
+	if t != nil {
+		t.Source, t.Order = source, order
+		t.Steps = []TraceStep{}
+	}
+}
+
+// reset clears the steps recorded so far. Safe to call on a nil trace.
+func (t *Trace) reset() {
+	if t != nil {
+		t.Steps = []TraceStep{}
+	}
+}
+
+// pick records a word picked from candidates at index i with probability p.
+// Safe to call on a nil trace.
+func (t *Trace) pick(direction string, state, candidates []string, weights []int, i int, p float64) {
+	if t == nil {
+		return
+	}
+	step := TraceStep{
+		Direction:   direction,
+		State:       append([]string(nil), state...),
+		Chosen:      candidates[i],
+		Candidates:  len(candidates),
+		Count:       weights[i],
+		Probability: p,
+	}
+	if direction == TraceBackward {
+		step.Word1, step.Word2 = stateKey(append([]string{candidates[i]}, state[:len(state)-1]...))
+		step.NextWord = state[len(state)-1]
+	} else {
+		step.Word1, step.Word2 = stateKey(state)
+		step.NextWord = candidates[i]
+	}
+	t.Steps = append(t.Steps, step)
+}
+
+// state records a chain state that wasn't sampled from weighted candidates:
+// the seed context or a random start. Safe to call on a nil trace.
+func (t *Trace) state(direction string, seq []string) {
+	if t == nil {
+		return
+	}
+	step := TraceStep{Direction: direction, State: append([]string(nil), seq...)}
+	if direction == TraceSeed {
+		order := len(seq) - 1
+		step.State = step.State[:order]
+		step.Chosen = seq[order]
+		step.Word1, step.Word2 = stateKey(seq[:order])
+		step.NextWord = seq[order]
+	}
+	t.Steps = append(t.Steps, step)
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -26,13 +27,14 @@ const (
 type Client struct {
 	channel          string
 	cfg              *config.Config
-	brain            *markov.Brain
+	brainFor         func(channel string) *markov.Brain // Looks up the channel's brain (nil in the bot's own channel)
 	conn             net.Conn
 	writer           *bufio.Writer
 	running          bool
 	mu               sync.Mutex
 	ctx              context.Context // cancelled by Manager.Stop() to unblock pending dials
 	timeoutUntil     time.Time
+	lastMentionReply time.Time // When the bot last answered an @mention or reply
 	onMessage        func(channel, username, message, color, emotes, badges string)
 	onConnect        func(channel string)
 	onDisconnect     func(channel string)
@@ -42,7 +44,10 @@ type Client struct {
 	onTimeout        func(channel string, durationSecs int)
 	onTimeoutCleared func(channel string)
 	onGeneration     func(channel string, result markov.GenerationResult)
-	globalGenerator  func(int) string // Function to generate from all brains
+	generatorFor     func(channel string) markov.Generator // Picks a channel's group or global generator (nil for its own brain)
+	forgetUser       func(userID, username string) (markov.ForgetResult, error)
+	onEmoteSets      func(sets string)                     // Called with the bot's emote-sets tag
+	responseFilter   func(channel, response string) string // Applied to generated responses before sending
 }
 
 // Message represents a parsed IRC message
@@ -56,13 +61,15 @@ type Message struct {
 	Content  string
 }
 
-// NewClient creates a new Twitch client for a channel
-func NewClient(channel string, cfg *config.Config, brain *markov.Brain, ctx context.Context) *Client {
+// NewClient creates a new Twitch client for a channel. brainFor looks up the
+// channel's brain for each message, so the brain can be closed while the
+// channel is quiet; it's nil in the bot's own channel, which has no brain.
+func NewClient(channel string, cfg *config.Config, brainFor func(channel string) *markov.Brain, ctx context.Context) *Client {
 	return &Client{
-		channel: strings.ToLower(channel),
-		cfg:     cfg,
-		brain:   brain,
-		ctx:     ctx,
+		channel:  strings.ToLower(channel),
+		cfg:      cfg,
+		brainFor: brainFor,
+		ctx:      ctx,
 	}
 }
 
@@ -100,9 +107,31 @@ func (c *Client) SetTimeoutUntil(t time.Time) {
 	c.timeoutUntil = t
 }
 
-// SetGlobalGenerator sets the function to generate from all brains
-func (c *Client) SetGlobalGenerator(gen func(int) string) {
-	c.globalGenerator = gen
+// getBrain returns the client's brain (nil in the bot's own channel)
+func (c *Client) getBrain() *markov.Brain {
+	if c.brainFor == nil {
+		return nil
+	}
+	return c.brainFor(c.channel)
+}
+
+// SetGeneratorSource sets the function that picks the generator for a
+// channel's brain mode: its brain group, the global brain, or nil for its own brain
+func (c *Client) SetGeneratorSource(generatorFor func(channel string) markov.Generator) {
+	c.generatorFor = generatorFor
+}
+
+// SetForgetUser sets the function that removes a user's contributions from all brains
+func (c *Client) SetForgetUser(forget func(userID, username string) (markov.ForgetResult, error)) {
+	c.forgetUser = forget
+}
+
+// SetEmoteHandlers sets the callback for the bot's emote sets (from
+// GLOBALUSERSTATE and USERSTATE) and the filter applied to generated
+// responses before they are sent
+func (c *Client) SetEmoteHandlers(onEmoteSets func(sets string), responseFilter func(channel, response string) string) {
+	c.onEmoteSets = onEmoteSets
+	c.responseFilter = responseFilter
 }
 
 // Connect establishes connection to Twitch IRC with retry logic
@@ -259,6 +288,24 @@ func (c *Client) SendMessage(message string) {
 	c.sendRaw(fmt.Sprintf("PRIVMSG #%s :%s", c.channel, message))
 }
 
+// SendReply sends a chat message threaded under the message with the given
+// IRC message ID, using Twitch's reply-parent-msg-id tag
+func (c *Client) SendReply(parentMsgID, message string) {
+	if parentMsgID == "" {
+		c.SendMessage(message)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil || !c.running {
+		return
+	}
+
+	c.sendRaw(fmt.Sprintf("@reply-parent-msg-id=%s PRIVMSG #%s :%s", parentMsgID, c.channel, message))
+}
+
 // Channel returns the channel name
 func (c *Client) Channel() string {
 	return c.channel
@@ -382,6 +429,7 @@ func (c *Client) handleMessage(raw string) {
 					return
 				}
 				c.cfg.SetChannelUseGlobalBrain(userChannel, true)
+				c.cfg.SetChannelBrainGroup(userChannel, "")
 				c.SendMessage(fmt.Sprintf("@%s I will now use ALL channel brains to generate messages in your channel!", msg.Username))
 				return
 			}
@@ -395,10 +443,69 @@ func (c *Client) handleMessage(raw string) {
 					return
 				}
 				c.cfg.SetChannelUseGlobalBrain(userChannel, false)
+				c.cfg.SetChannelBrainGroup(userChannel, "")
 				c.SendMessage(fmt.Sprintf("@%s I will now use only YOUR channel's brain to generate messages!", msg.Username))
 				return
 			}
 
+			// !group <name> - generate from a named brain group
+			if cmd == "!group" || strings.HasPrefix(cmd, "!group ") {
+				if !c.cfg.GetAllowGlobalLocalCommands() {
+					return
+				}
+				userChannel := strings.ToLower(msg.Username)
+				if !c.cfg.ChannelExists(userChannel) {
+					c.SendMessage(fmt.Sprintf("@%s I'm not in your channel yet! Use !join first.", msg.Username))
+					return
+				}
+				name := config.NormalizeBrainGroupName(strings.TrimPrefix(cmd, "!group"))
+				if name == "" {
+					if current := c.cfg.GetChannelBrainGroup(userChannel); current != "" {
+						c.SendMessage(fmt.Sprintf("@%s Your channel uses the brain group \"%s\". Use !group <name> to change or !local to leave it.", msg.Username, current))
+					} else {
+						c.SendMessage(fmt.Sprintf("@%s Your channel isn't using a brain group. Use !group <name> to pick one.", msg.Username))
+					}
+					return
+				}
+				if err := c.cfg.SetChannelBrainGroup(userChannel, name); err != nil {
+					c.SendMessage(fmt.Sprintf("@%s There's no brain group called \"%s\".", msg.Username, name))
+					return
+				}
+				c.SendMessage(fmt.Sprintf("@%s I will now use the \"%s\" brain group to generate messages in your channel!", msg.Username, name))
+				return
+			}
+
+			// !blacklist add/remove <word> - manage the user's channel's own blacklist
+			if cmd == "!blacklist" || strings.HasPrefix(cmd, "!blacklist ") {
+				if !c.cfg.GetAllowBlacklistCommand() {
+					return
+				}
+				userChannel := strings.ToLower(msg.Username)
+				if !c.cfg.ChannelExists(userChannel) {
+					c.SendMessage(fmt.Sprintf("@%s I'm not in your channel yet! Use !join first.", msg.Username))
+					return
+				}
+				parts := strings.Fields(msg.Content)
+				if len(parts) < 3 {
+					// Show the count only, so the bot doesn't repeat blacklisted words (or spoilers) in chat
+					count := len(c.cfg.GetChannelBlacklistedWords(userChannel))
+					c.SendMessage(fmt.Sprintf("@%s Your channel has %d blacklisted words. Use !blacklist add <word> or !blacklist remove <word> to change them.", msg.Username, count))
+					return
+				}
+				word := strings.ToLower(strings.Join(parts[2:], " "))
+				switch strings.ToLower(parts[1]) {
+				case "add":
+					c.cfg.AddChannelBlacklistedWord(userChannel, word)
+					c.SendMessage(fmt.Sprintf("@%s Got it, I won't learn or say that in your channel.", msg.Username))
+				case "remove":
+					c.cfg.RemoveChannelBlacklistedWord(userChannel, word)
+					c.SendMessage(fmt.Sprintf("@%s Removed that from your channel's blacklist.", msg.Username))
+				default:
+					c.SendMessage(fmt.Sprintf("@%s Use !blacklist add <word> or !blacklist remove <word> to manage your channel's blacklist.", msg.Username))
+				}
+				return
+			}
+
 			// !timer - set inactivity timer for user's channel
 			if strings.HasPrefix(cmd, "!timer") {
 				if !c.cfg.GetAllowTimerCommand() {
@@ -455,15 +562,52 @@ func (c *Client) handleMessage(raw string) {
 			c.SendMessage(fmt.Sprintf("@%s I will now learn from your messages again!", msg.Username))
 			return
 		}
+		if cmd == "!forgetme" {
+			userID := msg.Tags["user-id"]
+			if c.forgetUser == nil || userID == "" {
+				return
+			}
+			// Forgetting touches every brain, so don't hold up the read loop
+			go func() {
+				if result, err := c.forgetUser(userID, msg.Username); errors.Is(err, errForgetCooldown) {
+					c.SendMessage(fmt.Sprintf("@%s I've already forgotten you — you can ask again in a few minutes.", msg.Username))
+					return
+				} else if len(result.Failed) > 0 {
+					c.SendMessage(fmt.Sprintf("@%s Sorry, I couldn't forget your messages in every channel. Please let the bot owner know.", msg.Username))
+					return
+				} else if err != nil {
+					c.SendMessage(fmt.Sprintf("@%s Sorry, I couldn't forget your messages right now. Please try again later.", msg.Username))
+					return
+				}
+				c.SendMessage(fmt.Sprintf("@%s I've forgotten everything I learned from you. Use !ignoreme to stop me learning from you again.", msg.Username))
+			}()
+			return
+		}
 
 		// Process with brain (if brain exists - bot's own channel has no brain)
-		if c.brain != nil {
-			// Check if channel uses global brain for generation
-			var generator func(int) string
-			if c.cfg.GetChannelUseGlobalBrain(c.channel) && c.globalGenerator != nil {
-				generator = c.globalGenerator
+		if brain := c.getBrain(); brain != nil {
+			// Check if channel generates from a brain group or the global brain
+			var generator markov.Generator
+			if c.generatorFor != nil {
+				generator = c.generatorFor(c.channel)
+			}
+			botUsername := c.cfg.GetBotUsername()
+			var result markov.GenerationResult
+			replyTo := ""
+			if isAddressedTo(msg, botUsername) && c.mentionReplyAllowed() {
+				result = brain.ReplyWithInfo(msg.Content, msg.Username, msg.Tags["user-id"], msg.Tags["emotes"], botUsername, generator)
+				replyTo = msg.Tags["id"]
+			} else {
+				result = brain.ProcessMessageWithInfo(msg.Content, msg.Username, msg.Tags["user-id"], msg.Tags["emotes"], botUsername, generator)
+			}
+
+			if result.Response != "" && c.responseFilter != nil {
+				result.Response = c.responseFilter(c.channel, result.Response)
+				if result.Response == "" {
+					result.Success = false
+					result.FailureReason = "only_unusable_emotes"
+				}
 			}
-			result := c.brain.ProcessMessageWithInfo(msg.Content, msg.Username, c.cfg.GetBotUsername(), generator)
 
 			// Emit generation event if generation was triggered
 			if result.Triggered && c.onGeneration != nil {
@@ -473,9 +617,17 @@ func (c *Client) handleMessage(raw string) {
 			if result.Response != "" {
 				// Don't send if the bot is currently timed out in this channel
 				if !c.IsTimedOut() {
-					c.SendMessage(result.Response)
+					if result.ReplyTo != "" {
+						c.SendReply(replyTo, result.Response)
+						c.mu.Lock()
+						c.lastMentionReply = time.Now()
+						c.mu.Unlock()
+					} else {
+						c.SendMessage(result.Response)
+					}
 					// Log the quote to database
 					database.SaveQuote(c.channel, result.Response)
+					brain.SaveLastMessage(result.Response)
 				} else {
 					log.Printf("[%s] Skipping message generation — bot is timed out until %s", c.channel, c.TimeoutUntil().Format("15:04:05"))
 				}
@@ -541,6 +693,12 @@ func (c *Client) handleMessage(raw string) {
 			}
 		}
 
+	case "GLOBALUSERSTATE", "USERSTATE":
+		// Both carry the emote sets the bot can use
+		if sets := msg.Tags["emote-sets"]; sets != "" && c.onEmoteSets != nil {
+			c.onEmoteSets(sets)
+		}
+
 	case "RECONNECT":
 		log.Printf("[%s] Received RECONNECT, reconnecting...", c.channel)
 		// Let Manager.onDisconnect own all reconnect behavior. Reconnecting here
@@ -599,6 +757,30 @@ func unescapeIRCTag(s string) string {
 	return b.String()
 }
 
+// mentionReplyAllowed reports whether mention answers are enabled for the
+// channel and its cooldown has elapsed since the last one
+func (c *Client) mentionReplyAllowed() bool {
+	if !c.cfg.GetChannelMentionReplies(c.channel) {
+		return false
+	}
+	cooldown := time.Duration(c.cfg.GetChannelMentionCooldown(c.channel)) * time.Second
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.lastMentionReply) >= cooldown
+}
+
+// isAddressedTo reports whether a chat message @mentions the bot or is a
+// Twitch reply to one of the bot's messages
+func isAddressedTo(msg *Message, botUsername string) bool {
+	if botUsername == "" {
+		return false
+	}
+	if strings.EqualFold(msg.Tags["reply-parent-user-login"], botUsername) {
+		return true
+	}
+	return markov.MentionsBot(msg.Content, botUsername)
+}
+
 func parseMessage(raw string) *Message {
 	msg := &Message{
 		Raw:  raw,
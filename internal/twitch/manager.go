@@ -3,6 +3,7 @@ package twitch
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -40,10 +41,21 @@ type Manager struct {
 	eventHandler  func(event string, data interface{})
 	stopChan      chan struct{}
 	reconnecting  map[string]bool
-	ctx           context.Context    // cancelled on Stop() to unblock all pending dials
-	cancel        context.CancelFunc // cancels ctx
+	ctx           context.Context      // cancelled on Stop() to unblock all pending dials
+	cancel        context.CancelFunc   // cancels ctx
+	emoteSets     string               // the bot's emote-sets tag, as last received
+	usableEmotes  map[string]bool      // emote IDs in emoteSets (nil until fetched)
+	forgotAt      map[string]time.Time // when each user ID last used !forgetme
 }
 
+// forgetCooldown is how long a chatter must wait between uses of !forgetme,
+// which goes through every brain
+const forgetCooldown = 5 * time.Minute
+
+// errForgetCooldown is returned by forgetUserFromChat within forgetCooldown
+// of the user's last !forgetme
+var errForgetCooldown = errors.New("forget requested too recently")
+
 // NewManager creates a new Twitch connection manager
 func NewManager(cfg *config.Config) *Manager {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -57,6 +69,7 @@ func NewManager(cfg *config.Config) *Manager {
 		followersOnly: make(map[string]bool),
 		timedOut:      make(map[string]time.Time),
 		reconnecting:  make(map[string]bool),
+		forgotAt:      make(map[string]time.Time),
 		stopChan:      make(chan struct{}),
 		ctx:           ctx,
 		cancel:        cancel,
@@ -91,6 +104,15 @@ func (m *Manager) Start() error {
 	// Start the OAuth token refresh monitor
 	go m.monitorTokenRefresh()
 
+	// Start the brain decay job (checks hourly for due decay policies)
+	m.brainMgr.StartDecayJob(m.onDecay)
+
+	// Fill the global brain index from the brains on disk if it's new
+	m.brainMgr.StartGlobalIndex()
+
+	// Start the scheduled brain snapshot job (checks hourly, off unless enabled)
+	m.brainMgr.StartSnapshotJob()
+
 	// Do an immediate check for live channels
 	m.updateLiveConnections()
 
@@ -116,6 +138,9 @@ func (m *Manager) Stop() {
 	for _, client := range clients {
 		client.Disconnect()
 	}
+
+	// Learn whatever chat is still queued and close the brain databases
+	m.brainMgr.Close()
 }
 
 // JoinChannel connects to a new channel
@@ -137,12 +162,12 @@ func (m *Manager) JoinChannel(channel string) error {
 		return nil
 	}
 
-	// Only create brain for non-bot channels
-	var brain *markov.Brain
+	// Only non-bot channels have a brain
+	var brainFor func(channel string) *markov.Brain
 	if !isBotChannel {
-		brain = m.brainMgr.GetBrain(channel)
+		brainFor = m.brainMgr.GetBrain
 	}
-	client := NewClient(channel, m.cfg, brain, m.ctx)
+	client := NewClient(channel, m.cfg, brainFor, m.ctx)
 
 	client.SetCallbacks(
 		m.onMessage,
@@ -156,8 +181,10 @@ func (m *Manager) JoinChannel(channel string) error {
 		m.onGeneration,
 	)
 
-	// Set global generator for combined brain generation
-	client.SetGlobalGenerator(m.brainMgr.GenerateGlobal)
+	// Set the generator source for brain group and global brain generation
+	client.SetGeneratorSource(m.brainMgr.GeneratorFor)
+	client.SetForgetUser(m.forgetUserFromChat)
+	client.SetEmoteHandlers(m.onEmoteSets, m.filterResponse)
 
 	// Restore any unexpired timeout state from a previous session. Without this,
 	// every reconnect would create a fresh client with timeoutUntil=0, causing
@@ -246,6 +273,7 @@ func (m *Manager) LeaveChannel(channel string) {
 
 	// Always remove from config, even if not currently connected
 	m.cfg.RemoveChannel(channel)
+	m.brainMgr.RefreshGlobalIndex(channel)
 	log.Printf("Left channel: %s (brain data deleted)", channel)
 }
 
@@ -481,10 +509,87 @@ func (m *Manager) onGeneration(channel string, result markov.GenerationResult) {
 			"counter":        result.Counter,
 			"interval":       result.Interval,
 			"using_global":   result.UsingGlobal,
+			"reply_to":       result.ReplyTo,
+			"trace":          result.Trace,
+			"dampening":      result.Dampening,
 		})
 	}
 }
 
+func (m *Manager) onDecay(result markov.DecayResult) {
+	m.mu.RLock()
+	handler := m.eventHandler
+	m.mu.RUnlock()
+
+	if handler != nil {
+		handler("decay", result)
+	}
+}
+
+// ForgetUser removes everything a chatter contributed from all brains. The
+// username is resolved to a Twitch user ID through the API, falling back to
+// IDs the bot has already stored.
+func (m *Manager) ForgetUser(username string) (markov.ForgetResult, error) {
+	username = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(username), "@"))
+
+	var userID string
+	if clientID, oauthToken := m.cfg.GetClientID(), m.cfg.GetOAuthToken(); clientID != "" && oauthToken != "" {
+		userID, _, _ = m.lookupTwitchUser(username, clientID, oauthToken)
+	}
+	if userID == "" {
+		userID = m.cfg.GetUserIDByUsername(username)
+	}
+	if userID == "" {
+		return markov.ForgetResult{Username: username}, fmt.Errorf("couldn't find a Twitch user ID for %s", username)
+	}
+
+	return m.forgetUser(userID, username)
+}
+
+// forgetUser removes a user ID's contributions from all brains and reports
+// the result as a "forget" event. If some brains failed, what was forgotten
+// is still reported, and the error is returned too.
+func (m *Manager) forgetUser(userID, username string) (markov.ForgetResult, error) {
+	result, err := m.brainMgr.ForgetUser(userID)
+	result.Username = strings.ToLower(username)
+	if err != nil && len(result.Failed) == 0 {
+		return result, err
+	}
+	log.Printf("Forgot %s (ID: %s): %d transitions reduced, %d removed across %d brains", result.Username, userID, result.Reduced, result.Removed, result.Brains)
+	if err != nil {
+		log.Printf("Forgetting %s (ID: %s) is incomplete: %v", result.Username, userID, err)
+	}
+
+	m.mu.RLock()
+	handler := m.eventHandler
+	m.mu.RUnlock()
+
+	if handler != nil {
+		handler("forget", result)
+	}
+	return result, err
+}
+
+// forgetUserFromChat handles !forgetme: forgetUser, at most once per user
+// every forgetCooldown across all channels
+func (m *Manager) forgetUserFromChat(userID, username string) (markov.ForgetResult, error) {
+	now := time.Now()
+	m.mu.Lock()
+	for id, at := range m.forgotAt {
+		if now.Sub(at) >= forgetCooldown {
+			delete(m.forgotAt, id)
+		}
+	}
+	if _, recent := m.forgotAt[userID]; recent {
+		m.mu.Unlock()
+		return markov.ForgetResult{UserID: userID, Username: strings.ToLower(username)}, errForgetCooldown
+	}
+	m.forgotAt[userID] = now
+	m.mu.Unlock()
+
+	return m.forgetUser(userID, username)
+}
+
 func (m *Manager) onBanned(channel string) {
 	log.Printf("Bot was banned from channel: %s - leaving channel", channel)
 	m.LeaveChannel(channel)
@@ -856,11 +961,12 @@ func (m *Manager) handleUsernameChange(oldName, newName, userID string) {
 	oldPath := filepath.Join(brainsDir, oldName+".db")
 	newPath := filepath.Join(brainsDir, newName+".db")
 
-	// Also handle WAL and SHM files
+	// Also handle WAL and SHM files, and the brain's snapshots
 	filesToRename := []struct{ old, new string }{
 		{oldPath, newPath},
 		{oldPath + "-wal", newPath + "-wal"},
 		{oldPath + "-shm", newPath + "-shm"},
+		{filepath.Join(brainsDir, "snapshots", oldName), filepath.Join(brainsDir, "snapshots", newName)},
 	}
 
 	for _, f := range filesToRename {
@@ -876,6 +982,10 @@ func (m *Manager) handleUsernameChange(oldName, newName, userID string) {
 	// Update channel name in database
 	m.cfg.RenameChannel(oldName, newName)
 
+	// Move the brain's global index rows over to the new name
+	m.brainMgr.RefreshGlobalIndex(oldName)
+	m.brainMgr.RefreshGlobalIndex(newName)
+
 	// Update the user ID mapping
 	m.cfg.SetUserIDMapping(userID, newName)
 
@@ -1099,25 +1209,16 @@ func (m *Manager) generateTimerMessage(channel string, client *Client) {
 		return
 	}
 
-	// Choose generator based on global brain setting
-	var generator func(int) string
-	if m.cfg.GetChannelUseGlobalBrain(channel) {
-		generator = m.brainMgr.GenerateGlobal
-	}
+	// Choose generator based on the channel's brain group or global brain setting
+	generator := m.brainMgr.GeneratorFor(channel)
 
-	maxAttempts := 5
-	var response string
-	for i := 0; i < maxAttempts; i++ {
-		if generator != nil {
-			response = generator(maxAttempts)
-		} else {
-			response = brain.Generate(maxAttempts)
-		}
-		if response != "" {
-			break
-		}
+	// Same generation settings and checks as a chat response
+	result := brain.GenerateWithInfo(generator)
+	if !result.Success {
+		log.Printf("[%s] Inactivity timer generation failed after %d attempt(s): %s", channel, result.Attempts, result.FailureReason)
 	}
 
+	response := m.filterResponse(channel, result.Response)
 	if response != "" {
 		client.SendMessage(response)
 		database.SaveQuote(channel, response)
@@ -1142,12 +1243,13 @@ func (m *Manager) generateTimerMessage(channel string, client *Client) {
 				"triggered":      true,
 				"success":        true,
 				"response":       response,
-				"attempts":       1,
+				"attempts":       result.Attempts,
 				"failure_reason": "",
 				"counter":        0,
 				"interval":       0,
 				"using_global":   m.cfg.GetChannelUseGlobalBrain(channel),
 				"timer":          true,
+				"trace":          result.Trace,
 			})
 		}
 	}
@@ -1347,6 +1449,104 @@ func (m *Manager) ensureChannelIDs(channels []string, clientID, oauthToken strin
 	return result
 }
 
+// onEmoteSets records the bot's emote sets and refreshes the usable emote
+// IDs when they change
+func (m *Manager) onEmoteSets(sets string) {
+	m.mu.Lock()
+	if sets == m.emoteSets {
+		m.mu.Unlock()
+		return
+	}
+	m.emoteSets = sets
+	m.mu.Unlock()
+
+	go m.refreshUsableEmotes(sets)
+}
+
+// refreshUsableEmotes looks up the emote IDs in the bot's emote sets
+func (m *Manager) refreshUsableEmotes(sets string) {
+	clientID := m.cfg.GetClientID()
+	oauthToken := m.cfg.GetOAuthToken()
+	if clientID == "" || oauthToken == "" {
+		return
+	}
+
+	token := strings.TrimPrefix(oauthToken, "oauth:")
+	client := &http.Client{Timeout: 30 * time.Second}
+	setIDs := strings.Split(sets, ",")
+	usable := make(map[string]bool)
+
+	for start := 0; start < len(setIDs); start += helixChunkSize {
+		end := start + helixChunkSize
+		if end > len(setIDs) {
+			end = len(setIDs)
+		}
+
+		params := "?"
+		for i, id := range setIDs[start:end] {
+			if i > 0 {
+				params += "&"
+			}
+			params += "emote_set_id=" + id
+		}
+
+		req, err := http.NewRequest("GET", "https://api.twitch.tv/helix/chat/emotes/set"+params, nil)
+		if err != nil {
+			return
+		}
+		req.Header.Set("Client-ID", clientID)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("Error looking up emote sets: %v", err)
+			return
+		}
+
+		var apiResp struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&apiResp)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || err != nil {
+			log.Printf("Twitch API error looking up emote sets: %d", resp.StatusCode)
+			return
+		}
+
+		for _, emote := range apiResp.Data {
+			usable[emote.ID] = true
+		}
+	}
+
+	m.mu.Lock()
+	if m.emoteSets == sets {
+		m.usableEmotes = usable
+	}
+	m.mu.Unlock()
+	log.Printf("Bot can use %d emotes from %d emote sets", len(usable), len(setIDs))
+}
+
+// filterResponse removes emotes the bot can't use from a generated message
+// in channels that ask for it. Nothing is removed until the bot's usable
+// emotes are known.
+func (m *Manager) filterResponse(channel, response string) string {
+	if !m.cfg.GetChannelStripEmotes(channel) {
+		return response
+	}
+
+	m.mu.RLock()
+	usable := m.usableEmotes
+	m.mu.RUnlock()
+	if usable == nil {
+		return response
+	}
+
+	emotes := m.cfg.GetEmoteIDs(strings.Fields(response))
+	return markov.StripEmotes(response, emotes, func(id string) bool { return usable[id] })
+}
+
 // helixChunkSize bounds how many logins/IDs we send in a single Helix request.
 // Twitch allows up to 100, but smaller chunks keep URLs short, reduce per-request
 // latency on slow links, and prevent total failure when a single chunk times out.
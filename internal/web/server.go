@@ -10,6 +10,7 @@ import (
 	"embed"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -30,6 +31,7 @@ import (
 
 	"twitchbot/internal/config"
 	"twitchbot/internal/database"
+	"twitchbot/internal/markov"
 	"twitchbot/internal/twitch"
 )
 
@@ -39,6 +41,9 @@ var staticFiles embed.FS
 // helixChunkSize bounds how many logins we send in a single Twitch Helix request.
 const helixChunkSize = 25
 
+// maxImportSize bounds the compressed size of an uploaded brain export.
+const maxImportSize = 256 << 20
+
 // Server represents the web UI server
 type Server struct {
 	cfg           *config.Config
@@ -152,10 +157,18 @@ func (s *Server) Start() error {
 	mux.HandleFunc("/api/live", s.authMiddleware(s.handleLiveChannels))
 	mux.HandleFunc("/api/brains", s.authMiddleware(s.handleBrains))
 	mux.HandleFunc("/api/brains/", s.authMiddleware(s.handleBrainAction))
+	mux.HandleFunc("/api/snapshots", s.authMiddleware(s.handleSnapshotPolicy))
+	mux.HandleFunc("/api/groups", s.authMiddleware(s.handleGroups))
+	mux.HandleFunc("/api/groups/", s.authMiddleware(s.handleGroupAction))
 	mux.HandleFunc("/api/blacklist", s.authMiddleware(s.handleBlacklist))
 	mux.HandleFunc("/api/blacklist/", s.authMiddleware(s.handleBlacklistAction))
+	mux.HandleFunc("/api/links", s.authMiddleware(s.handleLinkAllowlist))
+	mux.HandleFunc("/api/links/", s.authMiddleware(s.handleLinkAllowlistAction))
+	mux.HandleFunc("/api/filters", s.authMiddleware(s.handleFilterRules))
+	mux.HandleFunc("/api/filters/", s.authMiddleware(s.handleFilterRuleAction))
 	mux.HandleFunc("/api/userblacklist", s.authMiddleware(s.handleUserBlacklist))
 	mux.HandleFunc("/api/userblacklist/", s.authMiddleware(s.handleUserBlacklistAction))
+	mux.HandleFunc("/api/forget", s.authMiddleware(s.handleForgetUser))
 	mux.HandleFunc("/api/database", s.authMiddleware(s.handleDatabase))
 	mux.HandleFunc("/api/activity", s.authMiddleware(s.handleActivity))
 	mux.HandleFunc("/api/logout", s.authMiddleware(s.handleLogout))
@@ -497,8 +510,10 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 			"allow_global_local_commands": s.cfg.GetAllowGlobalLocalCommands(),
 			"allow_response_command":      s.cfg.GetAllowResponseCommand(),
 			"allow_timer_command":         s.cfg.GetAllowTimerCommand(),
+			"allow_blacklist_command":     s.cfg.GetAllowBlacklistCommand(),
 			"default_timer_enabled":       s.cfg.GetDefaultTimerEnabled(),
 			"default_timer_minutes":       s.cfg.GetDefaultTimerMinutes(),
+			"max_open_brains":             s.cfg.GetMaxOpenBrains(),
 			"local_ip":                    getLocalIP(),
 		}
 		jsonResponse(w, config)
@@ -513,8 +528,10 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 			AllowGlobalLocal     *bool   `json:"allow_global_local_commands"`
 			AllowResponseCommand *bool   `json:"allow_response_command"`
 			AllowTimerCommand    *bool   `json:"allow_timer_command"`
+			AllowBlacklistCmd    *bool   `json:"allow_blacklist_command"`
 			DefaultTimerEnabled  *bool   `json:"default_timer_enabled"`
 			DefaultTimerMinutes  *int    `json:"default_timer_minutes"`
+			MaxOpenBrains        *int    `json:"max_open_brains"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			httpError(w, "Invalid request", http.StatusBadRequest)
@@ -545,12 +562,18 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 		if req.AllowTimerCommand != nil {
 			s.cfg.SetAllowTimerCommand(*req.AllowTimerCommand)
 		}
+		if req.AllowBlacklistCmd != nil {
+			s.cfg.SetAllowBlacklistCommand(*req.AllowBlacklistCmd)
+		}
 		if req.DefaultTimerEnabled != nil {
 			s.cfg.SetDefaultTimerEnabled(*req.DefaultTimerEnabled)
 		}
 		if req.DefaultTimerMinutes != nil {
 			s.cfg.SetDefaultTimerMinutes(*req.DefaultTimerMinutes)
 		}
+		if req.MaxOpenBrains != nil {
+			s.cfg.SetMaxOpenBrains(*req.MaxOpenBrains)
+		}
 
 		jsonResponse(w, map[string]string{"status": "updated"})
 
@@ -587,8 +610,21 @@ func (s *Server) handleChannels(w http.ResponseWriter, r *http.Request) {
 				"message_interval":  s.cfg.GetChannelMessageInterval(ch.Channel),
 				"user_id":           s.cfg.GetUserIDByUsername(ch.Channel),
 				"use_global":        s.cfg.GetChannelUseGlobalBrain(ch.Channel),
+				"global_opt_out":    s.cfg.GetChannelGlobalOptOut(ch.Channel),
+				"brain_group":       s.cfg.GetChannelBrainGroup(ch.Channel),
+				"link_policy":       s.cfg.GetChannelLinkPolicy(ch.Channel),
+				"allowed_scripts":   s.cfg.GetChannelAllowedScripts(ch.Channel),
+				"storage":           s.cfg.GetChannelStorage(ch.Channel),
 				"timer_enabled":     s.cfg.GetChannelTimerEnabled(ch.Channel),
 				"timer_minutes":     s.cfg.GetChannelTimerMinutes(ch.Channel),
+				"markov_order":      s.cfg.GetChannelMarkovOrder(ch.Channel),
+				"seeded_replies":    s.cfg.GetChannelSeededReplies(ch.Channel),
+				"spam_dampening":    s.cfg.GetChannelSpamDampening(ch.Channel),
+				"learn_quota":       s.cfg.GetChannelLearnQuota(ch.Channel),
+				"mention_replies":   s.cfg.GetChannelMentionReplies(ch.Channel),
+				"mention_cooldown":  s.cfg.GetChannelMentionCooldown(ch.Channel),
+				"strip_emotes":      s.cfg.GetChannelStripEmotes(ch.Channel),
+				"originality":       s.cfg.GetChannelOriginalityThreshold(ch.Channel),
 				"followers_only":    s.manager.IsChannelFollowersOnly(ch.Channel),
 				"timed_out":         s.manager.IsChannelTimedOut(ch.Channel),
 				"timeout_until":     s.manager.GetChannelTimeoutUntil(ch.Channel),
@@ -686,6 +722,403 @@ func (s *Server) handleChannelAction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check for /group suffix (generate from a named brain group, "" for none)
+	if strings.HasSuffix(channel, "/group") {
+		channel = strings.TrimSuffix(channel, "/group")
+		if r.Method == http.MethodPut {
+			var req struct {
+				Group string `json:"group"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Brain groups can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			if err := s.cfg.SetChannelBrainGroup(channel, req.Group); err != nil {
+				httpError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			jsonResponse(w, map[string]interface{}{"status": "updated", "channel": channel, "group": s.cfg.GetChannelBrainGroup(channel)})
+			return
+		}
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check for /blacklist suffix (the channel's own blacklisted words)
+	if strings.HasSuffix(channel, "/blacklist") {
+		channel = strings.TrimSuffix(channel, "/blacklist")
+		switch r.Method {
+		case http.MethodGet:
+			jsonResponse(w, s.cfg.GetChannelBlacklistedWords(channel))
+		case http.MethodPost:
+			var req struct {
+				Word string `json:"word"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if strings.TrimSpace(req.Word) == "" {
+				httpError(w, "Word required", http.StatusBadRequest)
+				return
+			}
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Blacklists can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			s.cfg.AddChannelBlacklistedWord(channel, strings.TrimSpace(req.Word))
+			jsonResponse(w, map[string]string{"status": "added", "channel": channel, "word": req.Word})
+		case http.MethodDelete:
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Blacklists can only be changed for joined channels", http.StatusBadRequest)
+				return
+			}
+			word := r.URL.Query().Get("word")
+			s.cfg.RemoveChannelBlacklistedWord(channel, word)
+			jsonResponse(w, map[string]string{"status": "removed", "channel": channel, "word": word})
+		default:
+			httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	// Check for /links suffix (set what happens to chat messages with links)
+	if strings.HasSuffix(channel, "/links") {
+		channel = strings.TrimSuffix(channel, "/links")
+		if r.Method == http.MethodPut {
+			var req struct {
+				Policy string `json:"policy"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Link policies can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			if err := s.cfg.SetChannelLinkPolicy(channel, req.Policy); err != nil {
+				httpError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			jsonResponse(w, map[string]interface{}{"status": "updated", "channel": channel, "policy": req.Policy})
+			return
+		}
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check for /scripts suffix (set the writing systems the channel learns)
+	if strings.HasSuffix(channel, "/scripts") {
+		channel = strings.TrimSuffix(channel, "/scripts")
+		if r.Method == http.MethodPut {
+			var req struct {
+				Scripts []string `json:"scripts"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Scripts can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			if err := s.cfg.SetChannelAllowedScripts(channel, req.Scripts); err != nil {
+				httpError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			jsonResponse(w, map[string]interface{}{"status": "updated", "channel": channel, "scripts": s.cfg.GetChannelAllowedScripts(channel)})
+			return
+		}
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check for /storage suffix (pick the channel's brain storage backend)
+	if strings.HasSuffix(channel, "/storage") {
+		channel = strings.TrimSuffix(channel, "/storage")
+		if r.Method == http.MethodPut {
+			var req struct {
+				Storage string `json:"storage"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Storage can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			if err := s.cfg.SetChannelStorage(channel, req.Storage); err != nil {
+				httpError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Close the brain so it's reopened with the new backend on next use
+			s.manager.GetBrainManager().RemoveBrain(channel)
+			jsonResponse(w, map[string]interface{}{"status": "updated", "channel": channel, "storage": req.Storage})
+			return
+		}
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check for /global-pool suffix (keep the channel's brain in or out of the global index)
+	if strings.HasSuffix(channel, "/global-pool") {
+		channel = strings.TrimSuffix(channel, "/global-pool")
+		if r.Method == http.MethodPut {
+			var req struct {
+				OptOut bool `json:"opt_out"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Global opt-out can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			if err := s.cfg.SetChannelGlobalOptOut(channel, req.OptOut); err != nil {
+				httpError(w, "Failed to save global opt-out", http.StatusInternalServerError)
+				return
+			}
+			s.manager.GetBrainManager().RefreshGlobalIndex(channel)
+			jsonResponse(w, map[string]interface{}{"status": "updated", "channel": channel, "opt_out": req.OptOut})
+			return
+		}
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check for /order suffix (set Markov chain order)
+	if strings.HasSuffix(channel, "/order") {
+		channel = strings.TrimSuffix(channel, "/order")
+		if r.Method == http.MethodPut {
+			var req struct {
+				Order   int  `json:"order"`
+				Confirm bool `json:"confirm"` // Change the order even though learned transitions go unused
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if req.Order < 1 || req.Order > 4 {
+				httpError(w, "Order must be between 1 and 4", http.StatusBadRequest)
+				return
+			}
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Markov order can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			stranded, err := s.manager.GetBrainManager().SetChannelOrder(channel, req.Order, req.Confirm)
+			if errors.Is(err, markov.ErrOrderChangeStrands) {
+				// The dashboard asks before resending with confirm set
+				httpError(w, fmt.Sprintf("%d transitions were learned at order %d and won't be used at order %d until it's changed back",
+					stranded, s.cfg.GetChannelMarkovOrder(channel), req.Order), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				httpError(w, "Failed to change order", http.StatusInternalServerError)
+				return
+			}
+			jsonResponse(w, map[string]interface{}{"status": "updated", "channel": channel, "order": req.Order, "unused": stranded})
+			return
+		}
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check for /seeded suffix (toggle keyword-seeded replies)
+	if strings.HasSuffix(channel, "/seeded") {
+		channel = strings.TrimSuffix(channel, "/seeded")
+		if r.Method == http.MethodPut {
+			var req struct {
+				SeededReplies bool `json:"seeded_replies"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "On-topic replies can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			s.cfg.SetChannelSeededReplies(channel, req.SeededReplies)
+			jsonResponse(w, map[string]interface{}{"status": "updated", "channel": channel, "seeded_replies": req.SeededReplies})
+			return
+		}
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check for /dampening suffix (toggle spam dampening before learning)
+	if strings.HasSuffix(channel, "/dampening") {
+		channel = strings.TrimSuffix(channel, "/dampening")
+		if r.Method == http.MethodPut {
+			var req struct {
+				SpamDampening bool `json:"spam_dampening"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Spam dampening can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			s.cfg.SetChannelSpamDampening(channel, req.SpamDampening)
+			jsonResponse(w, map[string]interface{}{"status": "updated", "channel": channel, "spam_dampening": req.SpamDampening})
+			return
+		}
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check for /generation suffix (get/set generation tuning)
+	if strings.HasSuffix(channel, "/generation") {
+		channel = strings.TrimSuffix(channel, "/generation")
+		switch r.Method {
+		case http.MethodGet:
+			jsonResponse(w, s.cfg.GetChannelGenerationSettings(channel))
+		case http.MethodPut:
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Generation settings can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			var req config.GenerationSettings
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if err := s.cfg.SetChannelGenerationSettings(channel, req); err != nil {
+				httpError(w, "Failed to save generation settings", http.StatusInternalServerError)
+				return
+			}
+			jsonResponse(w, s.cfg.GetChannelGenerationSettings(channel))
+		default:
+			httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	// Check for /originality suffix (set how much of a reply may be copied from chat)
+	if strings.HasSuffix(channel, "/originality") {
+		channel = strings.TrimSuffix(channel, "/originality")
+		if r.Method == http.MethodPut {
+			var req struct {
+				Threshold int `json:"threshold"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Originality thresholds can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			if req.Threshold < 0 || req.Threshold > 100 {
+				httpError(w, "Threshold must be between 0 and 100", http.StatusBadRequest)
+				return
+			}
+			s.cfg.SetChannelOriginalityThreshold(channel, req.Threshold)
+			jsonResponse(w, map[string]interface{}{"status": "updated", "channel": channel, "originality": req.Threshold})
+			return
+		}
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check for /quota suffix (set the per-chatter learning quota)
+	if strings.HasSuffix(channel, "/quota") {
+		channel = strings.TrimSuffix(channel, "/quota")
+		if r.Method == http.MethodPut {
+			var req struct {
+				LearnQuota int `json:"learn_quota"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Learning quotas can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			if req.LearnQuota < 0 || req.LearnQuota > 1000 {
+				httpError(w, "Quota must be between 0 and 1000 messages", http.StatusBadRequest)
+				return
+			}
+			s.cfg.SetChannelLearnQuota(channel, req.LearnQuota)
+			jsonResponse(w, map[string]interface{}{"status": "updated", "channel": channel, "learn_quota": req.LearnQuota})
+			return
+		}
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check for /emotes suffix (toggle stripping emotes the bot can't use)
+	if strings.HasSuffix(channel, "/emotes") {
+		channel = strings.TrimSuffix(channel, "/emotes")
+		if r.Method == http.MethodPut {
+			var req struct {
+				StripEmotes bool `json:"strip_emotes"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Emote stripping can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			s.cfg.SetChannelStripEmotes(channel, req.StripEmotes)
+			jsonResponse(w, map[string]interface{}{"status": "updated", "channel": channel, "strip_emotes": req.StripEmotes})
+			return
+		}
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check for /mentions suffix (toggle/set @mention answers and cooldown)
+	if strings.HasSuffix(channel, "/mentions") {
+		channel = strings.TrimSuffix(channel, "/mentions")
+		if r.Method == http.MethodPut {
+			var req struct {
+				Enabled  *bool `json:"enabled"`
+				Cooldown *int  `json:"cooldown"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Mention replies can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			if req.Enabled != nil {
+				s.cfg.SetChannelMentionReplies(channel, *req.Enabled)
+			}
+			if req.Cooldown != nil {
+				if *req.Cooldown < 0 || *req.Cooldown > 3600 {
+					httpError(w, "Cooldown must be between 0 and 3600 seconds", http.StatusBadRequest)
+					return
+				}
+				s.cfg.SetChannelMentionCooldown(channel, *req.Cooldown)
+			}
+			jsonResponse(w, map[string]interface{}{
+				"status":           "updated",
+				"channel":          channel,
+				"mention_replies":  s.cfg.GetChannelMentionReplies(channel),
+				"mention_cooldown": s.cfg.GetChannelMentionCooldown(channel),
+			})
+			return
+		}
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	// Check for /timer suffix (toggle/set inactivity timer)
 	if strings.HasSuffix(channel, "/timer") {
 		channel = strings.TrimSuffix(channel, "/timer")
@@ -985,6 +1418,11 @@ func (s *Server) handleBrainAction(w http.ResponseWriter, r *http.Request) {
 		action = parts[1]
 	}
 
+	if action == "snapshots" {
+		s.handleBrainSnapshots(w, r, channel, parts[2:])
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		if action == "stats" {
@@ -1016,6 +1454,50 @@ func (s *Server) handleBrainAction(w http.ResponseWriter, r *http.Request) {
 				pageSize = 50
 			}
 			jsonResponse(w, brain.GetTransitions(search, page, pageSize))
+		} else if action == "decay" {
+			brain := s.manager.GetBrainManager().GetBrain(channel)
+			if brain == nil {
+				httpError(w, "Failed to load brain for channel", http.StatusInternalServerError)
+				return
+			}
+			jsonResponse(w, map[string]interface{}{
+				"policy":      s.cfg.GetChannelDecayPolicy(channel),
+				"last_report": brain.LastDecay(),
+			})
+		} else if action == "analytics" {
+			brain := s.manager.GetBrainManager().GetBrain(channel)
+			if brain == nil {
+				httpError(w, "Failed to load brain for channel", http.StatusInternalServerError)
+				return
+			}
+			jsonResponse(w, brain.Analytics())
+		} else if action == "chatters" {
+			brain := s.manager.GetBrainManager().GetBrain(channel)
+			if brain == nil {
+				httpError(w, "Failed to load brain for channel", http.StatusInternalServerError)
+				return
+			}
+			jsonResponse(w, brain.TopChatters(20))
+		} else if action == "generate" {
+			// Generate a message the way the channel would, without sending it;
+			// ?explain=1 includes the trace of how it was built
+			brain := s.manager.GetBrainManager().GetBrain(channel)
+			if brain == nil {
+				httpError(w, "Failed to load brain for channel", http.StatusInternalServerError)
+				return
+			}
+			result := brain.Preview(s.manager.GetBrainManager().GeneratorFor(channel))
+			if r.URL.Query().Get("explain") != "1" {
+				result.Trace = nil
+			}
+			jsonResponse(w, result)
+		} else if action == "export" {
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.ToLower(channel)+".brain.jsonl.gz"))
+			if err := s.manager.GetBrainManager().ExportBrain(channel, w); err != nil {
+				// Headers may already be sent; all we can do is log and cut the stream short
+				log.Printf("[%s] Brain export failed: %v", channel, err)
+			}
 		} else {
 			httpError(w, "Unknown action", http.StatusBadRequest)
 		}
@@ -1024,12 +1506,75 @@ func (s *Server) handleBrainAction(w http.ResponseWriter, r *http.Request) {
 		if action == "clean" {
 			result := s.manager.GetBrainManager().CleanBrain(channel)
 			jsonResponse(w, result)
+		} else if action == "decay" {
+			// Run the channel's decay policy now
+			jsonResponse(w, s.manager.GetBrainManager().DecayBrain(channel))
+		} else if action == "merge" {
+			// Merge this channel's brain into another one
+			var req struct {
+				Destination  string   `json:"destination"`
+				Weight       *float64 `json:"weight"`
+				DeleteSource bool     `json:"delete_source"`
+				Confirm      bool     `json:"confirm"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if req.Destination == "" {
+				httpError(w, "Destination channel required", http.StatusBadRequest)
+				return
+			}
+			weight := 1.0
+			if req.Weight != nil {
+				weight = *req.Weight
+			}
+			result, err := s.manager.GetBrainManager().MergeBrains(channel, req.Destination, weight, req.DeleteSource, req.Confirm, s.dbCleanProgressReporter("merge"))
+			s.broadcastEvent("clean_progress", map[string]interface{}{
+				"phase": "merge", "complete": true,
+			})
+			if errors.Is(err, markov.ErrMergeOrderMismatch) {
+				// The dashboard asks before resending with confirm set
+				httpError(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				httpError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			jsonResponse(w, result)
+		} else if action == "import" {
+			// Body is a brain export; ?mode=replace erases the brain first, default merges
+			mode := r.URL.Query().Get("mode")
+			if mode != "" && mode != "merge" && mode != "replace" {
+				httpError(w, "Mode must be merge or replace", http.StatusBadRequest)
+				return
+			}
+			body := http.MaxBytesReader(w, r.Body, maxImportSize)
+			result, err := s.manager.GetBrainManager().ImportBrain(channel, body, mode == "replace")
+			if err != nil {
+				httpError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			jsonResponse(w, result)
 		} else {
 			httpError(w, "Unknown action", http.StatusBadRequest)
 		}
 
 	case http.MethodPut:
-		if action == "transition" {
+		if action == "decay" {
+			var policy config.DecayPolicy
+			if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+				httpError(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			if !s.cfg.ChannelExists(channel) {
+				httpError(w, "Decay policies can only be set for joined channels", http.StatusBadRequest)
+				return
+			}
+			s.cfg.SetChannelDecayPolicy(channel, policy)
+			jsonResponse(w, s.cfg.GetChannelDecayPolicy(channel))
+		} else if action == "transition" {
 			var req struct {
 				Word1    string `json:"word1"`
 				Word2    string `json:"word2"`
@@ -1091,6 +1636,160 @@ func (s *Server) handleBrainAction(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleBrainSnapshots handles /api/brains/{channel}/snapshots[/{id}[/restore]]
+func (s *Server) handleBrainSnapshots(w http.ResponseWriter, r *http.Request, channel string, parts []string) {
+	brainMgr := s.manager.GetBrainManager()
+	id := ""
+	if len(parts) > 0 {
+		id = parts[0]
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		jsonResponse(w, brainMgr.ListSnapshots(channel))
+
+	case id == "" && r.Method == http.MethodPost:
+		snapshot, err := brainMgr.SnapshotBrain(channel, markov.SnapshotManual)
+		if err != nil {
+			httpError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, snapshot)
+
+	case id != "" && len(parts) == 2 && parts[1] == "restore" && r.Method == http.MethodPost:
+		var req struct {
+			Confirm bool `json:"confirm"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		undo, err := brainMgr.RestoreSnapshot(channel, id, req.Confirm)
+		if errors.Is(err, markov.ErrSnapshotOrderMismatch) {
+			// The dashboard asks before resending with confirm set
+			httpError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{"status": "restored", "channel": channel, "id": id, "undo": undo})
+
+	case id != "" && len(parts) == 1 && r.Method == http.MethodDelete:
+		if err := brainMgr.DeleteSnapshot(channel, id); err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jsonResponse(w, map[string]string{"status": "deleted", "channel": channel, "id": id})
+
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleSnapshotPolicy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, s.cfg.GetSnapshotPolicy())
+
+	case http.MethodPut:
+		var policy config.SnapshotPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			httpError(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := s.cfg.SetSnapshotPolicy(policy); err != nil {
+			httpError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, s.cfg.GetSnapshotPolicy())
+
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleGroups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, s.cfg.GetBrainGroups())
+
+	case http.MethodPost:
+		var req struct {
+			Name    string                    `json:"name"`
+			Members []config.BrainGroupMember `json:"members"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := s.cfg.CreateBrainGroup(req.Name); err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.cfg.SetBrainGroupMembers(req.Name, req.Members); err != nil {
+			httpError(w, "Failed to save group members", http.StatusInternalServerError)
+			return
+		}
+		s.refreshGroupMembers(req.Members)
+		jsonResponse(w, s.cfg.GetBrainGroup(req.Name))
+
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleGroupAction(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/groups/")
+	group := s.cfg.GetBrainGroup(name)
+	if group == nil {
+		httpError(w, "Brain group not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, group)
+
+	case http.MethodPut:
+		// Replace the group's members
+		var req struct {
+			Members []config.BrainGroupMember `json:"members"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := s.cfg.SetBrainGroupMembers(group.Name, req.Members); err != nil {
+			httpError(w, "Failed to save group members", http.StatusInternalServerError)
+			return
+		}
+		s.refreshGroupMembers(group.Members, req.Members)
+		jsonResponse(w, s.cfg.GetBrainGroup(group.Name))
+
+	case http.MethodDelete:
+		if err := s.cfg.DeleteBrainGroup(group.Name); err != nil {
+			httpError(w, "Failed to delete group", http.StatusInternalServerError)
+			return
+		}
+		s.refreshGroupMembers(group.Members)
+		jsonResponse(w, map[string]string{"status": "deleted", "name": group.Name})
+
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// refreshGroupMembers reindexes the brains of channels that joined or left a
+// brain group, since group membership keeps opted out brains in the global index
+func (s *Server) refreshGroupMembers(memberLists ...[]config.BrainGroupMember) {
+	for _, members := range memberLists {
+		for _, member := range members {
+			if channel := strings.ToLower(strings.TrimSpace(member.Channel)); channel != "" {
+				s.manager.GetBrainManager().RefreshGlobalIndex(channel)
+			}
+		}
+	}
+}
+
 func (s *Server) handleBlacklist(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
@@ -1139,6 +1838,87 @@ func (s *Server) handleBlacklistAction(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) handleLinkAllowlist(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, s.cfg.GetLinkAllowlist())
+
+	case http.MethodPost:
+		var req struct {
+			Domain string `json:"domain"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := s.cfg.AddLinkAllowlistDomain(req.Domain); err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jsonResponse(w, map[string]string{"status": "added", "domain": req.Domain})
+
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleLinkAllowlistAction(w http.ResponseWriter, r *http.Request) {
+	domain := strings.TrimPrefix(r.URL.Path, "/api/links/")
+	if domain == "" {
+		httpError(w, "Domain required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		s.cfg.RemoveLinkAllowlistDomain(domain)
+		jsonResponse(w, map[string]string{"status": "removed", "domain": domain})
+
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleFilterRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, s.cfg.GetFilterRules())
+
+	case http.MethodPost:
+		var req config.FilterRule
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		rule, err := s.cfg.AddFilterRule(req)
+		if err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jsonResponse(w, rule)
+
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleFilterRuleAction(w http.ResponseWriter, r *http.Request) {
+	var id int64
+	if _, err := fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/api/filters/"), "%d", &id); err != nil {
+		httpError(w, "Invalid rule ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		s.cfg.RemoveFilterRule(id)
+		jsonResponse(w, map[string]interface{}{"status": "removed", "id": id})
+
+	default:
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 func (s *Server) handleUserBlacklist(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
@@ -1181,6 +1961,36 @@ func (s *Server) handleUserBlacklistAction(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+func (s *Server) handleForgetUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Username) == "" {
+		httpError(w, "Username required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.manager.ForgetUser(req.Username)
+	if len(result.Failed) > 0 {
+		httpError(w, fmt.Sprintf("Forgot %s in %d brain(s), but failed in: %s", result.Username, result.Brains, strings.Join(result.Failed, ", ")), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jsonResponse(w, result)
+}
+
 func (s *Server) handleDatabase(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
@@ -1191,7 +2001,7 @@ func (s *Server) handleDatabase(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPost:
 		progress := s.dbCleanProgressReporter("optimize")
 
-		// Clean non-ASCII transitions from all brains
+		// Clean transitions outside each channel's allowed scripts from all brains
 		nonASCIIRemoved := s.manager.GetBrainManager().CleanNonASCIIAll(progress)
 
 		// Vacuum/optimize database
@@ -1347,10 +2157,14 @@ func (s *Server) broadcastEvent(event string, data interface{}) {
 			attempts, _ := genData["attempts"].(int)
 			failureReason, _ := genData["failure_reason"].(string)
 			usingGlobal, _ := genData["using_global"].(bool)
+			replyTo, _ := genData["reply_to"].(string)
 
 			var message string
 			if success {
 				message = "🤖 Generated: \"" + response + "\""
+				if replyTo != "" {
+					message = "🤖 Replied to @" + replyTo + ": \"" + response + "\""
+				}
 
 				// Also broadcast a new_quote event for the quotes page
 				go func() {
@@ -1360,9 +2174,15 @@ func (s *Server) broadcastEvent(event string, data interface{}) {
 				}()
 			} else {
 				reasons := map[string]string{
-					"empty_generation": "empty output",
-					"blacklisted_word": "blacklisted word in output",
-					"unknown":          "unknown reason",
+					"empty_generation":     "empty output",
+					"blacklisted_word":     "blacklisted word in output",
+					"filter_rule":          "matched a filter rule",
+					"only_links":           "nothing left without links",
+					"only_unusable_emotes": "only emotes the bot can't use",
+					"too_similar":          "too similar to a chat message",
+					"too_short":            "shorter than the minimum words",
+					"too_long":             "longer than the maximum characters",
+					"unknown":              "unknown reason",
 				}
 				reason := reasons[failureReason]
 				if reason == "" {
@@ -1370,6 +2190,10 @@ func (s *Server) broadcastEvent(event string, data interface{}) {
 				}
 				message = fmt.Sprintf("⚠️ Generation failed after %d attempt(s): %s", attempts, reason)
 			}
+			if dampening, ok := genData["dampening"].(*markov.DampeningStats); ok && dampening != nil &&
+				(dampening.Dampened > 0 || dampening.Throttled > 0) {
+				message += fmt.Sprintf(" (spam dampened: %d copies, %d repeats skipped)", dampening.Dampened, dampening.Throttled)
+			}
 
 			botName := s.cfg.GetBotUsername()
 			if botName == "" {
@@ -127,6 +127,7 @@ function parseEmotes(message, emotesTag) {
 // Pagination state
 const ITEMS_PER_PAGE = 10;
 let channelsData = [];
+let groupsData = [];
 let channelsPage = 1;
 let channelsFilter = '';
 let brainsData = [];
@@ -347,6 +348,7 @@ function cacheElements() {
     elements.allowGlobalLocal = document.getElementById('allow-global-local');
     elements.allowResponseCmd = document.getElementById('allow-response-cmd');
     elements.allowTimerCmd = document.getElementById('allow-timer-cmd');
+    elements.allowBlacklistCmd = document.getElementById('allow-blacklist-cmd');
     elements.brainModeLocal = document.getElementById('brain-mode-local');
     elements.brainModeGlobal = document.getElementById('brain-mode-global');
     elements.defaultTimerOff = document.getElementById('default-timer-off');
@@ -483,6 +485,11 @@ function setupEventListeners() {
         await api.put('/api/config', { allow_timer_command: elements.allowTimerCmd.checked });
     });
 
+    // Blacklist command toggle
+    elements.allowBlacklistCmd.addEventListener('change', async () => {
+        await api.put('/api/config', { allow_blacklist_command: elements.allowBlacklistCmd.checked });
+    });
+
     // Default brain mode radio buttons
     elements.brainModeLocal.addEventListener('change', async () => {
         if (elements.brainModeLocal.checked) {
@@ -529,17 +536,43 @@ function setupEventListeners() {
         renderBrains(brainsData);
     });
 
+    // Brain groups
+    document.getElementById('add-group-btn').addEventListener('click', addGroup);
+    document.getElementById('new-group-name').addEventListener('keypress', e => {
+        if (e.key === 'Enter') addGroup();
+    });
+
     // Blacklist
     document.getElementById('add-blacklist-btn').addEventListener('click', addBlacklistWord);
     elements.newBlacklistWord.addEventListener('keypress', e => {
         if (e.key === 'Enter') addBlacklistWord();
     });
 
+    // Channel blacklists
+    document.getElementById('add-channel-blacklist-btn').addEventListener('click', addChannelBlacklistWord);
+    document.getElementById('new-channel-blacklist-word').addEventListener('keypress', e => {
+        if (e.key === 'Enter') addChannelBlacklistWord();
+    });
+    document.getElementById('channel-blacklist-channel').addEventListener('change', loadChannelBlacklist);
+
+    // Link allowlist
+    document.getElementById('add-link-domain-btn').addEventListener('click', addLinkDomain);
+    document.getElementById('new-link-domain').addEventListener('keypress', e => {
+        if (e.key === 'Enter') addLinkDomain();
+    });
+
+    // Filter rules
+    document.getElementById('add-filter-rule-btn').addEventListener('click', addFilterRule);
+    document.getElementById('new-filter-pattern').addEventListener('keypress', e => {
+        if (e.key === 'Enter') addFilterRule();
+    });
+
     // Ignored users
     document.getElementById('add-ignored-user-btn').addEventListener('click', addIgnoredUser);
     elements.newIgnoredUser.addEventListener('keypress', e => {
         if (e.key === 'Enter') addIgnoredUser();
     });
+    document.getElementById('forget-user-btn').addEventListener('click', forgetUser);
 
     // Database
     document.getElementById('clean-optimize-btn').addEventListener('click', cleanAndOptimizeAll);
@@ -680,6 +713,12 @@ function handleWebSocketEvent(data) {
         if (quotesState.page === 1) {
             loadAdminQuotes();
         }
+    } else if (data.event === 'decay') {
+        const d = data.data;
+        addSystemEntry(d.channel, `🍂 Brain decay: ${d.decayed.toLocaleString()} transitions aged, ${d.pruned.toLocaleString()} pruned`);
+    } else if (data.event === 'forget') {
+        const d = data.data;
+        addSystemEntry(botUsername, `🧹 Forgot @${d.username}: ${d.reduced.toLocaleString()} transitions reduced, ${d.removed.toLocaleString()} removed across ${d.brains} brain(s)`);
     } else if (data.event === 'clean_progress') {
         updateCleanProgress(data.data);
     }
@@ -694,7 +733,9 @@ function updateCleanProgress(d) {
     if (!container || !bar || !label) return;
 
     container.style.display = 'block';
-    const phaseLabel = d.phase === 'optimize' ? 'Optimizing' : 'Cleaning';
+    const phaseLabels = { optimize: 'Optimizing', merge: 'Merging', clean: 'Cleaning' };
+    const phaseLabel = phaseLabels[d.phase] || 'Cleaning';
+    const unit = d.phase === 'merge' ? 'transitions' : 'channels';
 
     if (d.complete) {
         bar.style.width = '100%';
@@ -705,7 +746,7 @@ function updateCleanProgress(d) {
     const pct = d.total > 0 ? Math.round((d.current / d.total) * 100) : 0;
     bar.style.width = pct + '%';
     label.textContent = d.total > 0
-        ? `${phaseLabel} ${d.current}/${d.total} channels — ${d.channel}`
+        ? `${phaseLabel} ${d.current.toLocaleString()}/${d.total.toLocaleString()} ${unit} — ${d.channel}`
         : `${phaseLabel}...`;
 }
 
@@ -717,11 +758,15 @@ async function loadInitialData() {
     await Promise.all([
         loadStatus(),
         loadChannels(),
+        loadGroups(),
         loadLiveChannels(),
         loadBrains(),
         loadBlacklist(),
+        loadFilterRules(),
+        loadLinkAllowlist(),
         loadIgnoredUsers(),
         loadDatabaseStats(),
+        loadSnapshotPolicy(),
         loadActivity(),
         loadAdminQuotes()
     ]);
@@ -871,6 +916,7 @@ function drawAppRamSparkline() {
 
 async function loadConfig() {
     const config = await api.get('/api/config');
+    document.getElementById('max-open-brains').value = config.max_open_brains;
     elements.intervalSlider.value = config.message_interval;
     elements.intervalValue.textContent = config.message_interval;
     
@@ -885,6 +931,7 @@ async function loadConfig() {
     
     // Set timer command toggle
     elements.allowTimerCmd.checked = config.allow_timer_command !== false;
+    elements.allowBlacklistCmd.checked = config.allow_blacklist_command !== false;
     
     // Set default brain mode
     if (config.default_brain_mode === 'global') {
@@ -1129,6 +1176,14 @@ async function loadChannels() {
     const channels = await api.get('/api/channels');
     channelsData = channels || [];
     renderChannels(channelsData);
+    renderChannelBlacklistOptions(channelsData);
+}
+
+async function loadGroups() {
+    const groups = await api.get('/api/groups');
+    groupsData = groups || [];
+    renderGroups(groupsData);
+    renderChannels(channelsData);
 }
 
 async function loadLiveChannels() {
@@ -1147,6 +1202,95 @@ async function loadBlacklist() {
     renderBlacklist(words);
 }
 
+function renderChannelBlacklistOptions(channels) {
+    const select = document.getElementById('channel-blacklist-channel');
+    const current = select.value;
+    const names = channels.map(ch => ch.channel).sort();
+    select.innerHTML = names.length > 0
+        ? names.map(name => `<option value="${name}" ${name === current ? 'selected' : ''}>${name}</option>`).join('')
+        : '<option value="">No channels</option>';
+    loadChannelBlacklist();
+}
+
+async function loadChannelBlacklist() {
+    const channel = document.getElementById('channel-blacklist-channel').value;
+    const container = document.getElementById('channel-blacklist-words');
+    if (!channel) {
+        container.innerHTML = '';
+        return;
+    }
+    const words = await api.get(`/api/channels/${channel}/blacklist`);
+    if (!words || words.length === 0) {
+        container.innerHTML = `<div class="empty-state">No words blacklisted in ${channel}</div>`;
+        return;
+    }
+    container.innerHTML = words.map(word => `
+        <span class="tag">
+            ${escapeHtml(word)}
+            <button class="remove-btn" onclick="removeChannelBlacklistWord('${channel}', '${escapeHtml(word)}')">&times;</button>
+        </span>
+    `).join('');
+}
+
+async function addChannelBlacklistWord() {
+    const channel = document.getElementById('channel-blacklist-channel').value;
+    const input = document.getElementById('new-channel-blacklist-word');
+    const word = input.value.trim().toLowerCase();
+    if (!channel || !word) return;
+
+    const data = await api.post(`/api/channels/${channel}/blacklist`, { word });
+    if (data.error) {
+        showToast(data.error, 'error');
+        return;
+    }
+    input.value = '';
+    loadChannelBlacklist();
+}
+
+async function removeChannelBlacklistWord(channel, word) {
+    await api.delete(`/api/channels/${channel}/blacklist?word=${encodeURIComponent(word)}`);
+    loadChannelBlacklist();
+}
+
+async function loadLinkAllowlist() {
+    const domains = await api.get('/api/links');
+    const container = document.getElementById('link-allowlist');
+    if (!domains || domains.length === 0) {
+        container.innerHTML = '<div class="empty-state">No allowlisted domains</div>';
+        return;
+    }
+    container.innerHTML = domains.map(domain => `
+        <span class="tag">
+            ${escapeHtml(domain)}
+            <button class="remove-btn" onclick="removeLinkDomain('${escapeHtml(domain)}')">&times;</button>
+        </span>
+    `).join('');
+}
+
+async function addLinkDomain() {
+    const input = document.getElementById('new-link-domain');
+    const domain = input.value.trim().toLowerCase();
+    if (!domain) return;
+
+    const data = await api.post('/api/links', { domain });
+    if (data.error) {
+        showToast(data.error, 'error');
+        return;
+    }
+    input.value = '';
+    loadLinkAllowlist();
+}
+
+async function removeLinkDomain(domain) {
+    await api.delete(`/api/links/${encodeURIComponent(domain)}`);
+    loadLinkAllowlist();
+}
+
+async function loadFilterRules() {
+    const rules = await api.get('/api/filters');
+    renderFilterRules(rules);
+}
+
 async function loadIgnoredUsers() {
     const users = await api.get('/api/userblacklist');
     renderIgnoredUsers(users);
@@ -1158,6 +1302,40 @@ async function loadDatabaseStats() {
     elements.dbChannels.textContent = (stats.unique_channels || 0).toLocaleString();
     elements.dbBlacklisted.textContent = (stats.blacklisted_words || 0).toLocaleString();
     elements.dbDirectory.textContent = stats.data_directory || '-';
+    document.getElementById('db-open-brains').textContent = (stats.open_brains || 0).toLocaleString();
+}
+
+async function saveMaxOpenBrains() {
+    const max = parseInt(document.getElementById('max-open-brains').value) || 0;
+    const data = await api.put('/api/config', { max_open_brains: max });
+    if (data.error) {
+        showToast(data.error, 'error');
+        return;
+    }
+    const config = await api.get('/api/config');
+    document.getElementById('max-open-brains').value = config.max_open_brains;
+    showToast(config.max_open_brains ? `At most ${config.max_open_brains} brains are kept open` : 'Brains are never closed for being idle', 'success');
+}
+
+async function loadSnapshotPolicy() {
+    const policy = await api.get('/api/snapshots');
+    document.getElementById('snapshot-enabled').checked = policy.enabled;
+    document.getElementById('snapshot-interval').value = policy.interval_hours;
+    document.getElementById('snapshot-keep').value = policy.keep;
+}
+
+async function saveSnapshotPolicy() {
+    const policy = await api.put('/api/snapshots', {
+        enabled: document.getElementById('snapshot-enabled').checked,
+        interval_hours: parseInt(document.getElementById('snapshot-interval').value),
+        keep: parseInt(document.getElementById('snapshot-keep').value)
+    });
+    if (policy.error) {
+        showToast(policy.error, 'error');
+        return;
+    }
+    showToast(policy.enabled ? `Brains are snapshotted every ${policy.interval_hours} hours, keeping ${policy.keep}` : 'Scheduled snapshots disabled', 'success');
+    loadSnapshotPolicy();
 }
 
 // Rendering
@@ -1198,6 +1376,19 @@ function renderChannels(channels) {
         const useGlobal = ch.use_global || false;
         const timerEnabled = ch.timer_enabled || false;
         const timerMinutes = ch.timer_minutes || 15;
+        const markovOrder = ch.markov_order || 2;
+        const seededReplies = ch.seeded_replies || false;
+        const spamDampening = ch.spam_dampening || false;
+        const learnQuota = ch.learn_quota || 0;
+        const stripEmotes = ch.strip_emotes || false;
+        const globalOptOut = ch.global_opt_out || false;
+        const brainGroup = ch.brain_group || '';
+        const mentionReplies = ch.mention_replies !== false;
+        const mentionCooldown = ch.mention_cooldown != null ? ch.mention_cooldown : 30;
+        const originality = ch.originality != null ? ch.originality : 80;
+        const linkPolicy = ch.link_policy || 'skip';
+        const allowedScripts = (ch.allowed_scripts || ['latin']).join(', ');
+        const storage = ch.storage || 'sqlite';
         return `
         <div class="list-item channel-item">
             <div class="info">
@@ -1227,6 +1418,15 @@ function renderChannels(channels) {
                             <span>${useGlobal ? 'Global' : 'Local'}</span>
                         </label>
                     </div>
+                    <div class="channel-order">
+                        <label class="small" title="Brain group: generate from a named group of brains instead (overrides Global/Local)">
+                            <span>Group</span>
+                            <select onchange="updateChannelGroup('${ch.channel}', this.value)" onclick="event.stopPropagation()">
+                                <option value="" ${brainGroup === '' ? 'selected' : ''}>none</option>
+                                ${groupsData.map(g => `<option value="${escapeHtml(g.name)}" ${g.name === brainGroup ? 'selected' : ''}>${escapeHtml(g.name)}</option>`).join('')}
+                            </select>
+                        </label>
+                    </div>
                     <div class="actions">
                         <button class="btn danger" onclick="removeChannel('${ch.channel}')">Remove</button>
                     </div>
@@ -1247,6 +1447,93 @@ function renderChannels(channels) {
                             <span>Timer</span>
                         </label>
                     </div>
+                    <div class="channel-order">
+                        <label class="small" title="Markov order: how many previous words pick the next one.&#10;Lower = more creative, higher = closer to real chat.&#10;Transitions learned at another order go unused until it is changed back.">
+                            <span>Order</span>
+                            <select onchange="updateChannelOrder('${ch.channel}', this.value)" onclick="event.stopPropagation()">
+                                ${[1, 2, 3, 4].map(n => `<option value="${n}" ${n === markovOrder ? 'selected' : ''}>${n}</option>`).join('')}
+                            </select>
+                        </label>
+                    </div>
+                    <div class="channel-seeded-toggle">
+                        <label class="toggle-label small" title="On-topic replies: build replies through a word from the triggering message or the last few chat lines">
+                            <input type="checkbox" ${seededReplies ? 'checked' : ''} 
+                                onchange="toggleSeededReplies('${ch.channel}', this.checked)">
+                            <span>On-topic</span>
+                        </label>
+                    </div>
+                    <div class="channel-seeded-toggle">
+                        <label class="toggle-label small" title="Dampen spam: when chat floods with a copypasta or emote wall, learn the copies with diminishing weight, and skip users repeating themselves">
+                            <input type="checkbox" ${spamDampening ? 'checked' : ''} 
+                                onchange="toggleSpamDampening('${ch.channel}', this.checked)">
+                            <span>Dampen spam</span>
+                        </label>
+                    </div>
+                    <div class="channel-seeded-toggle">
+                        <label class="toggle-label small" title="Strip emotes: remove emotes the bot can't use (such as other channels' subscriber emotes) from its messages">
+                            <input type="checkbox" ${stripEmotes ? 'checked' : ''} 
+                                onchange="toggleStripEmotes('${ch.channel}', this.checked)">
+                            <span>Own emotes</span>
+                        </label>
+                    </div>
+                    <div class="channel-seeded-toggle">
+                        <label class="toggle-label small" title="Share: include this channel's brain in the global brain other channels can generate from (brain groups it's a member of use it either way)">
+                            <input type="checkbox" ${globalOptOut ? '' : 'checked'} 
+                                onchange="toggleGlobalPool('${ch.channel}', this.checked)">
+                            <span>Share</span>
+                        </label>
+                    </div>
+                    <div class="channel-seeded-toggle channel-mentions">
+                        <label class="toggle-label small" title="Mentions: answer @mentions and replies to the bot right away, at most once per cooldown">
+                            <input type="checkbox" ${mentionReplies ? 'checked' : ''} 
+                                onchange="updateChannelMentions('${ch.channel}', { enabled: this.checked })">
+                            <span>Mentions</span>
+                        </label>
+                        <input type="number" class="interval-input" min="0" max="3600" value="${mentionCooldown}"
+                            title="Mention cooldown (seconds)"
+                            onchange="updateChannelMentions('${ch.channel}', { cooldown: parseInt(this.value) })"
+                            onclick="event.stopPropagation()">
+                    </div>
+                    <div class="channel-seeded-toggle channel-mentions">
+                        <label class="toggle-label small" title="Originality: reject replies when at least this % of the words were copied in a row from one recent chat message (0 = off)">
+                            <span>Max copied %</span>
+                        </label>
+                        <input type="number" class="interval-input" min="0" max="100" value="${originality}"
+                            onchange="updateChannelOriginality('${ch.channel}', parseInt(this.value))"
+                            onclick="event.stopPropagation()">
+                    </div>
+                    <div class="channel-seeded-toggle channel-mentions">
+                        <label class="toggle-label small" title="Quota: learn at most this many messages from each chatter every 10 minutes, so one very active chatter can't take over the brain (0 = no quota)">
+                            <span>Per-chatter quota</span>
+                        </label>
+                        <input type="number" class="interval-input" min="0" max="1000" value="${learnQuota}"
+                            onchange="updateChannelQuota('${ch.channel}', parseInt(this.value))"
+                            onclick="event.stopPropagation()">
+                    </div>
+                    <div class="channel-order">
+                        <label class="small" title="Links: what happens to chat messages with links to domains that aren't allowlisted.&#10;Skip: don't learn the message. Strip: learn it without the link. Learn: learn it as-is.&#10;The bot never sends links either way.">
+                            <span>Links</span>
+                            <select onchange="updateChannelLinkPolicy('${ch.channel}', this.value)" onclick="event.stopPropagation()">
+                                ${['skip', 'strip', 'learn'].map(p => `<option value="${p}" ${p === linkPolicy ? 'selected' : ''}>${p}</option>`).join('')}
+                            </select>
+                        </label>
+                    </div>
+                    <div class="channel-order">
+                        <label class="small" title="Scripts: the writing systems messages are learned in, comma separated. ASCII and emoji are always allowed.&#10;Options: any, latin, latin-extended, cyrillic, greek, cjk, arabic, hebrew, thai, devanagari">
+                            <span>Scripts</span>
+                            <input type="text" class="scripts-input" value="${allowedScripts}"
+                                onchange="updateChannelScripts('${ch.channel}', this)"
+                                onclick="event.stopPropagation()">
+                        </label>
+                    </div>
+                    <div class="channel-order">
+                        <label class="small" title="Storage: where the brain's transitions are read from.&#10;SQLite: the brain's database file. Memory: the whole brain is also kept in memory for faster generation in busy channels, still saved to the file.">
+                            <span>Storage</span>
+                            <select onchange="updateChannelStorage('${ch.channel}', this.value)" onclick="event.stopPropagation()">
+                                ${['sqlite', 'memory'].map(s => `<option value="${s}" ${s === storage ? 'selected' : ''}>${s}</option>`).join('')}
+                            </select>
+                        </label>
+                    </div>
                 </div>
             </div>
         </div>
@@ -1301,6 +1588,46 @@ async function updateChannelInterval(channel, interval) {
     }
 }
 
+async function updateChannelLinkPolicy(channel, policy) {
+    const data = await api.put(`/api/channels/${channel}/links`, { policy });
+    if (data.error) {
+        showToast(data.error, 'error');
+        return;
+    }
+    const actions = { skip: 'skips messages with links', strip: 'strips links before learning', learn: 'learns links' };
+    showToast(`${channel} ${actions[policy]}`, 'success');
+}
+
+async function updateChannelStorage(channel, storage) {
+    const data = await api.put(`/api/channels/${channel}/storage`, { storage });
+    if (data.error) {
+        showToast(data.error, 'error');
+        return;
+    }
+    showToast(storage === 'memory' ? `${channel}'s brain is kept in memory` : `${channel}'s brain is read from disk`, 'success');
+}
+
+async function updateChannelScripts(channel, input) {
+    const scripts = input.value.split(/[\s,]+/).filter(s => s);
+    const data = await api.put(`/api/channels/${channel}/scripts`, { scripts });
+    if (data.error) {
+        showToast(data.error, 'error');
+        return;
+    }
+    input.value = data.scripts.join(', ');
+    showToast(`${channel} learns ${data.scripts.join(', ')}`, 'success');
+}
+
+async function updateChannelGroup(channel, group) {
+    const data = await api.put(`/api/channels/${channel}/group`, { group });
+    if (data.error) {
+        showToast(data.error, 'error');
+        return;
+    }
+    showToast(group ? `${channel} now generates from the "${group}" group` : `${channel} no longer uses a brain group`, 'success');
+    loadGroups();
+}
+
 async function toggleGlobalBrain(channel, useGlobal) {
     try {
         await fetch(`/api/channels/${channel}/global`, {
@@ -1357,6 +1684,144 @@ async function updateChannelTimer(channel, minutes) {
     }
 }
 
+async function updateChannelOrder(channel, order) {
+    const num = parseInt(order);
+    if (isNaN(num) || num < 1 || num > 4) {
+        showToast('Order must be between 1 and 4', 'error');
+        return;
+    }
+    const send = confirmed => fetch(`/api/channels/${channel}/order`, {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ order: num, confirm: confirmed })
+    });
+    try {
+        let res = await send(false);
+        if (res.status === 409) {
+            // The brain has learned at its current order: those transitions go unused
+            const data = await res.json();
+            if (!confirm(`${data.error}.\n\nChange the order of "${channel}" anyway?`)) {
+                loadChannels();
+                return;
+            }
+            res = await send(true);
+        }
+        if (!res.ok) {
+            const data = await res.json();
+            showToast(`Failed to update order: ${data.error}`, 'error');
+            loadChannels();
+            return;
+        }
+        showToast(`${channel} Markov order set to ${num}`, 'success');
+    } catch (err) {
+        showToast('Failed to update order', 'error');
+    }
+}
+
+async function toggleSeededReplies(channel, enabled) {
+    try {
+        await fetch(`/api/channels/${channel}/seeded`, {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ seeded_replies: enabled })
+        });
+        showToast(`${channel} on-topic replies ${enabled ? 'enabled' : 'disabled'}`, 'success');
+    } catch (err) {
+        showToast('Failed to update reply mode', 'error');
+    }
+}
+
+async function toggleSpamDampening(channel, enabled) {
+    try {
+        await fetch(`/api/channels/${channel}/dampening`, {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ spam_dampening: enabled })
+        });
+        showToast(`${channel} spam dampening ${enabled ? 'enabled' : 'disabled'}`, 'success');
+    } catch (err) {
+        showToast('Failed to update spam dampening', 'error');
+    }
+}
+
+async function toggleStripEmotes(channel, enabled) {
+    try {
+        await fetch(`/api/channels/${channel}/emotes`, {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ strip_emotes: enabled })
+        });
+        showToast(`${channel} ${enabled ? 'only uses emotes the bot has' : 'uses any learned emote'}`, 'success');
+    } catch (err) {
+        showToast('Failed to update emote setting', 'error');
+    }
+}
+
+async function toggleGlobalPool(channel, shared) {
+    try {
+        await fetch(`/api/channels/${channel}/global-pool`, {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ opt_out: !shared })
+        });
+        showToast(`${channel} brain ${shared ? 'shared with' : 'kept out of'} the global brain`, 'success');
+    } catch (err) {
+        showToast('Failed to update global brain setting', 'error');
+    }
+}
+
+async function updateChannelMentions(channel, settings) {
+    if (settings.cooldown !== undefined && (isNaN(settings.cooldown) || settings.cooldown < 0 || settings.cooldown > 3600)) {
+        showToast('Cooldown must be between 0 and 3600 seconds', 'error');
+        return;
+    }
+    try {
+        const res = await fetch(`/api/channels/${channel}/mentions`, {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(settings)
+        });
+        const data = await res.json();
+        showToast(`${channel} mention answers ${data.mention_replies ? `on (${data.mention_cooldown}s cooldown)` : 'off'}`, 'success');
+    } catch (err) {
+        showToast('Failed to update mention settings', 'error');
+    }
+}
+
+async function updateChannelOriginality(channel, threshold) {
+    if (isNaN(threshold) || threshold < 0 || threshold > 100) {
+        showToast('Threshold must be between 0 and 100', 'error');
+        return;
+    }
+    try {
+        await fetch(`/api/channels/${channel}/originality`, {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ threshold })
+        });
+        showToast(`${channel} originality check ${threshold > 0 ? `rejects replies ${threshold}% copied from chat` : 'off'}`, 'success');
+    } catch (err) {
+        showToast('Failed to update originality threshold', 'error');
+    }
+}
+
+async function updateChannelQuota(channel, quota) {
+    if (isNaN(quota) || quota < 0 || quota > 1000) {
+        showToast('Quota must be between 0 and 1000 messages', 'error');
+        return;
+    }
+    try {
+        await fetch(`/api/channels/${channel}/quota`, {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ learn_quota: quota })
+        });
+        showToast(`${channel} ${quota > 0 ? `learns at most ${quota} messages per chatter every 10 minutes` : 'has no per-chatter quota'}`, 'success');
+    } catch (err) {
+        showToast('Failed to update learning quota', 'error');
+    }
+}
+
 function renderLiveChannels(liveChannels) {
     if (!liveChannels || liveChannels.length === 0) {
         elements.channelList.innerHTML = '<div class="empty-state">No channels are live</div>';
@@ -1470,6 +1935,9 @@ function renderBrains(brains) {
                 </div>
             </div>
             <div class="actions" onclick="event.stopPropagation()">
+                <a class="btn" href="/api/brains/${brain.channel}/export" download>Export</a>
+                <button class="btn" onclick="importBrain('${brain.channel}')">Import</button>
+                <button class="btn" onclick="mergeBrain('${brain.channel}')">Merge</button>
                 <button class="btn danger" onclick="eraseBrain('${brain.channel}')">Erase</button>
             </div>
         </div>
@@ -1478,6 +1946,73 @@ function renderBrains(brains) {
     renderPagination(elements.brainsPagination, brainsPage, totalPages, filtered.length, 'brains');
 }
 
+function renderGroups(groups) {
+    const container = document.getElementById('groups-list');
+    if (!groups || groups.length === 0) {
+        container.innerHTML = '<div class="empty-state">No brain groups</div>';
+        return;
+    }
+
+    container.innerHTML = groups.map(g => {
+        const members = g.members.map(m => `${m.channel}:${m.weight}`).join(', ');
+        const users = g.channels.length > 0 ? `used by ${g.channels.join(', ')}` : 'not used by any channel';
+        return `
+        <div class="list-item">
+            <div class="info">
+                <div class="name">${escapeHtml(g.name)}</div>
+                <div class="stats">${g.members.length} members • ${escapeHtml(users)}</div>
+            </div>
+            <div class="input-group">
+                <input type="text" id="group-members-${escapeHtml(g.name)}" value="${escapeHtml(members)}"
+                    placeholder="channel:weight, channel:weight..." title="Members as channel:weight (weight 0.1-10, default 1)">
+                <button class="btn" onclick="saveGroupMembers('${escapeHtml(g.name)}')">Save</button>
+                <button class="btn danger" onclick="deleteGroup('${escapeHtml(g.name)}')">Delete</button>
+            </div>
+        </div>`;
+    }).join('');
+}
+
+// parseGroupMembers turns "channel:weight, channel" into group members
+function parseGroupMembers(text) {
+    return text.split(',').map(part => part.trim()).filter(part => part).map(part => {
+        const [channel, weight] = part.split(':').map(s => s.trim());
+        return { channel: channel.toLowerCase(), weight: weight ? parseFloat(weight) : 1 };
+    });
+}
+
+async function addGroup() {
+    const input = document.getElementById('new-group-name');
+    const name = input.value.trim();
+    if (!name) return;
+
+    const data = await api.post('/api/groups', { name, members: [] });
+    if (data.error) {
+        showToast(data.error, 'error');
+        return;
+    }
+    input.value = '';
+    showToast(`Created brain group "${data.name}"`, 'success');
+    loadGroups();
+}
+
+async function saveGroupMembers(name) {
+    const input = document.getElementById(`group-members-${name}`);
+    const data = await api.put(`/api/groups/${encodeURIComponent(name)}`, { members: parseGroupMembers(input.value) });
+    if (data.error) {
+        showToast(data.error, 'error');
+        return;
+    }
+    showToast(`"${name}" now has ${data.members.length} members`, 'success');
+    loadGroups();
+}
+
+async function deleteGroup(name) {
+    if (!confirm(`Delete the brain group "${name}"? Channels using it go back to their own brain.`)) return;
+    await api.delete(`/api/groups/${encodeURIComponent(name)}`);
+    loadGroups();
+    loadChannels();
+}
+
 function renderBlacklist(words) {
     if (!words || words.length === 0) {
         elements.blacklistWords.innerHTML = '<div class="empty-state">No blacklisted words</div>';
@@ -1492,6 +2027,26 @@ function renderBlacklist(words) {
     `).join('');
 }
 
+function renderFilterRules(rules) {
+    const container = document.getElementById('filter-rules');
+    if (!rules || rules.length === 0) {
+        container.innerHTML = '<div class="empty-state">No filter rules</div>';
+        return;
+    }
+
+    const actions = {
+        'block_learning': "don't learn",
+        'block_output': "don't say",
+        'mask': 'mask'
+    };
+    container.innerHTML = rules.map(rule => `
+        <span class="tag" title="${rule.kind}${rule.normalize ? ', normalized' : ''}: ${actions[rule.action] || rule.action}">
+            ${rule.kind === 'word' ? '' : `<small>${rule.kind}</small> `}${escapeHtml(rule.pattern)}${rule.normalize ? ' <small>~</small>' : ''} <small>${actions[rule.action] || rule.action}</small>
+            <button class="remove-btn" onclick="removeFilterRule(${rule.id})">&times;</button>
+        </span>
+    `).join('');
+}
+
 function renderIgnoredUsers(users) {
     if (!users || users.length === 0) {
         elements.ignoredUsers.innerHTML = '<div class="empty-state">No ignored users</div>';
@@ -1540,18 +2095,30 @@ function addGenerationEntry(data) {
     let message, statusClass;
     
     if (data.success) {
-        message = `🤖 Generated: "${data.response}"`;
+        message = data.reply_to
+            ? `🤖 Replied to @${data.reply_to}: "${data.response}"`
+            : `🤖 Generated: "${data.response}"`;
         statusClass = 'generation-success';
     } else {
         const reasons = {
             'empty_generation': 'empty output',
             'blacklisted_word': 'blacklisted word in output',
+            'filter_rule': 'matched a filter rule',
+            'only_links': 'nothing left without links',
+            'only_unusable_emotes': "only emotes the bot can't use",
+            'too_similar': 'too similar to a chat message',
+            'too_short': 'shorter than the minimum words',
+            'too_long': 'longer than the maximum characters',
             'unknown': 'unknown reason'
         };
         const reason = reasons[data.failure_reason] || data.failure_reason;
         message = `⚠️ Generation failed after ${data.attempts} attempt(s): ${reason}`;
         statusClass = 'generation-failed';
     }
+    const damp = data.dampening;
+    if (damp && (damp.dampened > 0 || damp.throttled > 0)) {
+        message += ` (spam dampened: ${damp.dampened} copies, ${damp.throttled} repeats skipped)`;
+    }
     
     const globalLabel = data.using_global ? ' (global)' : ' (local)';
     
@@ -1561,7 +2128,9 @@ function addGenerationEntry(data) {
         username: (botUsername || 'bot') + globalLabel, 
         message,
         isGeneration: true,
-        statusClass
+        statusClass,
+        trace: data.trace,
+        response: data.response
     });
     
     if (activityLog.length > MAX_LOG_ENTRIES) {
@@ -1576,7 +2145,7 @@ function addGenerationEntry(data) {
 }
 
 function renderActivityLog() {
-    elements.activityLog.innerHTML = activityLog.map(entry => {
+    elements.activityLog.innerHTML = activityLog.map((entry, i) => {
         if (entry.isGeneration) {
             return `
             <div class="log-entry ${entry.statusClass}">
@@ -1584,6 +2153,7 @@ function renderActivityLog() {
                 <span class="channel">#${entry.channel}</span>
                 <span class="username" style="color: var(--accent)">${escapeHtml(entry.username)}:</span>
                 <span class="message">${escapeHtml(entry.message)}</span>
+                ${entry.trace ? `<button class="trace-btn" onclick="showLogTrace(${i})" title="Show how this message was generated">explain</button>` : ''}
             </div>
         `}
         const userColor = getUserColor(entry.username, entry.color);
@@ -1687,6 +2257,85 @@ async function eraseBrain(channel) {
     loadDatabaseStats();
 }
 
+// Import a brain export (.brain.jsonl.gz) into a channel's brain
+function importBrain(channel) {
+    const input = document.createElement('input');
+    input.type = 'file';
+    input.accept = '.gz,application/gzip';
+    input.onchange = async () => {
+        const file = input.files[0];
+        if (!file) return;
+        const replace = confirm(`Replace the "${channel}" brain with ${file.name}?\n\nOK = replace (erases current data)\nCancel = merge (adds counts to current data)`);
+        try {
+            const res = await fetch(`/api/brains/${channel}/import?mode=${replace ? 'replace' : 'merge'}`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/gzip' },
+                body: file
+            });
+            const data = await res.json();
+            if (!res.ok) {
+                showToast(`Import failed: ${data.error}`, 'error');
+                return;
+            }
+            const skipped = data.skipped ? `, ${data.skipped} skipped` : '';
+            showToast(`Imported ${data.imported.toLocaleString()} transitions from ${data.source_channel} into ${channel} (${data.mode}${skipped})`, 'success');
+        } catch (err) {
+            showToast('Failed to import brain', 'error');
+        }
+        loadBrains();
+        loadDatabaseStats();
+    };
+    input.click();
+}
+
+// Merge a channel's brain into another channel's brain
+async function mergeBrain(channel) {
+    const destination = prompt(`Merge the "${channel}" brain into which channel's brain?`);
+    if (!destination || !destination.trim()) return;
+    const weightText = prompt('Weight factor for the merged counts (e.g. 0.5 = half, 1 = as is):', '1');
+    if (weightText === null) return;
+    const weight = parseFloat(weightText);
+    if (isNaN(weight) || weight <= 0 || weight > 100) {
+        showToast('Weight must be greater than 0 and at most 100', 'error');
+        return;
+    }
+    const deleteSource = confirm(`Delete the "${channel}" brain after merging?\n\nOK = delete it\nCancel = keep it`);
+
+    const container = document.getElementById('clean-progress-container');
+    const bar = document.getElementById('clean-progress-bar');
+    const label = document.getElementById('clean-progress-label');
+    container.style.display = 'block';
+    bar.style.width = '0%';
+    label.textContent = 'Starting merge...';
+
+    try {
+        const send = (confirmed) => fetch(`/api/brains/${channel}/merge`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ destination: destination.trim().toLowerCase(), weight, delete_source: deleteSource, confirm: confirmed })
+        });
+        let res = await send(false);
+        if (res.status === 409) {
+            // The brains are used at different Markov orders
+            const conflict = await res.json();
+            if (!confirm(`${conflict.error}.\n\nMerge anyway?`)) return;
+            res = await send(true);
+        }
+        const data = await res.json();
+        if (!res.ok) {
+            showToast(`Merge failed: ${data.error}`, 'error');
+            return;
+        }
+        showToast(`Merged ${data.merged.toLocaleString()} transitions from ${data.source} into ${data.destination}${data.source_deleted ? ' and deleted the source' : ''}`, 'success');
+    } catch (err) {
+        showToast('Failed to merge brains', 'error');
+    } finally {
+        container.style.display = 'none';
+        loadBrains();
+        loadDatabaseStats();
+    }
+}
+
 async function addBlacklistWord() {
     const word = elements.newBlacklistWord.value.trim().toLowerCase();
     if (!word) return;
@@ -1710,6 +2359,30 @@ async function clearBlacklist() {
     loadDatabaseStats();
 }
 
+async function addFilterRule() {
+    const input = document.getElementById('new-filter-pattern');
+    const pattern = input.value.trim();
+    if (!pattern) return;
+
+    const data = await api.post('/api/filters', {
+        pattern,
+        kind: document.getElementById('new-filter-kind').value,
+        action: document.getElementById('new-filter-action').value,
+        normalize: document.getElementById('new-filter-normalize').checked
+    });
+    if (data.error) {
+        showToast(data.error, 'error');
+        return;
+    }
+    input.value = '';
+    loadFilterRules();
+}
+
+async function removeFilterRule(id) {
+    await api.delete(`/api/filters/${id}`);
+    loadFilterRules();
+}
+
 async function addIgnoredUser() {
     const username = elements.newIgnoredUser.value.trim().toLowerCase();
     if (!username) return;
@@ -1724,8 +2397,25 @@ async function removeIgnoredUser(username) {
     loadIgnoredUsers();
 }
 
+async function forgetUser() {
+    const input = document.getElementById('forget-user');
+    const username = input.value.trim().toLowerCase().replace(/^@/, '');
+    if (!username) return;
+    if (!confirm(`Forget everything learned from @${username} in ALL brains? This cannot be undone.`)) return;
+
+    const result = await api.post('/api/forget', { username });
+    if (result.error) {
+        alert(result.error);
+        return;
+    }
+    input.value = '';
+    alert(`Forgot @${username}: ${result.reduced.toLocaleString()} transitions reduced, ${result.removed.toLocaleString()} removed across ${result.brains} brain(s)`);
+    loadBrains();
+    loadDatabaseStats();
+}
+
 async function cleanAndOptimizeAll() {
-    if (!confirm('Clean and optimize ALL brain data?\n\nThis will:\n- Remove entries containing blacklisted words\n- Remove non-ASCII characters\n- Optimize database files')) return;
+    if (!confirm('Clean and optimize ALL brain data?\n\nThis will:\n- Remove entries containing blacklisted words\n- Remove text outside each channel\'s allowed scripts\n- Optimize database files')) return;
 
     const btn = document.getElementById('clean-optimize-btn');
     const container = document.getElementById('clean-progress-container');
@@ -1748,7 +2438,7 @@ async function cleanAndOptimizeAll() {
         let msg = `Cleaned ${cleanResult.total_removed} blacklisted entries.`;
 
         if (optimizeResult.non_ascii_removed > 0) {
-            msg += `\nRemoved ${optimizeResult.non_ascii_removed} non-ASCII transitions.`;
+            msg += `\nRemoved ${optimizeResult.non_ascii_removed} transitions outside allowed scripts.`;
         }
 
         if (cleanResult.channels && cleanResult.channels.length > 0) {
@@ -1781,14 +2471,314 @@ let editorState = {
     total: 0
 };
 
-function openBrainEditor(channel) {
+function openBrainEditor(channel, search = '') {
     editorState.channel = channel;
     editorState.page = 1;
-    editorState.search = '';
+    editorState.search = search;
     document.getElementById('editor-channel').textContent = channel;
-    document.getElementById('transition-search').value = '';
+    document.getElementById('transition-search').value = search;
     document.getElementById('brain-editor-modal').classList.add('active');
+    document.getElementById('brain-analytics').innerHTML = '';
     loadTransitions();
+    loadDecay();
+    loadSnapshots();
+    loadGenerationSettings();
+}
+
+async function loadAnalytics() {
+    if (!editorState.channel) return;
+    const container = document.getElementById('brain-analytics');
+    container.innerHTML = '<div class="empty-state">Analyzing brain...</div>';
+    const a = await api.get(`/api/brains/${editorState.channel}/analytics`);
+    if (a.error) {
+        container.innerHTML = '';
+        showToast(a.error, 'error');
+        return;
+    }
+    const pct = share => `${(share * 100).toFixed(1)}%`;
+    const growth = a.growth.length > 1
+        ? `${a.growth[0].day}: ${a.growth[0].total_entries.toLocaleString()} → ${a.growth[a.growth.length - 1].day}: ${a.growth[a.growth.length - 1].total_entries.toLocaleString()} transitions`
+        : 'not enough history yet';
+    container.innerHTML = `
+        <div><span class="health health-${a.health}">${a.health}</span>
+            ${a.transitions.toLocaleString()} transitions over ${a.states.toLocaleString()} states at order ${a.order} •
+            ${a.branching_factor.toFixed(2)} next words per state •
+            ${pct(a.dead_end_share)} dead ends •
+            ${pct(a.singleton_share)} seen once</div>
+        <div>Growth: ${growth}</div>
+        <div>Top words: ${a.top_words.map(w => `<span class="word">${displayWord(w.word)}</span> ${w.count}`).join(', ') || '—'}</div>
+        <div>Top n-grams: ${a.top_ngrams.map(n => `<span class="word">${n.words.map(displayWord).join(' ')}</span> ${n.count}`).join(', ') || '—'}</div>
+    `;
+}
+
+async function loadChatters() {
+    if (!editorState.channel) return;
+    const container = document.getElementById('brain-analytics');
+    const r = await api.get(`/api/brains/${editorState.channel}/chatters`);
+    if (r.error) {
+        container.innerHTML = '';
+        showToast(r.error, 'error');
+        return;
+    }
+    const quota = r.quota > 0 ? `quota ${r.quota} messages per ${r.quota_window} minutes` : 'no quota';
+    const rows = r.chatters.map(c => `
+        <div>${escapeHtml(c.username || c.user_id)}: ${c.messages} messages (${(c.share * 100).toFixed(1)}%)
+            ${c.transitions ? ` • ${c.transitions.toLocaleString()} transitions contributed` : ''}
+            ${c.over_quota ? ` • ${c.over_quota} over quota` : ''}</div>
+    `).join('');
+    container.innerHTML = `
+        <div>Most represented in the last ${r.recent_messages.toLocaleString()} learned messages (${quota}):</div>
+        ${rows || '<div>No chatters recorded yet</div>'}
+    `;
+}
+
+async function loadSnapshots() {
+    if (!editorState.channel) return;
+    const snapshots = await api.get(`/api/brains/${editorState.channel}/snapshots`);
+    const select = document.getElementById('snapshot-select');
+    if (!snapshots.length) {
+        select.innerHTML = '<option value="">No snapshots</option>';
+        return;
+    }
+    select.innerHTML = snapshots.map(s =>
+        `<option value="${s.id}">${new Date(s.created_at).toLocaleString()} (${s.kind}, ${(s.size / 1024 / 1024).toFixed(1)} MB)</option>`
+    ).join('');
+}
+
+async function takeSnapshot() {
+    if (!editorState.channel) return;
+    const data = await api.post(`/api/brains/${editorState.channel}/snapshots`, {});
+    if (data.error) {
+        showToast(data.error, 'error');
+        return;
+    }
+    showToast(`Snapshot of ${editorState.channel} taken`, 'success');
+    loadSnapshots();
+}
+
+async function restoreSnapshot() {
+    const id = document.getElementById('snapshot-select').value;
+    if (!editorState.channel || !id) return;
+    if (!confirm(`Roll "${editorState.channel}" back to this snapshot? The current brain is snapshotted first, so this can be undone.`)) return;
+    const url = `/api/brains/${editorState.channel}/snapshots/${id}/restore`;
+    let res = await fetch(url, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ confirm: false })
+    });
+    if (res.status === 409) {
+        // The snapshot was taken at another Markov order
+        const conflict = await res.json();
+        if (!confirm(`${conflict.error}.\n\nRestore it anyway?`)) return;
+        res = await fetch(url, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ confirm: true })
+        });
+    }
+    const data = await res.json();
+    if (data.error) {
+        showToast(data.error, 'error');
+        return;
+    }
+    showToast(`${editorState.channel} restored`, 'success');
+    loadSnapshots();
+    loadTransitions();
+    loadDecay();
+    loadBrains();
+}
+
+async function deleteSnapshot() {
+    const id = document.getElementById('snapshot-select').value;
+    if (!editorState.channel || !id) return;
+    if (!confirm('Delete this snapshot?')) return;
+    const data = await api.delete(`/api/brains/${editorState.channel}/snapshots/${id}`);
+    if (data.error) {
+        showToast(data.error, 'error');
+        return;
+    }
+    showToast('Snapshot deleted', 'success');
+    loadSnapshots();
+}
+
+async function loadGenerationSettings() {
+    if (!editorState.channel) return;
+    const settings = await api.get(`/api/channels/${editorState.channel}/generation`);
+    document.getElementById('gen-min-words').value = settings.min_words;
+    document.getElementById('gen-max-words').value = settings.max_words;
+    document.getElementById('gen-max-chars').value = settings.max_chars;
+    document.getElementById('gen-temperature').value = settings.temperature;
+    document.getElementById('gen-top-k').value = settings.top_k;
+    document.getElementById('gen-retries').value = settings.retries;
+}
+
+async function saveGenerationSettings() {
+    if (!editorState.channel) return;
+    const res = handleAuthExpired(await fetch(`/api/channels/${editorState.channel}/generation`, {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({
+            min_words: parseInt(document.getElementById('gen-min-words').value),
+            max_words: parseInt(document.getElementById('gen-max-words').value),
+            max_chars: parseInt(document.getElementById('gen-max-chars').value),
+            temperature: parseFloat(document.getElementById('gen-temperature').value),
+            top_k: parseInt(document.getElementById('gen-top-k').value),
+            retries: parseInt(document.getElementById('gen-retries').value)
+        })
+    }));
+    const data = await res.json();
+    if (!res.ok) {
+        showToast(data.error, 'error');
+        return;
+    }
+    showToast(`${editorState.channel} generates ${data.min_words}-${data.max_words} words`, 'success');
+    loadGenerationSettings();
+}
+
+async function loadDecay() {
+    if (!editorState.channel) return;
+    const data = await api.get(`/api/brains/${editorState.channel}/decay`);
+    document.getElementById('decay-enabled').checked = data.policy.enabled;
+    document.getElementById('decay-days').value = data.policy.days;
+    document.getElementById('decay-keep').value = data.policy.keep_percent;
+    document.getElementById('decay-prune').value = data.policy.prune_below;
+    renderDecayReport(data.last_report);
+}
+
+function renderDecayReport(report) {
+    const el = document.getElementById('decay-report');
+    if (!report) {
+        el.textContent = 'Never decayed';
+        el.title = '';
+        return;
+    }
+    el.textContent = `Last run ${new Date(report.ran_at).toLocaleString()}: ${report.decayed.toLocaleString()} aged, ${report.pruned.toLocaleString()} pruned`;
+    el.title = report.pruned_sample.length > 0
+        ? 'Pruned (sample):\n' + report.pruned_sample.map(t => `${t.word1} ${t.word2} → ${t.next_word}`.trim()).join('\n')
+        : '';
+}
+
+async function saveDecayPolicy() {
+    if (!editorState.channel) return;
+    const res = handleAuthExpired(await fetch(`/api/brains/${editorState.channel}/decay`, {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({
+            enabled: document.getElementById('decay-enabled').checked,
+            days: parseInt(document.getElementById('decay-days').value),
+            keep_percent: parseInt(document.getElementById('decay-keep').value),
+            prune_below: parseInt(document.getElementById('decay-prune').value)
+        })
+    }));
+    const data = await res.json();
+    if (!res.ok) {
+        showToast(data.error, 'error');
+        return;
+    }
+    showToast(`${editorState.channel} decay ${data.enabled ? `every ${data.days} days` : 'disabled'}`, 'success');
+    loadDecay();
+}
+
+async function runDecay() {
+    if (!editorState.channel) return;
+    if (!confirm(`Run the decay policy on "${editorState.channel}" now? Pruned transitions cannot be restored.`)) return;
+    const report = await api.post(`/api/brains/${editorState.channel}/decay`, {});
+    renderDecayReport(report);
+    loadTransitions();
+    loadBrains();
+}
+
+// Generation traces
+let traceState = {
+    channel: null,
+    trace: null
+};
+
+function showLogTrace(i) {
+    const entry = activityLog[i];
+    if (entry && entry.trace) {
+        showTrace(entry.channel, entry.response, entry.trace);
+    }
+}
+
+async function explainGeneration() {
+    if (!editorState.channel) return;
+    const data = await api.get(`/api/brains/${editorState.channel}/generate?explain=1`);
+    if (data.error) {
+        showToast(data.error, 'error');
+        return;
+    }
+    if (!data.success) {
+        showToast(`Generation failed after ${data.attempts} attempt(s): ${data.failure_reason}`, 'error');
+    }
+    showTrace(editorState.channel, data.response, data.trace);
+}
+
+function showTrace(channel, response, trace) {
+    traceState = { channel, trace };
+    document.getElementById('trace-title').textContent = response || '(nothing)';
+
+    const source = trace.source === 'group' ? `the "${trace.group}" brain group`
+        : trace.source === 'global' ? 'the global brain' : `#${channel}'s brain`;
+    const changes = (trace.changes || []).map(c => c === 'links_stripped' ? 'links were stripped' : 'filter rules masked words');
+    document.getElementById('trace-summary').textContent =
+        `Generated from ${source} at Markov order ${trace.order} in ${trace.steps.length} step(s).` +
+        (changes.length ? ` Before sending, ${changes.join(' and ')}; the chain produced: "${trace.generated}".` : '') +
+        ' Click a step to open its transition in the brain editor.';
+
+    const list = document.getElementById('trace-steps');
+    if (!trace.steps.length) {
+        list.innerHTML = '<div class="empty-state">No steps recorded</div>';
+    } else {
+        list.innerHTML = `
+            <div class="transition-row trace-row header">
+                <span>Step</span>
+                <span>Context</span>
+                <span>Chosen</span>
+                <span>Odds</span>
+                <span>Brains</span>
+            </div>
+            ${trace.steps.map((step, i) => `
+                <div class="transition-row trace-row clickable" onclick="openTraceStep(${i})" title="${step.word1 || step.word2 ? `${displayWord(step.word1)} ${displayWord(step.word2)} → ${displayWord(step.next_word)}` : 'Random start'}">
+                    <span>${i + 1}. ${step.direction}</span>
+                    <span class="word">${step.state.length ? step.state.map(displayWord).join(' ') : '—'}</span>
+                    <span class="word">${step.chosen ? displayWord(step.chosen) : '—'}</span>
+                    <span class="count">${step.candidates ? `${(step.probability * 100).toFixed(1)}% of ${step.candidates}` : '—'}</span>
+                    <span class="trace-channels">${traceChannels(step)}</span>
+                </div>
+            `).join('')}
+        `;
+    }
+    document.getElementById('trace-modal').classList.add('active');
+}
+
+// Lists the brains a global or group step's transition came from, most first
+function traceChannels(step) {
+    if (!step.channels) return '';
+    return Object.entries(step.channels)
+        .sort((a, b) => b[1] - a[1])
+        .map(([ch, count]) => `#${escapeHtml(ch)} (${count})`)
+        .join(', ');
+}
+
+// Opens the brain editor searching for a trace step's transition, in the
+// brain that contributed most to it in global and group mode
+function openTraceStep(i) {
+    const step = traceState.trace.steps[i];
+    if (!step.chosen) return;
+    let channel = traceState.channel;
+    if (step.channels) {
+        const top = Object.entries(step.channels).sort((a, b) => b[1] - a[1])[0];
+        if (top) channel = top[0];
+    }
+    closeTrace();
+    document.querySelectorAll('.tab-btn').forEach(b => b.classList.toggle('active', b.dataset.tab === 'database'));
+    document.querySelectorAll('.tab-content').forEach(c => c.classList.toggle('active', c.id === 'database'));
+    openBrainEditor(channel, step.chosen);
+}
+
+function closeTrace() {
+    document.getElementById('trace-modal').classList.remove('active');
 }
 
 function closeBrainEditor() {
@@ -1815,6 +2805,7 @@ async function loadTransitions() {
 function renderTransitions(result) {
     document.getElementById('editor-showing').textContent = result.transitions.length;
     document.getElementById('editor-total').textContent = result.total.toLocaleString();
+    document.getElementById('editor-order').textContent = result.order || 2;
     
     const maxPages = Math.ceil(result.total / editorState.pageSize) || 1;
     document.getElementById('first-page-btn').disabled = editorState.page <= 1;
@@ -1836,20 +2827,20 @@ function renderTransitions(result) {
     
     list.innerHTML = `
         <div class="transition-row header">
-            <span>Word 1</span>
-            <span>Word 2</span>
+            <span>Context</span>
+            <span>Last Word</span>
             <span>Next Word</span>
             <span>Count</span>
             <span></span>
         </div>
         ${result.transitions.map(t => `
-            <div class="transition-row">
-                <span class="word" title="${escapeHtml(t.word1)}">${escapeHtml(t.word1)}</span>
-                <span class="word" title="${escapeHtml(t.word2)}">${escapeHtml(t.word2)}</span>
-                <span class="word" title="${escapeHtml(t.next_word)}">${escapeHtml(t.next_word)}</span>
+            <div class="transition-row ${t.order !== result.order ? 'other-order' : ''}" ${t.order !== result.order ? `title="Learned at order ${t.order} — not used at the current order"` : ''}>
+                <span class="word" title="${displayWord(t.word1)}">${t.word1 ? displayWord(t.word1) : '—'}</span>
+                <span class="word" title="${displayWord(t.word2)}">${displayWord(t.word2)}</span>
+                <span class="word" title="${displayWord(t.next_word)}">${displayWord(t.next_word)}</span>
                 <input type="number" class="count-input" value="${t.count}" min="1" 
-                    onchange="updateTransitionCount('${escapeHtml(t.word1)}', '${escapeHtml(t.word2)}', '${escapeHtml(t.next_word)}', this.value)">
-                <button class="delete-btn" onclick="deleteTransition('${escapeHtml(t.word1)}', '${escapeHtml(t.word2)}', '${escapeHtml(t.next_word)}')">Delete</button>
+                    onchange="updateTransitionCount('${jsWord(t.word1)}', '${jsWord(t.word2)}', '${jsWord(t.next_word)}', this.value)">
+                <button class="delete-btn" onclick="deleteTransition('${jsWord(t.word1)}', '${jsWord(t.word2)}', '${jsWord(t.next_word)}')">Delete</button>
             </div>
         `).join('')}
     `;
@@ -2073,6 +3064,16 @@ function escapeHtml(text) {
     return div.innerHTML;
 }
 
+// Brain words may contain the start/end-of-message boundary tokens (\u0002 / \u0003)
+function displayWord(word) {
+    return escapeHtml(word).replace(/\u0002/g, '‹start›').replace(/\u0003/g, '‹end›');
+}
+
+// Escapes a brain word for use inside a quoted inline-handler argument
+function jsWord(word) {
+    return escapeHtml(word).replace(/\u0002/g, '\\u0002').replace(/\u0003/g, '\\u0003');
+}
+
 // Load and display version info
 async function loadVersion() {
     try {